@@ -0,0 +1,566 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"net/netip"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Diff returns a Transaction that, when run against current's table, will transform it
+// into desired's table. (current and desired should refer to the same family and table.)
+//
+// Rules are compared in order: everything after the first rule that differs between
+// the current and desired versions of a chain is deleted and re-added. Set and map
+// elements are added or deleted individually. Objects whose definitions have changed
+// are deleted and re-created, along with any rules or elements that refer to them.
+func Diff(current, desired *Fake) *Transaction {
+	current.mutex.RLock()
+	defer current.mutex.RUnlock()
+	if desired != current {
+		desired.mutex.RLock()
+		defer desired.mutex.RUnlock()
+	}
+
+	tx := current.NewTransaction()
+	cur, want := current.Table, desired.Table
+
+	if want == nil {
+		if cur != nil {
+			tx.Delete(&Table{})
+		}
+		return tx
+	}
+	if cur != nil && !reflect.DeepEqual(cur.Comment, want.Comment) {
+		// There's no way to modify a table, so just start over
+		tx.Delete(&Table{})
+		cur = nil
+	}
+	if cur == nil {
+		tx.Add(&Table{Comment: copyPtr(want.Comment)})
+		cur = &FakeTable{}
+	}
+
+	// Figure out which objects need to be created, and which need to be deleted or
+	// re-created (because their definitions have changed). Anything referring to
+	// the latter must be removed before they are deleted and re-added afterward.
+	addChains, recreateChains := diffObjects(cur.Chains, want.Chains, func(c1, c2 *FakeChain) bool {
+		return objectsEqual(c1.Chain.deepCopy(), c2.Chain.deepCopy())
+	})
+	addSets, recreateSets := diffObjects(cur.Sets, want.Sets, func(s1, s2 *FakeSet) bool {
+		return objectsEqual(s1.Set.deepCopy(), s2.Set.deepCopy())
+	})
+	addMaps, recreateMaps := diffObjects(cur.Maps, want.Maps, func(m1, m2 *FakeMap) bool {
+		return objectsEqual(m1.Map.deepCopy(), m2.Map.deepCopy())
+	})
+	addFlowtables, recreateFlowtables := diffObjects(cur.Flowtables, want.Flowtables, objectsEqual[*Flowtable])
+	addCounters, recreateCounters := diffObjects(cur.Counters, want.Counters, objectsEqual[*Counter])
+	addQuotas, recreateQuotas := diffObjects(cur.Quotas, want.Quotas, objectsEqual[*Quota])
+	addCTTimeouts, recreateCTTimeouts := diffObjects(cur.CTTimeouts, want.CTTimeouts, objectsEqual[*CTTimeout])
+	addCTExpectations, recreateCTExpectations := diffObjects(cur.CTExpectations, want.CTExpectations, objectsEqual[*CTExpectation])
+
+	recreated := make(map[string]bool)
+	for _, names := range []map[string]bool{recreateChains, recreateSets, recreateMaps, recreateFlowtables, recreateCounters, recreateQuotas, recreateCTTimeouts, recreateCTExpectations} {
+		for name := range names {
+			recreated[name] = true
+		}
+	}
+
+	// Create new objects.
+	for _, name := range addChains {
+		tx.Add(withoutHandle(want.Chains[name].Chain.deepCopy()))
+	}
+	for _, name := range addSets {
+		tx.Add(withoutHandle(want.Sets[name].Set.deepCopy()))
+	}
+	for _, name := range addMaps {
+		tx.Add(withoutHandle(want.Maps[name].Map.deepCopy()))
+	}
+	for _, name := range addFlowtables {
+		tx.Add(withoutHandle(want.Flowtables[name]))
+	}
+	for _, name := range addCounters {
+		tx.Add(withoutHandle(want.Counters[name]))
+	}
+	for _, name := range addQuotas {
+		tx.Add(withoutHandle(want.Quotas[name]))
+	}
+	for _, name := range addCTTimeouts {
+		tx.Add(withoutHandle(want.CTTimeouts[name].deepCopy()))
+	}
+	for _, name := range addCTExpectations {
+		tx.Add(withoutHandle(want.CTExpectations[name]))
+	}
+
+	// Remove rules that are out of date (or that refer to recreated objects).
+	addRules := make(map[string][]*Rule)
+	for _, name := range sortKeys(cur.Chains) {
+		curRules := cur.Chains[name].Rules
+		if recreateChains[name] {
+			if len(curRules) > 0 {
+				tx.Flush(&Chain{Name: name})
+			}
+			if want.Chains[name] != nil {
+				addRules[name] = want.Chains[name].Rules
+			}
+			continue
+		}
+
+		wantRules := want.Chains[name].Rules
+		same := 0
+		for same < len(curRules) && same < len(wantRules) &&
+			rulesEqual(curRules[same], wantRules[same]) &&
+			!referencesAny(curRules[same].Rule, recreated) {
+			same++
+		}
+		for _, rule := range curRules[same:] {
+			tx.Delete(&Rule{Chain: name, Handle: copyPtr(rule.Handle)})
+		}
+		addRules[name] = wantRules[same:]
+	}
+	for _, name := range addChains {
+		addRules[name] = want.Chains[name].Rules
+	}
+
+	// Remove elements that are out of date (or that refer to recreated chains).
+	addSetElements := make(map[string][]*Element)
+	for _, name := range sortKeys(want.Sets) {
+		if cur.Sets[name] == nil || recreateSets[name] {
+			addSetElements[name] = want.Sets[name].Elements
+			continue
+		}
+		addSetElements[name] = diffElements(tx, cur.Sets[name].Elements, want.Sets[name].Elements, want.Sets[name].keyTypes(), recreated)
+	}
+	addMapElements := make(map[string][]*Element)
+	for _, name := range sortKeys(want.Maps) {
+		if cur.Maps[name] == nil || recreateMaps[name] {
+			addMapElements[name] = want.Maps[name].Elements
+			continue
+		}
+		addMapElements[name] = diffElements(tx, cur.Maps[name].Elements, want.Maps[name].Elements, want.Maps[name].keyTypes(), recreated)
+	}
+
+	// Delete old objects, and recreate changed ones.
+	for _, name := range sortKeys(recreateMaps) {
+		tx.Delete(&Map{Name: name})
+		if want.Maps[name] != nil {
+			tx.Add(withoutHandle(want.Maps[name].Map.deepCopy()))
+		}
+	}
+	for _, name := range sortKeys(recreateSets) {
+		tx.Delete(&Set{Name: name})
+		if want.Sets[name] != nil {
+			tx.Add(withoutHandle(want.Sets[name].Set.deepCopy()))
+		}
+	}
+	for _, name := range sortKeys(recreateFlowtables) {
+		tx.Delete(&Flowtable{Name: name})
+		if want.Flowtables[name] != nil {
+			tx.Add(withoutHandle(want.Flowtables[name]))
+		}
+	}
+	for _, name := range sortKeys(recreateCounters) {
+		tx.Delete(&Counter{Name: name})
+		if want.Counters[name] != nil {
+			tx.Add(withoutHandle(want.Counters[name]))
+		}
+	}
+	for _, name := range sortKeys(recreateQuotas) {
+		tx.Delete(&Quota{Name: name})
+		if want.Quotas[name] != nil {
+			tx.Add(withoutHandle(want.Quotas[name]))
+		}
+	}
+	for _, name := range sortKeys(recreateCTTimeouts) {
+		tx.Delete(&CTTimeout{Name: name})
+		if want.CTTimeouts[name] != nil {
+			tx.Add(withoutHandle(want.CTTimeouts[name].deepCopy()))
+		}
+	}
+	for _, name := range sortKeys(recreateCTExpectations) {
+		tx.Delete(&CTExpectation{Name: name})
+		if want.CTExpectations[name] != nil {
+			tx.Add(withoutHandle(want.CTExpectations[name]))
+		}
+	}
+	for _, name := range sortKeys(recreateChains) {
+		tx.Delete(&Chain{Name: name})
+		if want.Chains[name] != nil {
+			tx.Add(withoutHandle(want.Chains[name].Chain.deepCopy()))
+		}
+	}
+
+	// Finally, add new rules and elements.
+	for _, name := range sortKeys(addRules) {
+		for _, rule := range addRules[name] {
+			tx.Add(&Rule{Chain: name, Rule: rule.Rule, Comment: copyPtr(rule.Comment)})
+		}
+	}
+	for _, name := range sortKeys(addSetElements) {
+		for _, element := range addSetElements[name] {
+			tx.Add(element.deepCopy())
+		}
+	}
+	for _, name := range sortKeys(addMapElements) {
+		for _, element := range addMapElements[name] {
+			tx.Add(element.deepCopy())
+		}
+	}
+
+	return tx
+}
+
+// diffObjects compares two maps of objects, returning the (sorted) names of the objects
+// that are only in want, and the names of the objects that are only in cur or whose
+// definitions differ between cur and want.
+func diffObjects[T any](cur, want map[string]T, equal func(T, T) bool) ([]string, map[string]bool) {
+	var add []string
+	recreate := make(map[string]bool)
+	for _, name := range sortKeys(want) {
+		if existing, ok := cur[name]; !ok {
+			add = append(add, name)
+		} else if !equal(existing, want[name]) {
+			recreate[name] = true
+		}
+	}
+	for name := range cur {
+		if _, ok := want[name]; !ok {
+			recreate[name] = true
+		}
+	}
+	return add, recreate
+}
+
+// diffElements adds delete operations to tx for the elements of curElements that are
+// not in wantElements (or that differ from their version in wantElements, or that
+// refer to recreated objects), and returns the elements of wantElements that will need
+// to be added.
+func diffElements(tx *Transaction, curElements, wantElements []*Element, keyTypes []string, recreated map[string]bool) []*Element {
+	var toAdd []*Element
+	var curIndex, wantIndex elementIndex
+	for _, element := range curElements {
+		i := wantIndex.find(wantElements, keyTypes, element.Key)
+		if i == -1 || !elementsEqual(element, wantElements[i]) || referencesAny(strings.Join(element.Value, " "), recreated) {
+			tx.Delete(element.deepCopy())
+		}
+	}
+	for _, element := range wantElements {
+		i := curIndex.find(curElements, keyTypes, element.Key)
+		if i == -1 || !elementsEqual(element, curElements[i]) || referencesAny(strings.Join(element.Value, " "), recreated) {
+			toAdd = append(toAdd, element)
+		}
+	}
+	return toAdd
+}
+
+// objectsEqual compares two objects (or two copies of objects), ignoring their Handles
+func objectsEqual[T any](obj1, obj2 T) bool {
+	return reflect.DeepEqual(withoutHandle(obj1), withoutHandle(obj2))
+}
+
+// withoutHandle clears the Handle field of a pointer to (a copy of) an object, or
+// returns a copy of a non-pointer object with its Handle cleared.
+func withoutHandle[T any](obj T) T {
+	val := reflect.ValueOf(&obj).Elem()
+	if val.Kind() == reflect.Pointer {
+		copied := reflect.New(val.Elem().Type())
+		copied.Elem().Set(val.Elem())
+		val.Set(copied)
+		val = copied.Elem()
+	}
+	val.FieldByName("Handle").Set(reflect.Zero(val.FieldByName("Handle").Type()))
+	return obj
+}
+
+// rulesEqual compares the Rule and Comment fields of two rules
+func rulesEqual(rule1, rule2 *Rule) bool {
+	return rule1.Rule == rule2.Rule && reflect.DeepEqual(rule1.Comment, rule2.Comment)
+}
+
+// elementsEqual compares the Value, Timeout, and Comment fields of two elements (which
+// are assumed to have matching keys).
+func elementsEqual(element1, element2 *Element) bool {
+	return reflect.DeepEqual(element1.Value, element2.Value) &&
+		reflect.DeepEqual(element1.Timeout, element2.Timeout) &&
+		reflect.DeepEqual(element1.Comment, element2.Comment)
+}
+
+// referencesAny checks if rule (a rule, or the value of a map element) refers to any of
+// the named objects, via "@name", "jump name", "goto name", "counter name name",
+// "quota name name", "ct timeout set name", or "ct expectation set name".
+func referencesAny(rule string, names map[string]bool) bool {
+	if len(names) == 0 {
+		return false
+	}
+	words := strings.Split(rule, " ")
+	for i, word := range words {
+		if strings.HasPrefix(word, "@") && names[word[1:]] {
+			return true
+		}
+		if i > 0 && (words[i-1] == "jump" || words[i-1] == "goto" || words[i-1] == "name") && names[word] {
+			return true
+		}
+		if i > 1 && words[i-1] == "set" && (words[i-2] == "timeout" || words[i-2] == "expectation") && names[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal returns true if fake and other contain equivalent rulesets. This is the same as
+// checking whether DiffString returns "", but is cheaper.
+func (fake *Fake) Equal(other *Fake) bool {
+	lines1 := fake.canonicalDump()
+	lines2 := other.canonicalDump()
+	if len(lines1) != len(lines2) {
+		return false
+	}
+	for i := range lines1 {
+		if lines1[i] != lines2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DiffString returns a human-readable, line-based diff between the rulesets in fake and
+// other (in the format of Dump, with lines only in fake prefixed by "- " and lines only
+// in other prefixed by "+ "), or "" if they are equivalent. The comparison ignores
+// object handles, the order in which objects were created, and the order of set and map
+// elements, and treats equivalent element keys (eg "http" and "80" for an
+// inet_service) as the same. (The order of the rules within each chain is significant.)
+func (fake *Fake) DiffString(other *Fake) string {
+	lines1 := fake.canonicalDump()
+	lines2 := other.canonicalDump()
+
+	// Skip the common prefix and suffix, so the (quadratic) LCS table only has to
+	// cover the lines that actually differ.
+	for len(lines1) > 0 && len(lines2) > 0 && lines1[0] == lines2[0] {
+		lines1, lines2 = lines1[1:], lines2[1:]
+	}
+	for len(lines1) > 0 && len(lines2) > 0 && lines1[len(lines1)-1] == lines2[len(lines2)-1] {
+		lines1, lines2 = lines1[:len(lines1)-1], lines2[:len(lines2)-1]
+	}
+
+	// Find the longest common subsequence of the remaining lines, and output
+	// everything else.
+	lcs := make([][]int, len(lines1)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(lines2)+1)
+	}
+	for i := len(lines1) - 1; i >= 0; i-- {
+		for j := len(lines2) - 1; j >= 0; j-- {
+			if lines1[i] == lines2[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	buf := &strings.Builder{}
+	i, j := 0, 0
+	for i < len(lines1) || j < len(lines2) {
+		switch {
+		case i < len(lines1) && j < len(lines2) && lines1[i] == lines2[j]:
+			i++
+			j++
+		case j == len(lines2) || (i < len(lines1) && lcs[i+1][j] >= lcs[i][j+1]):
+			buf.WriteString("- " + lines1[i] + "\n")
+			i++
+		default:
+			buf.WriteString("+ " + lines2[j] + "\n")
+			j++
+		}
+	}
+	return buf.String()
+}
+
+// canonicalDump returns the lines of a dump of fake, with objects sorted by name, set and
+// map elements sorted, and element keys normalized.
+func (fake *Fake) canonicalDump() []string {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return nil
+	}
+	table := fake.Table.copy()
+	for _, set := range table.Sets {
+		set.Elements = normalizeElements(set.Elements, set.keyTypes())
+	}
+	for _, mapObj := range table.Maps {
+		mapObj.Elements = normalizeElements(mapObj.Elements, mapObj.keyTypes())
+	}
+
+	normalized := &Fake{nftContext: fake.nftContext, Table: table}
+	dump := normalized.dump(&dumpObjects{
+		chains:         sortKeys(table.Chains),
+		sets:           sortKeys(table.Sets),
+		maps:           sortKeys(table.Maps),
+		flowtables:     sortKeys(table.Flowtables),
+		counters:       sortKeys(table.Counters),
+		quotas:         sortKeys(table.Quotas),
+		ctTimeouts:     sortKeys(table.CTTimeouts),
+		ctExpectations: sortKeys(table.CTExpectations),
+		sortElements:   true,
+	})
+	return strings.Split(strings.TrimSuffix(dump, "\n"), "\n")
+}
+
+// normalizeElements returns copies of elements with their keys normalized: service
+// names are converted to port numbers, and IP addresses and prefixes are converted to
+// their canonical string forms.
+func normalizeElements(elements []*Element, keyTypes []string) []*Element {
+	normalized := make([]*Element, len(elements))
+	for i, element := range elements {
+		ecopy := element.deepCopy()
+		for j, key := range ecopy.Key {
+			if j < len(keyTypes) && keyTypes[j] == "inet_service" {
+				ecopy.Key[j] = resolveService(key)
+			} else if addr, err := netip.ParseAddr(key); err == nil {
+				ecopy.Key[j] = addr.String()
+			} else if prefix, err := netip.ParsePrefix(key); err == nil {
+				ecopy.Key[j] = prefix.String()
+			}
+		}
+		normalized[i] = ecopy
+	}
+	return normalized
+}
+
+// handleCommentRegexp matches the "# handle" comment added by DumpOptions.IncludeHandles
+var handleCommentRegexp = regexp.MustCompile(`\s*# handle \d+$`)
+
+// NormalizeDump returns a canonical form of dump (a series of "add" commands, in the
+// format returned by Fake.Dump), so that two dumps can be compared while ignoring
+// insignificant differences; eg, to compare a Fake's state against a "golden" file. In
+// the normalized form:
+//
+//   - Blank lines, comment lines, and "# handle" comments are removed.
+//   - Whitespace is canonicalized (except inside quoted strings), as is the spacing
+//     of braces, commas, and semicolons.
+//   - "add element" commands that add multiple elements are split into separate
+//     commands for each element.
+//   - The table comes first, followed by the other objects (sorted), followed by the
+//     rules (grouped by chain, with the chains sorted by name, but with each chain's
+//     rules in their original order), followed by the elements (sorted).
+//
+// Note that NormalizeDump does not understand the semantics of rules; two rules that
+// are written differently but behave the same will not normalize to the same thing.
+func NormalizeDump(dump string) string {
+	var tables, objects, elements []string
+	rules := make(map[string][]string)
+	for _, line := range strings.Split(dump, "\n") {
+		line = strings.TrimSpace(handleCommentRegexp.ReplaceAllString(line, ""))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		tokens, err := ParseRuleExpr(line)
+		if err != nil {
+			objects = append(objects, strings.Join(strings.Fields(line), " "))
+			continue
+		}
+		switch {
+		case isCommand(tokens, "rule") && len(tokens) > 5:
+			chain := tokens[4].Value
+			rules[chain] = append(rules[chain], formatRuleTokens(tokens, ", "))
+		case isCommand(tokens, "element") && len(tokens) == 6 && tokens[5].Type == AnonymousSetToken:
+			prefix := formatRuleTokens(tokens[:5], ", ")
+			for _, element := range tokens[5].Elements {
+				elements = append(elements, prefix+" { "+normalizeRuleText(element)+" }")
+			}
+		case isCommand(tokens, "table"):
+			tables = append(tables, formatRuleTokens(tokens, ","))
+		default:
+			// The braces in an object definition contain properties rather than
+			// set elements, so any commas are part of a property value (eg,
+			// "flags interval,timeout").
+			objects = append(objects, formatRuleTokens(tokens, ","))
+		}
+	}
+
+	sort.Strings(objects)
+	sort.Strings(elements)
+	lines := append(tables, objects...)
+	for _, chain := range sortKeys(rules) {
+		lines = append(lines, rules[chain]...)
+	}
+	lines = append(lines, elements...)
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// isCommand returns true if tokens start with "add objectType" followed by at least
+// the family and table.
+func isCommand(tokens []RuleToken, objectType string) bool {
+	if len(tokens) < 4 {
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		if tokens[i].Type != WordToken {
+			return false
+		}
+	}
+	return tokens[0].Value == "add" && tokens[1].Value == objectType
+}
+
+// normalizeRuleText returns text (a rule, or some other part of an nft command) with its
+// whitespace canonicalized, as described in NormalizeDump.
+func normalizeRuleText(text string) string {
+	tokens, err := ParseRuleExpr(text)
+	if err != nil {
+		return strings.Join(strings.Fields(text), " ")
+	}
+	return formatRuleTokens(tokens, ", ")
+}
+
+// formatRuleTokens joins tokens back together, with canonical whitespace, using
+// elementSep between the elements of each top-level AnonymousSetToken.
+func formatRuleTokens(tokens []RuleToken, elementSep string) string {
+	var words []string
+	for _, token := range tokens {
+		switch token.Type {
+		case StringToken:
+			words = append(words, `"`+token.Value+`"`)
+		case SetReferenceToken:
+			words = append(words, "@"+token.Value)
+		case AnonymousSetToken:
+			if len(token.Elements) == 0 {
+				words = append(words, "{ }")
+				continue
+			}
+			elements := make([]string, len(token.Elements))
+			for i := range token.Elements {
+				elements[i] = normalizeRuleText(token.Elements[i])
+			}
+			words = append(words, "{ "+strings.Join(elements, elementSep)+" }")
+		default:
+			// Separate semicolons (eg, in "{ type filter hook input priority 0; }")
+			words = append(words, strings.Fields(strings.ReplaceAll(token.Value, ";", " ; "))...)
+		}
+	}
+	return strings.Join(words, " ")
+}
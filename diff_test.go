@@ -0,0 +1,456 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		current string
+		desired string
+		diff    string
+	}{
+		{
+			name:    "no changes",
+			current: `add table ip kube-proxy`,
+			desired: `add table ip kube-proxy`,
+			diff:    ``,
+		},
+		{
+			name:    "create table",
+			current: ``,
+			desired: `
+				add table ip kube-proxy { comment "rules for kube-proxy" ; }
+				add chain ip kube-proxy chain1
+				add rule ip kube-proxy chain1 drop
+				`,
+			diff: `
+				add table ip kube-proxy { comment "rules for kube-proxy" ; }
+				add chain ip kube-proxy chain1
+				add rule ip kube-proxy chain1 drop
+				`,
+		},
+		{
+			name: "delete table",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				`,
+			desired: ``,
+			diff: `
+				delete table ip kube-proxy
+				`,
+		},
+		{
+			name: "append rules",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.1 drop
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.1 drop
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.2 drop
+				`,
+			diff: `
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.2 drop
+				`,
+		},
+		{
+			name: "reorder rules",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.1 drop
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.2 drop
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.3 drop
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.1 drop
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.3 drop
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.2 drop
+				`,
+			diff: `
+				delete rule ip kube-proxy chain1 handle 4
+				delete rule ip kube-proxy chain1 handle 5
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.3 drop
+				add rule ip kube-proxy chain1 ip saddr 10.0.0.2 drop
+				`,
+		},
+		{
+			name: "change rule comment",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add rule ip kube-proxy chain1 drop comment "old"
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add rule ip kube-proxy chain1 drop comment "new"
+				`,
+			diff: `
+				delete rule ip kube-proxy chain1 handle 3
+				add rule ip kube-proxy chain1 drop comment "new"
+				`,
+		},
+		{
+			name: "set and map elements",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add chain ip kube-proxy chain2
+				add set ip kube-proxy set1 { type ipv4_addr ; }
+				add map ip kube-proxy map1 { type ipv4_addr : verdict ; }
+				add element ip kube-proxy set1 { 10.0.0.1 }
+				add element ip kube-proxy set1 { 10.0.0.2 }
+				add element ip kube-proxy map1 { 10.0.0.1 : goto chain1 }
+				add element ip kube-proxy map1 { 10.0.0.2 : goto chain1 }
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add chain ip kube-proxy chain2
+				add set ip kube-proxy set1 { type ipv4_addr ; }
+				add map ip kube-proxy map1 { type ipv4_addr : verdict ; }
+				add element ip kube-proxy set1 { 10.0.0.2 }
+				add element ip kube-proxy set1 { 10.0.0.3 }
+				add element ip kube-proxy map1 { 10.0.0.1 : goto chain1 }
+				add element ip kube-proxy map1 { 10.0.0.2 : goto chain2 }
+				`,
+			diff: `
+				delete element ip kube-proxy set1 { 10.0.0.1 }
+				delete element ip kube-proxy map1 { 10.0.0.2 }
+				add element ip kube-proxy set1 { 10.0.0.3 }
+				add element ip kube-proxy map1 { 10.0.0.2 : goto chain2 }
+				`,
+		},
+		{
+			name: "delete referenced chain",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy services
+				add chain ip kube-proxy svc1
+				add chain ip kube-proxy svc2
+				add map ip kube-proxy service-ips { type ipv4_addr : verdict ; }
+				add rule ip kube-proxy services ip daddr vmap @service-ips
+				add rule ip kube-proxy services ip daddr 10.0.0.2 goto svc2
+				add rule ip kube-proxy svc1 drop
+				add rule ip kube-proxy svc2 drop
+				add element ip kube-proxy service-ips { 10.0.0.1 : goto svc1 }
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy services
+				add chain ip kube-proxy svc1
+				add map ip kube-proxy service-ips { type ipv4_addr : verdict ; }
+				add rule ip kube-proxy services ip daddr vmap @service-ips
+				add rule ip kube-proxy svc1 drop
+				add element ip kube-proxy service-ips { 10.0.0.1 : goto svc1 }
+				`,
+			diff: `
+				delete rule ip kube-proxy services handle 7
+				flush chain ip kube-proxy svc2
+				delete chain ip kube-proxy svc2
+				`,
+		},
+		{
+			name: "change set definition",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add set ip kube-proxy set1 { type ipv4_addr ; }
+				add rule ip kube-proxy chain1 ip saddr @set1 drop
+				add rule ip kube-proxy chain1 accept
+				add element ip kube-proxy set1 { 10.0.0.1 }
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add set ip kube-proxy set1 { type ipv4_addr ; flags interval ; }
+				add rule ip kube-proxy chain1 ip saddr @set1 drop
+				add rule ip kube-proxy chain1 accept
+				add element ip kube-proxy set1 { 10.0.0.0/8 }
+				`,
+			diff: `
+				delete rule ip kube-proxy chain1 handle 4
+				delete rule ip kube-proxy chain1 handle 5
+				delete set ip kube-proxy set1
+				add set ip kube-proxy set1 { type ipv4_addr ; flags interval ; }
+				add rule ip kube-proxy chain1 ip saddr @set1 drop
+				add rule ip kube-proxy chain1 accept
+				add element ip kube-proxy set1 { 10.0.0.0/8 }
+				`,
+		},
+		{
+			name: "change ct timeout policy",
+			current: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add ct timeout ip kube-proxy tcp-short { protocol tcp ; policy = { established : 600 } ; }
+				add ct expectation ip kube-proxy sip { protocol tcp ; dport 5060 ; timeout 3600000ms ; size 12 ; }
+				add rule ip kube-proxy chain1 tcp dport 8080 ct timeout set tcp-short
+				`,
+			desired: `
+				add table ip kube-proxy
+				add chain ip kube-proxy chain1
+				add ct timeout ip kube-proxy tcp-short { protocol tcp ; policy = { established : 300 } ; }
+				add ct expectation ip kube-proxy sip { protocol tcp ; dport 5060 ; timeout 3600000ms ; size 12 ; }
+				add rule ip kube-proxy chain1 tcp dport 8080 ct timeout set tcp-short
+				`,
+			diff: `
+				delete rule ip kube-proxy chain1 handle 5
+				delete ct timeout ip kube-proxy tcp-short
+				add ct timeout ip kube-proxy tcp-short { protocol tcp ; policy = { established : 300 } ; }
+				add rule ip kube-proxy chain1 tcp dport 8080 ct timeout set tcp-short
+				`,
+		},
+		{
+			name: "change table comment",
+			current: `
+				add table ip kube-proxy { comment "old" ; }
+				add chain ip kube-proxy chain1
+				`,
+			desired: `
+				add table ip kube-proxy { comment "new" ; }
+				add chain ip kube-proxy chain1
+				`,
+			diff: `
+				delete table ip kube-proxy
+				add table ip kube-proxy { comment "new" ; }
+				add chain ip kube-proxy chain1
+				`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			current := NewFake(IPv4Family, "kube-proxy")
+			if err := current.ParseDump(dedent.Dedent(tc.current)); err != nil {
+				t.Fatalf("unexpected error parsing current: %v", err)
+			}
+			desired := NewFake(IPv4Family, "kube-proxy")
+			if err := desired.ParseDump(dedent.Dedent(tc.desired)); err != nil {
+				t.Fatalf("unexpected error parsing desired: %v", err)
+			}
+
+			tx := Diff(current, desired)
+			expectedDiff := strings.TrimPrefix(dedent.Dedent(tc.diff), "\n")
+			if diff := cmp.Diff(expectedDiff, tx.String()); diff != "" {
+				t.Errorf("unexpected Diff output:\n%s", diff)
+			}
+
+			if err := current.Run(context.Background(), tx); err != nil {
+				t.Fatalf("unexpected error running diff: %v", err)
+			}
+			if diff := cmp.Diff(desired.Dump(), current.Dump()); diff != "" {
+				t.Errorf("current does not match desired after applying diff:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFakeEqual(t *testing.T) {
+	fake1 := NewFake(IPv4Family, "kube-proxy")
+	fake2 := NewFake(IPv4Family, "kube-proxy")
+	if !fake1.Equal(fake2) {
+		t.Errorf("expected two empty fakes to be equal")
+	}
+
+	tx := fake1.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain1"})
+	tx.Add(&Chain{Name: "chain2"})
+	tx.Add(&Set{Name: "ips", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "ports", Type: "inet_service : verdict"})
+	tx.Add(&Rule{Chain: "chain1", Rule: "ip daddr @ips drop"})
+	tx.Add(&Rule{Chain: "chain1", Rule: "tcp dport vmap @ports"})
+	tx.Add(&Rule{Chain: "chain2", Rule: "accept"})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.2"}})
+	tx.Add(&Element{Map: "ports", Key: []string{"http"}, Value: []string{"goto chain2"}})
+	if err := fake1.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake1.Equal(fake2) {
+		t.Errorf("expected populated fake to not equal empty fake")
+	}
+
+	// Build the same ruleset in a different order, with different handles
+	tx = fake2.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "extra"})
+	tx.Add(&Map{Name: "ports", Type: "inet_service : verdict"})
+	tx.Add(&Set{Name: "ips", Type: "ipv4_addr"})
+	tx.Add(&Chain{Name: "chain2"})
+	tx.Add(&Rule{Chain: "chain2", Rule: "accept"})
+	tx.Add(&Element{Map: "ports", Key: []string{"80"}, Value: []string{"goto chain2"}})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.2"}})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.1"}})
+	tx.Add(&Chain{Name: "chain1"})
+	tx.Add(&Rule{Chain: "chain1", Rule: "tcp dport vmap @ports"})
+	tx.Insert(&Rule{Chain: "chain1", Rule: "ip daddr @ips drop"})
+	tx.Delete(&Chain{Name: "extra"})
+	if err := fake2.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := fake1.DiffString(fake2); diff != "" {
+		t.Errorf("expected fakes to be equal, got diff:\n%s", diff)
+	}
+	if !fake1.Equal(fake2) || !fake2.Equal(fake1) {
+		t.Errorf("expected fakes to be equal")
+	}
+	if cmp.Diff(fake1.Dump(), fake2.Dump()) == "" {
+		t.Errorf("expected Dump outputs to differ")
+	}
+
+	// Now make them differ
+	tx = fake2.NewTransaction()
+	tx.Flush(&Chain{Name: "chain2"})
+	tx.Add(&Rule{Chain: "chain2", Rule: "drop"})
+	tx.Delete(&Element{Set: "ips", Key: []string{"10.0.0.1"}})
+	if err := fake2.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake1.Equal(fake2) {
+		t.Errorf("expected fakes to differ")
+	}
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		- add rule ip kube-proxy chain2 accept
+		- add element ip kube-proxy ips { 10.0.0.1 }
+		+ add rule ip kube-proxy chain2 drop
+		`), "\n")
+	if diff := cmp.Diff(expected, fake1.DiffString(fake2)); diff != "" {
+		t.Errorf("unexpected DiffString output:\n%s", diff)
+	}
+}
+
+func TestFakeEqualLargeSets(t *testing.T) {
+	// Equal and DiffString must not need memory proportional to the product of
+	// the sizes of the two rulesets.
+	const numElements = 50000
+	fakes := make([]*Fake, 2)
+	for i := range fakes {
+		fakes[i] = NewFake(IPv4Family, "kube-proxy")
+		tx := fakes[i].NewTransaction()
+		tx.Add(&Table{})
+		tx.Add(&Set{Name: "ips", Type: "ipv4_addr"})
+		for j := 0; j < numElements; j++ {
+			tx.Add(&Element{Set: "ips", Key: []string{fmt.Sprintf("10.%d.%d.%d", j>>16, (j>>8)&0xff, j&0xff)}})
+		}
+		if err := fakes[i].Run(context.Background(), tx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if !fakes[0].Equal(fakes[1]) {
+		t.Errorf("expected fakes to be equal")
+	}
+	if diff := fakes[0].DiffString(fakes[1]); diff != "" {
+		t.Errorf("expected fakes to be equal, got diff:\n%s", diff)
+	}
+
+	tx := fakes[1].NewTransaction()
+	tx.Delete(&Element{Set: "ips", Key: []string{"10.0.1.0"}})
+	if err := fakes[1].Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fakes[0].Equal(fakes[1]) {
+		t.Errorf("expected fakes to differ")
+	}
+	if diff := cmp.Diff("- add element ip kube-proxy ips { 10.0.1.0 }\n", fakes[0].DiffString(fakes[1])); diff != "" {
+		t.Errorf("unexpected DiffString output:\n%s", diff)
+	}
+}
+
+func TestNormalizeDump(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "services"})
+	tx.Add(&Chain{
+		Name:     "filter-input",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority),
+		Comment:  PtrTo("kube-proxy  input"),
+	})
+	tx.Add(&Set{Name: "ips", Type: "ipv4_addr", Flags: []SetFlag{IntervalFlag, TimeoutFlag}})
+	tx.Add(&Map{Name: "ports", Type: "inet_service : verdict"})
+	tx.Add(&Rule{Chain: "filter-input", Rule: "ip saddr @ips drop"})
+	tx.Add(&Rule{Chain: "filter-input", Rule: "tcp dport { 80, 443 } jump services", Comment: PtrTo("web")})
+	tx.Add(&Rule{Chain: "services", Rule: "tcp dport vmap @ports"})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.2"}})
+	tx.Add(&Element{Map: "ports", Key: []string{"80"}, Value: []string{"accept"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	golden := dedent.Dedent(`
+		# A hand-maintained golden file
+
+		add table ip kube-proxy   # handle 1
+		add map ip kube-proxy ports { type inet_service : verdict; }
+		add set ip kube-proxy ips { type ipv4_addr ; flags interval,timeout ; }
+		add chain ip kube-proxy services
+		add chain ip kube-proxy filter-input {type filter hook input priority 0;comment "kube-proxy  input";}
+
+		add rule ip kube-proxy services tcp dport vmap @ports
+		add rule ip kube-proxy filter-input ip saddr @ips   drop
+		add rule ip kube-proxy filter-input tcp dport {80,443} jump services comment "web"
+
+		add element ip kube-proxy ports { 80 : accept }
+		add element ip kube-proxy ips { 10.0.0.2, 10.0.0.1 }
+		`)
+
+	normalized := NormalizeDump(fake.DumpWithOptions(DumpOptions{IncludeHandles: true}))
+	if diff := cmp.Diff(normalized, NormalizeDump(golden)); diff != "" {
+		t.Errorf("expected dumps to normalize identically:\n%s", diff)
+	}
+	if NormalizeDump(normalized) != normalized {
+		t.Errorf("NormalizeDump is not idempotent")
+	}
+
+	// Rule order within a chain is significant
+	reordered := strings.Replace(golden,
+		"add rule ip kube-proxy filter-input ip saddr @ips   drop\n", "", 1) +
+		"add rule ip kube-proxy filter-input ip saddr @ips drop\n"
+	if NormalizeDump(reordered) == normalized {
+		t.Errorf("expected reordering rules within a chain to be significant")
+	}
+
+	// Whitespace inside quoted strings is significant
+	recommented := strings.Replace(golden, `"kube-proxy  input"`, `"kube-proxy input"`, 1)
+	if NormalizeDump(recommented) == normalized {
+		t.Errorf("expected whitespace in comments to be significant")
+	}
+
+	if NormalizeDump("\n# nothing here\n") != "" {
+		t.Errorf("expected empty dump to normalize to empty string")
+	}
+}
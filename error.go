@@ -24,6 +24,24 @@ import (
 	"syscall"
 )
 
+var (
+	// ErrNotFound is matched (via errors.Is) by nftables "not found" errors of any
+	// sort. (See IsNotFound.)
+	ErrNotFound = errors.New("not found")
+
+	// ErrAlreadyExists is matched (via errors.Is) by nftables "already exists"
+	// errors. (See IsAlreadyExists.)
+	ErrAlreadyExists = errors.New("already exists")
+
+	// ErrPermissionDenied is matched (via errors.Is) by nftables errors resulting
+	// from a lack of privileges. (See IsPermissionDenied.)
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrBusy is matched (via errors.Is) by nftables "device or resource busy"
+	// errors. (See IsBusy.)
+	ErrBusy = errors.New("busy")
+)
+
 type nftablesError struct {
 	wrapped error
 	msg     string
@@ -42,10 +60,16 @@ func wrapError(err error) error {
 			// English error strings regardless of the locale.
 			enoent := strings.Index(nerr.msg, "No such file or directory")
 			eexist := strings.Index(nerr.msg, "File exists")
+			eperm := strings.Index(nerr.msg, "Operation not permitted")
+			ebusy := strings.Index(nerr.msg, "Device or resource busy")
 			if enoent != -1 && (enoent < eol || eol == -1) {
 				nerr.errno = syscall.ENOENT
 			} else if eexist != -1 && (eexist < eol || eol == -1) {
 				nerr.errno = syscall.EEXIST
+			} else if eperm != -1 && (eperm < eol || eol == -1) {
+				nerr.errno = syscall.EPERM
+			} else if ebusy != -1 && (ebusy < eol || eol == -1) {
+				nerr.errno = syscall.EBUSY
 			}
 		}
 	}
@@ -64,6 +88,12 @@ func existsError(format string, args ...interface{}) error {
 	return &nftablesError{msg: fmt.Sprintf(format, args...), errno: syscall.EEXIST}
 }
 
+// busyError returns an nftablesError with the given message for which IsBusy will
+// return true.
+func busyError(format string, args ...interface{}) error {
+	return &nftablesError{msg: fmt.Sprintf(format, args...), errno: syscall.EBUSY}
+}
+
 func (nerr *nftablesError) Error() string {
 	return nerr.msg
 }
@@ -72,6 +102,22 @@ func (nerr *nftablesError) Unwrap() error {
 	return nerr.wrapped
 }
 
+// Is allows matching nerr against ErrNotFound, ErrAlreadyExists, ErrPermissionDenied,
+// and ErrBusy with errors.Is.
+func (nerr *nftablesError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return nerr.errno == syscall.ENOENT
+	case ErrAlreadyExists:
+		return nerr.errno == syscall.EEXIST
+	case ErrPermissionDenied:
+		return nerr.errno == syscall.EPERM
+	case ErrBusy:
+		return nerr.errno == syscall.EBUSY
+	}
+	return false
+}
+
 // IsNotFound tests if err corresponds to an nftables "not found" error of any sort.
 // (e.g., in response to a "delete rule" command, this might indicate that the rule
 // doesn't exist, or the chain doesn't exist, or the table doesn't exist.)
@@ -92,3 +138,23 @@ func IsAlreadyExists(err error) bool {
 	}
 	return false
 }
+
+// IsPermissionDenied tests if err corresponds to an nftables "operation not permitted"
+// error (e.g. because the process does not have CAP_NET_ADMIN).
+func IsPermissionDenied(err error) bool {
+	var nerr *nftablesError
+	if errors.As(err, &nerr) {
+		return nerr.errno == syscall.EPERM
+	}
+	return false
+}
+
+// IsBusy tests if err corresponds to an nftables "device or resource busy" error (e.g.
+// when trying to delete a set, map, or chain that is still referenced by a rule).
+func IsBusy(err error) bool {
+	var nerr *nftablesError
+	if errors.As(err, &nerr) {
+		return nerr.errno == syscall.EBUSY
+	}
+	return false
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package knftables
 
 import (
+	"errors"
 	"fmt"
 	"os/exec"
 	"testing"
@@ -32,6 +33,8 @@ func TestError(t *testing.T) {
 		err        error
 		isNotFound bool
 		isExists   bool
+		isPerm     bool
+		isBusy     bool
 	}{
 		{
 			name:       "generic doesn't exist",
@@ -51,6 +54,16 @@ func TestError(t *testing.T) {
 			isNotFound: false,
 			isExists:   true,
 		},
+		{
+			name:   "permission denied",
+			err:    mkExecError("Error: cache initialization failed: Operation not permitted\n"),
+			isPerm: true,
+		},
+		{
+			name:   "busy",
+			err:    mkExecError("Error: Could not process rule: Device or resource busy\ndelete set ip foo bar\n^^^^^^^^^^^^^^^^^^^^^\n"),
+			isBusy: true,
+		},
 		{
 			name:       "wrapped doesn't exist",
 			err:        fmt.Errorf("oh my! %w", mkExecError("Error: No such file or directory")),
@@ -87,6 +100,11 @@ func TestError(t *testing.T) {
 			isNotFound: false,
 			isExists:   true,
 		},
+		{
+			name:   "fake busy",
+			err:    busyError("in use"),
+			isBusy: true,
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			if IsNotFound(tc.err) != tc.isNotFound {
@@ -95,6 +113,24 @@ func TestError(t *testing.T) {
 			if IsAlreadyExists(tc.err) != tc.isExists {
 				t.Errorf("expected IsAlreadyExists %v, got %v", tc.isExists, IsAlreadyExists(tc.err))
 			}
+			if IsPermissionDenied(tc.err) != tc.isPerm {
+				t.Errorf("expected IsPermissionDenied %v, got %v", tc.isPerm, IsPermissionDenied(tc.err))
+			}
+			if IsBusy(tc.err) != tc.isBusy {
+				t.Errorf("expected IsBusy %v, got %v", tc.isBusy, IsBusy(tc.err))
+			}
+			if errors.Is(tc.err, ErrNotFound) != tc.isNotFound {
+				t.Errorf("expected errors.Is(ErrNotFound) %v, got %v", tc.isNotFound, errors.Is(tc.err, ErrNotFound))
+			}
+			if errors.Is(tc.err, ErrAlreadyExists) != tc.isExists {
+				t.Errorf("expected errors.Is(ErrAlreadyExists) %v, got %v", tc.isExists, errors.Is(tc.err, ErrAlreadyExists))
+			}
+			if errors.Is(tc.err, ErrPermissionDenied) != tc.isPerm {
+				t.Errorf("expected errors.Is(ErrPermissionDenied) %v, got %v", tc.isPerm, errors.Is(tc.err, ErrPermissionDenied))
+			}
+			if errors.Is(tc.err, ErrBusy) != tc.isBusy {
+				t.Errorf("expected errors.Is(ErrBusy) %v, got %v", tc.isBusy, errors.Is(tc.err, ErrBusy))
+			}
 		})
 	}
 }
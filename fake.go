@@ -17,25 +17,127 @@ limitations under the License.
 package knftables
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"reflect"
+	"net/netip"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Fake is a fake implementation of Interface
+// Fake is a fake implementation of Interface. Its methods are safe for concurrent use
+// from multiple goroutines (but directly accessing Table is not).
+//
+// When an element is added to a set or map that already contains an element with the
+// same key, Fake replaces the existing element with the new one, in its existing
+// position; the new element's Value, Comment, Timeout, and Counter take effect, and
+// any fields left unset in the new element are cleared. (Any pending expiration of
+// the old element carries over unless the new element specifies Expires.) This
+// applies equally to sets and maps. Creating an element whose key already exists is
+// an error, as with real nft.
+//
+// Fake assigns handles the way the kernel does: each newly-created table, chain, rule,
+// set, map, flowtable, counter, quota, ct timeout, or ct expectation gets the next
+// handle in sequence, starting from 1 (or from the value passed to SetHandleBase).
+// Operations that don't create a new object (including adding an object that already
+// exists, and adding set/map elements, which don't have handles) don't use up a
+// handle. Handles are not reused after an object is deleted.
+//
+// Real nft always performs the checks enabled by StrictTypes, ValidateChains,
+// ValidateNames, ValidateReferences, and ValidateFlags, but they are off by default in
+// Fake for backward compatibility.
 type Fake struct {
 	nftContext
 
+	// mutex protects the fields below
+	mutex sync.RWMutex
+
 	nextHandle int
 
+	// transactions contains copies of the transactions that have been successfully
+	// Run, in order.
+	transactions []*Transaction
+
+	// now is the current time according to the simulated clock used for element
+	// timeouts. (It starts at 0 and is advanced by Tick.)
+	now time.Duration
+
+	// capabilities, if non-nil, is the set of optional features that fake supports
+	// (as set by SetCapabilities). If nil, all features are supported.
+	capabilities map[Capability]bool
+
+	// StrictTypes, if set, causes Run to check that each set/map element has the
+	// same number of key (and value) components as its set/map's type, and that
+	// each element of a verdict map has a valid verdict as its value.
+	StrictTypes bool
+
+	// ValidateChains, if set, causes Run to check that each added base chain uses
+	// a Type and Hook that are valid together in fake's family, that its Priority
+	// is valid, and that it has a Device (or Devices) if and only if it is an
+	// ingress/egress chain. (netdev-family ingress/egress chains are always
+	// required to name at least one device, even if this is not set.)
+	ValidateChains bool
+
+	// ValidateNames, if set, causes Run to check that the names of added tables,
+	// chains, sets, maps, and other named objects are valid nft identifiers (at most
+	// 255 bytes, starting with a letter, "_", or ".", and containing only letters,
+	// digits, and "_", ".", "/", and "-").
+	ValidateNames bool
+
+	// ValidateReferences, if set, causes Run to refuse to delete a set, map, chain,
+	// or named stateful object (counter, quota, ct timeout, or ct expectation) that
+	// is still referenced by a rule (or, for a chain, by a verdict map element),
+	// returning an error for which IsBusy will return true, and to refuse
+	// to add a rule that refers to a named counter or quota ("counter name NAME" or
+	// "quota name NAME") that does not exist, returning an error for which
+	// IsNotFound will return true.
+	ValidateReferences bool
+
+	// ValidateFlags, if set, causes Run to check that the Flags of each added set or
+	// map are known flags that are compatible with each other (eg, not both
+	// "constant" and "dynamic") and with the set/map's key type (eg, "interval" can
+	// only be used with address and integer types).
+	ValidateFlags bool
+
+	// StrictScope, if set, causes Run and Check to reject transactions that were
+	// created for a different family or table than fake's (eg, by another Fake's
+	// NewTransaction). (Otherwise, Fake applies the transaction's operations to its
+	// own table regardless.)
+	StrictScope bool
+
+	// FailNextRun, if non-nil, will be returned by the next call to Run (which will
+	// then clear it) instead of running the transaction. Since Run is atomic, this
+	// means that none of the transaction's operations will be applied.
+	FailNextRun error
+
+	// InjectError, if non-nil, is called at the start of every Run (after
+	// FailNextRun is checked) with the transaction that is about to be run. If it
+	// returns an error, Run returns that error without applying any of the
+	// transaction's operations. (It is called with fake's mutex held, so it must not
+	// call any other methods on fake.)
+	InjectError func(tx *Transaction) error
+
 	// Table contains the Interface's table. This will be `nil` until you `tx.Add()`
 	// the table.
 	Table *FakeTable
 }
 
+// Capability is an optional nft feature that may not be supported by older versions of
+// nft (or the kernel). See Fake.SetCapabilities.
+type Capability string
+
+const (
+	// DestroyCapability is support for the "destroy" verb (Transaction.Destroy),
+	// which requires nft 1.0.8 and kernel 6.3 or later.
+	DestroyCapability Capability = "destroy"
+)
+
 // FakeTable wraps Table for the Fake implementation
 type FakeTable struct {
 	Table
@@ -48,6 +150,25 @@ type FakeTable struct {
 
 	// Maps contains the table's maps, keyed by name
 	Maps map[string]*FakeMap
+
+	// Flowtables contains the table's flowtables, keyed by name
+	Flowtables map[string]*Flowtable
+
+	// Counters contains the table's named counters, keyed by name
+	Counters map[string]*Counter
+
+	// Quotas contains the table's named quotas, keyed by name
+	Quotas map[string]*Quota
+
+	// CTTimeouts contains the table's conntrack timeout policies, keyed by name
+	CTTimeouts map[string]*CTTimeout
+
+	// CTExpectations contains the table's conntrack expectations, keyed by name
+	CTExpectations map[string]*CTExpectation
+
+	// expires contains the (simulated clock) expiration times of set/map elements
+	// that have a timeout.
+	expires map[*Element]time.Duration
 }
 
 // FakeChain wraps Chain for the Fake implementation
@@ -65,6 +186,8 @@ type FakeSet struct {
 	// Elements contains the set's elements. You can also use the FakeSet's
 	// FindElement() method to see if a particular element is present.
 	Elements []*Element
+
+	index elementIndex
 }
 
 // FakeMap wraps Set for the Fake implementation
@@ -74,6 +197,8 @@ type FakeMap struct {
 	// Elements contains the map's elements. You can also use the FakeMap's
 	// FindElement() method to see if a particular element is present.
 	Elements []*Element
+
+	index elementIndex
 }
 
 // NewFake creates a new fake Interface, for unit tests
@@ -86,10 +211,53 @@ func NewFake(family Family, table string) *Fake {
 	}
 }
 
+// NewFakeFromDump creates a new fake Interface, populated from dump. dump can be in the
+// format returned by Fake.Dump or Interface.DumpTable (as with ParseDump), or it can be
+// the raw output of "nft list table" for the given family and table (eg, captured from a
+// real system). Objects that Fake does not support cause an error. All objects are
+// assigned new handles, as though they had been created by a transaction.
+func NewFakeFromDump(family Family, table, dump string) (*Fake, error) {
+	fake := NewFake(family, table)
+	if isListOutput(dump) {
+		var err error
+		dump, err = listOutputToTransaction(family, table, dump)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := fake.ParseDump(dump); err != nil {
+		return nil, err
+	}
+	return fake, nil
+}
+
+// isListOutput returns true if dump looks like the output of "nft list table" rather
+// than a series of "add" commands.
+func isListOutput(dump string) bool {
+	for _, line := range strings.Split(dump, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		return strings.HasPrefix(line, "table ")
+	}
+	return false
+}
+
 var _ Interface = &Fake{}
 
 // List is part of Interface.
 func (fake *Fake) List(_ context.Context, objectType string) ([]string, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if objectType == "table" || objectType == "tables" {
+		if fake.Table == nil {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s %s", fake.family, fake.table)}, nil
+	}
+
 	if fake.Table == nil {
 		return nil, notFoundError("no such table %q", fake.table)
 	}
@@ -109,7 +277,93 @@ func (fake *Fake) List(_ context.Context, objectType string) ([]string, error) {
 		for name := range fake.Table.Maps {
 			result = append(result, name)
 		}
+	case "flowtable", "flowtables":
+		for name := range fake.Table.Flowtables {
+			result = append(result, name)
+		}
+	case "counter", "counters":
+		for name := range fake.Table.Counters {
+			result = append(result, name)
+		}
+	case "quota", "quotas":
+		for name := range fake.Table.Quotas {
+			result = append(result, name)
+		}
+	case "ct timeout", "ct timeouts":
+		for name := range fake.Table.CTTimeouts {
+			result = append(result, name)
+		}
+	case "ct expectation", "ct expectations":
+		for name := range fake.Table.CTExpectations {
+			result = append(result, name)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported object type %q", objectType)
+	}
+
+	return result, nil
+}
+
+// ListWithHandles is part of Interface.
+func (fake *Fake) ListWithHandles(_ context.Context, objectType string) (map[string]int, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return nil, notFoundError("no such table %q", fake.table)
+	}
 
+	result := make(map[string]int)
+	switch objectType {
+	case "chain", "chains":
+		for name, chain := range fake.Table.Chains {
+			if chain.Handle != nil {
+				result[name] = *chain.Handle
+			}
+		}
+	case "set", "sets":
+		for name, set := range fake.Table.Sets {
+			if set.Handle != nil {
+				result[name] = *set.Handle
+			}
+		}
+	case "map", "maps":
+		for name, mapObj := range fake.Table.Maps {
+			if mapObj.Handle != nil {
+				result[name] = *mapObj.Handle
+			}
+		}
+	case "flowtable", "flowtables":
+		for name, flowtable := range fake.Table.Flowtables {
+			if flowtable.Handle != nil {
+				result[name] = *flowtable.Handle
+			}
+		}
+	case "counter", "counters":
+		for name, counter := range fake.Table.Counters {
+			if counter.Handle != nil {
+				result[name] = *counter.Handle
+			}
+		}
+	case "quota", "quotas":
+		for name, quota := range fake.Table.Quotas {
+			if quota.Handle != nil {
+				result[name] = *quota.Handle
+			}
+		}
+	case "ct timeout", "ct timeouts":
+		for name, timeout := range fake.Table.CTTimeouts {
+			if timeout.Handle != nil {
+				result[name] = *timeout.Handle
+			}
+		}
+	case "ct expectation", "ct expectations":
+		for name, expectation := range fake.Table.CTExpectations {
+			if expectation.Handle != nil {
+				result[name] = *expectation.Handle
+			}
+		}
 	default:
 		return nil, fmt.Errorf("unsupported object type %q", objectType)
 	}
@@ -117,8 +371,100 @@ func (fake *Fake) List(_ context.Context, objectType string) ([]string, error) {
 	return result, nil
 }
 
+// HasTable is part of Interface.
+func (fake *Fake) HasTable(_ context.Context) (bool, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	return fake.Table != nil, nil
+}
+
+// ListChainsFull is part of Interface.
+func (fake *Fake) ListChainsFull(_ context.Context) ([]*Chain, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return nil, notFoundError("no such table %q", fake.table)
+	}
+
+	chains := make([]*Chain, 0, len(fake.Table.Chains))
+	for _, name := range sortKeys(fake.Table.Chains) {
+		chains = append(chains, fake.Table.Chains[name].Chain.deepCopy())
+	}
+	return chains, nil
+}
+
+// ListSetsFull is part of Interface.
+func (fake *Fake) ListSetsFull(_ context.Context) ([]*Set, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return nil, notFoundError("no such table %q", fake.table)
+	}
+
+	sets := make([]*Set, 0, len(fake.Table.Sets))
+	for _, name := range sortKeys(fake.Table.Sets) {
+		sets = append(sets, fake.Table.Sets[name].Set.deepCopy())
+	}
+	return sets, nil
+}
+
+// ListMapsFull is part of Interface.
+func (fake *Fake) ListMapsFull(_ context.Context) ([]*Map, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return nil, notFoundError("no such table %q", fake.table)
+	}
+
+	maps := make([]*Map, 0, len(fake.Table.Maps))
+	for _, name := range sortKeys(fake.Table.Maps) {
+		maps = append(maps, fake.Table.Maps[name].Map.deepCopy())
+	}
+	return maps, nil
+}
+
+// GetChain is part of Interface.
+func (fake *Fake) GetChain(_ context.Context, name string) (*Chain, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil || fake.Table.Chains[name] == nil {
+		return nil, notFoundError("no such chain %q", name)
+	}
+	return fake.Table.Chains[name].Chain.deepCopy(), nil
+}
+
+// GetSet is part of Interface.
+func (fake *Fake) GetSet(_ context.Context, name string) (*Set, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil || fake.Table.Sets[name] == nil {
+		return nil, notFoundError("no such set %q", name)
+	}
+	return fake.Table.Sets[name].Set.deepCopy(), nil
+}
+
+// GetMap is part of Interface.
+func (fake *Fake) GetMap(_ context.Context, name string) (*Map, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil || fake.Table.Maps[name] == nil {
+		return nil, notFoundError("no such map %q", name)
+	}
+	return fake.Table.Maps[name].Map.deepCopy(), nil
+}
+
 // ListRules is part of Interface
 func (fake *Fake) ListRules(_ context.Context, chain string) ([]*Rule, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
 	if fake.Table == nil {
 		return nil, notFoundError("no such chain %q", chain)
 	}
@@ -126,67 +472,442 @@ func (fake *Fake) ListRules(_ context.Context, chain string) ([]*Rule, error) {
 	if ch == nil {
 		return nil, notFoundError("no such chain %q", chain)
 	}
-	return ch.Rules, nil
+
+	rules := make([]*Rule, len(ch.Rules))
+	for i := range ch.Rules {
+		rules[i] = ch.Rules[i].deepCopy()
+	}
+	return rules, nil
 }
 
 // ListElements is part of Interface
 func (fake *Fake) ListElements(_ context.Context, objectType, name string) ([]*Element, error) {
-	if fake.Table == nil {
-		return nil, notFoundError("no such %s %q", objectType, name)
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	elements, err := fake.findElements(objectType, name)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Element, len(elements))
+	for i := range elements {
+		result[i] = fake.copyElement(elements[i])
 	}
-	if objectType == "set" {
-		s := fake.Table.Sets[name]
-		if s != nil {
-			return s.Elements, nil
+	return result, nil
+}
+
+// RangeElements is part of Interface. Note that the Fake is locked while fn is being
+// called, so fn must not call any other methods on the Fake.
+func (fake *Fake) RangeElements(_ context.Context, objectType, name string, fn func(*Element) bool) error {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	elements, err := fake.findElements(objectType, name)
+	if err != nil {
+		return err
+	}
+	for _, element := range elements {
+		if !fn(fake.copyElement(element)) {
+			break
 		}
-	} else if objectType == "map" {
-		m := fake.Table.Maps[name]
-		if m != nil {
-			return m.Elements, nil
+	}
+	return nil
+}
+
+// ElementCount is part of Interface.
+func (fake *Fake) ElementCount(_ context.Context, objectType, name string) (int, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	elements, err := fake.findElements(objectType, name)
+	if err != nil {
+		return 0, err
+	}
+	return len(elements), nil
+}
+
+// ListElementsMatching is part of Interface.
+func (fake *Fake) ListElementsMatching(ctx context.Context, objectType, name string, predicate func(*Element) bool) ([]*Element, error) {
+	return listElementsMatching(ctx, fake, objectType, name, predicate)
+}
+
+// findElements returns the (internal) elements of the named set or map. fake.mutex must
+// be held.
+func (fake *Fake) findElements(objectType, name string) ([]*Element, error) {
+	if fake.Table != nil {
+		if objectType == "set" {
+			if s := fake.Table.Sets[name]; s != nil {
+				return s.Elements, nil
+			}
+		} else if objectType == "map" {
+			if m := fake.Table.Maps[name]; m != nil {
+				return m.Elements, nil
+			}
 		}
 	}
 	return nil, notFoundError("no such %s %q", objectType, name)
 }
 
+// copyElement returns a copy of element for returning to the caller, with Expires
+// filled in if appropriate. fake.mutex must be held.
+func (fake *Fake) copyElement(element *Element) *Element {
+	ecopy := element.deepCopy()
+	if expires, ok := fake.Table.expires[element]; ok {
+		ecopy.Expires = PtrTo(expires - fake.now)
+	}
+	return ecopy
+}
+
+// deepCopy returns a copy of chain that shares no memory with the original.
+func (chain *Chain) deepCopy() *Chain {
+	ccopy := *chain
+	ccopy.Type = copyPtr(chain.Type)
+	ccopy.Hook = copyPtr(chain.Hook)
+	ccopy.Priority = copyPtr(chain.Priority)
+	ccopy.Policy = copyPtr(chain.Policy)
+	ccopy.Device = copyPtr(chain.Device)
+	if chain.Devices != nil {
+		ccopy.Devices = append([]string{}, chain.Devices...)
+	}
+	ccopy.Comment = copyPtr(chain.Comment)
+	ccopy.Handle = copyPtr(chain.Handle)
+	return &ccopy
+}
+
+// deepCopy returns a copy of timeout that shares no memory with the original.
+func (timeout *CTTimeout) deepCopy() *CTTimeout {
+	tcopy := *timeout
+	tcopy.L3Proto = copyPtr(timeout.L3Proto)
+	if timeout.Policy != nil {
+		tcopy.Policy = make(map[string]time.Duration, len(timeout.Policy))
+		for state, t := range timeout.Policy {
+			tcopy.Policy[state] = t
+		}
+	}
+	tcopy.Comment = copyPtr(timeout.Comment)
+	tcopy.Handle = copyPtr(timeout.Handle)
+	return &tcopy
+}
+
+// deepCopy returns a copy of set that shares no memory with the original.
+func (set *Set) deepCopy() *Set {
+	scopy := *set
+	scopy.Flags = append([]SetFlag(nil), set.Flags...)
+	scopy.Timeout = copyPtr(set.Timeout)
+	scopy.GCInterval = copyPtr(set.GCInterval)
+	scopy.Size = copyPtr(set.Size)
+	scopy.Policy = copyPtr(set.Policy)
+	scopy.AutoMerge = copyPtr(set.AutoMerge)
+	scopy.Comment = copyPtr(set.Comment)
+	scopy.Handle = copyPtr(set.Handle)
+	return &scopy
+}
+
+// deepCopy returns a copy of mapObj that shares no memory with the original.
+func (mapObj *Map) deepCopy() *Map {
+	mcopy := *mapObj
+	mcopy.Flags = append([]SetFlag(nil), mapObj.Flags...)
+	mcopy.Timeout = copyPtr(mapObj.Timeout)
+	mcopy.GCInterval = copyPtr(mapObj.GCInterval)
+	mcopy.Size = copyPtr(mapObj.Size)
+	mcopy.Policy = copyPtr(mapObj.Policy)
+	mcopy.Comment = copyPtr(mapObj.Comment)
+	mcopy.Handle = copyPtr(mapObj.Handle)
+	return &mcopy
+}
+
+// deepCopy returns a copy of rule that shares no memory with the original.
+func (rule *Rule) deepCopy() *Rule {
+	rcopy := *rule
+	rcopy.Comment = copyPtr(rule.Comment)
+	rcopy.Index = copyPtr(rule.Index)
+	rcopy.Handle = copyPtr(rule.Handle)
+	rcopy.Counter = copyPtr(rule.Counter)
+	return &rcopy
+}
+
+// deepCopy returns a copy of element that shares no memory with the original.
+func (element *Element) deepCopy() *Element {
+	ecopy := *element
+	ecopy.Key = append([]string(nil), element.Key...)
+	ecopy.Value = append([]string(nil), element.Value...)
+	ecopy.Timeout = copyPtr(element.Timeout)
+	ecopy.Expires = copyPtr(element.Expires)
+	ecopy.Counter = copyPtr(element.Counter)
+	ecopy.Comment = copyPtr(element.Comment)
+	return &ecopy
+}
+
+// copyPtr returns a pointer to a copy of *ptr, or nil if ptr is nil.
+func copyPtr[T any](ptr *T) *T {
+	if ptr == nil {
+		return nil
+	}
+	return PtrTo(*ptr)
+}
+
 // NewTransaction is part of Interface
 func (fake *Fake) NewTransaction() *Transaction {
 	return &Transaction{nftContext: &fake.nftContext}
 }
 
-// Run is part of Interface
-func (fake *Fake) Run(_ context.Context, tx *Transaction) error {
-	updatedTable, err := fake.run(tx)
+// Run is part of Interface. If ctx is cancelled (before or during the Run), it returns
+// ctx.Err() without applying any of the transaction's operations.
+func (fake *Fake) Run(ctx context.Context, tx *Transaction) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if fake.FailNextRun != nil {
+		err := fake.FailNextRun
+		fake.FailNextRun = nil
+		return err
+	}
+	if fake.InjectError != nil {
+		if err := fake.InjectError(tx); err != nil {
+			return err
+		}
+	}
+
+	updatedTable, err := fake.run(ctx, tx)
 	if err == nil {
 		fake.Table = updatedTable
+		fake.transactions = append(fake.transactions, tx.copy())
 	}
 	return err
 }
 
-// Check is part of Interface
-func (fake *Fake) Check(_ context.Context, tx *Transaction) error {
-	_, err := fake.run(tx)
+// RunBatched is part of Interface. Fake applies the whole transaction at once, as with
+// Run, regardless of batchSize.
+func (fake *Fake) RunBatched(ctx context.Context, tx *Transaction, _ int) error {
+	return fake.Run(ctx, tx)
+}
+
+// AppliedTransactions returns copies of the transactions that have been successfully Run
+// against fake (including by ParseDump), in order. (Transactions that failed, or that
+// were only passed to Check, are not included.)
+func (fake *Fake) AppliedTransactions() []*Transaction {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	transactions := make([]*Transaction, len(fake.transactions))
+	for i, tx := range fake.transactions {
+		transactions[i] = tx.copy()
+	}
+	return transactions
+}
+
+// LastTransaction returns a copy of the most recent transaction that was successfully
+// Run against fake, or nil if there have been none.
+func (fake *Fake) LastTransaction() *Transaction {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if len(fake.transactions) == 0 {
+		return nil
+	}
+	return fake.transactions[len(fake.transactions)-1].copy()
+}
+
+// Reset returns fake to the state it was in when it was created, discarding its table
+// (Table is set to nil), the record of applied transactions, and the simulated clock, and
+// restarting handle numbering. The family and table name, the configuration fields
+// (StrictTypes, ValidateChains, ValidateNames, ValidateReferences, ValidateFlags,
+// StrictScope, FailNextRun, and InjectError), and the capabilities set by
+// SetCapabilities are preserved. This is useful for reusing a single Fake across
+// multiple test cases.
+func (fake *Fake) Reset() {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.reset()
+}
+
+// ResetAll is like Reset, but also returns the configuration fields (StrictTypes,
+// ValidateChains, ValidateNames, ValidateReferences, ValidateFlags, StrictScope,
+// FailNextRun, and InjectError) to their defaults, and undoes any call to
+// SetCapabilities.
+func (fake *Fake) ResetAll() {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.reset()
+	fake.StrictTypes = false
+	fake.ValidateChains = false
+	fake.ValidateNames = false
+	fake.ValidateReferences = false
+	fake.ValidateFlags = false
+	fake.StrictScope = false
+	fake.capabilities = nil
+	fake.FailNextRun = nil
+	fake.InjectError = nil
+}
+
+// reset implements Reset. fake.mutex must be held.
+func (fake *Fake) reset() {
+	fake.Table = nil
+	fake.nextHandle = 0
+	fake.transactions = nil
+	fake.now = 0
+}
+
+// SetHandleBase causes the next object that fake creates to be assigned handle n, with
+// subsequent objects getting handles n+1, n+2, etc. (This is reset by Reset.)
+func (fake *Fake) SetHandleBase(n int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.nextHandle = n - 1
+}
+
+// SetCapabilities causes fake to simulate a version of nft that supports only the given
+// optional features; Run and Check will fail on any transaction that uses a feature
+// not in caps. (By default, fake supports all features. This is undone by ResetAll.)
+func (fake *Fake) SetCapabilities(caps ...Capability) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.capabilities = make(map[Capability]bool, len(caps))
+	for _, c := range caps {
+		fake.capabilities[c] = true
+	}
+}
+
+// supports returns whether fake supports capability. fake.mutex must be held.
+func (fake *Fake) supports(capability Capability) bool {
+	return fake.capabilities == nil || fake.capabilities[capability]
+}
+
+// allocateHandle returns the handle for a newly-created object. fake.mutex must be held.
+func (fake *Fake) allocateHandle() *int {
+	fake.nextHandle++
+	return PtrTo(fake.nextHandle)
+}
+
+// Check is part of Interface. It performs all of the same validation as Run, but never
+// makes any changes to fake (including to the handles that will be assigned to
+// subsequently-created objects).
+func (fake *Fake) Check(ctx context.Context, tx *Transaction) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	nextHandle := fake.nextHandle
+	_, err := fake.run(ctx, tx)
+	fake.nextHandle = nextHandle
 	return err
 }
 
-func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
+// Validate checks the internal consistency of fake's current state: that every rule's
+// jump/goto targets and set/map references exist, that every element has the right
+// number of key and value components for its set or map, that verdict map values are
+// valid verdicts pointing to existing chains, and that no set or map has more elements
+// than its Size. This is mostly redundant with the validation that Run does, but it
+// can be useful as a test assertion when the fake has been populated via ParseDump or
+// by modifying Table directly. All problems found are returned, joined together.
+func (fake *Fake) Validate() error {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	table := fake.Table
+	if table == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, cname := range sortKeys(table.Chains) {
+		for _, rule := range table.Chains[cname].Rules {
+			if err := checkRuleRefs(rule, table); err != nil {
+				errs = append(errs, fmt.Errorf("chain %q: rule %q: %w", cname, rule.Rule, err))
+			}
+		}
+	}
+	for _, sname := range sortKeys(table.Sets) {
+		set := table.Sets[sname]
+		for _, element := range set.Elements {
+			if err := checkElementArity(element, set.Type, set.TypeOf); err != nil {
+				errs = append(errs, fmt.Errorf("set %q: %w", sname, err))
+			}
+		}
+		if set.Size != nil && *set.Size != 0 && uint64(len(set.Elements)) > *set.Size {
+			errs = append(errs, fmt.Errorf("set %q: has %d elements but size is %d", sname, len(set.Elements), *set.Size))
+		}
+	}
+	for _, mname := range sortKeys(table.Maps) {
+		mapObj := table.Maps[mname]
+		for _, element := range mapObj.Elements {
+			if err := checkElementArity(element, mapObj.Type, mapObj.TypeOf); err != nil {
+				errs = append(errs, fmt.Errorf("map %q: %w", mname, err))
+			}
+			if err := checkVerdictElement(element, mapObj.Type, mapObj.TypeOf); err != nil {
+				errs = append(errs, fmt.Errorf("map %q: %w", mname, err))
+			}
+			if err := checkElementRefs(element, table); err != nil {
+				errs = append(errs, fmt.Errorf("map %q: element %q: %w", mname, strings.Join(element.Key, " . "), err))
+			}
+		}
+		if mapObj.Size != nil && *mapObj.Size != 0 && uint64(len(mapObj.Elements)) > *mapObj.Size {
+			errs = append(errs, fmt.Errorf("map %q: has %d elements but size is %d", mname, len(mapObj.Elements), *mapObj.Size))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (fake *Fake) run(ctx context.Context, tx *Transaction) (*FakeTable, error) {
 	if tx.err != nil {
 		return nil, tx.err
 	}
+	if fake.StrictScope && tx.nftContext != nil && (tx.family != fake.family || tx.table != fake.table) {
+		return nil, fmt.Errorf("transaction is for table \"%s %s\" but fake is for table \"%s %s\"",
+			tx.family, tx.table, fake.family, fake.table)
+	}
 
 	updatedTable := fake.Table.copy()
 	for _, op := range tx.operations {
-		// If the table hasn't been created, and this isn't a Table operation, then fail
+		// Check for cancellation between operations, so that large
+		// transactions can be interrupted
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if op.verb == destroyVerb && !fake.supports(DestroyCapability) {
+			return nil, fmt.Errorf("syntax error, unexpected destroy (nft version does not support %q)", DestroyCapability)
+		}
+		// If the table hasn't been created, and this isn't a Table (or ruleset)
+		// operation, then fail
 		if updatedTable == nil {
-			if _, ok := op.obj.(*Table); !ok {
+			switch op.obj.(type) {
+			case *Table, *ruleset:
+			default:
 				return nil, notFoundError("no such table \"%s %s\"", fake.family, fake.table)
 			}
 		}
 
-		if op.verb == addVerb || op.verb == createVerb || op.verb == insertVerb {
-			fake.nextHandle++
+		if op.verb == destroyVerb {
+			exists, err := updatedTable.hasObject(op.obj)
+			if err != nil {
+				return nil, err
+			} else if !exists {
+				continue
+			}
+			op.verb = deleteVerb
+		}
+		if fake.ValidateNames && (op.verb == addVerb || op.verb == createVerb || op.verb == renameVerb) {
+			if err := checkObjectName(op.obj, fake.table); err != nil {
+				return nil, err
+			}
 		}
 
 		switch obj := op.obj.(type) {
+		case *ruleset:
+			// Fake only knows about its own table, so that's all there is to
+			// flush.
+			updatedTable = nil
+
 		case *Table:
 			err := checkExists(op.verb, "table", fake.table, updatedTable != nil)
 			if err != nil {
@@ -194,20 +915,16 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 			}
 			switch op.verb {
 			case flushVerb:
-				updatedTable = nil
-				fallthrough
+				// Flushing removes the table's contents but not the table
+				// itself (so it keeps its handle and comment).
+				updatedTable = newFakeTable(updatedTable.Table)
 			case addVerb, createVerb:
 				if updatedTable != nil {
 					continue
 				}
 				table := *obj
-				table.Handle = PtrTo(fake.nextHandle)
-				updatedTable = &FakeTable{
-					Table:  table,
-					Chains: make(map[string]*FakeChain),
-					Sets:   make(map[string]*FakeSet),
-					Maps:   make(map[string]*FakeMap),
-				}
+				table.Handle = fake.allocateHandle()
+				updatedTable = newFakeTable(table)
 			case deleteVerb:
 				updatedTable = nil
 			default:
@@ -215,34 +932,73 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 			}
 
 		case *Chain:
-			existingChain := updatedTable.Chains[obj.Name]
-			err := checkExists(op.verb, "chain", obj.Name, existingChain != nil)
-			if err != nil {
-				return nil, err
+			var existingChain *FakeChain
+			if obj.Handle != nil {
+				existingChain = updatedTable.findChainByHandle(*obj.Handle)
+				if existingChain == nil {
+					return nil, notFoundError("no chain with handle %d", *obj.Handle)
+				}
+			} else {
+				existingChain = updatedTable.Chains[obj.Name]
+				err := checkExists(op.verb, "chain", obj.Name, existingChain != nil)
+				if err != nil {
+					return nil, err
+				}
 			}
 			switch op.verb {
 			case addVerb, createVerb:
+				if fake.ValidateChains {
+					if err := checkBaseChain(fake.family, obj); err != nil {
+						return nil, err
+					}
+				} else if fake.family == NetDevFamily {
+					if err := checkChainDevices(obj); err != nil {
+						return nil, err
+					}
+				}
 				if existingChain != nil {
 					continue
 				}
 				chain := *obj
-				chain.Handle = PtrTo(fake.nextHandle)
+				chain.Devices = append([]string(nil), obj.Devices...)
+				chain.Handle = fake.allocateHandle()
 				updatedTable.Chains[obj.Name] = &FakeChain{
 					Chain: chain,
 				}
 			case flushVerb:
 				existingChain.Rules = nil
 			case deleteVerb:
-				// FIXME delete-by-handle
-				delete(updatedTable.Chains, obj.Name)
+				if fake.ValidateReferences {
+					if err := updatedTable.checkNotReferenced("chain", existingChain.Name); err != nil {
+						return nil, err
+					}
+				}
+				delete(updatedTable.Chains, existingChain.Name)
 			default:
 				return nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
 
-		case *Rule:
-			existingChain := updatedTable.Chains[obj.Chain]
+		case *chainRename:
+			existingChain := updatedTable.Chains[obj.chain.Name]
 			if existingChain == nil {
-				return nil, notFoundError("no such chain %q", obj.Chain)
+				return nil, notFoundError("no such chain %q", obj.chain.Name)
+			}
+			if updatedTable.Chains[obj.newName] != nil {
+				return nil, existsError("chain %q already exists", obj.newName)
+			}
+			updatedTable.renameChain(existingChain, obj.newName)
+
+		case *rulesReset:
+			existingChain := updatedTable.Chains[obj.chain]
+			if existingChain == nil {
+				return nil, notFoundError("no such chain %q", obj.chain)
+			}
+			updatedTable.resetRuleCounters(existingChain)
+
+		case *Rule:
+			existingChain := updatedTable.Chains[obj.Chain]
+			if existingChain == nil {
+				return nil, notFoundError("no such chain %q", obj.Chain)
 			}
 			if op.verb == deleteVerb {
 				i := findRule(existingChain.Rules, *obj.Handle)
@@ -266,10 +1022,22 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 				}
 				refRule = *obj.Index
 			}
+			// Index only describes where to put the rule; it's not part of the
+			// rule itself.
+			rule.Index = nil
+			rule.Rule, rule.Counter = initRuleCounter(obj.Rule, obj.Counter)
 
+			if err := checkRuleBraces(obj); err != nil {
+				return nil, err
+			}
 			if err := checkRuleRefs(obj, updatedTable); err != nil {
 				return nil, err
 			}
+			if fake.ValidateReferences {
+				if err := checkNamedObjectRefs(obj, updatedTable); err != nil {
+					return nil, err
+				}
+			}
 
 			switch op.verb {
 			case addVerb:
@@ -278,14 +1046,14 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 				} else {
 					existingChain.Rules = append(existingChain.Rules[:refRule+1], append([]*Rule{&rule}, existingChain.Rules[refRule+1:]...)...)
 				}
-				rule.Handle = PtrTo(fake.nextHandle)
+				rule.Handle = fake.allocateHandle()
 			case insertVerb:
 				if refRule == -1 {
 					existingChain.Rules = append([]*Rule{&rule}, existingChain.Rules...)
 				} else {
 					existingChain.Rules = append(existingChain.Rules[:refRule], append([]*Rule{&rule}, existingChain.Rules[refRule:]...)...)
 				}
-				rule.Handle = PtrTo(fake.nextHandle)
+				rule.Handle = fake.allocateHandle()
 			case replaceVerb:
 				existingChain.Rules[refRule] = &rule
 			default:
@@ -293,77 +1061,338 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 			}
 
 		case *Set:
-			existingSet := updatedTable.Sets[obj.Name]
-			err := checkExists(op.verb, "set", obj.Name, existingSet != nil)
-			if err != nil {
-				return nil, err
+			var existingSet *FakeSet
+			if obj.Handle != nil {
+				existingSet = updatedTable.findSetByHandle(*obj.Handle)
+				if existingSet == nil {
+					return nil, notFoundError("no set with handle %d", *obj.Handle)
+				}
+			} else {
+				existingSet = updatedTable.Sets[obj.Name]
+				err := checkExists(op.verb, "set", obj.Name, existingSet != nil)
+				if err != nil {
+					return nil, err
+				}
 			}
 			switch op.verb {
 			case addVerb, createVerb:
+				if fake.ValidateFlags {
+					if err := checkSetFlags("set", obj.Name, obj.Flags, obj.Type, obj.TypeOf, obj.Timeout); err != nil {
+						return nil, err
+					}
+				}
 				if existingSet != nil {
 					continue
 				}
 				set := *obj
-				set.Handle = PtrTo(fake.nextHandle)
+				set.Handle = fake.allocateHandle()
 				updatedTable.Sets[obj.Name] = &FakeSet{
 					Set: set,
 				}
 			case flushVerb:
+				for _, element := range existingSet.Elements {
+					delete(updatedTable.expires, element)
+				}
 				existingSet.Elements = nil
+			case resetVerb:
+				for i := range existingSet.Elements {
+					existingSet.Elements[i] = updatedTable.resetElement(existingSet.Elements[i])
+				}
 			case deleteVerb:
-				// FIXME delete-by-handle
-				delete(updatedTable.Sets, obj.Name)
+				if fake.ValidateReferences {
+					if err := updatedTable.checkNotReferenced("set", existingSet.Name); err != nil {
+						return nil, err
+					}
+				}
+				for _, element := range existingSet.Elements {
+					delete(updatedTable.expires, element)
+				}
+				delete(updatedTable.Sets, existingSet.Name)
 			default:
 				return nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
 		case *Map:
-			existingMap := updatedTable.Maps[obj.Name]
-			err := checkExists(op.verb, "map", obj.Name, existingMap != nil)
-			if err != nil {
-				return nil, err
+			var existingMap *FakeMap
+			if obj.Handle != nil {
+				existingMap = updatedTable.findMapByHandle(*obj.Handle)
+				if existingMap == nil {
+					return nil, notFoundError("no map with handle %d", *obj.Handle)
+				}
+			} else {
+				existingMap = updatedTable.Maps[obj.Name]
+				err := checkExists(op.verb, "map", obj.Name, existingMap != nil)
+				if err != nil {
+					return nil, err
+				}
 			}
 			switch op.verb {
-			case addVerb:
+			case addVerb, createVerb:
+				if fake.ValidateFlags {
+					if err := checkSetFlags("map", obj.Name, obj.Flags, obj.Type, obj.TypeOf, obj.Timeout); err != nil {
+						return nil, err
+					}
+				}
 				if existingMap != nil {
 					continue
 				}
 				mapObj := *obj
-				mapObj.Handle = PtrTo(fake.nextHandle)
+				mapObj.Handle = fake.allocateHandle()
 				updatedTable.Maps[obj.Name] = &FakeMap{
 					Map: mapObj,
 				}
 			case flushVerb:
+				for _, element := range existingMap.Elements {
+					delete(updatedTable.expires, element)
+				}
 				existingMap.Elements = nil
+			case resetVerb:
+				for i := range existingMap.Elements {
+					existingMap.Elements[i] = updatedTable.resetElement(existingMap.Elements[i])
+				}
+			case deleteVerb:
+				if fake.ValidateReferences {
+					if err := updatedTable.checkNotReferenced("map", existingMap.Name); err != nil {
+						return nil, err
+					}
+				}
+				for _, element := range existingMap.Elements {
+					delete(updatedTable.expires, element)
+				}
+				delete(updatedTable.Maps, existingMap.Name)
+			default:
+				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+			}
+		case *Flowtable:
+			var existingFlowtable *Flowtable
+			if obj.Handle != nil {
+				existingFlowtable = updatedTable.findFlowtableByHandle(*obj.Handle)
+				if existingFlowtable == nil {
+					return nil, notFoundError("no flowtable with handle %d", *obj.Handle)
+				}
+			} else {
+				existingFlowtable = updatedTable.Flowtables[obj.Name]
+				err := checkExists(op.verb, "flowtable", obj.Name, existingFlowtable != nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+			switch op.verb {
+			case addVerb, createVerb:
+				if existingFlowtable != nil {
+					continue
+				}
+				flowtable := *obj
+				flowtable.Devices = append([]string{}, obj.Devices...)
+				flowtable.Handle = fake.allocateHandle()
+				updatedTable.Flowtables[obj.Name] = &flowtable
+			case deleteVerb:
+				delete(updatedTable.Flowtables, existingFlowtable.Name)
+			default:
+				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+			}
+		case *Counter:
+			var existingCounter *Counter
+			if obj.Handle != nil {
+				existingCounter = updatedTable.findCounterByHandle(*obj.Handle)
+				if existingCounter == nil {
+					return nil, notFoundError("no counter with handle %d", *obj.Handle)
+				}
+			} else {
+				existingCounter = updatedTable.Counters[obj.Name]
+				err := checkExists(op.verb, "counter", obj.Name, existingCounter != nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+			switch op.verb {
+			case addVerb, createVerb:
+				if existingCounter != nil {
+					continue
+				}
+				counter := *obj
+				if counter.Packets == nil {
+					counter.Packets = PtrTo[uint64](0)
+					counter.Bytes = PtrTo[uint64](0)
+				}
+				counter.Handle = fake.allocateHandle()
+				updatedTable.Counters[obj.Name] = &counter
+			case resetVerb:
+				counter := *existingCounter
+				counter.Packets = PtrTo[uint64](0)
+				counter.Bytes = PtrTo[uint64](0)
+				updatedTable.Counters[counter.Name] = &counter
+			case deleteVerb:
+				if fake.ValidateReferences {
+					if err := updatedTable.checkNotReferenced("counter", existingCounter.Name); err != nil {
+						return nil, err
+					}
+				}
+				delete(updatedTable.Counters, existingCounter.Name)
+			default:
+				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+			}
+		case *Quota:
+			var existingQuota *Quota
+			if obj.Handle != nil {
+				existingQuota = updatedTable.findQuotaByHandle(*obj.Handle)
+				if existingQuota == nil {
+					return nil, notFoundError("no quota with handle %d", *obj.Handle)
+				}
+			} else {
+				existingQuota = updatedTable.Quotas[obj.Name]
+				err := checkExists(op.verb, "quota", obj.Name, existingQuota != nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+			switch op.verb {
+			case addVerb, createVerb:
+				if existingQuota != nil {
+					continue
+				}
+				quota := *obj
+				if quota.Used == nil {
+					quota.Used = PtrTo[uint64](0)
+				}
+				quota.Handle = fake.allocateHandle()
+				updatedTable.Quotas[obj.Name] = &quota
+			case resetVerb:
+				quota := *existingQuota
+				quota.Used = PtrTo[uint64](0)
+				updatedTable.Quotas[quota.Name] = &quota
+			case deleteVerb:
+				if fake.ValidateReferences {
+					if err := updatedTable.checkNotReferenced("quota", existingQuota.Name); err != nil {
+						return nil, err
+					}
+				}
+				delete(updatedTable.Quotas, existingQuota.Name)
+			default:
+				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+			}
+		case *CTTimeout:
+			var existingTimeout *CTTimeout
+			if obj.Handle != nil {
+				existingTimeout = updatedTable.findCTTimeoutByHandle(*obj.Handle)
+				if existingTimeout == nil {
+					return nil, notFoundError("no ct timeout with handle %d", *obj.Handle)
+				}
+			} else {
+				existingTimeout = updatedTable.CTTimeouts[obj.Name]
+				err := checkExists(op.verb, "ct timeout", obj.Name, existingTimeout != nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+			switch op.verb {
+			case addVerb, createVerb:
+				if existingTimeout != nil {
+					continue
+				}
+				timeout := obj.deepCopy()
+				timeout.Handle = fake.allocateHandle()
+				updatedTable.CTTimeouts[obj.Name] = timeout
+			case deleteVerb:
+				if fake.ValidateReferences {
+					if err := updatedTable.checkNotReferenced("ct timeout", existingTimeout.Name); err != nil {
+						return nil, err
+					}
+				}
+				delete(updatedTable.CTTimeouts, existingTimeout.Name)
+			default:
+				return nil, fmt.Errorf("unhandled operation %q", op.verb)
+			}
+		case *CTExpectation:
+			var existingExpectation *CTExpectation
+			if obj.Handle != nil {
+				existingExpectation = updatedTable.findCTExpectationByHandle(*obj.Handle)
+				if existingExpectation == nil {
+					return nil, notFoundError("no ct expectation with handle %d", *obj.Handle)
+				}
+			} else {
+				existingExpectation = updatedTable.CTExpectations[obj.Name]
+				err := checkExists(op.verb, "ct expectation", obj.Name, existingExpectation != nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+			switch op.verb {
+			case addVerb, createVerb:
+				if existingExpectation != nil {
+					continue
+				}
+				expectation := *obj
+				expectation.Handle = fake.allocateHandle()
+				updatedTable.CTExpectations[obj.Name] = &expectation
 			case deleteVerb:
-				// FIXME delete-by-handle
-				delete(updatedTable.Maps, obj.Name)
+				if fake.ValidateReferences {
+					if err := updatedTable.checkNotReferenced("ct expectation", existingExpectation.Name); err != nil {
+						return nil, err
+					}
+				}
+				delete(updatedTable.CTExpectations, existingExpectation.Name)
 			default:
 				return nil, fmt.Errorf("unhandled operation %q", op.verb)
 			}
 		case *Element:
-			if len(obj.Value) == 0 {
+			if obj.Set != "" {
 				existingSet := updatedTable.Sets[obj.Set]
 				if existingSet == nil {
 					return nil, notFoundError("no such set %q", obj.Set)
 				}
-				switch op.verb {
+				keyTypes := existingSet.keyTypes()
+				elemVerb := op.verb
+				if elemVerb == updateVerb && existingSet.index.find(existingSet.Elements, keyTypes, obj.Key) == -1 {
+					elemVerb, obj = addVerb, elementForUpdate(obj)
+				}
+				if fake.StrictTypes && (elemVerb == addVerb || elemVerb == createVerb) {
+					if err := checkElementArity(obj, existingSet.Type, existingSet.TypeOf); err != nil {
+						return nil, err
+					}
+				}
+				switch elemVerb {
 				case addVerb, createVerb:
 					element := *obj
-					if i := findElement(existingSet.Elements, element.Key); i != -1 {
+					if i := existingSet.index.find(existingSet.Elements, keyTypes, element.Key); i != -1 {
 						if op.verb == createVerb {
 							return nil, existsError("element %q already exists", strings.Join(element.Key, " . "))
 						}
+						updatedTable.trackExpiry(&element, existingSet.Elements[i], existingSet.Timeout, fake.now)
 						existingSet.Elements[i] = &element
 					} else {
+						if hasSetFlag(existingSet.Flags, IntervalFlag) && (existingSet.AutoMerge == nil || !*existingSet.AutoMerge) {
+							if err := checkIntervalOverlap(existingSet.Elements, &element); err != nil {
+								return nil, err
+							}
+						}
+						if existingSet.Size != nil && *existingSet.Size != 0 && uint64(len(existingSet.Elements)) >= *existingSet.Size {
+							return nil, fmt.Errorf("too many elements in set %q", existingSet.Name)
+						}
+						updatedTable.trackExpiry(&element, nil, existingSet.Timeout, fake.now)
 						existingSet.Elements = append(existingSet.Elements, &element)
+						existingSet.index.appended(existingSet.Elements, keyTypes)
+					}
+					if existingSet.AutoMerge != nil && *existingSet.AutoMerge && hasSetFlag(existingSet.Flags, IntervalFlag) {
+						updatedTable.mergeIntervals(existingSet)
 					}
 				case deleteVerb:
 					element := *obj
-					if i := findElement(existingSet.Elements, element.Key); i != -1 {
+					if i := existingSet.index.find(existingSet.Elements, keyTypes, element.Key); i != -1 {
+						delete(updatedTable.expires, existingSet.Elements[i])
 						existingSet.Elements = append(existingSet.Elements[:i], existingSet.Elements[i+1:]...)
+						existingSet.index.invalidate()
 					} else {
 						return nil, notFoundError("no such element %q", strings.Join(element.Key, " . "))
 					}
+				case resetVerb:
+					i := existingSet.index.find(existingSet.Elements, keyTypes, obj.Key)
+					if i == -1 {
+						return nil, notFoundError("no such element %q", strings.Join(obj.Key, " . "))
+					}
+					existingSet.Elements[i] = updatedTable.resetElement(existingSet.Elements[i])
+				case updateVerb:
+					i := existingSet.index.find(existingSet.Elements, keyTypes, obj.Key)
+					existingSet.Elements[i] = updatedTable.updateElement(existingSet.Elements[i], obj, existingSet.Timeout, fake.now)
 				default:
 					return nil, fmt.Errorf("unhandled operation %q", op.verb)
 				}
@@ -375,24 +1404,59 @@ func (fake *Fake) run(tx *Transaction) (*FakeTable, error) {
 				if err := checkElementRefs(obj, updatedTable); err != nil {
 					return nil, err
 				}
-				switch op.verb {
+				keyTypes := existingMap.keyTypes()
+				elemVerb := op.verb
+				if elemVerb == updateVerb && existingMap.index.find(existingMap.Elements, keyTypes, obj.Key) == -1 {
+					elemVerb, obj = addVerb, elementForUpdate(obj)
+				}
+				if fake.StrictTypes && (elemVerb == addVerb || elemVerb == createVerb) {
+					if err := checkElementArity(obj, existingMap.Type, existingMap.TypeOf); err != nil {
+						return nil, err
+					}
+					if err := checkVerdictElement(obj, existingMap.Type, existingMap.TypeOf); err != nil {
+						return nil, err
+					}
+				}
+				switch elemVerb {
 				case addVerb, createVerb:
 					element := *obj
-					if i := findElement(existingMap.Elements, element.Key); i != -1 {
+					if i := existingMap.index.find(existingMap.Elements, keyTypes, element.Key); i != -1 {
 						if op.verb == createVerb {
-							return nil, existsError("element %q already exists", strings.Join(element.Key, ". "))
+							return nil, existsError("element %q already exists", strings.Join(element.Key, " . "))
 						}
+						updatedTable.trackExpiry(&element, existingMap.Elements[i], existingMap.Timeout, fake.now)
 						existingMap.Elements[i] = &element
 					} else {
+						if hasSetFlag(existingMap.Flags, IntervalFlag) {
+							if err := checkIntervalOverlap(existingMap.Elements, &element); err != nil {
+								return nil, err
+							}
+						}
+						if existingMap.Size != nil && *existingMap.Size != 0 && uint64(len(existingMap.Elements)) >= *existingMap.Size {
+							return nil, fmt.Errorf("too many elements in map %q", existingMap.Name)
+						}
+						updatedTable.trackExpiry(&element, nil, existingMap.Timeout, fake.now)
 						existingMap.Elements = append(existingMap.Elements, &element)
+						existingMap.index.appended(existingMap.Elements, keyTypes)
 					}
 				case deleteVerb:
 					element := *obj
-					if i := findElement(existingMap.Elements, element.Key); i != -1 {
+					if i := existingMap.index.find(existingMap.Elements, keyTypes, element.Key); i != -1 {
+						delete(updatedTable.expires, existingMap.Elements[i])
 						existingMap.Elements = append(existingMap.Elements[:i], existingMap.Elements[i+1:]...)
+						existingMap.index.invalidate()
 					} else {
 						return nil, notFoundError("no such element %q", strings.Join(element.Key, " . "))
 					}
+				case resetVerb:
+					i := existingMap.index.find(existingMap.Elements, keyTypes, obj.Key)
+					if i == -1 {
+						return nil, notFoundError("no such element %q", strings.Join(obj.Key, " . "))
+					}
+					existingMap.Elements[i] = updatedTable.resetElement(existingMap.Elements[i])
+				case updateVerb:
+					i := existingMap.index.find(existingMap.Elements, keyTypes, obj.Key)
+					existingMap.Elements[i] = updatedTable.updateElement(existingMap.Elements[i], obj, existingMap.Timeout, fake.now)
 				default:
 					return nil, fmt.Errorf("unhandled operation %q", op.verb)
 				}
@@ -422,6 +1486,40 @@ func checkExists(verb verb, objectType, name string, exists bool) error {
 	return nil
 }
 
+// checkRuleBraces checks that the braces (eg, around anonymous sets) in rule are
+// balanced, and that they are not empty (which nft rejects). (Braces inside quoted
+// strings are ignored.)
+func checkRuleBraces(rule *Rule) error {
+	depth := 0
+	inQuotes := false
+	empty := false
+	for _, c := range rule.Rule {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			empty = false
+		case inQuotes:
+		case c == '{':
+			depth++
+			empty = true
+		case c == '}':
+			if empty {
+				return fmt.Errorf("rule %q has an empty anonymous set", rule.Rule)
+			}
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("rule %q has unbalanced braces", rule.Rule)
+			}
+		case c != ' ' && c != '\t' && c != '\n':
+			empty = false
+		}
+	}
+	if depth != 0 || inQuotes {
+		return fmt.Errorf("rule %q has unbalanced braces or quotes", rule.Rule)
+	}
+	return nil
+}
+
 // checkRuleRefs checks for chains, sets, and maps referenced by rule in table
 func checkRuleRefs(rule *Rule, table *FakeTable) error {
 	words := strings.Split(rule.Rule, " ")
@@ -433,173 +1531,1893 @@ func checkRuleRefs(rule *Rule, table *FakeTable) error {
 					return notFoundError("no such map %q", name)
 				}
 			} else {
-				// recent nft lets you use a map in a set lookup
-				if table.Sets[name] == nil && table.Maps[name] == nil {
+				// recent nft lets you use a map in a set lookup, and "flow add"
+				// refers to a flowtable
+				if table.Sets[name] == nil && table.Maps[name] == nil && table.Flowtables[name] == nil {
 					return notFoundError("no such set %q", name)
 				}
 			}
-		} else if (word == "goto" || word == "jump") && i < len(words)-1 {
-			name := words[i+1]
-			if table.Chains[name] == nil {
-				return notFoundError("no such chain %q", name)
-			}
 		}
 	}
-	return nil
-}
 
-// checkElementRefs checks for chains referenced by an element
-func checkElementRefs(element *Element, table *FakeTable) error {
-	if len(element.Value) != 1 {
-		return nil
+	// Use ruleReferences for jumps, so as to find the ones inside anonymous vmaps.
+	_, _, chains, err := table.ruleReferences(rule)
+	if err != nil {
+		return err
 	}
-	words := strings.Split(element.Value[0], " ")
-	if len(words) == 2 && (words[0] == "goto" || words[0] == "jump") {
-		name := words[1]
-		if table.Chains[name] == nil {
-			return notFoundError("no such chain %q", name)
+	for _, chain := range chains {
+		if err := checkJumpTarget(chain, table); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// Dump dumps the current contents of fake, in a way that looks like an nft transaction.
-func (fake *Fake) Dump() string {
-	if fake.Table == nil {
-		return ""
-	}
-
-	buf := &strings.Builder{}
-
-	table := fake.Table
-	chains := sortKeys(table.Chains)
-	sets := sortKeys(table.Sets)
-	maps := sortKeys(table.Maps)
-
-	// Write out all of the object adds first.
-
-	table.writeOperation(addVerb, &fake.nftContext, buf)
-	for _, cname := range chains {
-		ch := table.Chains[cname]
-		ch.writeOperation(addVerb, &fake.nftContext, buf)
+// checkNamedObjectRefs checks that the named counters and quotas referenced by rule (via
+// "counter name NAME" or "quota name NAME") exist in table. References that choose the
+// object via a map lookup (eg "counter name ip saddr map { ... }") are not checked.
+func checkNamedObjectRefs(rule *Rule, table *FakeTable) error {
+	refs, err := ruleObjectReferences(rule)
+	if err != nil {
+		return err
 	}
-	for _, sname := range sets {
-		s := table.Sets[sname]
-		s.writeOperation(addVerb, &fake.nftContext, buf)
+	for _, name := range refs["counter"] {
+		if table.Counters[name] == nil {
+			return notFoundError("no such counter %q", name)
+		}
 	}
-	for _, mname := range maps {
-		m := table.Maps[mname]
-		m.writeOperation(addVerb, &fake.nftContext, buf)
+	for _, name := range refs["quota"] {
+		if table.Quotas[name] == nil {
+			return notFoundError("no such quota %q", name)
+		}
 	}
+	return nil
+}
 
-	// Now write their contents.
+// statementKeywords contains words that start a new statement (or are a verdict) in a
+// rule, and so cannot be part of an expression.
+var statementKeywords = map[string]bool{
+	"accept": true, "drop": true, "continue": true, "return": true, "jump": true,
+	"goto": true, "reject": true, "counter": true, "quota": true, "limit": true,
+	"log": true, "set": true, "snat": true, "dnat": true, "masquerade": true,
+	"redirect": true, "notrack": true, "queue": true,
+}
 
-	for _, cname := range chains {
-		ch := table.Chains[cname]
-		for _, rule := range ch.Rules {
-			// Avoid outputing handles
-			dumpRule := *rule
-			dumpRule.Handle = nil
-			dumpRule.Index = nil
-			dumpRule.writeOperation(addVerb, &fake.nftContext, buf)
+// isMapLookupExpr returns true if tokens starts with a map lookup expression (eg,
+// "ip saddr map { ... }" or "ip saddr . tcp dport map @m") rather than a literal name.
+func isMapLookupExpr(tokens []RuleToken) bool {
+	for i, token := range tokens {
+		if token.Type != WordToken || statementKeywords[token.Value] {
+			return false
 		}
-	}
-	for _, sname := range sets {
-		s := table.Sets[sname]
-		for _, element := range s.Elements {
-			element.writeOperation(addVerb, &fake.nftContext, buf)
+		if token.Value == "map" {
+			return i > 0 && i+1 < len(tokens) &&
+				(tokens[i+1].Type == AnonymousSetToken || tokens[i+1].Type == SetReferenceToken)
 		}
 	}
-	for _, mname := range maps {
-		m := table.Maps[mname]
-		for _, element := range m.Elements {
-			element.writeOperation(addVerb, &fake.nftContext, buf)
+	return false
+}
+
+// resetRuleCounters zeroes the inline counters of chain's rules.
+func (table *FakeTable) resetRuleCounters(chain *FakeChain) {
+	// Rules may be shared with another copy of table, so they must be replaced
+	// rather than modified.
+	for i, rule := range chain.Rules {
+		if rule.Counter != nil && *rule.Counter != (RuleCounter{}) {
+			resetRule := *rule
+			resetRule.Counter = &RuleCounter{}
+			chain.Rules[i] = &resetRule
 		}
 	}
+}
 
-	return buf.String()
+// initRuleCounter returns the rule text and counter to store for a newly-added rule
+// with the given text and Counter. A rule with an inline counter always gets a non-nil
+// Counter, starting at zero unless the caller specified initial values (either in
+// counter or in the rule text itself).
+func initRuleCounter(ruleText string, counter *RuleCounter) (string, *RuleCounter) {
+	ruleText, parsed := splitRuleCounter(ruleText)
+	switch {
+	case counter != nil:
+		return ruleText, copyPtr(counter)
+	case parsed != nil:
+		return ruleText, parsed
+	case findRuleCounter(strings.Split(ruleText, " ")) != -1:
+		return ruleText, &RuleCounter{}
+	default:
+		return ruleText, nil
+	}
 }
 
-// ParseDump can parse a dump for a given nft instance.
-// It expects fake's table name and family in all rules.
-// The best way to verify that everything important was properly parsed is to
-// compare given data with nft.Dump() output.
-func (fake *Fake) ParseDump(data string) (err error) {
-	lines := strings.Split(data, "\n")
-	var i int
-	var line string
-	parsingDone := false
-	defer func() {
-		if err != nil && !parsingDone {
-			err = fmt.Errorf("%w (at line %v: %s", err, i+1, line)
-		}
-	}()
-	tx := fake.NewTransaction()
-	commonRegexp := regexp.MustCompile(fmt.Sprintf(`add %s %s %s (.*)`, noSpaceGroup, fake.family, fake.table))
+// renameChain renames chain to newName, updating its rules and any jumps/gotos to it.
+func (table *FakeTable) renameChain(chain *FakeChain, newName string) {
+	oldName := chain.Name
+	renamed := &FakeChain{Chain: chain.Chain}
+	renamed.Name = newName
+	for _, rule := range chain.Rules {
+		renamedRule := *rule
+		renamedRule.Chain = newName
+		renamed.Rules = append(renamed.Rules, &renamedRule)
+	}
+	delete(table.Chains, oldName)
+	table.Chains[newName] = renamed
 
-	for i, line = range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || line[0] == '#' {
-			continue
-		}
-		match := commonRegexp.FindStringSubmatch(line)
-		if match == nil {
-			return fmt.Errorf("could not parse, or wrong table/family")
-		}
-		var obj Object
-		switch match[1] {
-		case "table":
-			obj = &Table{}
-		case "chain":
-			obj = &Chain{}
-		case "rule":
-			obj = &Rule{}
-		case "map":
-			obj = &Map{}
-		case "set":
-			obj = &Set{}
-		case "element":
-			obj = &Element{}
-		default:
-			return fmt.Errorf("unknown object %s", match[1])
+	// Rules and elements may be shared with another copy of table, so they must be
+	// replaced rather than modified.
+	for _, ch := range table.Chains {
+		for i, rule := range ch.Rules {
+			if updated, changed := renameJumpTarget(rule.Rule, oldName, newName); changed {
+				renamedRule := *rule
+				renamedRule.Rule = updated
+				ch.Rules[i] = &renamedRule
+			}
 		}
-		err = obj.parse(match[2])
-		if err != nil {
-			return err
+	}
+	for _, m := range table.Maps {
+		for i, element := range m.Elements {
+			if len(element.Value) != 1 {
+				continue
+			}
+			if updated, changed := renameJumpTarget(element.Value[0], oldName, newName); changed {
+				renamedElement := element.deepCopy()
+				renamedElement.Value[0] = updated
+				if expires, ok := table.expires[element]; ok {
+					delete(table.expires, element)
+					table.expires[renamedElement] = expires
+				}
+				m.Elements[i] = renamedElement
+			}
 		}
-		tx.Add(obj)
 	}
-	parsingDone = true
-	return fake.Run(context.Background(), tx)
 }
 
-func sortKeys[K ~string, V any](m map[K]V) []K {
-	keys := make([]K, 0, len(m))
-	for key := range m {
-		keys = append(keys, key)
+// renameJumpTarget replaces "jump oldName" and "goto oldName" in rule (including in
+// anonymous verdict maps) with the corresponding references to newName. If it makes
+// any changes, the rest of the rule is reformatted as from ParseRuleExpr's tokens.
+func renameJumpTarget(rule, oldName, newName string) (string, bool) {
+	tokens, err := ParseRuleExpr(rule)
+	if err != nil {
+		return rule, false
 	}
-	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
-	return keys
-}
 
-func findRule(rules []*Rule, handle int) int {
-	for i := range rules {
-		if rules[i].Handle != nil && *rules[i].Handle == handle {
-			return i
+	changed := false
+	renameWords := func(words []string) {
+		for i := 1; i < len(words); i++ {
+			if (words[i-1] == "jump" || words[i-1] == "goto") && words[i] == oldName {
+				words[i] = newName
+				changed = true
+			}
 		}
 	}
-	return -1
-}
 
-func findElement(elements []*Element, key []string) int {
+	words := make([]string, len(tokens))
+	for i, token := range tokens {
+		switch token.Type {
+		case StringToken:
+			words[i] = `"` + token.Value + `"`
+		case SetReferenceToken:
+			words[i] = "@" + token.Value
+		case AnonymousSetToken:
+			elements := make([]string, len(token.Elements))
+			for j, elem := range token.Elements {
+				elemWords := strings.Fields(elem)
+				renameWords(elemWords)
+				elements[j] = strings.Join(elemWords, " ")
+			}
+			words[i] = "{ " + strings.Join(elements, ", ") + " }"
+		default:
+			words[i] = token.Value
+		}
+	}
+	// jump/goto can only be followed by a plain word, so this only renames
+	// WordTokens.
+	renameWords(words)
+
+	if !changed {
+		return rule, false
+	}
+	return strings.Join(words, " "), true
+}
+
+// maxNameLength is the maximum length of an nftables object name (NFT_NAME_MAXLEN,
+// minus the trailing NUL).
+const maxNameLength = 255
+
+// nameRegexp matches the names that nft accepts as unquoted identifiers.
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z_.][a-zA-Z0-9_./-]*$`)
+
+// checkObjectName checks that the name of obj (which is being added, or that a chain
+// is being renamed to) is valid. tableName is the name of fake's table.
+func checkObjectName(obj Object, tableName string) error {
+	var objectType, name string
+	switch obj := obj.(type) {
+	case *Table:
+		objectType, name = "table", tableName
+	case *Chain:
+		objectType, name = "chain", obj.Name
+	case *chainRename:
+		objectType, name = "chain", obj.newName
+	case *Set:
+		objectType, name = "set", obj.Name
+	case *Map:
+		objectType, name = "map", obj.Name
+	case *Flowtable:
+		objectType, name = "flowtable", obj.Name
+	case *Counter:
+		objectType, name = "counter", obj.Name
+	case *Quota:
+		objectType, name = "quota", obj.Name
+	case *CTTimeout:
+		objectType, name = "ct timeout", obj.Name
+	case *CTExpectation:
+		objectType, name = "ct expectation", obj.Name
+	default:
+		return nil
+	}
+
+	if len(name) > maxNameLength {
+		return fmt.Errorf("%s name %q is too long (%d bytes, max is %d)", objectType, name, len(name), maxNameLength)
+	}
+	if !nameRegexp.MatchString(name) {
+		return fmt.Errorf("%s name %q contains invalid characters", objectType, name)
+	}
+	return nil
+}
+
+// checkJumpTarget checks that name is a valid jump/goto target in table: it must exist
+// and must be a regular chain, not a base chain.
+func checkJumpTarget(name string, table *FakeTable) error {
+	chain := table.Chains[name]
+	if chain == nil {
+		return notFoundError("no such chain %q", name)
+	}
+	if chain.Hook != nil {
+		return fmt.Errorf("cannot jump/goto base chain %q", name)
+	}
+	return nil
+}
+
+// validChainHooks maps each family to the chain types it supports, and the hooks each
+// type can be used with.
+var validChainHooks = map[Family]map[BaseChainType][]BaseChainHook{
+	IPv4Family: {
+		FilterType: {PreroutingHook, InputHook, ForwardHook, OutputHook, PostroutingHook},
+		NATType:    {PreroutingHook, InputHook, OutputHook, PostroutingHook},
+		RouteType:  {OutputHook},
+	},
+	IPv6Family: {
+		FilterType: {PreroutingHook, InputHook, ForwardHook, OutputHook, PostroutingHook},
+		NATType:    {PreroutingHook, InputHook, OutputHook, PostroutingHook},
+		RouteType:  {OutputHook},
+	},
+	InetFamily: {
+		FilterType: {PreroutingHook, InputHook, ForwardHook, OutputHook, PostroutingHook, IngressHook},
+		NATType:    {PreroutingHook, InputHook, OutputHook, PostroutingHook},
+		RouteType:  {OutputHook},
+	},
+	ARPFamily: {
+		FilterType: {InputHook, OutputHook},
+	},
+	BridgeFamily: {
+		FilterType: {PreroutingHook, InputHook, ForwardHook, OutputHook, PostroutingHook},
+	},
+	NetDevFamily: {
+		FilterType: {IngressHook, EgressHook},
+	},
+}
+
+// checkBaseChain checks that chain's Type, Hook, Priority, and Device are valid for
+// family. (It does nothing if chain is a regular chain.)
+func checkBaseChain(family Family, chain *Chain) error {
+	if chain.Hook == nil {
+		return nil
+	}
+
+	hooks, ok := validChainHooks[family][*chain.Type]
+	if !ok {
+		return fmt.Errorf("chain %q: invalid Type %q for family %q", chain.Name, *chain.Type, family)
+	}
+	validHook := false
+	for _, hook := range hooks {
+		if hook == *chain.Hook {
+			validHook = true
+			break
+		}
+	}
+	if !validHook {
+		return fmt.Errorf("chain %q: invalid Hook %q for %q chain in family %q", chain.Name, *chain.Hook, *chain.Type, family)
+	}
+
+	if _, err := ParsePriority(family, string(*chain.Priority)); err != nil {
+		return fmt.Errorf("chain %q: invalid Priority: %w", chain.Name, err)
+	}
+	if err := checkPriorityHook(family, *chain.Hook, *chain.Priority); err != nil {
+		return fmt.Errorf("chain %q: invalid Priority: %w", chain.Name, err)
+	}
+
+	return checkChainDevices(chain)
+}
+
+// intervalTypes are the set/map key datatypes that can be used with IntervalFlag.
+var intervalTypes = map[string]bool{
+	"ipv4_addr":    true,
+	"ipv6_addr":    true,
+	"ether_addr":   true,
+	"inet_proto":   true,
+	"inet_service": true,
+	"mark":         true,
+	"ifname":       true,
+	"iface_index":  true,
+	"dscp":         true,
+	"ecn":          true,
+	"ct_label":     true,
+	"integer":      true,
+	"time":         true,
+	"day":          true,
+	"hour":         true,
+}
+
+// incompatibleSetFlags lists pairs of flags that cannot be used together.
+var incompatibleSetFlags = [][2]SetFlag{
+	{ConstantFlag, DynamicFlag},
+	{ConstantFlag, TimeoutFlag},
+}
+
+// checkSetFlags checks that flags (the Flags of the set or map called name, of type
+// typ/typeOf and with the given timeout) are known, compatible with each other, and
+// compatible with the key type.
+func checkSetFlags(objType, name string, flags []SetFlag, typ, typeOf string, timeout *time.Duration) error {
+	hasFlag := make(map[SetFlag]bool, len(flags))
+	for _, flag := range flags {
+		switch flag {
+		case ConstantFlag, DynamicFlag, IntervalFlag, TimeoutFlag:
+			hasFlag[flag] = true
+		default:
+			return fmt.Errorf("%s %q: unknown flag %q", objType, name, flag)
+		}
+	}
+
+	for _, pair := range incompatibleSetFlags {
+		if hasFlag[pair[0]] && hasFlag[pair[1]] {
+			return fmt.Errorf("%s %q: flags %q and %q are incompatible", objType, name, pair[0], pair[1])
+		}
+	}
+	if hasFlag[ConstantFlag] && timeout != nil {
+		return fmt.Errorf("%s %q: flag %q is incompatible with Timeout", objType, name, ConstantFlag)
+	}
+
+	if hasFlag[IntervalFlag] {
+		for _, keyType := range parseKeyTypes(typ, typeOf) {
+			// (parseKeyTypes returns "" for TypeOf expressions whose type it
+			// doesn't know.)
+			if keyType != "" && !intervalTypes[keyType] {
+				return fmt.Errorf("%s %q: flag %q cannot be used with datatype %q", objType, name, IntervalFlag, keyType)
+			}
+		}
+	}
+	return nil
+}
+
+// validPriorityHooks maps symbolic priority names to the hooks they can be used with, for
+// names that can't be used with every hook.
+var validPriorityHooks = map[BaseChainPriority][]BaseChainHook{
+	DNATPriority: {PreroutingHook, OutputHook},
+	SNATPriority: {InputHook, PostroutingHook},
+}
+
+var bridgeValidPriorityHooks = map[BaseChainPriority][]BaseChainHook{
+	DNATPriority: {PreroutingHook},
+	OutPriority:  {OutputHook},
+	SNATPriority: {PostroutingHook},
+}
+
+// checkPriorityHook checks that, if priority is symbolic, then it is valid for use with
+// hook in family. (ParsePriority has already checked that it is a known name for family.)
+func checkPriorityHook(family Family, hook BaseChainHook, priority BaseChainPriority) error {
+	if _, err := strconv.Atoi(string(priority)); err == nil {
+		return nil
+	}
+	name, _ := splitPriority(string(priority))
+
+	if (family == ARPFamily || family == NetDevFamily) && name != string(FilterPriority) {
+		return fmt.Errorf("priority %q cannot be used in family %q", name, family)
+	}
+
+	validHooks := validPriorityHooks
+	if family == BridgeFamily {
+		validHooks = bridgeValidPriorityHooks
+	}
+	hooks, restricted := validHooks[BaseChainPriority(name)]
+	if !restricted {
+		return nil
+	}
+	for _, h := range hooks {
+		if h == hook {
+			return nil
+		}
+	}
+	return fmt.Errorf("priority %q cannot be used with %q hook", name, hook)
+}
+
+// checkChainDevices checks that chain has a Device or Devices if and only if it is an
+// ingress/egress chain.
+func checkChainDevices(chain *Chain) error {
+	if chain.Hook == nil {
+		return nil
+	}
+	needsDevice := *chain.Hook == IngressHook || *chain.Hook == EgressHook
+	hasDevice := chain.Device != nil || len(chain.Devices) != 0
+	if needsDevice && !hasDevice {
+		return fmt.Errorf("chain %q: Device or Devices must be specified for %q hook", chain.Name, *chain.Hook)
+	} else if !needsDevice && hasDevice {
+		return fmt.Errorf("chain %q: Device and Devices must not be specified for %q hook", chain.Name, *chain.Hook)
+	}
+	return nil
+}
+
+// checkElementArity checks that element's key and value have the number of components
+// indicated by typ or typeOf.
+func checkElementArity(element *Element, typ, typeOf string) error {
+	typeStr := typ
+	if typeStr == "" {
+		typeStr = typeOf
+	}
+	keyType, valueType, _ := strings.Cut(typeStr, " : ")
+
+	keyArity := len(strings.Split(keyType, " . "))
+	if isCatchAll(element.Key) {
+		keyArity = 1
+	}
+	if len(element.Key) != keyArity {
+		return fmt.Errorf("element key %q has %d components but type %q has %d",
+			strings.Join(element.Key, " . "), len(element.Key), keyType, keyArity)
+	}
+	if valueType != "" {
+		valueArity := len(strings.Split(valueType, " . "))
+		if len(element.Value) != valueArity {
+			return fmt.Errorf("element value %q has %d components but type %q has %d",
+				strings.Join(element.Value, " . "), len(element.Value), valueType, valueArity)
+		}
+	}
+	return nil
+}
+
+// checkVerdictElement checks that, if typ/typeOf is the type of a verdict map, then
+// element's value is a valid verdict. (Any jump/goto target is checked separately, by
+// checkElementRefs.)
+func checkVerdictElement(element *Element, typ, typeOf string) error {
+	typeStr := typ
+	if typeStr == "" {
+		typeStr = typeOf
+	}
+	_, valueType, _ := strings.Cut(typeStr, " : ")
+	if strings.TrimSpace(valueType) != "verdict" {
+		return nil
+	}
+
+	value := strings.Join(element.Value, " . ")
+	words := strings.Fields(value)
+	switch {
+	case len(words) == 1 && (words[0] == "accept" || words[0] == "drop" || words[0] == "continue" || words[0] == "return"):
+		return nil
+	case len(words) == 2 && (words[0] == "jump" || words[0] == "goto"):
+		return nil
+	default:
+		return fmt.Errorf("element value %q is not a valid verdict", value)
+	}
+}
+
+// checkElementRefs checks for chains referenced by an element
+func checkElementRefs(element *Element, table *FakeTable) error {
+	if len(element.Value) != 1 {
+		return nil
+	}
+	words := strings.Split(element.Value[0], " ")
+	if len(words) == 2 && (words[0] == "goto" || words[0] == "jump") {
+		return checkJumpTarget(words[1], table)
+	}
+	return nil
+}
+
+// Dump dumps the current contents of fake, in a way that looks like an nft transaction.
+// Each set or map element is output as a separate "add element" command; use
+// DumpWithOptions with GroupElements to group the elements of each set or map.
+func (fake *Fake) Dump() string {
+	return fake.DumpWithOptions(DumpOptions{})
+}
+
+// DumpOptions contains options for Fake.DumpWithOptions
+type DumpOptions struct {
+	// IncludeHandles, if set, causes the handle of each table, chain, rule, and
+	// other object to be output as a "# handle N" comment at the end of its line
+	// (like "nft -a list table" does).
+	IncludeHandles bool
+
+	// SortElements, if set, causes the elements of each set and map to be output in
+	// order of their keys (with IP addresses, prefixes, and ranges ordered by
+	// address, numbers ordered numerically, and anything else ordered as strings,
+	// comparing concatenated keys one component at a time), rather than in the
+	// order they were added. This makes the output independent of the order in
+	// which elements were added.
+	SortElements bool
+
+	// GroupElements, if set, causes the elements of each set and map with more than
+	// one element to be output as a single "add element" command (eg, "add element
+	// ip mytable myset { 1.2.3.4, 5.6.7.8 }") rather than one command per element.
+	// This is more readable, and faster to re-parse, for large sets and maps.
+	// (ParseDump accepts either form.) This is not the default for Dump, because
+	// existing tests compare Dump output against expected dumps that list one
+	// element per line, and per-element lines give more useful line-based diffs.
+	GroupElements bool
+}
+
+// DumpWithOptions dumps the current contents of fake, as with Dump, but with the given
+// options.
+func (fake *Fake) DumpWithOptions(opts DumpOptions) string {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return ""
+	}
+	return fake.dumpTable(opts)
+}
+
+// dumpTable implements DumpWithOptions. fake.mutex must be held, and fake.Table must be
+// non-nil.
+func (fake *Fake) dumpTable(opts DumpOptions) string {
+	table := fake.Table
+	return fake.dump(&dumpObjects{
+		chains:         sortKeys(table.Chains),
+		sets:           sortKeys(table.Sets),
+		maps:           sortKeys(table.Maps),
+		flowtables:     sortKeys(table.Flowtables),
+		counters:       sortKeys(table.Counters),
+		quotas:         sortKeys(table.Quotas),
+		ctTimeouts:     sortKeys(table.CTTimeouts),
+		ctExpectations: sortKeys(table.CTExpectations),
+		includeHandles: opts.IncludeHandles,
+		sortElements:   opts.SortElements,
+		groupElements:  opts.GroupElements,
+	})
+}
+
+// DumpTable is part of Interface. It returns the same result as Dump, except that it
+// returns a "not found" error if the table does not exist.
+func (fake *Fake) DumpTable(_ context.Context) (string, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return "", notFoundError("no such table %q", fake.table)
+	}
+	return fake.dumpTable(DumpOptions{}), nil
+}
+
+// DumpChain dumps the named chain, in a way that looks like an nft transaction, along
+// with the table, and any sets, maps, flowtables, counters, quotas, ct timeouts, ct
+// expectations, and chains that are (directly or indirectly) referenced by its rules, so
+// that the output is self-contained. If the chain does not exist, it returns "".
+func (fake *Fake) DumpChain(name string) string {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil || fake.Table.Chains[name] == nil {
+		return ""
+	}
+	table := fake.Table
+
+	chains := make(map[string]bool)
+	sets := make(map[string]bool)
+	maps := make(map[string]bool)
+	flowtables := make(map[string]bool)
+	counters := make(map[string]bool)
+	quotas := make(map[string]bool)
+	ctTimeouts := make(map[string]bool)
+	ctExpectations := make(map[string]bool)
+
+	pending := []string{name}
+	for len(pending) > 0 {
+		cname := pending[0]
+		pending = pending[1:]
+		if chains[cname] || table.Chains[cname] == nil {
+			continue
+		}
+		chains[cname] = true
+
+		for _, rule := range table.Chains[cname].Rules {
+			ruleSets, ruleMaps, ruleChains, err := table.ruleReferences(rule)
+			if err != nil {
+				continue
+			}
+			for _, ref := range ruleSets {
+				if table.Sets[ref] != nil {
+					sets[ref] = true
+				}
+			}
+			for _, ref := range ruleMaps {
+				if m := table.Maps[ref]; m != nil && !maps[ref] {
+					maps[ref] = true
+					for _, elem := range m.Elements {
+						pending = append(pending, elementJumpTargets(elem)...)
+					}
+				}
+			}
+			pending = append(pending, ruleChains...)
+
+			// ruleReferences doesn't find flowtables or named stateful objects
+			tokens, _ := ParseRuleExpr(rule.Rule)
+			for _, token := range tokens {
+				if token.Type == SetReferenceToken && table.Flowtables[token.Value] != nil {
+					flowtables[token.Value] = true
+				}
+			}
+			objects, _ := ruleObjectReferences(rule)
+			for _, name := range objects["counter"] {
+				if table.Counters[name] != nil {
+					counters[name] = true
+				}
+			}
+			for _, name := range objects["quota"] {
+				if table.Quotas[name] != nil {
+					quotas[name] = true
+				}
+			}
+			for _, name := range objects["ct timeout"] {
+				if table.CTTimeouts[name] != nil {
+					ctTimeouts[name] = true
+				}
+			}
+			for _, name := range objects["ct expectation"] {
+				if table.CTExpectations[name] != nil {
+					ctExpectations[name] = true
+				}
+			}
+		}
+	}
+
+	return fake.dump(&dumpObjects{
+		chains:         sortKeys(chains),
+		sets:           sortKeys(sets),
+		maps:           sortKeys(maps),
+		flowtables:     sortKeys(flowtables),
+		counters:       sortKeys(counters),
+		quotas:         sortKeys(quotas),
+		ctTimeouts:     sortKeys(ctTimeouts),
+		ctExpectations: sortKeys(ctExpectations),
+	})
+}
+
+// ChainReferences returns the names of the sets, maps, and chains (via jump, goto, or an
+// anonymous verdict map) that are directly referenced by the rules in the named chain.
+// If the chain does not exist, it returns an error for which IsNotFound will return
+// true.
+func (fake *Fake) ChainReferences(chainName string) (sets, maps, chains []string, err error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return nil, nil, nil, notFoundError("no such table %q", fake.table)
+	}
+	chain := fake.Table.Chains[chainName]
+	if chain == nil {
+		return nil, nil, nil, notFoundError("no such chain %q", chainName)
+	}
+
+	setRefs := make(map[string]bool)
+	mapRefs := make(map[string]bool)
+	chainRefs := make(map[string]bool)
+	for _, rule := range chain.Rules {
+		ruleSets, ruleMaps, ruleChains, err := fake.Table.ruleReferences(rule)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, name := range ruleSets {
+			setRefs[name] = true
+		}
+		for _, name := range ruleMaps {
+			mapRefs[name] = true
+		}
+		for _, name := range ruleChains {
+			chainRefs[name] = true
+		}
+	}
+	return sortKeys(setRefs), sortKeys(mapRefs), sortKeys(chainRefs), nil
+}
+
+// ruleReferences returns the names of the sets, maps, and chains referenced by rule. A
+// "@name" reference is considered to be a map reference if there is a map by that name
+// in table, or if there is neither a set nor a map by that name and the reference
+// follows "map" or "vmap". (References to flowtables are ignored.)
+func (table *FakeTable) ruleReferences(rule *Rule) (sets, maps, chains []string, err error) {
+	tokens, err := ParseRuleExpr(rule.Rule)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, token := range tokens {
+		switch token.Type {
+		case SetReferenceToken:
+			name := token.Value
+			afterMap := i > 0 && tokens[i-1].Type == WordToken && (tokens[i-1].Value == "map" || tokens[i-1].Value == "vmap")
+			switch {
+			case table.Maps[name] != nil:
+				maps = append(maps, name)
+			case table.Sets[name] != nil:
+				sets = append(sets, name)
+			case table.Flowtables[name] != nil:
+			case afterMap:
+				maps = append(maps, name)
+			default:
+				sets = append(sets, name)
+			}
+		case WordToken:
+			if (token.Value == "jump" || token.Value == "goto") && i < len(tokens)-1 && tokens[i+1].Type == WordToken {
+				chains = append(chains, tokens[i+1].Value)
+			}
+		case AnonymousSetToken:
+			for _, elem := range token.Elements {
+				words := strings.Fields(elem)
+				for j := range words[:len(words)-1] {
+					if words[j] == "jump" || words[j] == "goto" {
+						chains = append(chains, words[j+1])
+					}
+				}
+			}
+		}
+	}
+	return sets, maps, chains, nil
+}
+
+// ruleObjectReferences returns the named stateful objects referenced by rule (via
+// "counter name", "quota name", "ct timeout set", or "ct expectation set"), keyed by
+// object type. Counter and quota references that choose the object via a map lookup
+// (eg "counter name ip saddr map { ... }") are not included.
+func ruleObjectReferences(rule *Rule) (map[string][]string, error) {
+	tokens, err := ParseRuleExpr(rule.Rule)
+	if err != nil {
+		return nil, err
+	}
+	word := func(i int) string {
+		if i < len(tokens) && tokens[i].Type != AnonymousSetToken {
+			return tokens[i].Value
+		}
+		return ""
+	}
+	refs := make(map[string][]string)
+	for i, token := range tokens {
+		switch {
+		case token.Type != WordToken:
+		case (token.Value == "counter" || token.Value == "quota") && word(i+1) == "name" && i+2 < len(tokens):
+			if !isMapLookupExpr(tokens[i+2:]) {
+				refs[token.Value] = append(refs[token.Value], tokens[i+2].Value)
+			}
+		case token.Value == "ct" && (word(i+1) == "timeout" || word(i+1) == "expectation") && word(i+2) == "set":
+			refs["ct "+word(i+1)] = append(refs["ct "+word(i+1)], word(i+3))
+		}
+	}
+	return refs, nil
+}
+
+// checkNotReferenced checks that the named object is not referenced by any rule in
+// table (or, for a chain, by any verdict map element), as nft would before deleting it.
+// objectType is "set", "map", "chain", "counter", "quota", "ct timeout", or
+// "ct expectation".
+func (table *FakeTable) checkNotReferenced(objectType, name string) error {
+	if objectType == "chain" {
+		for _, mname := range sortKeys(table.Maps) {
+			for _, elem := range table.Maps[mname].Elements {
+				for _, target := range elementJumpTargets(elem) {
+					if target == name {
+						return busyError("cannot delete chain %q: it is in use by an element of map %q", name, mname)
+					}
+				}
+			}
+		}
+	}
+	for _, cname := range sortKeys(table.Chains) {
+		for _, rule := range table.Chains[cname].Rules {
+			sets, maps, chains, err := table.ruleReferences(rule)
+			if err != nil {
+				continue
+			}
+			var refs []string
+			switch objectType {
+			case "set":
+				refs = sets
+			case "map":
+				refs = maps
+			case "chain":
+				refs = chains
+			default:
+				objects, _ := ruleObjectReferences(rule)
+				refs = objects[objectType]
+			}
+			for _, ref := range refs {
+				if ref == name {
+					return busyError("cannot delete %s %q: it is in use by a rule in chain %q", objectType, name, cname)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// elementJumpTargets returns the chain referenced by a verdict map element, if any.
+func elementJumpTargets(element *Element) []string {
+	if len(element.Value) != 1 {
+		return nil
+	}
+	words := strings.Split(element.Value[0], " ")
+	if len(words) == 2 && (words[0] == "goto" || words[0] == "jump") {
+		return []string{words[1]}
+	}
+	return nil
+}
+
+// dumpObjects lists the names of the objects of each type to include in a dump
+type dumpObjects struct {
+	chains         []string
+	sets           []string
+	maps           []string
+	flowtables     []string
+	counters       []string
+	quotas         []string
+	ctTimeouts     []string
+	ctExpectations []string
+
+	// includeHandles indicates that objects' handles should be output as comments
+	includeHandles bool
+	// sortElements indicates that set/map elements should be sorted by key
+	sortElements bool
+	// groupElements indicates that each set/map's elements should be output in a
+	// single command
+	groupElements bool
+}
+
+// dump dumps the table and the named objects (which must exist), in the given order.
+func (fake *Fake) dump(objects *dumpObjects) string {
+	buf := &strings.Builder{}
+	buf.Grow(fake.estimateDumpSize(objects))
+	line := &bytes.Buffer{}
+	table := fake.Table
+
+	// Write out all of the object adds first.
+
+	fake.dumpObject(buf, line, &table.Table, table.Handle, objects.includeHandles)
+	for _, cname := range objects.chains {
+		ch := table.Chains[cname]
+		fake.dumpObject(buf, line, &ch.Chain, ch.Handle, objects.includeHandles)
+	}
+	for _, sname := range objects.sets {
+		s := table.Sets[sname]
+		fake.dumpObject(buf, line, &s.Set, s.Handle, objects.includeHandles)
+	}
+	for _, mname := range objects.maps {
+		m := table.Maps[mname]
+		fake.dumpObject(buf, line, &m.Map, m.Handle, objects.includeHandles)
+	}
+	for _, fname := range objects.flowtables {
+		f := table.Flowtables[fname]
+		fake.dumpObject(buf, line, f, f.Handle, objects.includeHandles)
+	}
+	for _, cname := range objects.counters {
+		c := table.Counters[cname]
+		fake.dumpObject(buf, line, c, c.Handle, objects.includeHandles)
+	}
+	for _, qname := range objects.quotas {
+		q := table.Quotas[qname]
+		fake.dumpObject(buf, line, q, q.Handle, objects.includeHandles)
+	}
+	for _, tname := range objects.ctTimeouts {
+		t := table.CTTimeouts[tname]
+		fake.dumpObject(buf, line, t, t.Handle, objects.includeHandles)
+	}
+	for _, ename := range objects.ctExpectations {
+		e := table.CTExpectations[ename]
+		fake.dumpObject(buf, line, e, e.Handle, objects.includeHandles)
+	}
+
+	// Now write their contents.
+
+	dumpRule := &Rule{}
+	for _, cname := range objects.chains {
+		ch := table.Chains[cname]
+		for _, rule := range ch.Rules {
+			// Avoid outputing handles (except as a comment, if requested)
+			*dumpRule = *rule
+			dumpRule.Handle = nil
+			dumpRule.Index = nil
+			// Only output the counter's values if they are non-zero (which is
+			// only the case if they were explicitly set).
+			if dumpRule.Counter != nil && *dumpRule.Counter == (RuleCounter{}) {
+				dumpRule.Counter = nil
+			}
+			fake.dumpObject(buf, line, dumpRule, rule.Handle, objects.includeHandles)
+		}
+	}
+	for _, sname := range objects.sets {
+		fake.dumpElements(buf, sname, table.Sets[sname].Elements, objects)
+	}
+	for _, mname := range objects.maps {
+		fake.dumpElements(buf, mname, table.Maps[mname].Elements, objects)
+	}
+
+	return buf.String()
+}
+
+// dumpElements writes "add element" operations for the elements of the named set or
+// map to buf, sorting and/or grouping them as specified by objects.
+func (fake *Fake) dumpElements(buf *strings.Builder, name string, elements []*Element, objects *dumpObjects) {
+	if objects.sortElements {
+		elements = sortElements(elements)
+	}
+	if !objects.groupElements || len(elements) < 2 {
+		for _, element := range elements {
+			element.writeOperation(addVerb, &fake.nftContext, buf)
+		}
+		return
+	}
+
+	writeStrings(buf, "add element ", string(fake.family), " ", fake.table, " ", name, " { ")
+	for i, element := range elements {
+		if i > 0 {
+			writeStrings(buf, ", ")
+		}
+		element.writeElement(addVerb, buf)
+	}
+	writeStrings(buf, " }\n")
+}
+
+// estimateDumpSize returns a rough estimate of the length of the dump of objects, so
+// that the output buffer can be allocated at (approximately) the right size up front.
+func (fake *Fake) estimateDumpSize(objects *dumpObjects) int {
+	const objectSize = 128
+	table := fake.Table
+	prefix := len("add element   { }\n") + len(fake.family) + len(fake.table)
+	if objects.includeHandles {
+		prefix += len(" # handle 1000")
+	}
+
+	size := objectSize * (1 + len(objects.chains) + len(objects.sets) + len(objects.maps) +
+		len(objects.flowtables) + len(objects.counters) + len(objects.quotas) +
+		len(objects.ctTimeouts) + len(objects.ctExpectations))
+	for _, cname := range objects.chains {
+		for _, rule := range table.Chains[cname].Rules {
+			size += prefix + len(cname) + len(rule.Rule)
+			if rule.Comment != nil {
+				size += len(" comment \"\"") + len(*rule.Comment)
+			}
+		}
+	}
+	for _, sname := range objects.sets {
+		size += len(table.Sets[sname].Elements) * (prefix + len(sname) + 16)
+	}
+	for _, mname := range objects.maps {
+		size += len(table.Maps[mname].Elements) * (prefix + len(mname) + 32)
+	}
+	return size
+}
+
+// dumpObject writes an "add" operation for obj to buf, followed by a "# handle" comment
+// if includeHandles is set. line is used as scratch space, so that it can be reused
+// across calls.
+func (fake *Fake) dumpObject(buf *strings.Builder, line *bytes.Buffer, obj Object, handle *int, includeHandles bool) {
+	if !includeHandles || handle == nil {
+		obj.writeOperation(addVerb, &fake.nftContext, buf)
+		return
+	}
+	line.Reset()
+	obj.writeOperation(addVerb, &fake.nftContext, line)
+	buf.Write(bytes.TrimSuffix(line.Bytes(), []byte("\n")))
+	fmt.Fprintf(buf, " # handle %d\n", *handle)
+}
+
+// DumpJSON is part of Interface. It returns the current contents of fake in the same
+// JSON schema as "nft --json list table". (Since Fake does not parse rules, rule
+// objects do not contain an "expr" array, and sets/maps that were created with
+// TypeOf rather than Type do not contain a "type".)
+func (fake *Fake) DumpJSON(_ context.Context) (string, error) {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return "", notFoundError("no such table %q", fake.table)
+	}
+	table := fake.Table
+
+	objects := []map[string]interface{}{
+		{"metainfo": map[string]interface{}{"json_schema_version": 1}},
+	}
+	addObject := func(objectType string, obj map[string]interface{}) {
+		obj["family"] = string(fake.family)
+		if objectType == "table" {
+			obj["name"] = fake.table
+		} else {
+			obj["table"] = fake.table
+		}
+		objects = append(objects, map[string]interface{}{objectType: obj})
+	}
+
+	tableObj := map[string]interface{}{}
+	addJSONHandleAndComment(tableObj, table.Handle, table.Comment)
+	addObject("table", tableObj)
+
+	chainNames := sortKeys(table.Chains)
+	for _, cname := range chainNames {
+		ch := table.Chains[cname]
+		chainObj := map[string]interface{}{"name": ch.Name}
+		addJSONHandleAndComment(chainObj, ch.Handle, ch.Comment)
+		if ch.Type != nil {
+			chainObj["type"] = string(*ch.Type)
+			chainObj["hook"] = string(*ch.Hook)
+			if prio, err := ParsePriority(fake.family, string(*ch.Priority)); err == nil {
+				chainObj["prio"] = prio
+			}
+			chainObj["policy"] = string(AcceptPolicy)
+			if ch.Policy != nil {
+				chainObj["policy"] = string(*ch.Policy)
+			}
+		}
+		if ch.Device != nil {
+			chainObj["dev"] = *ch.Device
+		} else if len(ch.Devices) == 1 {
+			chainObj["dev"] = ch.Devices[0]
+		} else if len(ch.Devices) > 1 {
+			chainObj["dev"] = ch.Devices
+		}
+		addObject("chain", chainObj)
+	}
+	for _, sname := range sortKeys(table.Sets) {
+		s := table.Sets[sname]
+		setObj := map[string]interface{}{"name": s.Name}
+		addJSONHandleAndComment(setObj, s.Handle, s.Comment)
+		if s.Type != "" {
+			setObj["type"] = jsonTypeValue(s.Type)
+		}
+		addJSONSetProperties(setObj, s.Flags, s.Timeout, s.GCInterval, s.Size, s.Policy)
+		if len(s.Elements) > 0 {
+			elems := make([]interface{}, 0, len(s.Elements))
+			for _, elem := range s.Elements {
+				elems = append(elems, jsonElementKey(elem))
+			}
+			setObj["elem"] = elems
+		}
+		addObject("set", setObj)
+	}
+	for _, mname := range sortKeys(table.Maps) {
+		m := table.Maps[mname]
+		mapObj := map[string]interface{}{"name": m.Name}
+		addJSONHandleAndComment(mapObj, m.Handle, m.Comment)
+		if m.Type != "" {
+			keyType, valueType, _ := strings.Cut(m.Type, " : ")
+			mapObj["type"] = jsonTypeValue(keyType)
+			mapObj["map"] = jsonTypeValue(valueType)
+		}
+		addJSONSetProperties(mapObj, m.Flags, m.Timeout, m.GCInterval, m.Size, m.Policy)
+		if len(m.Elements) > 0 {
+			elems := make([]interface{}, 0, len(m.Elements))
+			for _, elem := range m.Elements {
+				elems = append(elems, []interface{}{jsonElementKey(elem), jsonElementValue(elem.Value)})
+			}
+			mapObj["elem"] = elems
+		}
+		addObject("map", mapObj)
+	}
+	for _, fname := range sortKeys(table.Flowtables) {
+		f := table.Flowtables[fname]
+		flowtableObj := map[string]interface{}{"name": f.Name, "hook": "ingress"}
+		addJSONHandleAndComment(flowtableObj, f.Handle, nil)
+		if prio, err := ParsePriority(fake.family, string(*f.Priority)); err == nil {
+			flowtableObj["prio"] = prio
+		}
+		if len(f.Devices) == 1 {
+			flowtableObj["dev"] = f.Devices[0]
+		} else if len(f.Devices) > 1 {
+			flowtableObj["dev"] = f.Devices
+		}
+		addObject("flowtable", flowtableObj)
+	}
+	for _, cname := range sortKeys(table.Counters) {
+		c := table.Counters[cname]
+		counterObj := map[string]interface{}{"name": c.Name}
+		addJSONHandleAndComment(counterObj, c.Handle, c.Comment)
+		if c.Packets != nil {
+			counterObj["packets"] = *c.Packets
+			counterObj["bytes"] = *c.Bytes
+		}
+		addObject("counter", counterObj)
+	}
+	for _, qname := range sortKeys(table.Quotas) {
+		q := table.Quotas[qname]
+		quotaObj := map[string]interface{}{"name": q.Name, "bytes": q.Bytes, "inv": q.Over}
+		addJSONHandleAndComment(quotaObj, q.Handle, q.Comment)
+		if q.Used != nil {
+			quotaObj["used"] = *q.Used
+		}
+		addObject("quota", quotaObj)
+	}
+	for _, tname := range sortKeys(table.CTTimeouts) {
+		t := table.CTTimeouts[tname]
+		timeoutObj := map[string]interface{}{"name": t.Name, "protocol": t.Protocol}
+		addJSONHandleAndComment(timeoutObj, t.Handle, t.Comment)
+		timeoutObj["l3proto"] = ctL3Proto(fake.family, t.L3Proto)
+		policy := make(map[string]int64, len(t.Policy))
+		for state, timeout := range t.Policy {
+			policy[state] = int64(timeout.Seconds())
+		}
+		timeoutObj["policy"] = policy
+		addObject("ct timeout", timeoutObj)
+	}
+	for _, ename := range sortKeys(table.CTExpectations) {
+		e := table.CTExpectations[ename]
+		expectationObj := map[string]interface{}{
+			"name":     e.Name,
+			"protocol": e.Protocol,
+			"dport":    e.DPort,
+			"timeout":  e.Timeout.Milliseconds(),
+			"size":     e.Size,
+		}
+		addJSONHandleAndComment(expectationObj, e.Handle, e.Comment)
+		expectationObj["l3proto"] = ctL3Proto(fake.family, e.L3Proto)
+		addObject("ct expectation", expectationObj)
+	}
+	for _, cname := range chainNames {
+		for _, rule := range table.Chains[cname].Rules {
+			ruleObj := map[string]interface{}{"chain": rule.Chain}
+			addJSONHandleAndComment(ruleObj, rule.Handle, rule.Comment)
+			addObject("rule", ruleObj)
+		}
+	}
+
+	out, err := json.Marshal(map[string]interface{}{"nftables": objects})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// addJSONHandleAndComment adds "handle" and "comment" fields to obj, if they are set.
+func addJSONHandleAndComment(obj map[string]interface{}, handle *int, comment *string) {
+	if handle != nil {
+		obj["handle"] = *handle
+	}
+	if comment != nil {
+		obj["comment"] = *comment
+	}
+}
+
+// ctL3Proto returns the "l3proto" of a ct timeout or ct expectation: l3proto if it is
+// set, or else the table's family.
+func ctL3Proto(family Family, l3proto *string) string {
+	if l3proto != nil {
+		return *l3proto
+	}
+	return string(family)
+}
+
+// addJSONSetProperties adds the properties shared by sets and maps to obj.
+func addJSONSetProperties(obj map[string]interface{}, flags []SetFlag, timeout, gcInterval *time.Duration, size *uint64, policy *SetPolicy) {
+	if len(flags) > 0 {
+		jsonFlags := make([]string, len(flags))
+		for i := range flags {
+			jsonFlags[i] = string(flags[i])
+		}
+		obj["flags"] = jsonFlags
+	}
+	if timeout != nil {
+		obj["timeout"] = int64(timeout.Seconds())
+	}
+	if gcInterval != nil {
+		obj["gc-interval"] = int64(gcInterval.Seconds())
+	}
+	if size != nil {
+		obj["size"] = *size
+	}
+	if policy != nil {
+		obj["policy"] = string(*policy)
+	}
+}
+
+// jsonTypeValue converts a set/map type (eg "ipv4_addr . inet_service") to nft's JSON
+// representation: a string for a simple type or an array for a concatenation.
+func jsonTypeValue(typ string) interface{} {
+	types := strings.Split(typ, " . ")
+	if len(types) == 1 {
+		return strings.TrimSpace(typ)
+	}
+	for i := range types {
+		types[i] = strings.TrimSpace(types[i])
+	}
+	return types
+}
+
+// jsonElementKey converts element's key to nft's JSON representation, wrapping it in
+// an "elem" object if the element has a timeout, counter, or comment.
+func jsonElementKey(element *Element) interface{} {
+	key := jsonElementValue(element.Key)
+	if element.Timeout == nil && element.Counter == nil && element.Comment == nil {
+		return key
+	}
+	elem := map[string]interface{}{"val": key}
+	if element.Timeout != nil {
+		elem["timeout"] = int64(element.Timeout.Seconds())
+	}
+	if element.Counter != nil {
+		elem["counter"] = map[string]interface{}{
+			"packets": element.Counter.Packets,
+			"bytes":   element.Counter.Bytes,
+		}
+	}
+	if element.Comment != nil {
+		elem["comment"] = *element.Comment
+	}
+	return map[string]interface{}{"elem": elem}
+}
+
+// jsonElementValue converts an element key or value to nft's JSON representation. This
+// is the inverse of parseElementValue.
+func jsonElementValue(values []string) interface{} {
+	if len(values) == 1 {
+		return jsonElementAtom(values[0])
+	}
+	concat := make([]interface{}, len(values))
+	for i := range values {
+		concat[i] = jsonElementAtom(values[i])
+	}
+	return map[string]interface{}{"concat": concat}
+}
+
+// jsonElementAtom converts a single component of an element key or value to nft's JSON
+// representation.
+func jsonElementAtom(value string) interface{} {
+	if num, err := strconv.Atoi(value); err == nil {
+		return num
+	}
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return map[string]interface{}{
+			"prefix": map[string]interface{}{
+				"addr": prefix.Addr().String(),
+				"len":  prefix.Bits(),
+			},
+		}
+	}
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return unquoted
+	}
+	words := strings.Split(value, " ")
+	switch {
+	case len(words) == 1 && simpleVerdicts[value]:
+		return map[string]interface{}{value: nil}
+	case len(words) == 2 && (words[0] == "jump" || words[0] == "goto"):
+		return map[string]interface{}{
+			words[0]: map[string]interface{}{"target": words[1]},
+		}
+	}
+	return value
+}
+
+// simpleVerdicts are the verdicts that don't take an argument
+var simpleVerdicts = map[string]bool{
+	"accept":   true,
+	"drop":     true,
+	"continue": true,
+	"return":   true,
+}
+
+// Summary returns a one-line summary of the contents of fake, such as "table ip
+// kube-proxy: 3 chains, 2 sets (150 elems), 1 map (4 elems)", which may be more useful
+// than the full Dump() in test failure messages.
+func (fake *Fake) Summary() string {
+	fake.mutex.RLock()
+	defer fake.mutex.RUnlock()
+
+	if fake.Table == nil {
+		return fmt.Sprintf("table %s %s: does not exist", fake.family, fake.table)
+	}
+
+	setElems := 0
+	for _, s := range fake.Table.Sets {
+		setElems += len(s.Elements)
+	}
+	mapElems := 0
+	for _, m := range fake.Table.Maps {
+		mapElems += len(m.Elements)
+	}
+
+	return fmt.Sprintf("table %s %s: %s, %s (%s), %s (%s)", fake.family, fake.table,
+		pluralize(len(fake.Table.Chains), "chain"),
+		pluralize(len(fake.Table.Sets), "set"), pluralize(setElems, "elem"),
+		pluralize(len(fake.Table.Maps), "map"), pluralize(mapElems, "elem"),
+	)
+}
+
+// pluralize returns "1 thing" or "N things"
+func pluralize(count int, thing string) string {
+	if count == 1 {
+		return "1 " + thing
+	}
+	return fmt.Sprintf("%d %ss", count, thing)
+}
+
+// ParseDump can parse a dump for a given nft instance.
+// It expects fake's table name and family in all rules.
+// The best way to verify that everything important was properly parsed is to
+// compare given data with nft.Dump() output.
+func (fake *Fake) ParseDump(data string) (err error) {
+	lines := strings.Split(data, "\n")
+	var i int
+	var line string
+	parsingDone := false
+	defer func() {
+		if err != nil && !parsingDone {
+			err = fmt.Errorf("%w (at line %v: %s", err, i+1, line)
+		}
+	}()
+	tx := fake.NewTransaction()
+	commonRegexp := regexp.MustCompile(fmt.Sprintf(`^add (ct [^ ]*|[^ ]*) %s %s(?: (.*))?$`, regexp.QuoteMeta(string(fake.family)), regexp.QuoteMeta(fake.table)))
+
+	for i, line = range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		match := commonRegexp.FindStringSubmatch(line)
+		if match == nil {
+			return fmt.Errorf("could not parse, or wrong table/family")
+		}
+		var obj Object
+		switch match[1] {
+		case "table":
+			obj = &Table{}
+		case "chain":
+			obj = &Chain{}
+		case "rule":
+			obj = &Rule{}
+		case "map":
+			obj = &Map{}
+		case "set":
+			obj = &Set{}
+		case "element":
+			obj = &Element{}
+		case "flowtable":
+			obj = &Flowtable{}
+		case "counter":
+			obj = &Counter{}
+		case "quota":
+			obj = &Quota{}
+		case "ct timeout":
+			obj = &CTTimeout{}
+		case "ct expectation":
+			obj = &CTExpectation{}
+		default:
+			return fmt.Errorf("unknown object %s", match[1])
+		}
+		if match[1] == "element" {
+			elements, err := parseElementLine(match[2])
+			if err != nil {
+				return err
+			}
+			for _, element := range elements {
+				tx.Add(element)
+			}
+			continue
+		}
+		err = obj.parse(match[2])
+		if err != nil {
+			return err
+		}
+		tx.Add(obj)
+	}
+	parsingDone = true
+	return fake.Run(context.Background(), tx)
+}
+
+// parseElementLine parses the arguments of an "add element" command, which may contain
+// multiple comma-separated elements (as output by DumpOptions.GroupElements).
+func parseElementLine(line string) ([]*Element, error) {
+	start := strings.Index(line, " { ")
+	if start == -1 || !strings.HasSuffix(line, " }") {
+		return nil, fmt.Errorf("failed parsing element add command")
+	}
+	name := line[:start]
+	parts := splitAnonymousSet(line[start+3 : len(line)-2])
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("failed parsing element add command")
+	}
+
+	elements := make([]*Element, 0, len(parts))
+	for _, part := range parts {
+		element := &Element{}
+		if err := element.parse(name + " { " + part + " }"); err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+func sortKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// sortElements returns a copy of elements, sorted by key (as described in DumpOptions).
+func sortElements(elements []*Element) []*Element {
+	sorted := append([]*Element(nil), elements...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Key, sorted[j].Key
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if cmp := compareKeyComponents(a[k], b[k]); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return len(a) < len(b)
+	})
+	return sorted
+}
+
+// compareKeyComponents compares two components of element keys, returning -1, 0, or 1.
+func compareKeyComponents(a, b string) int {
+	if aStart, aEnd, ok := parseInterval(a); ok {
+		if bStart, bEnd, ok := parseInterval(b); ok {
+			if cmp := aStart.Compare(bStart); cmp != 0 {
+				return cmp
+			}
+			return aEnd.Compare(bEnd)
+		}
+	}
+	if aNum, err := strconv.ParseUint(a, 0, 64); err == nil {
+		if bNum, err := strconv.ParseUint(b, 0, 64); err == nil {
+			switch {
+			case aNum < bNum:
+				return -1
+			case aNum > bNum:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func findRule(rules []*Rule, handle int) int {
+	for i := range rules {
+		if rules[i].Handle != nil && *rules[i].Handle == handle {
+			return i
+		}
+	}
+	return -1
+}
+
+func findElement(elements []*Element, keyTypes []string, key []string) int {
+	for i := range elements {
+		if keysEqual(elements[i].Key, key, keyTypes) {
+			return i
+		}
+	}
+	return -1
+}
+
+// elementIndex indexes a FakeSet's or FakeMap's Elements by key, so that elements can be
+// found without scanning the whole list. It is rebuilt automatically if Elements is
+// replaced or changes length; code that removes an element must call invalidate(), and
+// code that appends an element should call appended(). Fake.run only uses the index on
+// its own copy of the table, but callers may modify the Elements of fake.Table in place,
+// so FindElement uses lookup() rather than find(). (The index may be updated by
+// FindElement, so it has its own lock, to allow concurrent readers of the Fake.)
+type elementIndex struct {
+	mutex sync.Mutex
+
+	// elements is the slice that positions was built from
+	elements  []*Element
+	positions map[string]int
+}
+
+// indexKey returns a normalized form of key, such that keysEqual(key1, key2, keyTypes)
+// is true exactly when indexKey(key1, keyTypes) == indexKey(key2, keyTypes).
+func indexKey(key []string, keyTypes []string) string {
+	if len(key) == 1 && (len(keyTypes) == 0 || keyTypes[0] != "inet_service") {
+		return key[0]
+	}
+	components := make([]string, len(key))
+	for i := range key {
+		components[i] = key[i]
+		if i < len(keyTypes) && keyTypes[i] == "inet_service" {
+			components[i] = resolveService(key[i])
+		}
+	}
+	return strings.Join(components, "\x00")
+}
+
+// current returns true if idx is up to date with elements.
+func (idx *elementIndex) current(elements []*Element) bool {
+	if idx.positions == nil || len(elements) != len(idx.elements) {
+		return false
+	}
+	return len(elements) == 0 || &elements[0] == &idx.elements[0]
+}
+
+// rebuild rebuilds idx from elements
+func (idx *elementIndex) rebuild(elements []*Element, keyTypes []string) {
+	idx.elements = elements
+	idx.positions = make(map[string]int, len(elements))
+	for i, element := range elements {
+		key := indexKey(element.Key, keyTypes)
+		if _, exists := idx.positions[key]; !exists {
+			idx.positions[key] = i
+		}
+	}
+}
+
+// find returns the index of the element of elements with the given key, or -1 if there
+// is no such element, as with findElement.
+func (idx *elementIndex) find(elements []*Element, keyTypes []string, key []string) int {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if !idx.current(elements) {
+		idx.rebuild(elements, keyTypes)
+	}
+	i, ok := idx.positions[indexKey(key, keyTypes)]
+	if !ok {
+		return -1
+	}
+	if !keysEqual(elements[i].Key, key, keyTypes) {
+		// elements was modified in place behind our back
+		idx.positions = nil
+		return findElement(elements, keyTypes, key)
+	}
+	return i
+}
+
+// lookup is like find, but can be used on elements that may have been modified in place
+// since idx was last updated. (If an element was overwritten with one with a new key,
+// the new key won't be in the index, so if find fails, lookup falls back to a linear
+// search.)
+func (idx *elementIndex) lookup(elements []*Element, keyTypes []string, key []string) int {
+	i := idx.find(elements, keyTypes, key)
+	if i == -1 {
+		i = findElement(elements, keyTypes, key)
+		if i != -1 {
+			idx.invalidate()
+		}
+	}
+	return i
+}
+
+// appended updates idx after an element has been appended to elements. (idx must have
+// been current with the slice before the append.)
+func (idx *elementIndex) appended(elements []*Element, keyTypes []string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if idx.positions == nil || len(elements) != len(idx.elements)+1 {
+		idx.elements = nil
+		idx.positions = nil
+		return
+	}
+	last := len(elements) - 1
+	key := indexKey(elements[last].Key, keyTypes)
+	if _, exists := idx.positions[key]; !exists {
+		idx.positions[key] = last
+	}
+	idx.elements = elements
+}
+
+// invalidate forces idx to be rebuilt the next time it is used
+func (idx *elementIndex) invalidate() {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.elements = nil
+	idx.positions = nil
+}
+
+// isCatchAll returns true if key is the key of a catch-all element.
+func isCatchAll(key []string) bool {
+	return len(key) == 1 && key[0] == CatchAllKey
+}
+
+// findCatchAllElement returns the index of the catch-all element of elements, or -1 if
+// there is none.
+func findCatchAllElement(elements []*Element) int {
 	for i := range elements {
-		if reflect.DeepEqual(elements[i].Key, key) {
+		if isCatchAll(elements[i].Key) {
 			return i
 		}
 	}
 	return -1
 }
 
+// findIntervalElement returns the index of the element of elements whose interval most
+// specifically contains key, or -1 if there is no such element. (Fake, like nft, does
+// not normally allow overlapping intervals, but if there are any, then the narrowest
+// one wins.)
+func findIntervalElement(elements []*Element, key []string) int {
+	if len(key) != 1 {
+		return -1
+	}
+	start, end, ok := parseInterval(key[0])
+	if !ok {
+		return -1
+	}
+
+	found := -1
+	var foundStart, foundEnd netip.Addr
+	for i, element := range elements {
+		if len(element.Key) != 1 {
+			continue
+		}
+		elemStart, elemEnd, ok := parseInterval(element.Key[0])
+		if !ok || elemStart.Is4() != start.Is4() {
+			continue
+		}
+		if start.Less(elemStart) || elemEnd.Less(end) {
+			continue
+		}
+		if found == -1 || (!elemStart.Less(foundStart) && !foundEnd.Less(elemEnd)) {
+			found, foundStart, foundEnd = i, elemStart, elemEnd
+		}
+	}
+	return found
+}
+
+// hasSetFlag checks if flags contains flag.
+func hasSetFlag(flags []SetFlag, flag SetFlag) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeIntervals merges set's overlapping and adjacent IP address, prefix, and range
+// elements, as nft does for interval sets with auto-merge. (Other elements are left
+// alone.) If one of the merged elements covers the entire merged range then it is
+// preserved as-is; otherwise the new merged element has no comment or timeout.
+func (table *FakeTable) mergeIntervals(set *FakeSet) {
+	type interval struct {
+		start, end netip.Addr
+		element    *Element
+	}
+	var intervals []interval
+	var elements []*Element
+	for _, element := range set.Elements {
+		if len(element.Key) == 1 {
+			if start, end, ok := parseInterval(element.Key[0]); ok {
+				intervals = append(intervals, interval{start, end, element})
+				continue
+			}
+		}
+		elements = append(elements, element)
+	}
+	sort.SliceStable(intervals, func(i, j int) bool {
+		return intervals[i].start.Less(intervals[j].start)
+	})
+
+	for i := 0; i < len(intervals); {
+		start, end := intervals[i].start, intervals[i].end
+		j := i + 1
+		for ; j < len(intervals) && intervals[j].start.Is4() == start.Is4(); j++ {
+			// Stop unless intervals[j] overlaps or is adjacent to [start, end]
+			next := end.Next()
+			if next.IsValid() && next.Less(intervals[j].start) {
+				break
+			}
+			if end.Less(intervals[j].end) {
+				end = intervals[j].end
+			}
+		}
+
+		// If one of the elements covers the whole range, keep it and drop the
+		// others; otherwise replace them all with a new element.
+		var mergedElement *Element
+		for _, merged := range intervals[i:j] {
+			if mergedElement == nil && merged.start == start && merged.end == end {
+				mergedElement = merged.element
+			} else {
+				delete(table.expires, merged.element)
+			}
+		}
+		if mergedElement == nil {
+			mergedElement = &Element{
+				Set: set.Name,
+				Key: []string{formatInterval(start, end)},
+			}
+		}
+		elements = append(elements, mergedElement)
+		i = j
+	}
+	set.Elements = elements
+}
+
+// checkIntervalOverlap checks that element (which must not already be in elements)
+// does not overlap any of elements, when they are IP addresses, prefixes, or ranges.
+func checkIntervalOverlap(elements []*Element, element *Element) error {
+	if len(element.Key) != 1 {
+		return nil
+	}
+	start, end, ok := parseInterval(element.Key[0])
+	if !ok {
+		return nil
+	}
+	for _, existing := range elements {
+		if len(existing.Key) != 1 {
+			continue
+		}
+		existingStart, existingEnd, ok := parseInterval(existing.Key[0])
+		if !ok || existingStart.Is4() != start.Is4() {
+			continue
+		}
+		if !end.Less(existingStart) && !existingEnd.Less(start) {
+			return existsError("element %q: interval overlaps with an existing one (%q)", element.Key[0], existing.Key[0])
+		}
+	}
+	return nil
+}
+
+// parseInterval parses key as an IP address, CIDR prefix, or "START-END" IP range, and
+// returns the first and last addresses it contains.
+func parseInterval(key string) (netip.Addr, netip.Addr, bool) {
+	if strings.Contains(key, "/") {
+		prefix, err := netip.ParsePrefix(key)
+		if err != nil {
+			return netip.Addr{}, netip.Addr{}, false
+		}
+		prefix = prefix.Masked()
+		return prefix.Addr(), lastAddr(prefix), true
+	}
+	if first, last, found := strings.Cut(key, "-"); found {
+		start, err1 := netip.ParseAddr(first)
+		end, err2 := netip.ParseAddr(last)
+		if err1 != nil || err2 != nil || start.Is4() != end.Is4() || end.Less(start) {
+			return netip.Addr{}, netip.Addr{}, false
+		}
+		return start, end, true
+	}
+	addr, err := netip.ParseAddr(key)
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	return addr, addr, true
+}
+
+// lastAddr returns the last address in prefix (which must be masked).
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+// formatInterval formats the IP range [start, end] the way nft would: as a single
+// address, a CIDR prefix, or a "START-END" range.
+func formatInterval(start, end netip.Addr) string {
+	if start == end {
+		return start.String()
+	}
+	for bits := 0; bits < start.BitLen(); bits++ {
+		prefix := netip.PrefixFrom(start, bits).Masked()
+		if prefix.Addr() == start && lastAddr(prefix) == end {
+			return prefix.String()
+		}
+	}
+	return start.String() + "-" + end.String()
+}
+
+// keysEqual compares two element keys. keyTypes, if non-nil, gives the datatypes of the
+// key components, so that (e.g.) "http" and "80" can be recognized as the same
+// inet_service.
+func keysEqual(key1, key2 []string, keyTypes []string) bool {
+	if len(key1) != len(key2) {
+		return false
+	}
+	for i := range key1 {
+		if key1[i] == key2[i] {
+			continue
+		}
+		if i < len(keyTypes) && keyTypes[i] == "inet_service" {
+			if resolveService(key1[i]) == resolveService(key2[i]) {
+				continue
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// wellKnownServices maps service names to port numbers, for the services that nft is
+// likely to know about (from /etc/services).
+var wellKnownServices = map[string]string{
+	"ftp-data": "20",
+	"ftp":      "21",
+	"ssh":      "22",
+	"telnet":   "23",
+	"smtp":     "25",
+	"domain":   "53",
+	"bootps":   "67",
+	"bootpc":   "68",
+	"tftp":     "69",
+	"http":     "80",
+	"kerberos": "88",
+	"pop3":     "110",
+	"sunrpc":   "111",
+	"ntp":      "123",
+	"imap":     "143",
+	"snmp":     "161",
+	"ldap":     "389",
+	"https":    "443",
+	"syslog":   "514",
+	"ldaps":    "636",
+	"imaps":    "993",
+	"pop3s":    "995",
+}
+
+// resolveService returns the port number corresponding to service, which may be
+// either a port number or a well-known service name.
+func resolveService(service string) string {
+	if port, ok := wellKnownServices[service]; ok {
+		return port
+	}
+	return service
+}
+
+// parseKeyTypes returns the datatypes of the components of a set/map key, given the
+// set/map's Type or TypeOf. Components whose type can't be determined are returned as
+// "".
+func parseKeyTypes(typ, typeOf string) []string {
+	var keyTypes []string
+	if typ != "" {
+		key, _, _ := strings.Cut(typ, " : ")
+		for _, t := range strings.Split(key, " . ") {
+			keyTypes = append(keyTypes, strings.TrimSpace(t))
+		}
+	} else {
+		key, _, _ := strings.Cut(typeOf, " : ")
+		for _, expr := range strings.Split(key, " . ") {
+			expr = strings.TrimSpace(expr)
+			if strings.HasSuffix(expr, " dport") || strings.HasSuffix(expr, " sport") {
+				keyTypes = append(keyTypes, "inet_service")
+			} else {
+				keyTypes = append(keyTypes, "")
+			}
+		}
+	}
+	return keyTypes
+}
+
+// keyTypes returns the datatypes of the components of s's key
+func (s *FakeSet) keyTypes() []string {
+	return parseKeyTypes(s.Type, s.TypeOf)
+}
+
+// keyTypes returns the datatypes of the components of m's key
+func (m *FakeMap) keyTypes() []string {
+	return parseKeyTypes(m.Type, m.TypeOf)
+}
+
+// newFakeTable returns a new empty FakeTable for table.
+func newFakeTable(table Table) *FakeTable {
+	return &FakeTable{
+		Table:          table,
+		Chains:         make(map[string]*FakeChain),
+		Sets:           make(map[string]*FakeSet),
+		Maps:           make(map[string]*FakeMap),
+		Flowtables:     make(map[string]*Flowtable),
+		Counters:       make(map[string]*Counter),
+		Quotas:         make(map[string]*Quota),
+		CTTimeouts:     make(map[string]*CTTimeout),
+		CTExpectations: make(map[string]*CTExpectation),
+	}
+}
+
 // copy creates a copy of table with new arrays/maps so we can perform a transaction
 // on it without changing the original table.
 func (table *FakeTable) copy() *FakeTable {
@@ -607,12 +3425,7 @@ func (table *FakeTable) copy() *FakeTable {
 		return nil
 	}
 
-	tcopy := &FakeTable{
-		Table:  table.Table,
-		Chains: make(map[string]*FakeChain),
-		Sets:   make(map[string]*FakeSet),
-		Maps:   make(map[string]*FakeMap),
-	}
+	tcopy := newFakeTable(table.Table)
 	for name, chain := range table.Chains {
 		tcopy.Chains[name] = &FakeChain{
 			Chain: chain.Chain,
@@ -631,26 +3444,379 @@ func (table *FakeTable) copy() *FakeTable {
 			Elements: append([]*Element{}, mapObj.Elements...),
 		}
 	}
+	for name, flowtable := range table.Flowtables {
+		tcopy.Flowtables[name] = flowtable
+	}
+	// (Counters and quotas are replaced rather than modified when they are reset, so
+	// they can be shared between copies.)
+	for name, counter := range table.Counters {
+		tcopy.Counters[name] = counter
+	}
+	for name, quota := range table.Quotas {
+		tcopy.Quotas[name] = quota
+	}
+	for name, timeout := range table.CTTimeouts {
+		tcopy.CTTimeouts[name] = timeout
+	}
+	for name, expectation := range table.CTExpectations {
+		tcopy.CTExpectations[name] = expectation
+	}
+	if table.expires != nil {
+		tcopy.expires = make(map[*Element]time.Duration, len(table.expires))
+		for element, expires := range table.expires {
+			tcopy.expires[element] = expires
+		}
+	}
 
 	return tcopy
 }
 
+// resetElement returns a copy of element with its counter (if any) zeroed, and
+// transfers element's expiration time to the copy. (The element is replaced rather
+// than modified since it may be shared with another copy of table.)
+func (table *FakeTable) resetElement(element *Element) *Element {
+	if element.Counter == nil {
+		return element
+	}
+	reset := element.deepCopy()
+	reset.Counter = &ElementCounter{}
+	if expires, ok := table.expires[element]; ok {
+		delete(table.expires, element)
+		table.expires[reset] = expires
+	}
+	return reset
+}
+
+// elementForUpdate returns the element that is created by updating a nonexistent
+// element. An update is sent to nft as an "add element" command containing only the
+// element's key, timeout, and value, so that is all the new element gets.
+func elementForUpdate(update *Element) *Element {
+	return &Element{
+		Set:     update.Set,
+		Map:     update.Map,
+		Key:     update.Key,
+		Value:   update.Value,
+		Timeout: update.Timeout,
+	}
+}
+
+// updateElement returns a copy of element (which is in a set/map whose default timeout is
+// defaultTimeout) with its expiration time restarted as of now, as requested by update.
+// (If update has a Timeout, it replaces element's Timeout.)
+func (table *FakeTable) updateElement(element, update *Element, defaultTimeout *time.Duration, now time.Duration) *Element {
+	updated := element.deepCopy()
+	if update.Timeout != nil {
+		updated.Timeout = copyPtr(update.Timeout)
+	}
+	delete(table.expires, element)
+	table.trackExpiry(updated, nil, defaultTimeout, now)
+	return updated
+}
+
+// trackExpiry records the expiration time of element, which has just been added to a
+// set/map whose default timeout is defaultTimeout. If element is replacing an existing
+// element, oldElement is that element, and its expiration time will be preserved unless
+// element has its own Timeout or Expires, in which case the timer is restarted (as with
+// an update; nft sends the same command for both).
+func (table *FakeTable) trackExpiry(element, oldElement *Element, defaultTimeout *time.Duration, now time.Duration) {
+	// element.Expires is only used to initialize the expiration time; ListElements
+	// recomputes it from table.expires.
+	initialExpires := element.Expires
+	element.Expires = nil
+
+	if oldElement != nil {
+		if expires, ok := table.expires[oldElement]; ok {
+			delete(table.expires, oldElement)
+			if initialExpires == nil && element.Timeout == nil {
+				table.expires[element] = expires
+				return
+			}
+		}
+	}
+
+	timeout := element.Timeout
+	if timeout == nil {
+		timeout = defaultTimeout
+	}
+	if timeout == nil || *timeout == 0 {
+		return
+	}
+	if initialExpires != nil && *initialExpires < *timeout {
+		timeout = initialExpires
+	}
+	if table.expires == nil {
+		table.expires = make(map[*Element]time.Duration)
+	}
+	table.expires[element] = now + *timeout
+}
+
+// expireElements returns elements minus any elements that have expired as of now.
+func (table *FakeTable) expireElements(elements []*Element, now time.Duration) []*Element {
+	var result []*Element
+	for _, element := range elements {
+		if expires, ok := table.expires[element]; ok && expires <= now {
+			delete(table.expires, element)
+			continue
+		}
+		result = append(result, element)
+	}
+	return result
+}
+
+// Tick advances fake's simulated clock by d, and removes any set/map elements whose
+// timeout has now expired. (An element's timeout is its own Timeout, if set, or else its
+// set/map's Timeout. Elements with neither never expire. Re-adding an existing element
+// restarts its timeout only if the new element has a Timeout.)
+func (fake *Fake) Tick(d time.Duration) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.now += d
+	if fake.Table == nil {
+		return
+	}
+
+	for _, s := range fake.Table.Sets {
+		s.Elements = fake.Table.expireElements(s.Elements, fake.now)
+	}
+	for _, m := range fake.Table.Maps {
+		m.Elements = fake.Table.expireElements(m.Elements, fake.now)
+	}
+}
+
+// hasObject returns whether obj exists in table (which may be nil), for a destroy
+// operation. It returns an error if obj is a Rule or Element whose chain, set, or map
+// does not exist.
+func (table *FakeTable) hasObject(obj Object) (bool, error) {
+	if table == nil {
+		return false, nil
+	}
+	switch obj := obj.(type) {
+	case *Table:
+		return true, nil
+	case *Chain:
+		if obj.Handle != nil {
+			return table.findChainByHandle(*obj.Handle) != nil, nil
+		}
+		return table.Chains[obj.Name] != nil, nil
+	case *Rule:
+		chain := table.Chains[obj.Chain]
+		if chain == nil {
+			return false, notFoundError("no such chain %q", obj.Chain)
+		}
+		return findRule(chain.Rules, *obj.Handle) != -1, nil
+	case *Set:
+		if obj.Handle != nil {
+			return table.findSetByHandle(*obj.Handle) != nil, nil
+		}
+		return table.Sets[obj.Name] != nil, nil
+	case *Map:
+		if obj.Handle != nil {
+			return table.findMapByHandle(*obj.Handle) != nil, nil
+		}
+		return table.Maps[obj.Name] != nil, nil
+	case *Flowtable:
+		if obj.Handle != nil {
+			return table.findFlowtableByHandle(*obj.Handle) != nil, nil
+		}
+		return table.Flowtables[obj.Name] != nil, nil
+	case *Counter:
+		if obj.Handle != nil {
+			return table.findCounterByHandle(*obj.Handle) != nil, nil
+		}
+		return table.Counters[obj.Name] != nil, nil
+	case *Quota:
+		if obj.Handle != nil {
+			return table.findQuotaByHandle(*obj.Handle) != nil, nil
+		}
+		return table.Quotas[obj.Name] != nil, nil
+	case *CTTimeout:
+		if obj.Handle != nil {
+			return table.findCTTimeoutByHandle(*obj.Handle) != nil, nil
+		}
+		return table.CTTimeouts[obj.Name] != nil, nil
+	case *CTExpectation:
+		if obj.Handle != nil {
+			return table.findCTExpectationByHandle(*obj.Handle) != nil, nil
+		}
+		return table.CTExpectations[obj.Name] != nil, nil
+	case *Element:
+		if obj.Set != "" {
+			set := table.Sets[obj.Set]
+			if set == nil {
+				return false, notFoundError("no such set %q", obj.Set)
+			}
+			return set.index.find(set.Elements, set.keyTypes(), obj.Key) != -1, nil
+		}
+		mapObj := table.Maps[obj.Map]
+		if mapObj == nil {
+			return false, notFoundError("no such map %q", obj.Map)
+		}
+		return mapObj.index.find(mapObj.Elements, mapObj.keyTypes(), obj.Key) != -1, nil
+	default:
+		return false, fmt.Errorf("unhandled object type %T", obj)
+	}
+}
+
+// findChainByHandle returns the chain in table with the given handle, or nil if there is
+// no such chain.
+func (table *FakeTable) findChainByHandle(handle int) *FakeChain {
+	for _, chain := range table.Chains {
+		if chain.Handle != nil && *chain.Handle == handle {
+			return chain
+		}
+	}
+	return nil
+}
+
+// findSetByHandle returns the set in table with the given handle, or nil if there is no
+// such set.
+func (table *FakeTable) findSetByHandle(handle int) *FakeSet {
+	for _, set := range table.Sets {
+		if set.Handle != nil && *set.Handle == handle {
+			return set
+		}
+	}
+	return nil
+}
+
+// findMapByHandle returns the map in table with the given handle, or nil if there is no
+// such map.
+func (table *FakeTable) findMapByHandle(handle int) *FakeMap {
+	for _, mapObj := range table.Maps {
+		if mapObj.Handle != nil && *mapObj.Handle == handle {
+			return mapObj
+		}
+	}
+	return nil
+}
+
+// findFlowtableByHandle returns the flowtable in table with the given handle, or nil if there is
+// no such flowtable.
+func (table *FakeTable) findFlowtableByHandle(handle int) *Flowtable {
+	for _, flowtable := range table.Flowtables {
+		if flowtable.Handle != nil && *flowtable.Handle == handle {
+			return flowtable
+		}
+	}
+	return nil
+}
+
+// findCounterByHandle returns the counter in table with the given handle, or nil if there is
+// no such counter.
+func (table *FakeTable) findCounterByHandle(handle int) *Counter {
+	for _, counter := range table.Counters {
+		if counter.Handle != nil && *counter.Handle == handle {
+			return counter
+		}
+	}
+	return nil
+}
+
+// findQuotaByHandle returns the quota in table with the given handle, or nil if there is
+// no such quota.
+func (table *FakeTable) findQuotaByHandle(handle int) *Quota {
+	for _, quota := range table.Quotas {
+		if quota.Handle != nil && *quota.Handle == handle {
+			return quota
+		}
+	}
+	return nil
+}
+
+// findCTTimeoutByHandle returns the ct timeout in table with the given handle, or nil if there is
+// no such ct timeout.
+func (table *FakeTable) findCTTimeoutByHandle(handle int) *CTTimeout {
+	for _, timeout := range table.CTTimeouts {
+		if timeout.Handle != nil && *timeout.Handle == handle {
+			return timeout
+		}
+	}
+	return nil
+}
+
+// findCTExpectationByHandle returns the ct expectation in table with the given handle, or nil if there is
+// no such ct expectation.
+func (table *FakeTable) findCTExpectationByHandle(handle int) *CTExpectation {
+	for _, expectation := range table.CTExpectations {
+		if expectation.Handle != nil && *expectation.Handle == handle {
+			return expectation
+		}
+	}
+	return nil
+}
+
 // FindElement finds an element of the set with the given key. If there is no matching
-// element, it returns nil.
+// element, it returns the set's catch-all element if it has one, or nil otherwise. If
+// the key includes an inet_service, then well-known service names (eg "http") will
+// match the corresponding port numbers (eg "80"). If the set has the IntervalFlag and
+// there is no exact match, then a single-component key (an IP address, prefix, or
+// range) will match the most specific element whose interval contains it.
 func (s *FakeSet) FindElement(key ...string) *Element {
-	index := findElement(s.Elements, key)
+	index := s.index.lookup(s.Elements, s.keyTypes(), key)
+	if index == -1 && hasSetFlag(s.Flags, IntervalFlag) {
+		index = findIntervalElement(s.Elements, key)
+	}
+	if index == -1 {
+		index = findCatchAllElement(s.Elements)
+	}
 	if index == -1 {
 		return nil
 	}
 	return s.Elements[index]
 }
 
+// SortedElements returns copies of the set's elements, sorted by key (in the same order
+// as with DumpOptions.SortElements). Elements with equal keys (which can only happen if
+// Elements has been modified directly) remain in their original order.
+func (s *FakeSet) SortedElements() []*Element {
+	sorted := sortElements(s.Elements)
+	for i := range sorted {
+		sorted[i] = sorted[i].deepCopy()
+	}
+	return sorted
+}
+
 // FindElement finds an element of the map with the given key. If there is no matching
-// element, it returns nil.
+// element, it returns the map's catch-all element if it has one, or nil otherwise. If
+// the key includes an inet_service, then well-known service names (eg "http") will
+// match the corresponding port numbers (eg "80"). If the map has the IntervalFlag and
+// there is no exact match, then a single-component key (an IP address, prefix, or
+// range) will match the most specific element whose interval contains it.
 func (m *FakeMap) FindElement(key ...string) *Element {
-	index := findElement(m.Elements, key)
+	index := m.index.lookup(m.Elements, m.keyTypes(), key)
+	if index == -1 && hasSetFlag(m.Flags, IntervalFlag) {
+		index = findIntervalElement(m.Elements, key)
+	}
+	if index == -1 {
+		index = findCatchAllElement(m.Elements)
+	}
 	if index == -1 {
 		return nil
 	}
 	return m.Elements[index]
 }
+
+// SortedElements returns copies of the map's elements, sorted by key (in the same order
+// as with DumpOptions.SortElements). Elements with equal keys (which can only happen if
+// Elements has been modified directly) remain in their original order.
+func (m *FakeMap) SortedElements() []*Element {
+	sorted := sortElements(m.Elements)
+	for i := range sorted {
+		sorted[i] = sorted[i].deepCopy()
+	}
+	return sorted
+}
+
+// FindElementsByValue returns the elements of the map whose value is value (eg, all of
+// the elements of a verdict map whose value is "drop"), in order. If there are no
+// matching elements, it returns nil.
+func (m *FakeMap) FindElementsByValue(value ...string) []*Element {
+	var elements []*Element
+	for _, element := range m.Elements {
+		if keysEqual(element.Value, value, nil) {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
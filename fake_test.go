@@ -18,11 +18,14 @@ package knftables
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/lithammer/dedent"
@@ -35,6 +38,9 @@ func TestFakeRun(t *testing.T) {
 	if err == nil || !IsNotFound(err) {
 		t.Errorf("expected table not found error but got: %v", err)
 	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected error to match ErrNotFound: %v", err)
+	}
 
 	tx := fake.NewTransaction()
 
@@ -89,7 +95,8 @@ func TestFakeRun(t *testing.T) {
 		Value: []string{"drop"},
 	})
 
-	// The transaction should contain exactly those commands, in order
+	// The transaction should contain exactly those commands, in order (except that
+	// consecutive element adds are coalesced, up until the repeated key)
 	expected := strings.TrimPrefix(dedent.Dedent(`
 		add table ip kube-proxy
 		add chain ip kube-proxy chain { comment "foo" ; }
@@ -99,8 +106,7 @@ func TestFakeRun(t *testing.T) {
 		add rule ip kube-proxy anotherchain ip saddr 1.2.3.4 drop comment "drop rule"
 		add rule ip kube-proxy anotherchain ip daddr 5.6.7.8 reject comment "reject rule"
 		add map ip kube-proxy map1 { type ipv4_addr . inet_proto . inet_service : verdict ; }
-		add element ip kube-proxy map1 { 192.168.0.1 . tcp . 80 : goto chain }
-		add element ip kube-proxy map1 { 192.168.0.2 . tcp . 443 comment "with a comment" : goto anotherchain }
+		add element ip kube-proxy map1 { 192.168.0.1 . tcp . 80 : goto chain, 192.168.0.2 . tcp . 443 comment "with a comment" : goto anotherchain }
 		add element ip kube-proxy map1 { 192.168.0.1 . tcp . 80 : drop }
 		`), "\n")
 	diff := cmp.Diff(expected, tx.String())
@@ -364,6 +370,30 @@ func TestFakeCheck(t *testing.T) {
 	if err == nil || !IsNotFound(err) {
 		t.Fatalf("unexpected error from Check: %v", err)
 	}
+
+	// Checking an add should not add anything, or affect the handles assigned by
+	// later operations.
+	dump := fake.Dump()
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{
+		Name: "another-chain",
+	})
+	err = fake.Check(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Check: %v", err)
+	}
+	if fake.Dump() != dump {
+		t.Errorf("Check modified the fake:\n%s", fake.Dump())
+	}
+
+	expectedHandle := *fake.Table.Chains["chain"].Rules[1].Handle + 1
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if handle := *fake.Table.Chains["another-chain"].Handle; handle != expectedHandle {
+		t.Errorf("expected new chain to have handle %d but got %d", expectedHandle, handle)
+	}
 }
 
 func assertRules(t *testing.T, fake *Fake, expected ...string) {
@@ -557,6 +587,44 @@ func TestFakeAddInsertReplace(t *testing.T) {
 	}
 
 	assertRules(t, fake, "thirteenth", "sixth", "twelfth", "fifth", "seventh", "ninth", "eighth", "fourth", "third", "eleventh", "tenth")
+
+	// Replace of a non-existent rule
+	tx = fake.NewTransaction()
+	tx.Replace(&Rule{
+		Chain:  "test",
+		Rule:   "fourteenth",
+		Handle: PtrTo(firstHandle),
+	})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not found error for Replace of deleted rule but got: %v", err)
+	}
+
+	// Out-of-range Index
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{
+		Chain: "test",
+		Rule:  "fourteenth",
+		Index: PtrTo(11),
+	})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not found error for out-of-range Index but got: %v", err)
+	}
+
+	// Negative Index
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{
+		Chain: "test",
+		Rule:  "fourteenth",
+		Index: PtrTo(-1),
+	})
+	err = fake.Run(context.Background(), tx)
+	if err == nil {
+		t.Errorf("expected error for negative Index")
+	}
+
+	assertRules(t, fake, "thirteenth", "sixth", "twelfth", "fifth", "seventh", "ninth", "eighth", "fourth", "third", "eleventh", "tenth")
 }
 
 func TestFakeParseDump(t *testing.T) {
@@ -578,6 +646,8 @@ func TestFakeParseDump(t *testing.T) {
 			add rule ip kube-proxy chain masquerade comment "comment"
 			add element ip kube-proxy map1 { 192.168.0.1 . tcp . 80 : drop }
 			add element ip kube-proxy map1 { 192.168.0.2 . tcp . 443 comment "with a comment" : goto anotherchain }
+			add element ip kube-proxy set1 { 192.168.0.3 . tcp . 80 timeout 60s comment "with a timeout" }
+			add element ip kube-proxy set1 { 192.168.0.4 . tcp . 80 timeout 60s }
 			`,
 		},
 		{
@@ -813,3 +883,5052 @@ func TestFakeParseDump(t *testing.T) {
 		}
 	}
 }
+
+func TestFakeSummary(t *testing.T) {
+	fake := NewFake(InetFamily, "foo")
+
+	expected := "table inet foo: does not exist"
+	if summary := fake.Summary(); summary != expected {
+		t.Errorf("expected %q, got %q", expected, summary)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain1"})
+	tx.Add(&Chain{Name: "chain2"})
+	tx.Add(&Chain{Name: "chain3"})
+	tx.Add(&Set{Name: "set1", Type: "ipv4_addr"})
+	tx.Add(&Set{Name: "set2", Type: "inet_service"})
+	for i := 0; i < 100; i++ {
+		tx.Add(&Element{Set: "set1", Key: []string{fmt.Sprintf("10.0.0.%d", i)}})
+	}
+	for i := 0; i < 50; i++ {
+		tx.Add(&Element{Set: "set2", Key: []string{fmt.Sprintf("%d", 1000+i)}})
+	}
+	tx.Add(&Map{Name: "map1", Type: "inet_service : verdict"})
+	for i := 0; i < 4; i++ {
+		tx.Add(&Element{Map: "map1", Key: []string{fmt.Sprintf("%d", 80+i)}, Value: []string{"drop"}})
+	}
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expected = "table inet foo: 3 chains, 2 sets (150 elems), 1 map (4 elems)"
+	if summary := fake.Summary(); summary != expected {
+		t.Errorf("expected %q, got %q", expected, summary)
+	}
+}
+
+func TestFakeServiceNames(t *testing.T) {
+	fake := NewFake(InetFamily, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "ports", Type: "inet_service"})
+	tx.Add(&Set{Name: "addrports", Type: "ipv4_addr . inet_service"})
+	tx.Add(&Set{Name: "typeofports", TypeOf: "ip daddr . tcp dport"})
+	tx.Add(&Set{Name: "names", Type: "ifname"})
+	tx.Add(&Element{Set: "ports", Key: []string{"http"}})
+	tx.Add(&Element{Set: "ports", Key: []string{"443"}})
+	tx.Add(&Element{Set: "addrports", Key: []string{"10.0.0.1", "ssh"}})
+	tx.Add(&Element{Set: "typeofports", Key: []string{"10.0.0.1", "https"}})
+	tx.Add(&Element{Set: "names", Key: []string{"http"}})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, tc := range []struct {
+		set   string
+		key   []string
+		found bool
+	}{
+		{set: "ports", key: []string{"80"}, found: true},
+		{set: "ports", key: []string{"http"}, found: true},
+		{set: "ports", key: []string{"https"}, found: true},
+		{set: "ports", key: []string{"22"}, found: false},
+		{set: "addrports", key: []string{"10.0.0.1", "22"}, found: true},
+		{set: "addrports", key: []string{"10.0.0.2", "22"}, found: false},
+		{set: "typeofports", key: []string{"10.0.0.1", "443"}, found: true},
+		{set: "names", key: []string{"80"}, found: false},
+	} {
+		elem := fake.Table.Sets[tc.set].FindElement(tc.key...)
+		if tc.found && elem == nil {
+			t.Errorf("expected to find %v in %s", tc.key, tc.set)
+		} else if !tc.found && elem != nil {
+			t.Errorf("expected not to find %v in %s but got %+v", tc.key, tc.set, elem)
+		}
+	}
+
+	// Re-adding an element by port number should replace the element added by name
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "ports", Key: []string{"80"}, Comment: PtrTo("http")})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if len(fake.Table.Sets["ports"].Elements) != 2 {
+		t.Errorf("expected element to be replaced, got %+v", fake.Table.Sets["ports"].Elements)
+	}
+}
+
+func TestFakeJumpToBaseChain(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{
+		Name:     "base",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority),
+	})
+	tx.Add(&Chain{Name: "regular"})
+	tx.Add(&Map{Name: "vmap", Type: "ipv4_addr : verdict"})
+	tx.Add(&Rule{Chain: "base", Rule: "tcp dport 80 jump regular"})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, verdict := range []string{"jump", "goto"} {
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "regular", Rule: "tcp dport 80 " + verdict + " base"})
+		err = fake.Run(context.Background(), tx)
+		if err == nil || !strings.Contains(err.Error(), "base chain") {
+			t.Errorf("expected base chain error for %s rule, got %v", verdict, err)
+		}
+
+		tx = fake.NewTransaction()
+		tx.Add(&Element{Map: "vmap", Key: []string{"10.0.0.1"}, Value: []string{verdict + " base"}})
+		err = fake.Run(context.Background(), tx)
+		if err == nil || !strings.Contains(err.Error(), "base chain") {
+			t.Errorf("expected base chain error for %s element, got %v", verdict, err)
+		}
+	}
+}
+
+func TestFakeDumpChain(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	err := fake.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy { comment "test" ; }
+		add chain ip kube-proxy services
+		add chain ip kube-proxy service-a
+		add chain ip kube-proxy endpoint-a
+		add chain ip kube-proxy mark-for-masquerade
+		add chain ip kube-proxy unrelated
+		add set ip kube-proxy masq-ips { type ipv4_addr ; }
+		add set ip kube-proxy unrelated-ips { type ipv4_addr ; }
+		add map ip kube-proxy service-ips { type ipv4_addr . inet_proto . inet_service : verdict ; }
+		add rule ip kube-proxy services ip daddr . meta l4proto . th dport vmap @service-ips
+		add rule ip kube-proxy service-a jump endpoint-a
+		add rule ip kube-proxy endpoint-a ip saddr @masq-ips jump mark-for-masquerade
+		add rule ip kube-proxy endpoint-a dnat to 10.180.0.1:80
+		add rule ip kube-proxy mark-for-masquerade mark set mark or 0x4000
+		add rule ip kube-proxy unrelated ip saddr @unrelated-ips drop
+		add element ip kube-proxy masq-ips { 10.180.0.1 }
+		add element ip kube-proxy unrelated-ips { 10.0.0.1 }
+		add element ip kube-proxy service-ips { 172.30.0.41 . tcp . 80 : goto service-a }
+		`))
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy { comment "test" ; }
+		add chain ip kube-proxy endpoint-a
+		add chain ip kube-proxy mark-for-masquerade
+		add chain ip kube-proxy service-a
+		add chain ip kube-proxy services
+		add set ip kube-proxy masq-ips { type ipv4_addr ; }
+		add map ip kube-proxy service-ips { type ipv4_addr . inet_proto . inet_service : verdict ; }
+		add rule ip kube-proxy endpoint-a ip saddr @masq-ips jump mark-for-masquerade
+		add rule ip kube-proxy endpoint-a dnat to 10.180.0.1:80
+		add rule ip kube-proxy mark-for-masquerade mark set mark or 0x4000
+		add rule ip kube-proxy service-a jump endpoint-a
+		add rule ip kube-proxy services ip daddr . meta l4proto . th dport vmap @service-ips
+		add element ip kube-proxy masq-ips { 10.180.0.1 }
+		add element ip kube-proxy service-ips { 172.30.0.41 . tcp . 80 : goto service-a }
+		`), "\n")
+	diff := cmp.Diff(expected, fake.DumpChain("services"))
+	if diff != "" {
+		t.Errorf("unexpected DumpChain content:\n%s", diff)
+	}
+
+	expected = strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy { comment "test" ; }
+		add chain ip kube-proxy mark-for-masquerade
+		add rule ip kube-proxy mark-for-masquerade mark set mark or 0x4000
+		`), "\n")
+	diff = cmp.Diff(expected, fake.DumpChain("mark-for-masquerade"))
+	if diff != "" {
+		t.Errorf("unexpected DumpChain content:\n%s", diff)
+	}
+
+	if dump := fake.DumpChain("nonexistent"); dump != "" {
+		t.Errorf("expected empty dump for nonexistent chain, got %q", dump)
+	}
+
+	// Jumps inside anonymous verdict maps are followed too
+	tx := fake.NewTransaction()
+	tx.Add(&Chain{Name: "port-80"})
+	tx.Add(&Chain{Name: "port-443"})
+	tx.Add(&Chain{Name: "ports"})
+	tx.Add(&Rule{Chain: "ports", Rule: "tcp dport vmap { 80 : jump port-80, 443 : goto port-443 }"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	expected = strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy { comment "test" ; }
+		add chain ip kube-proxy port-443
+		add chain ip kube-proxy port-80
+		add chain ip kube-proxy ports
+		add rule ip kube-proxy ports tcp dport vmap { 80 : jump port-80, 443 : goto port-443 }
+		`), "\n")
+	dump := fake.DumpChain("ports")
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected DumpChain content:\n%s", diff)
+	}
+	if err := NewFake(IPv4Family, "kube-proxy").ParseDump(dump); err != nil {
+		t.Errorf("DumpChain output is not self-contained: %v", err)
+	}
+}
+
+func TestFakeDeleteChainByHandle(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain1"})
+	tx.Add(&Chain{Name: "chain2"})
+	tx.Add(&Chain{Name: "chain3"})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	chain2Handle := *fake.Table.Chains["chain2"].Handle
+
+	// Delete by name
+	tx = fake.NewTransaction()
+	tx.Delete(&Chain{Name: "chain1"})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	// Delete by handle
+	tx = fake.NewTransaction()
+	tx.Delete(&Chain{Handle: PtrTo(chain2Handle)})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	chains, err := fake.List(context.Background(), "chains")
+	if err != nil {
+		t.Fatalf("unexpected error from List: %v", err)
+	}
+	if !reflect.DeepEqual(chains, []string{"chain3"}) {
+		t.Errorf("unexpected chains after delete: %v", chains)
+	}
+
+	// Delete by non-existent handle
+	tx = fake.NewTransaction()
+	tx.Delete(&Chain{Handle: PtrTo(chain2Handle)})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not found error but got: %v", err)
+	}
+}
+
+func TestFakeDeleteSetMapByHandle(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set1", Type: "ipv4_addr"})
+	tx.Add(&Set{Name: "set2", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "map1", Type: "ipv4_addr : verdict"})
+	tx.Add(&Map{Name: "map2", Type: "ipv4_addr : verdict"})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	set1Handle := *fake.Table.Sets["set1"].Handle
+	map2Handle := *fake.Table.Maps["map2"].Handle
+
+	tx = fake.NewTransaction()
+	tx.Delete(&Set{Handle: PtrTo(set1Handle)})
+	tx.Delete(&Map{Handle: PtrTo(map2Handle)})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	sets, _ := fake.List(context.Background(), "sets")
+	if !reflect.DeepEqual(sets, []string{"set2"}) {
+		t.Errorf("unexpected sets after delete: %v", sets)
+	}
+	maps, _ := fake.List(context.Background(), "maps")
+	if !reflect.DeepEqual(maps, []string{"map1"}) {
+		t.Errorf("unexpected maps after delete: %v", maps)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Delete(&Set{Handle: PtrTo(set1Handle)})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not found error but got: %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Delete(&Map{Handle: PtrTo(map2Handle)})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not found error but got: %v", err)
+	}
+}
+
+func TestFakeJumpTargets(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "tcp dport 80 jump nonexistent-chain"})
+	err := fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Fatalf("expected not found error but got: %v", err)
+	}
+	if fake.Table != nil {
+		t.Fatalf("failed transaction should not have created table")
+	}
+
+	// A chain added earlier in the same transaction is a valid target
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Chain{Name: "target"})
+	tx.Add(&Rule{Chain: "chain", Rule: "tcp dport 80 jump target"})
+	tx.Add(&Rule{Chain: "chain", Rule: "tcp dport 443 goto target"})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	// But a chain deleted earlier in the same transaction is not
+	tx = fake.NewTransaction()
+	tx.Flush(&Chain{Name: "chain"})
+	tx.Delete(&Chain{Name: "target"})
+	tx.Add(&Rule{Chain: "chain", Rule: "tcp dport 80 jump target"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Fatalf("expected not found error but got: %v", err)
+	}
+}
+
+func TestFakeStrictTypes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		element *Element
+		err     string
+	}{
+		{
+			name:    "correct set element",
+			element: &Element{Set: "set", Key: []string{"10.0.0.1", "80"}},
+		},
+		{
+			name:    "set element with too few components",
+			element: &Element{Set: "set", Key: []string{"10.0.0.1"}},
+			err:     "has 1 components but type",
+		},
+		{
+			name:    "set element with too many components",
+			element: &Element{Set: "set", Key: []string{"10.0.0.1", "tcp", "80"}},
+			err:     "has 3 components but type",
+		},
+		{
+			name:    "correct typeof set element",
+			element: &Element{Set: "typeofset", Key: []string{"10.0.0.1", "80"}},
+		},
+		{
+			name:    "incorrect typeof set element",
+			element: &Element{Set: "typeofset", Key: []string{"10.0.0.1"}},
+			err:     "has 1 components but type",
+		},
+		{
+			name:    "correct typeof map element",
+			element: &Element{Map: "typeofmap", Key: []string{"10.0.0.1", "tcp"}, Value: []string{"10.0.0.2", "80"}},
+		},
+		{
+			name:    "incorrect typeof map element key",
+			element: &Element{Map: "typeofmap", Key: []string{"10.0.0.1", "tcp", "80"}, Value: []string{"10.0.0.2", "80"}},
+			err:     "has 3 components but type",
+		},
+		{
+			name:    "incorrect typeof map element value",
+			element: &Element{Map: "typeofmap", Key: []string{"10.0.0.1", "tcp"}, Value: []string{"10.0.0.2"}},
+			err:     "element value \"10.0.0.2\" has 1 components",
+		},
+		{
+			name:    "correct map element",
+			element: &Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"10.0.0.2", "80"}},
+		},
+		{
+			name:    "map element with wrong key arity",
+			element: &Element{Map: "map", Key: []string{"10.0.0.1", "80"}, Value: []string{"10.0.0.2", "80"}},
+			err:     "element key",
+		},
+		{
+			name:    "map element with wrong value arity",
+			element: &Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"10.0.0.2"}},
+			err:     "element value",
+		},
+		{
+			name:    "verdict map element with accept",
+			element: &Element{Map: "vmap", Key: []string{"0x10"}, Value: []string{"accept"}},
+		},
+		{
+			name:    "verdict map element with return",
+			element: &Element{Map: "vmap", Key: []string{"0x10"}, Value: []string{"return"}},
+		},
+		{
+			name:    "verdict map element with jump",
+			element: &Element{Map: "vmap", Key: []string{"0x10"}, Value: []string{"jump target"}},
+		},
+		{
+			name:    "verdict map element with goto",
+			element: &Element{Map: "vmap", Key: []string{"0x10"}, Value: []string{"goto target"}},
+		},
+		{
+			name:    "verdict map element with non-verdict value",
+			element: &Element{Map: "vmap", Key: []string{"0x10"}, Value: []string{"10.0.0.1"}},
+			err:     "is not a valid verdict",
+		},
+		{
+			name:    "verdict map element with jump but no target",
+			element: &Element{Map: "vmap", Key: []string{"0x10"}, Value: []string{"jump"}},
+			err:     "is not a valid verdict",
+		},
+		{
+			name:    "verdict map element with two verdicts",
+			element: &Element{Map: "vmap", Key: []string{"0x10"}, Value: []string{"accept drop"}},
+			err:     "is not a valid verdict",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				fake := NewFake(IPv4Family, "kube-proxy")
+				fake.StrictTypes = strict
+
+				tx := fake.NewTransaction()
+				tx.Add(&Table{})
+				tx.Add(&Set{Name: "set", Type: "ipv4_addr . inet_service"})
+				tx.Add(&Set{Name: "typeofset", TypeOf: "ip daddr . tcp dport"})
+				tx.Add(&Map{Name: "map", Type: "ipv4_addr : ipv4_addr . inet_service"})
+				tx.Add(&Map{Name: "vmap", TypeOf: "meta mark : verdict"})
+				tx.Add(&Map{Name: "typeofmap", TypeOf: "ip daddr . meta l4proto : ip daddr . th dport"})
+				tx.Add(&Chain{Name: "target"})
+				tx.Add(tc.element)
+				err := fake.Run(context.Background(), tx)
+				if !strict || tc.err == "" {
+					if err != nil {
+						t.Errorf("unexpected error with StrictTypes=%v: %v", strict, err)
+					}
+				} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error containing %q, got %v", tc.err, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFakeTick(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{
+		Name:    "affinity",
+		Type:    "ipv4_addr",
+		Flags:   []SetFlag{TimeoutFlag},
+		Timeout: PtrTo(time.Hour),
+	})
+	tx.Add(&Set{
+		Name:  "notimeout",
+		Type:  "ipv4_addr",
+		Flags: []SetFlag{TimeoutFlag},
+	})
+	tx.Add(&Map{
+		Name:    "map",
+		Type:    "ipv4_addr : verdict",
+		Flags:   []SetFlag{TimeoutFlag},
+		Timeout: PtrTo(time.Hour),
+	})
+	tx.Add(&Element{Set: "affinity", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "affinity", Key: []string{"10.0.0.2"}, Timeout: PtrTo(10 * time.Minute)})
+	tx.Add(&Element{Set: "notimeout", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "notimeout", Key: []string{"10.0.0.2"}, Timeout: PtrTo(10 * time.Minute)})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertElements := func(objectType, name string, expected ...string) {
+		t.Helper()
+		elements, err := fake.ListElements(context.Background(), objectType, name)
+		if err != nil {
+			t.Fatalf("unexpected error from ListElements: %v", err)
+		}
+		var keys []string
+		for _, elem := range elements {
+			keys = append(keys, strings.Join(elem.Key, " . "))
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("expected %s %s to contain %v, got %v", objectType, name, expected, keys)
+		}
+	}
+
+	fake.Tick(5 * time.Minute)
+	assertElements("set", "affinity", "10.0.0.1", "10.0.0.2")
+	assertElements("set", "notimeout", "10.0.0.1", "10.0.0.2")
+	assertElements("map", "map", "10.0.0.1")
+
+	// Re-adding an element with a timeout restarts its timer, but re-adding it
+	// without one does not
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "affinity", Key: []string{"10.0.0.2"}, Timeout: PtrTo(10 * time.Minute)})
+	tx.Add(&Element{Set: "notimeout", Key: []string{"10.0.0.2"}})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	fake.Tick(5 * time.Minute)
+	assertElements("set", "affinity", "10.0.0.1", "10.0.0.2")
+	assertElements("set", "notimeout", "10.0.0.1")
+	assertElements("map", "map", "10.0.0.1")
+
+	// An element added later times out relative to when it was added
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "affinity", Key: []string{"10.0.0.3"}})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	fake.Tick(50 * time.Minute)
+	assertElements("set", "affinity", "10.0.0.3")
+	assertElements("set", "notimeout", "10.0.0.1")
+	assertElements("map", "map")
+
+	fake.Tick(10 * time.Minute)
+	assertElements("set", "affinity")
+}
+
+func TestFakeDeleteSetWithTimeouts(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr", Flags: []SetFlag{TimeoutFlag}, Timeout: PtrTo(time.Hour)})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict", Flags: []SetFlag{TimeoutFlag}, Timeout: PtrTo(time.Hour)})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.2"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if len(fake.Table.expires) != 3 {
+		t.Fatalf("expected 3 elements with expiration times, got %d", len(fake.Table.expires))
+	}
+
+	// Deleting a set or map stops tracking its elements' expiration times
+	tx = fake.NewTransaction()
+	tx.Delete(&Set{Name: "set"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if len(fake.Table.expires) != 1 {
+		t.Errorf("expected 1 element with expiration time after deleting set, got %d", len(fake.Table.expires))
+	}
+
+	tx = fake.NewTransaction()
+	tx.Delete(&Map{Name: "map"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if len(fake.Table.expires) != 0 {
+		t.Errorf("expected no elements with expiration times after deleting map, got %d", len(fake.Table.expires))
+	}
+}
+
+func TestFakeElementTimeout(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Map{
+		Name:    "affinity",
+		Type:    "ipv4_addr : verdict",
+		Flags:   []SetFlag{TimeoutFlag},
+		Timeout: PtrTo(time.Minute),
+	})
+	tx.Add(&Element{Map: "affinity", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	tx.Add(&Element{Map: "affinity", Key: []string{"10.0.0.2"}, Value: []string{"drop"}, Timeout: PtrTo(time.Hour)})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add map ip kube-proxy affinity { type ipv4_addr : verdict ; flags timeout ; timeout 60s ; }
+		add element ip kube-proxy affinity { 10.0.0.1 : drop }
+		add element ip kube-proxy affinity { 10.0.0.2 timeout 3600s : drop }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected dump:\n%s", diff)
+	}
+
+	fake.Tick(30 * time.Minute)
+	elements, err := fake.ListElements(context.Background(), "map", "affinity")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	if len(elements) != 1 {
+		t.Fatalf("expected 1 element after the map's default timeout, got %d", len(elements))
+	}
+	elem := elements[0]
+	if elem.Key[0] != "10.0.0.2" {
+		t.Errorf("expected element with its own timeout to remain, got %v", elem.Key)
+	}
+	if elem.Timeout == nil || *elem.Timeout != time.Hour {
+		t.Errorf("expected element Timeout to round-trip as 1h, got %v", elem.Timeout)
+	}
+	if elem.Expires == nil || *elem.Expires != 30*time.Minute {
+		t.Errorf("expected element to expire in 30m, got %v", elem.Expires)
+	}
+
+	fake.Tick(30 * time.Minute)
+	elements, err = fake.ListElements(context.Background(), "map", "affinity")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	if len(elements) != 0 {
+		t.Errorf("expected all elements to have expired, got %d", len(elements))
+	}
+}
+
+func TestFakeElementUpdate(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{
+		Name:    "recent",
+		Type:    "ipv4_addr",
+		Flags:   []SetFlag{TimeoutFlag},
+		Timeout: PtrTo(time.Minute),
+	})
+	tx.Add(&Map{
+		Name:    "affinity",
+		Type:    "ipv4_addr : verdict",
+		Flags:   []SetFlag{TimeoutFlag},
+		Timeout: PtrTo(time.Minute),
+	})
+	tx.Add(&Element{Set: "recent", Key: []string{"10.0.0.1"}, Comment: PtrTo("one")})
+	tx.Add(&Element{Set: "recent", Key: []string{"10.0.0.2"}})
+	tx.Add(&Element{Map: "affinity", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	// Updating 10.0.0.1 after 45s restarts its timer, so it outlives 10.0.0.2
+	fake.Tick(45 * time.Second)
+	tx = fake.NewTransaction()
+	tx.Update(&Element{Set: "recent", Key: []string{"10.0.0.1"}})
+	tx.Update(&Element{Map: "affinity", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Timeout: PtrTo(5 * time.Minute)})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	fake.Tick(30 * time.Second)
+	elements, err := fake.ListElements(context.Background(), "set", "recent")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	expected := []*Element{
+		{Set: "recent", Key: []string{"10.0.0.1"}, Comment: PtrTo("one"), Expires: PtrTo(30 * time.Second)},
+	}
+	if diff := cmp.Diff(expected, elements); diff != "" {
+		t.Errorf("unexpected elements after update:\n%s", diff)
+	}
+
+	elements, err = fake.ListElements(context.Background(), "map", "affinity")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	expected = []*Element{
+		{Map: "affinity", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Timeout: PtrTo(5 * time.Minute), Expires: PtrTo(270 * time.Second)},
+	}
+	if diff := cmp.Diff(expected, elements); diff != "" {
+		t.Errorf("unexpected map elements after update:\n%s", diff)
+	}
+
+	fake.Tick(30 * time.Second)
+	if count, _ := fake.ElementCount(context.Background(), "set", "recent"); count != 0 {
+		t.Errorf("expected updated element to expire eventually, got %d elements", count)
+	}
+
+	// Updating a non-existent element creates it (as "add element" would), with
+	// only the fields that are sent to nft for an update.
+	tx = fake.NewTransaction()
+	tx.Update(&Element{Set: "recent", Key: []string{"10.0.0.3"}, Comment: PtrTo("three")})
+	tx.Update(&Element{Map: "affinity", Key: []string{"10.0.0.3"}, Value: []string{"accept"}, Timeout: PtrTo(5 * time.Minute)})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	elements, err = fake.ListElements(context.Background(), "set", "recent")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	expected = []*Element{
+		{Set: "recent", Key: []string{"10.0.0.3"}, Expires: PtrTo(time.Minute)},
+	}
+	if diff := cmp.Diff(expected, elements); diff != "" {
+		t.Errorf("unexpected elements after updating missing element:\n%s", diff)
+	}
+	elements, err = fake.ListElements(context.Background(), "map", "affinity")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	expected = []*Element{
+		{Map: "affinity", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Timeout: PtrTo(5 * time.Minute), Expires: PtrTo(240 * time.Second)},
+		{Map: "affinity", Key: []string{"10.0.0.3"}, Value: []string{"accept"}, Timeout: PtrTo(5 * time.Minute), Expires: PtrTo(5 * time.Minute)},
+	}
+	if diff := cmp.Diff(expected, elements); diff != "" {
+		t.Errorf("unexpected map elements after updating missing element:\n%s", diff)
+	}
+}
+
+func TestFakeElementAddMatchesUpdate(t *testing.T) {
+	// "add element" and "update element" of an existing element with a timeout
+	// send the same command to nft, so they must have the same effect.
+	var dumps []string
+	for _, verb := range []verb{addVerb, updateVerb} {
+		fake := NewFake(IPv4Family, "kube-proxy")
+		tx := fake.NewTransaction()
+		tx.Add(&Table{})
+		tx.Add(&Map{
+			Name:    "affinity",
+			Type:    "ipv4_addr : verdict",
+			Flags:   []SetFlag{TimeoutFlag},
+			Timeout: PtrTo(time.Minute),
+		})
+		tx.Add(&Element{Map: "affinity", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Fatalf("unexpected error from Run: %v", err)
+		}
+
+		fake.Tick(45 * time.Second)
+		element := &Element{Map: "affinity", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Timeout: PtrTo(5 * time.Minute)}
+		tx = fake.NewTransaction()
+		if verb == addVerb {
+			tx.Add(element)
+		} else {
+			tx.Update(element)
+		}
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Fatalf("unexpected error from Run with %s: %v", verb, err)
+		}
+
+		fake.Tick(30 * time.Second)
+		elements, err := fake.ListElements(context.Background(), "map", "affinity")
+		if err != nil {
+			t.Fatalf("unexpected error from ListElements: %v", err)
+		}
+		expected := []*Element{
+			{Map: "affinity", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Timeout: PtrTo(5 * time.Minute), Expires: PtrTo(270 * time.Second)},
+		}
+		if diff := cmp.Diff(expected, elements); diff != "" {
+			t.Errorf("unexpected elements after %s:\n%s", verb, diff)
+		}
+		dumps = append(dumps, fake.Dump())
+	}
+	if diff := cmp.Diff(dumps[0], dumps[1]); diff != "" {
+		t.Errorf("add and update gave different results:\n%s", diff)
+	}
+}
+
+func TestFakeCatchAllElement(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "reject-chain"})
+	tx.Add(&Map{
+		Name: "services",
+		Type: "ipv4_addr . inet_service : verdict",
+	})
+	tx.Add(&Element{Map: "services", Key: []string{"10.0.0.1", "80"}, Value: []string{"accept"}})
+	tx.Add(&Element{Map: "services", Key: []string{CatchAllKey}, Value: []string{"goto reject-chain"}})
+	tx.Add(&Set{
+		Name: "nocatchall",
+		Type: "ipv4_addr",
+	})
+	tx.Add(&Element{Set: "nocatchall", Key: []string{"10.0.0.1"}})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy reject-chain
+		add set ip kube-proxy nocatchall { type ipv4_addr ; }
+		add map ip kube-proxy services { type ipv4_addr . inet_service : verdict ; }
+		add element ip kube-proxy nocatchall { 10.0.0.1 }
+		add element ip kube-proxy services { 10.0.0.1 . 80 : accept }
+		add element ip kube-proxy services { * : goto reject-chain }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected dump:\n%s", diff)
+	}
+
+	services := fake.Table.Maps["services"]
+	if elem := services.FindElement("10.0.0.1", "http"); elem == nil || elem.Value[0] != "accept" {
+		t.Errorf("expected exact match for 10.0.0.1 . http, got %+v", elem)
+	}
+	if elem := services.FindElement("10.0.0.2", "80"); elem == nil || elem.Value[0] != "goto reject-chain" {
+		t.Errorf("expected catch-all match for 10.0.0.2 . 80, got %+v", elem)
+	}
+	if elem := fake.Table.Sets["nocatchall"].FindElement("10.0.0.2"); elem != nil {
+		t.Errorf("expected no match in set without catch-all, got %+v", elem)
+	}
+
+	// The catch-all element can be deleted by its key
+	tx = fake.NewTransaction()
+	tx.Delete(&Element{Map: "services", Key: []string{CatchAllKey}})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if elem := fake.Table.Maps["services"].FindElement("10.0.0.2", "80"); elem != nil {
+		t.Errorf("expected no match after deleting catch-all, got %+v", elem)
+	}
+}
+
+func TestFakeElementExpires(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{
+		Name:    "affinity",
+		Type:    "ipv4_addr",
+		Flags:   []SetFlag{TimeoutFlag},
+		Timeout: PtrTo(time.Hour),
+	})
+	tx.Add(&Element{Set: "affinity", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "affinity", Key: []string{"10.0.0.2"}, Timeout: PtrTo(10 * time.Minute)})
+	tx.Add(&Element{Set: "affinity", Key: []string{"10.0.0.3"}, Expires: PtrTo(time.Minute)})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertExpires := func(expected map[string]time.Duration) {
+		t.Helper()
+		elements, err := fake.ListElements(context.Background(), "set", "affinity")
+		if err != nil {
+			t.Fatalf("unexpected error from ListElements: %v", err)
+		}
+		actual := make(map[string]time.Duration)
+		for _, elem := range elements {
+			if elem.Expires == nil {
+				t.Errorf("element %s has no Expires", elem.Key[0])
+				continue
+			}
+			actual[elem.Key[0]] = *elem.Expires
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("unexpected expiration times:\n%s", diff)
+		}
+	}
+
+	fake.Tick(30 * time.Second)
+	assertExpires(map[string]time.Duration{
+		"10.0.0.1": time.Hour - 30*time.Second,
+		"10.0.0.2": 10*time.Minute - 30*time.Second,
+		"10.0.0.3": 30 * time.Second,
+	})
+
+	// Renewing an element with an explicit Expires updates its expiration time
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "affinity", Key: []string{"10.0.0.3"}, Expires: PtrTo(5 * time.Minute)})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	fake.Tick(time.Minute)
+	assertExpires(map[string]time.Duration{
+		"10.0.0.1": time.Hour - 90*time.Second,
+		"10.0.0.2": 10*time.Minute - 90*time.Second,
+		"10.0.0.3": 4 * time.Minute,
+	})
+
+	// Expires is not included in the Dump
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add set ip kube-proxy affinity { type ipv4_addr ; flags timeout ; timeout 3600s ; }
+		add element ip kube-proxy affinity { 10.0.0.1 }
+		add element ip kube-proxy affinity { 10.0.0.2 timeout 600s }
+		add element ip kube-proxy affinity { 10.0.0.3 }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump result:\n%s", diff)
+	}
+}
+
+func TestFakeSetSize(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr", Size: PtrTo[uint64](2)})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict", Size: PtrTo[uint64](2)})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.2"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.2"}, Value: []string{"drop"}})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	// Re-adding an existing element is fine
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.2"}, Comment: PtrTo("replaced")})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.2"}, Value: []string{"accept"}})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	// Adding a third element is not
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.3"}})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !strings.Contains(err.Error(), "too many elements") {
+		t.Errorf("expected too many elements error, got %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.3"}, Value: []string{"drop"}})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !strings.Contains(err.Error(), "too many elements") {
+		t.Errorf("expected too many elements error, got %v", err)
+	}
+
+	// Unless you delete one first
+	tx = fake.NewTransaction()
+	tx.Delete(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.3"}})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+}
+
+func TestFakeConcurrency(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				tx := fake.NewTransaction()
+				tx.Add(&Rule{Chain: "chain", Rule: fmt.Sprintf("ip saddr 10.%d.0.%d drop", i, j)})
+				tx.Add(&Element{Set: "set", Key: []string{fmt.Sprintf("10.%d.0.%d", i, j)}})
+				if err := fake.Run(context.Background(), tx); err != nil {
+					t.Errorf("unexpected error from Run: %v", err)
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_ = fake.Dump()
+				_, _ = fake.ListRules(context.Background(), "chain")
+				_, _ = fake.ListElements(context.Background(), "set", "set")
+			}
+		}()
+	}
+	wg.Wait()
+
+	rules, err := fake.ListRules(context.Background(), "chain")
+	if err != nil {
+		t.Fatalf("unexpected error from ListRules: %v", err)
+	}
+	if len(rules) != 250 {
+		t.Errorf("expected 250 rules, got %d", len(rules))
+	}
+}
+
+func TestFakeListReturnsCopies(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop", Comment: PtrTo("original")})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Comment: PtrTo("original")})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	rules, err := fake.ListRules(context.Background(), "chain")
+	if err != nil {
+		t.Fatalf("unexpected error from ListRules: %v", err)
+	}
+	*rules[0].Comment = "modified"
+	rules[0].Rule = "accept"
+	rules[0] = nil
+
+	rules, err = fake.ListRules(context.Background(), "chain")
+	if err != nil {
+		t.Fatalf("unexpected error from ListRules: %v", err)
+	}
+	if rules[0] == nil || rules[0].Rule != "drop" || *rules[0].Comment != "original" {
+		t.Errorf("modifying ListRules result modified fake: %+v", rules[0])
+	}
+
+	elements, err := fake.ListElements(context.Background(), "map", "map")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	*elements[0].Comment = "modified"
+	elements[0].Key[0] = "10.0.0.2"
+	elements[0].Value[0] = "accept"
+
+	elements, err = fake.ListElements(context.Background(), "map", "map")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	expected := &Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Comment: PtrTo("original")}
+	if diff := cmp.Diff(expected, elements[0]); diff != "" {
+		t.Errorf("modifying ListElements result modified fake:\n%s", diff)
+	}
+}
+
+func TestNewFakeFromDump(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{Comment: PtrTo("rules for kube-proxy")})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Chain{
+		Name:     "base",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority),
+		// (nft always lists a base chain's policy, so the imported chain will
+		// have one.)
+		Policy: PtrTo(AcceptPolicy),
+	})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr", Flags: []SetFlag{IntervalFlag}})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr . inet_service : verdict"})
+	tx.Add(&Rule{Chain: "base", Rule: "ip saddr @set jump chain"})
+	tx.Add(&Rule{Chain: "base", Rule: "ip daddr . tcp dport vmap @map", Comment: PtrTo("services")})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.0/24"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1", "80"}, Value: []string{"goto chain"}})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	imported, err := NewFakeFromDump(IPv4Family, "kube-proxy", fake.Dump())
+	if err != nil {
+		t.Fatalf("unexpected error from NewFakeFromDump: %v", err)
+	}
+	if !fake.Equal(imported) {
+		t.Errorf("imported fake differs from original:\n%s", fake.DiffString(imported))
+	}
+	for name, ch := range imported.Table.Chains {
+		if ch.Handle == nil {
+			t.Errorf("expected imported chain %q to have a handle", name)
+		}
+		for _, rule := range ch.Rules {
+			if rule.Handle == nil {
+				t.Errorf("expected imported rule %q to have a handle", rule.Rule)
+			}
+		}
+	}
+
+	// Importing "nft list table" output
+	imported, err = NewFakeFromDump(IPv4Family, "kube-proxy", dedent.Dedent(`
+		table ip kube-proxy {
+			comment "rules for kube-proxy"
+			set set {
+				type ipv4_addr
+				flags interval
+				elements = { 10.0.0.0/24 }
+			}
+
+			map map {
+				type ipv4_addr . inet_service : verdict
+				elements = { 10.0.0.1 . 80 : goto chain }
+			}
+
+			chain chain {
+				drop
+			}
+
+			chain base {
+				type filter hook input priority filter; policy accept;
+				ip saddr @set jump chain
+				ip daddr . tcp dport vmap @map comment "services"
+			}
+		}
+		`))
+	if err != nil {
+		t.Fatalf("unexpected error from NewFakeFromDump: %v", err)
+	}
+	if !fake.Equal(imported) {
+		t.Errorf("imported fake differs from original:\n%s", fake.DiffString(imported))
+	}
+
+	// Errors
+	for _, tc := range []struct {
+		name string
+		dump string
+		err  string
+	}{
+		{
+			name: "wrong table",
+			dump: "add table ip kube\n",
+			err:  "wrong table/family",
+		},
+		{
+			name: "unsupported object",
+			dump: "add table ip kube-proxy\nadd synproxy ip kube-proxy proxy { mss 1460 ; }\n",
+			err:  "unknown object synproxy",
+		},
+		{
+			name: "unsupported object in list output",
+			dump: "table ip kube-proxy {\n\tsynproxy proxy {\n\t\tmss 1460\n\t}\n}\n",
+			err:  "unknown object synproxy",
+		},
+		{
+			name: "list output for wrong table",
+			dump: "table ip other {\n}\n",
+			err:  "table ip kube-proxy not found",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewFakeFromDump(IPv4Family, "kube-proxy", tc.dump)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestFakeParseDumpRoundTrip(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Chain{
+		Name:     "base",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority),
+	})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Rule{Chain: "base", Rule: "ip saddr @set jump chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	dump := fake.Dump()
+
+	loaded := NewFake(IPv4Family, "kube-proxy")
+	err = loaded.ParseDump(dump)
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	if diff := cmp.Diff(dump, loaded.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after ParseDump:\n%s", diff)
+	}
+
+	// Wrong table name
+	wrongTable := NewFake(IPv4Family, "kube")
+	err = wrongTable.ParseDump(dump)
+	if err == nil || !strings.Contains(err.Error(), "wrong table/family") {
+		t.Errorf("expected wrong table error, got %v", err)
+	}
+
+	// Malformed input
+	malformed := NewFake(IPv4Family, "kube-proxy")
+	err = malformed.ParseDump("add table ip kube-proxy\nadd widget ip kube-proxy foo\n")
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected error at line 2, got %v", err)
+	}
+}
+
+func TestFakeDumpIdempotent(t *testing.T) {
+	fake := NewFake(InetFamily, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{
+		Name:     "filter-input",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority + "-10"),
+		Comment:  PtrTo("input chain"),
+	})
+	tx.Add(&Chain{Name: "firewall"})
+	tx.Add(&Chain{Name: "reject-chain"})
+	tx.Add(&Set{
+		Name:    "allowed",
+		Type:    "ifname . ipv4_addr . inet_service",
+		Comment: PtrTo("allowed interface/destination pairs"),
+	})
+	tx.Add(&Map{
+		Name: "firewall-ips",
+		Type: "ipv4_addr . inet_proto . inet_service : verdict",
+	})
+	tx.Add(&Rule{
+		Chain:   "filter-input",
+		Rule:    `iifname "lo" accept`,
+		Comment: PtrTo("allow loopback"),
+	})
+	tx.Add(&Rule{
+		Chain: "filter-input",
+		Rule:  "ct state new jump firewall",
+	})
+	tx.Add(&Rule{
+		Chain: "firewall",
+		Rule:  "iifname . ip daddr . th dport @allowed accept",
+	})
+	tx.Add(&Rule{
+		Chain:   "firewall",
+		Rule:    "ip daddr . meta l4proto . th dport vmap @firewall-ips",
+		Comment: PtrTo("check firewall : vmap"),
+	})
+	tx.Add(&Rule{
+		Chain: "reject-chain",
+		Rule:  "reject",
+	})
+	// Elements are added in non-sorted order
+	tx.Add(&Element{
+		Set: "allowed",
+		Key: []string{`"eth1"`, "10.0.0.2", "443"},
+	})
+	tx.Add(&Element{
+		Set:     "allowed",
+		Key:     []string{`"eth0"`, "10.0.0.1", "80"},
+		Comment: PtrTo("web { server }"),
+	})
+	tx.Add(&Element{
+		Map:   "firewall-ips",
+		Key:   []string{"10.0.0.2", "tcp", "80"},
+		Value: []string{"drop"},
+	})
+	tx.Add(&Element{
+		Map:     "firewall-ips",
+		Key:     []string{"10.0.0.1", "tcp", "80"},
+		Value:   []string{"goto reject-chain"},
+		Comment: PtrTo("ns1/svc1 : p80"),
+	})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	dump := fake.Dump()
+
+	loaded := NewFake(InetFamily, "kube-proxy")
+	err = loaded.ParseDump(dump)
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	if diff := cmp.Diff(dump, loaded.Dump()); diff != "" {
+		t.Errorf("Dump not idempotent across ParseDump:\n%s", diff)
+	}
+}
+
+func TestFakeDumpJSON(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if _, err := fake.DumpJSON(context.Background()); err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error from empty Fake, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{
+		Name:     "filter-input",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority + "-10"),
+	})
+	tx.Add(&Chain{
+		Name:    "endpoint",
+		Comment: PtrTo("ns1/svc1"),
+	})
+	tx.Add(&Set{
+		Name:    "allowed",
+		Type:    "ifname . ipv4_addr . inet_service",
+		Flags:   []SetFlag{TimeoutFlag},
+		Timeout: PtrTo(time.Minute),
+	})
+	tx.Add(&Map{
+		Name: "map1",
+		Type: "ipv4_addr : verdict",
+	})
+	tx.Add(&Rule{
+		Chain:   "filter-input",
+		Rule:    "ip daddr vmap @map1",
+		Comment: PtrTo("check map1"),
+	})
+	tx.Add(&Rule{
+		Chain: "endpoint",
+		Rule:  "drop",
+	})
+	tx.Add(&Element{
+		Set:     "allowed",
+		Key:     []string{`"eth0"`, "10.0.0.1", "80"},
+		Comment: PtrTo("web"),
+	})
+	tx.Add(&Element{
+		Map:   "map1",
+		Key:   []string{"10.0.0.0/8"},
+		Value: []string{"goto endpoint"},
+	})
+	tx.Add(&Element{
+		Map:   "map1",
+		Key:   []string{"192.168.0.1"},
+		Value: []string{"drop"},
+	})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expected := strings.Join([]string{
+		`{"nftables":[`,
+		`{"metainfo":{"json_schema_version":1}},`,
+		`{"table":{"family":"ip","handle":1,"name":"kube-proxy"}},`,
+		`{"chain":{"comment":"ns1/svc1","family":"ip","handle":3,"name":"endpoint","table":"kube-proxy"}},`,
+		`{"chain":{"family":"ip","handle":2,"hook":"input","name":"filter-input","policy":"accept","prio":-10,"table":"kube-proxy","type":"filter"}},`,
+		`{"set":{"elem":[{"elem":{"comment":"web","val":{"concat":["eth0","10.0.0.1",80]}}}],"family":"ip","flags":["timeout"],"handle":4,"name":"allowed","table":"kube-proxy","timeout":60,"type":["ifname","ipv4_addr","inet_service"]}},`,
+		`{"map":{"elem":[[{"prefix":{"addr":"10.0.0.0","len":8}},{"goto":{"target":"endpoint"}}],["192.168.0.1",{"drop":null}]],"family":"ip","handle":5,"map":"verdict","name":"map1","table":"kube-proxy","type":"ipv4_addr"}},`,
+		`{"rule":{"chain":"endpoint","family":"ip","handle":7,"table":"kube-proxy"}},`,
+		`{"rule":{"chain":"filter-input","comment":"check map1","family":"ip","handle":6,"table":"kube-proxy"}}`,
+		`]}`,
+	}, "")
+	dump, err := fake.DumpJSON(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from DumpJSON: %v", err)
+	}
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected DumpJSON output:\n%s", diff)
+	}
+
+	// The real ListElements should be able to parse the fake's output
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "map", "ip", "kube-proxy", "map1"},
+			stdout: dump,
+		},
+	)
+	elems, err := nft.ListElements(context.Background(), "map", "map1")
+	if err != nil {
+		t.Fatalf("unexpected error parsing DumpJSON output: %v", err)
+	}
+	expectedElems := []*Element{
+		{Map: "map1", Key: []string{"10.0.0.0/8"}, Value: []string{"goto endpoint"}},
+		{Map: "map1", Key: []string{"192.168.0.1"}, Value: []string{"drop"}},
+	}
+	if diff := cmp.Diff(expectedElems, elems); diff != "" {
+		t.Errorf("unexpected ListElements result:\n%s", diff)
+	}
+}
+
+func TestFakeFlowtables(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Flowtable{
+		Name:     "offload",
+		Priority: PtrTo(FilterPriority),
+		Devices:  []string{"eth0", "eth1"},
+	})
+	tx.Add(&Chain{
+		Name:     "forward",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(ForwardHook),
+		Priority: PtrTo(FilterPriority),
+	})
+	tx.Add(&Rule{
+		Chain: "forward",
+		Rule:  "ip protocol tcp flow add @offload",
+	})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	flowtables, err := fake.List(context.Background(), "flowtables")
+	if err != nil {
+		t.Fatalf("unexpected error from List: %v", err)
+	}
+	if diff := cmp.Diff([]string{"offload"}, flowtables); diff != "" {
+		t.Errorf("unexpected List result:\n%s", diff)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy forward { type filter hook forward priority 0 ; }
+		add flowtable ip kube-proxy offload { hook ingress priority 0 ; devices = { eth0, eth1 } ; }
+		add rule ip kube-proxy forward ip protocol tcp flow add @offload
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected Dump result:\n%s", diff)
+	}
+	if diff := cmp.Diff(expected, fake.DumpChain("forward")); diff != "" {
+		t.Errorf("unexpected DumpChain result:\n%s", diff)
+	}
+
+	loaded := NewFake(IPv4Family, "kube-proxy")
+	if err := loaded.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	if diff := cmp.Diff(dump, loaded.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after ParseDump:\n%s", diff)
+	}
+
+	// A duplicate create fails, a duplicate add does not
+	tx = fake.NewTransaction()
+	tx.Create(&Flowtable{Name: "offload", Priority: PtrTo(FilterPriority)})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsAlreadyExists(err) {
+		t.Errorf("expected already-exists error, got %v", err)
+	}
+	tx = fake.NewTransaction()
+	tx.Add(&Flowtable{Name: "offload", Priority: PtrTo(FilterPriority)})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Errorf("unexpected error re-adding flowtable: %v", err)
+	}
+
+	// Delete by handle
+	handle := fake.Table.Flowtables["offload"].Handle
+	tx = fake.NewTransaction()
+	tx.Delete(&Flowtable{Handle: handle})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error deleting flowtable: %v", err)
+	}
+	if fake.Table.Flowtables["offload"] != nil {
+		t.Errorf("flowtable was not deleted")
+	}
+
+	tx = fake.NewTransaction()
+	tx.Delete(&Flowtable{Name: "offload"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+}
+
+func TestFakeCounters(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Counter{
+		Name:    "web",
+		Packets: PtrTo[uint64](10),
+		Bytes:   PtrTo[uint64](1500),
+		Comment: PtrTo("web traffic"),
+	})
+	tx.Add(&Counter{Name: "other"})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{
+		Chain: "chain",
+		Rule:  "tcp dport 80 counter name web accept",
+	})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	counters, err := fake.List(context.Background(), "counters")
+	if err != nil {
+		t.Fatalf("unexpected error from List: %v", err)
+	}
+	sort.Strings(counters)
+	if diff := cmp.Diff([]string{"other", "web"}, counters); diff != "" {
+		t.Errorf("unexpected List result:\n%s", diff)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add counter ip kube-proxy other { packets 0 bytes 0 ; }
+		add counter ip kube-proxy web { packets 10 bytes 1500 ; comment "web traffic" ; }
+		add rule ip kube-proxy chain tcp dport 80 counter name web accept
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected Dump result:\n%s", diff)
+	}
+
+	loaded := NewFake(IPv4Family, "kube-proxy")
+	if err := loaded.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	if diff := cmp.Diff(dump, loaded.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after ParseDump:\n%s", diff)
+	}
+
+	// DumpChain only includes the referenced counter
+	expected = strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add counter ip kube-proxy web { packets 10 bytes 1500 ; comment "web traffic" ; }
+		add rule ip kube-proxy chain tcp dport 80 counter name web accept
+		`), "\n")
+	// DumpChain only includes the referenced objects
+	expectedChain := strings.Replace(expected, "add ct timeout ip kube-proxy udp { protocol udp ; }\n", "", 1)
+	if diff := cmp.Diff(expectedChain, fake.DumpChain("chain")); diff != "" {
+		t.Errorf("unexpected DumpChain result:\n%s", diff)
+	}
+
+	// Reset zeroes the counter without otherwise modifying it
+	oldCounter := fake.Table.Counters["web"]
+	tx = fake.NewTransaction()
+	tx.Reset(&Counter{Name: "web"})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Reset: %v", err)
+	}
+	expectedCounter := &Counter{
+		Name:    "web",
+		Packets: PtrTo[uint64](0),
+		Bytes:   PtrTo[uint64](0),
+		Comment: PtrTo("web traffic"),
+		Handle:  oldCounter.Handle,
+	}
+	if diff := cmp.Diff(expectedCounter, fake.Table.Counters["web"]); diff != "" {
+		t.Errorf("unexpected counter after Reset:\n%s", diff)
+	}
+	if *oldCounter.Packets != 10 {
+		t.Errorf("Reset modified the old counter object")
+	}
+
+	tx = fake.NewTransaction()
+	tx.Reset(&Counter{Name: "nonexistent"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error from Reset, got %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Reset(&Chain{Name: "chain"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !strings.Contains(err.Error(), "not implemented") {
+		t.Errorf("expected not-implemented error from Reset, got %v", err)
+	}
+
+	// Delete by name and by handle
+	tx = fake.NewTransaction()
+	tx.Delete(&Counter{Name: "web"})
+	tx.Delete(&Counter{Handle: fake.Table.Counters["other"].Handle})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Delete: %v", err)
+	}
+	if len(fake.Table.Counters) != 0 {
+		t.Errorf("expected counters to be deleted, got %v", fake.Table.Counters)
+	}
+}
+
+func TestFakeQuotas(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Quota{
+		Name:    "limit",
+		Bytes:   10485760,
+		Over:    true,
+		Used:    PtrTo[uint64](4096),
+		Comment: PtrTo("10 MB"),
+	})
+	tx.Add(&Quota{Name: "other", Bytes: 1000})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{
+		Chain: "chain",
+		Rule:  "ip saddr 10.0.0.1 quota name limit drop",
+	})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	quotas, err := fake.List(context.Background(), "quota")
+	if err != nil {
+		t.Fatalf("unexpected error from List: %v", err)
+	}
+	sort.Strings(quotas)
+	if diff := cmp.Diff([]string{"limit", "other"}, quotas); diff != "" {
+		t.Errorf("unexpected List result:\n%s", diff)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add quota ip kube-proxy limit { over 10485760 bytes used 4096 bytes ; comment "10 MB" ; }
+		add quota ip kube-proxy other { 1000 bytes used 0 bytes ; }
+		add rule ip kube-proxy chain ip saddr 10.0.0.1 quota name limit drop
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected Dump result:\n%s", diff)
+	}
+
+	loaded := NewFake(IPv4Family, "kube-proxy")
+	if err := loaded.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	if diff := cmp.Diff(dump, loaded.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after ParseDump:\n%s", diff)
+	}
+
+	// Reset clears Used but leaves the rest of the quota alone
+	tx = fake.NewTransaction()
+	tx.Reset(&Quota{Name: "limit"})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Reset: %v", err)
+	}
+	quota := fake.Table.Quotas["limit"]
+	if quota.Used == nil || *quota.Used != 0 {
+		t.Errorf("expected Used to be reset to 0, got %v", quota.Used)
+	}
+	if quota.Bytes != 10485760 || !quota.Over {
+		t.Errorf("Reset modified quota limits: %+v", quota)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Delete(&Quota{Handle: fake.Table.Quotas["other"].Handle})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Delete: %v", err)
+	}
+	if fake.Table.Quotas["other"] != nil {
+		t.Errorf("quota was not deleted")
+	}
+
+	tx = fake.NewTransaction()
+	tx.Reset(&Quota{Name: "other"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+}
+
+func TestFakeCTObjects(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&CTTimeout{
+		Name:     "tcp-short",
+		Protocol: "tcp",
+		L3Proto:  PtrTo("ip"),
+		Policy: map[string]time.Duration{
+			"established": 10 * time.Minute,
+			"close":       10 * time.Second,
+		},
+		Comment: PtrTo("short tcp timeouts"),
+	})
+	tx.Add(&CTTimeout{Name: "udp", Protocol: "udp"})
+	tx.Add(&CTExpectation{Name: "sip", Protocol: "tcp", DPort: 5060, Timeout: time.Hour, Size: 12})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{
+		Chain: "chain",
+		Rule:  "tcp dport 8080 ct timeout set tcp-short",
+	})
+	tx.Add(&Rule{
+		Chain: "chain",
+		Rule:  "tcp dport 5060 ct expectation set sip",
+	})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	timeouts, err := fake.List(context.Background(), "ct timeouts")
+	if err != nil {
+		t.Fatalf("unexpected error from List: %v", err)
+	}
+	sort.Strings(timeouts)
+	if diff := cmp.Diff([]string{"tcp-short", "udp"}, timeouts); diff != "" {
+		t.Errorf("unexpected List result:\n%s", diff)
+	}
+	expectations, err := fake.List(context.Background(), "ct expectation")
+	if err != nil {
+		t.Fatalf("unexpected error from List: %v", err)
+	}
+	if diff := cmp.Diff([]string{"sip"}, expectations); diff != "" {
+		t.Errorf("unexpected List result:\n%s", diff)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add ct timeout ip kube-proxy tcp-short { protocol tcp ; l3proto ip ; policy = { close : 10, established : 600 } ; comment "short tcp timeouts" ; }
+		add ct timeout ip kube-proxy udp { protocol udp ; }
+		add ct expectation ip kube-proxy sip { protocol tcp ; dport 5060 ; timeout 3600000ms ; size 12 ; }
+		add rule ip kube-proxy chain tcp dport 8080 ct timeout set tcp-short
+		add rule ip kube-proxy chain tcp dport 5060 ct expectation set sip
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected Dump result:\n%s", diff)
+	}
+	// DumpChain only includes the referenced objects
+	expectedChain := strings.Replace(expected, "add ct timeout ip kube-proxy udp { protocol udp ; }\n", "", 1)
+	if diff := cmp.Diff(expectedChain, fake.DumpChain("chain")); diff != "" {
+		t.Errorf("unexpected DumpChain result:\n%s", diff)
+	}
+
+	loaded := NewFake(IPv4Family, "kube-proxy")
+	if err := loaded.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	if diff := cmp.Diff(dump, loaded.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after ParseDump:\n%s", diff)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Create(&CTTimeout{Name: "udp", Protocol: "udp"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsAlreadyExists(err) {
+		t.Errorf("expected already-exists error, got %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Delete(&CTTimeout{Handle: fake.Table.CTTimeouts["udp"].Handle})
+	tx.Delete(&CTExpectation{Name: "sip"})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Delete: %v", err)
+	}
+	if fake.Table.CTTimeouts["udp"] != nil {
+		t.Errorf("ct timeout was not deleted")
+	}
+	if fake.Table.CTExpectations["sip"] != nil {
+		t.Errorf("ct expectation was not deleted")
+	}
+
+	tx = fake.NewTransaction()
+	tx.Delete(&CTExpectation{Name: "sip"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+}
+
+func TestFakeAutoMerge(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		family    Family
+		set       *Set
+		elements  []string
+		expected  []string
+		noChanges bool
+	}{
+		{
+			name:     "overlapping prefixes",
+			family:   IPv4Family,
+			elements: []string{"10.0.0.0/24", "10.0.0.128/25"},
+			expected: []string{"10.0.0.0/24"},
+		},
+		{
+			name:     "overlapping prefixes, smaller first",
+			family:   IPv4Family,
+			elements: []string{"10.0.0.128/25", "10.0.0.0/24"},
+			expected: []string{"10.0.0.0/24"},
+		},
+		{
+			name:     "adjacent prefixes",
+			family:   IPv4Family,
+			elements: []string{"10.0.0.0/25", "10.0.0.128/25"},
+			expected: []string{"10.0.0.0/24"},
+		},
+		{
+			name:     "overlapping ranges",
+			family:   IPv4Family,
+			elements: []string{"10.0.0.1-10.0.0.5", "10.0.0.3-10.0.0.9", "10.0.0.10"},
+			expected: []string{"10.0.0.1-10.0.0.10"},
+		},
+		{
+			name:     "non-overlapping",
+			family:   IPv4Family,
+			elements: []string{"10.0.1.0/24", "10.0.0.1", "10.0.0.3"},
+			expected: []string{"10.0.0.1", "10.0.0.3", "10.0.1.0/24"},
+		},
+		{
+			name:     "IPv6",
+			family:   IPv6Family,
+			elements: []string{"fd00::/64", "fd00::1", "fd00:0:0:1::/64"},
+			expected: []string{"fd00::/63"},
+		},
+		{
+			name:      "no auto-merge",
+			family:    IPv4Family,
+			set:       &Set{Name: "ips", Type: "ipv4_addr", Flags: []SetFlag{IntervalFlag}},
+			elements:  []string{"10.0.0.0/25", "10.0.0.128/25"},
+			noChanges: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			set := tc.set
+			if set == nil {
+				set = &Set{
+					Name:      "ips",
+					Type:      "ipv4_addr",
+					Flags:     []SetFlag{IntervalFlag},
+					AutoMerge: PtrTo(true),
+				}
+				if tc.family == IPv6Family {
+					set.Type = "ipv6_addr"
+				}
+			}
+			if tc.noChanges {
+				tc.expected = tc.elements
+			}
+
+			fake := NewFake(tc.family, "kube-proxy")
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(set)
+			err := fake.Run(context.Background(), tx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Add the elements one at a time to make sure merging works
+			// against elements from earlier transactions.
+			for _, key := range tc.elements {
+				tx = fake.NewTransaction()
+				tx.Add(&Element{Set: "ips", Key: []string{key}})
+				err := fake.Run(context.Background(), tx)
+				if err != nil {
+					t.Fatalf("unexpected error adding %q: %v", key, err)
+				}
+			}
+
+			elements, err := fake.ListElements(context.Background(), "set", "ips")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var keys []string
+			for _, element := range elements {
+				keys = append(keys, element.Key[0])
+			}
+			if diff := cmp.Diff(tc.expected, keys); diff != "" {
+				t.Errorf("unexpected elements:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFakeIntervalOverlap(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		flags    []SetFlag
+		existing []string
+		element  string
+		err      bool
+	}{
+		{
+			name:     "disjoint prefixes",
+			flags:    []SetFlag{IntervalFlag},
+			existing: []string{"10.0.0.0/24", "10.0.2.0/24"},
+			element:  "10.0.1.0/24",
+		},
+		{
+			name:     "adjacent ranges",
+			flags:    []SetFlag{IntervalFlag},
+			existing: []string{"10.0.0.1-10.0.0.5"},
+			element:  "10.0.0.6-10.0.0.9",
+		},
+		{
+			name:     "re-adding existing element",
+			flags:    []SetFlag{IntervalFlag},
+			existing: []string{"10.0.0.0/24"},
+			element:  "10.0.0.0/24",
+		},
+		{
+			name:     "overlapping prefix",
+			flags:    []SetFlag{IntervalFlag},
+			existing: []string{"10.0.0.0/24"},
+			element:  "10.0.0.128/25",
+			err:      true,
+		},
+		{
+			name:     "address in existing range",
+			flags:    []SetFlag{IntervalFlag},
+			existing: []string{"10.0.0.1-10.0.0.5"},
+			element:  "10.0.0.3",
+			err:      true,
+		},
+		{
+			name:     "range containing existing address",
+			flags:    []SetFlag{IntervalFlag},
+			existing: []string{"10.0.0.3"},
+			element:  "10.0.0.1-10.0.0.5",
+			err:      true,
+		},
+		{
+			name:     "overlap in non-interval set",
+			existing: []string{"10.0.0.1"},
+			element:  "10.0.0.1/32",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFake(IPv4Family, "kube-proxy")
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(&Set{Name: "ips", Type: "ipv4_addr", Flags: tc.flags})
+			for _, key := range tc.existing {
+				tx.Add(&Element{Set: "ips", Key: []string{key}})
+			}
+			if err := fake.Run(context.Background(), tx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			tx = fake.NewTransaction()
+			tx.Add(&Element{Set: "ips", Key: []string{tc.element}})
+			err := fake.Run(context.Background(), tx)
+			if tc.err {
+				if err == nil || !strings.Contains(err.Error(), "interval overlaps with an existing one") {
+					t.Errorf("expected overlap error, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFakeElementCounters(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "ips", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "ports", Type: "inet_service : verdict"})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.1"}, Counter: &ElementCounter{Packets: 3, Bytes: 180}})
+	tx.Add(&Element{Set: "ips", Key: []string{"10.0.0.2"}})
+	tx.Add(&Element{Map: "ports", Key: []string{"80"}, Value: []string{"accept"}, Counter: &ElementCounter{Packets: 10, Bytes: 1500}})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	elements, err := fake.ListElements(context.Background(), "set", "ips")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	expected := []*Element{
+		{Set: "ips", Key: []string{"10.0.0.1"}, Counter: &ElementCounter{Packets: 3, Bytes: 180}},
+		{Set: "ips", Key: []string{"10.0.0.2"}},
+	}
+	if diff := cmp.Diff(expected, elements); diff != "" {
+		t.Errorf("unexpected ListElements result:\n%s", diff)
+	}
+
+	dump := fake.Dump()
+	expectedDump := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add set ip kube-proxy ips { type ipv4_addr ; }
+		add map ip kube-proxy ports { type inet_service : verdict ; }
+		add element ip kube-proxy ips { 10.0.0.1 counter packets 3 bytes 180 }
+		add element ip kube-proxy ips { 10.0.0.2 }
+		add element ip kube-proxy ports { 80 counter packets 10 bytes 1500 : accept }
+		`), "\n")
+	if diff := cmp.Diff(expectedDump, dump); diff != "" {
+		t.Errorf("unexpected Dump result:\n%s", diff)
+	}
+	loaded := NewFake(IPv4Family, "kube-proxy")
+	if err := loaded.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	if diff := cmp.Diff(dump, loaded.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after ParseDump:\n%s", diff)
+	}
+
+	// Resetting zeroes the counters (and leaves elements without counters alone)
+	tx = fake.NewTransaction()
+	tx.Reset(&Element{Set: "ips", Key: []string{"10.0.0.1"}})
+	tx.Reset(&Element{Set: "ips", Key: []string{"10.0.0.2"}})
+	tx.Reset(&Element{Map: "ports", Key: []string{"80"}})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Reset: %v", err)
+	}
+	if elem := fake.Table.Sets["ips"].FindElement("10.0.0.1"); elem == nil || !reflect.DeepEqual(elem.Counter, &ElementCounter{}) {
+		t.Errorf("expected counter to be reset, got %+v", elem)
+	}
+	if elem := fake.Table.Sets["ips"].FindElement("10.0.0.2"); elem == nil || elem.Counter != nil {
+		t.Errorf("expected element to have no counter, got %+v", elem)
+	}
+	if elem := fake.Table.Maps["ports"].FindElement("80"); elem == nil || !reflect.DeepEqual(elem.Counter, &ElementCounter{}) || elem.Value[0] != "accept" {
+		t.Errorf("expected counter to be reset, got %+v", elem)
+	}
+	// The previously-listed elements are unaffected
+	if elements[0].Counter.Bytes != 180 {
+		t.Errorf("reset modified a ListElements result")
+	}
+
+	tx = fake.NewTransaction()
+	tx.Reset(&Element{Set: "ips", Key: []string{"10.0.0.3"}})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+}
+
+func TestFakeResetSetsAndMaps(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	err := fake.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy
+		add set ip kube-proxy ips { type ipv4_addr ; flags timeout ; timeout 3600s ; }
+		add map ip kube-proxy ports { type inet_service : verdict ; }
+		add element ip kube-proxy ips { 10.0.0.1 counter packets 3 bytes 180 }
+		add element ip kube-proxy ips { 10.0.0.2 comment "no counter" }
+		add element ip kube-proxy ports { 80 counter packets 10 bytes 1500 : accept }
+		`))
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	fake.Tick(time.Minute)
+
+	tx := fake.NewTransaction()
+	tx.Reset(&Set{Name: "ips"})
+	tx.Reset(&Map{Name: "ports"})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Reset: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add set ip kube-proxy ips { type ipv4_addr ; flags timeout ; timeout 3600s ; }
+		add map ip kube-proxy ports { type inet_service : verdict ; }
+		add element ip kube-proxy ips { 10.0.0.1 counter packets 0 bytes 0 }
+		add element ip kube-proxy ips { 10.0.0.2 comment "no counter" }
+		add element ip kube-proxy ports { 80 counter packets 0 bytes 0 : accept }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after Reset:\n%s", diff)
+	}
+
+	// Resetting doesn't affect the elements' timeouts
+	elements, err := fake.ListElements(context.Background(), "set", "ips")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	for _, elem := range elements {
+		if elem.Expires == nil || *elem.Expires != 59*time.Minute {
+			t.Errorf("unexpected Expires for %s: %v", elem.Key[0], elem.Expires)
+		}
+	}
+
+	tx = fake.NewTransaction()
+	tx.Reset(&Set{Name: "nonexistent"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+}
+
+func TestFakeRenameChain(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	err := fake.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy services
+		add chain ip kube-proxy svc-old
+		add chain ip kube-proxy other
+		add map ip kube-proxy service-ips { type ipv4_addr : verdict ; }
+		add rule ip kube-proxy services ip daddr vmap @service-ips
+		add rule ip kube-proxy services ip daddr 10.0.0.2 goto svc-old
+		add rule ip kube-proxy services tcp dport vmap { 80 : jump svc-old, 443 : jump svc-old, 8080 : jump other }
+		add rule ip kube-proxy svc-old ip saddr 10.0.0.0/8 jump other
+		add rule ip kube-proxy svc-old drop
+		add element ip kube-proxy service-ips { 10.0.0.1 : goto svc-old }
+		`))
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	oldHandle := *fake.Table.Chains["svc-old"].Handle
+
+	tx := fake.NewTransaction()
+	tx.Rename(&Chain{Name: "svc-old"}, "svc-new")
+	if diff := cmp.Diff("rename chain ip kube-proxy svc-old svc-new\n", tx.String()); diff != "" {
+		t.Errorf("unexpected transaction content:\n%s", diff)
+	}
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Rename: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy other
+		add chain ip kube-proxy services
+		add chain ip kube-proxy svc-new
+		add map ip kube-proxy service-ips { type ipv4_addr : verdict ; }
+		add rule ip kube-proxy services ip daddr vmap @service-ips
+		add rule ip kube-proxy services ip daddr 10.0.0.2 goto svc-new
+		add rule ip kube-proxy services tcp dport vmap { 80 : jump svc-new, 443 : jump svc-new, 8080 : jump other }
+		add rule ip kube-proxy svc-new ip saddr 10.0.0.0/8 jump other
+		add rule ip kube-proxy svc-new drop
+		add element ip kube-proxy service-ips { 10.0.0.1 : goto svc-new }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after Rename:\n%s", diff)
+	}
+	chain := fake.Table.Chains["svc-new"]
+	if chain == nil || *chain.Handle != oldHandle {
+		t.Errorf("expected renamed chain to keep handle %d, got %+v", oldHandle, chain)
+	}
+	for _, rule := range chain.Rules {
+		if rule.Chain != "svc-new" {
+			t.Errorf("expected rule to be in chain svc-new, got %q", rule.Chain)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		oldName string
+		newName string
+		check   func(error) bool
+	}{
+		{
+			name:    "old chain doesn't exist",
+			oldName: "svc-old",
+			newName: "svc-other",
+			check:   IsNotFound,
+		},
+		{
+			name:    "new chain already exists",
+			oldName: "svc-new",
+			newName: "other",
+			check:   IsAlreadyExists,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := fake.NewTransaction()
+			tx.Rename(&Chain{Name: tc.oldName}, tc.newName)
+			err := fake.Run(context.Background(), tx)
+			if err == nil || !tc.check(err) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+				t.Errorf("failed Rename modified the table:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFakeValidateNames(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		table string
+		obj   Object
+		err   string
+	}{
+		{
+			name: "valid names",
+			obj:  &Chain{Name: "service-ULMVA6XW-ns1/svc1/tcp/p80"},
+		},
+		{
+			name: "valid set name",
+			obj:  &Set{Name: "_cluster.ips", Type: "ipv4_addr"},
+		},
+		{
+			name: "maximum-length name",
+			obj:  &Map{Name: strings.Repeat("m", 255), Type: "ipv4_addr : verdict"},
+		},
+		{
+			name: "over-long name",
+			obj:  &Chain{Name: strings.Repeat("c", 256)},
+			err:  "is too long",
+		},
+		{
+			name: "illegal character",
+			obj:  &Set{Name: "my set", Type: "ipv4_addr"},
+			err:  "contains invalid characters",
+		},
+		{
+			name: "illegal first character",
+			obj:  &Counter{Name: "1st-counter"},
+			err:  "contains invalid characters",
+		},
+		{
+			name:  "illegal table name",
+			table: "kube;proxy",
+			obj:   &Chain{Name: "chain"},
+			err:   `table name "kube;proxy" contains invalid characters`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			table := tc.table
+			if table == "" {
+				table = "kube-proxy"
+			}
+			fake := NewFake(IPv4Family, table)
+			fake.ValidateNames = true
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(tc.obj)
+			err := fake.Run(context.Background(), tx)
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+
+			// Without ValidateNames, everything is accepted
+			fake = NewFake(IPv4Family, table)
+			tx = fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(tc.obj)
+			if err := fake.Run(context.Background(), tx); err != nil {
+				t.Errorf("unexpected error without ValidateNames: %v", err)
+			}
+		})
+	}
+
+	// Renaming a chain checks the new name
+	fake := NewFake(IPv4Family, "kube-proxy")
+	fake.ValidateNames = true
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Rename(&Chain{Name: "chain"}, "bad name")
+	err := fake.Run(context.Background(), tx)
+	if err == nil || !strings.Contains(err.Error(), "contains invalid characters") {
+		t.Errorf("expected invalid-name error from Rename, got %v", err)
+	}
+}
+
+func TestFakeListTables(t *testing.T) {
+	fake := NewFake(IPv6Family, "kube-proxy")
+
+	tables, err := fake.List(context.Background(), "tables")
+	if err != nil {
+		t.Fatalf("unexpected error from List: %v", err)
+	}
+	if len(tables) != 0 {
+		t.Errorf("expected no tables, got %v", tables)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	tables, err = fake.List(context.Background(), "table")
+	if err != nil {
+		t.Fatalf("unexpected error from List: %v", err)
+	}
+	if diff := cmp.Diff([]string{"ip6 kube-proxy"}, tables); diff != "" {
+		t.Errorf("unexpected List result:\n%s", diff)
+	}
+}
+
+func TestFakeListFull(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if _, err := fake.ListChainsFull(context.Background()); err == nil || !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{
+		Name:     "nat-prerouting",
+		Type:     PtrTo(NATType),
+		Hook:     PtrTo(PreroutingHook),
+		Priority: PtrTo(DNATPriority),
+	})
+	tx.Add(&Chain{Name: "services", Comment: PtrTo("services")})
+	tx.Add(&Set{
+		Name:    "ips",
+		Type:    "ipv4_addr",
+		Flags:   []SetFlag{IntervalFlag},
+		Comment: PtrTo("some IPs"),
+	})
+	tx.Add(&Map{
+		Name:    "vmap",
+		TypeOf:  "ip daddr : verdict",
+		Timeout: PtrTo(time.Minute),
+	})
+	err := fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	chains, err := fake.ListChainsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListChainsFull: %v", err)
+	}
+	expectedChains := []*Chain{
+		{
+			Name:     "nat-prerouting",
+			Type:     PtrTo(NATType),
+			Hook:     PtrTo(PreroutingHook),
+			Priority: PtrTo(DNATPriority),
+			Handle:   PtrTo(2),
+		},
+		{
+			Name:    "services",
+			Comment: PtrTo("services"),
+			Handle:  PtrTo(3),
+		},
+	}
+	if diff := cmp.Diff(expectedChains, chains); diff != "" {
+		t.Errorf("unexpected chains:\n%s", diff)
+	}
+
+	sets, err := fake.ListSetsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListSetsFull: %v", err)
+	}
+	expectedSets := []*Set{{
+		Name:    "ips",
+		Type:    "ipv4_addr",
+		Flags:   []SetFlag{IntervalFlag},
+		Comment: PtrTo("some IPs"),
+		Handle:  PtrTo(4),
+	}}
+	if diff := cmp.Diff(expectedSets, sets); diff != "" {
+		t.Errorf("unexpected sets:\n%s", diff)
+	}
+
+	maps, err := fake.ListMapsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error from ListMapsFull: %v", err)
+	}
+	expectedMaps := []*Map{{
+		Name:    "vmap",
+		TypeOf:  "ip daddr : verdict",
+		Timeout: PtrTo(time.Minute),
+		Handle:  PtrTo(5),
+	}}
+	if diff := cmp.Diff(expectedMaps, maps); diff != "" {
+		t.Errorf("unexpected maps:\n%s", diff)
+	}
+
+	// The results are copies
+	*sets[0].Comment = "modified"
+	sets[0].Flags[0] = TimeoutFlag
+	if *fake.Table.Sets["ips"].Comment != "some IPs" || fake.Table.Sets["ips"].Flags[0] != IntervalFlag {
+		t.Errorf("modifying ListSetsFull result modified the Fake")
+	}
+}
+
+func TestFakeGet(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if _, err := fake.GetChain(context.Background(), "chain"); !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain", Comment: PtrTo("a chain")})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr", Flags: []SetFlag{IntervalFlag}})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	chain, err := fake.GetChain(context.Background(), "chain")
+	if err != nil {
+		t.Fatalf("unexpected error from GetChain: %v", err)
+	}
+	if diff := cmp.Diff(&Chain{Name: "chain", Comment: PtrTo("a chain"), Handle: PtrTo(2)}, chain); diff != "" {
+		t.Errorf("unexpected chain:\n%s", diff)
+	}
+
+	set, err := fake.GetSet(context.Background(), "set")
+	if err != nil {
+		t.Fatalf("unexpected error from GetSet: %v", err)
+	}
+	if diff := cmp.Diff(&Set{Name: "set", Type: "ipv4_addr", Flags: []SetFlag{IntervalFlag}, Handle: PtrTo(3)}, set); diff != "" {
+		t.Errorf("unexpected set:\n%s", diff)
+	}
+
+	mapObj, err := fake.GetMap(context.Background(), "map")
+	if err != nil {
+		t.Fatalf("unexpected error from GetMap: %v", err)
+	}
+	if diff := cmp.Diff(&Map{Name: "map", Type: "ipv4_addr : verdict", Handle: PtrTo(4)}, mapObj); diff != "" {
+		t.Errorf("unexpected map:\n%s", diff)
+	}
+
+	// The results are copies
+	set.Flags[0] = TimeoutFlag
+	if fake.Table.Sets["set"].Flags[0] != IntervalFlag {
+		t.Errorf("modifying GetSet result modified the Fake")
+	}
+
+	if _, err := fake.GetSet(context.Background(), "map"); !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+	if _, err := fake.GetMap(context.Background(), "set"); !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+}
+
+func TestFakeInjectError(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+
+	// A one-shot error fails only the next Run, without applying anything
+	transient := fmt.Errorf("transient failure")
+	fake.FailNextRun = transient
+	err := fake.Run(context.Background(), tx)
+	if err != transient {
+		t.Errorf("expected injected error, got %v", err)
+	}
+	if fake.Table != nil {
+		t.Errorf("expected failed transaction to not be applied")
+	}
+	if fake.FailNextRun != nil {
+		t.Errorf("expected FailNextRun to be cleared")
+	}
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error on retry: %v", err)
+	}
+	if fake.Table == nil || fake.Table.Chains["chain"] == nil {
+		t.Errorf("expected retried transaction to be applied")
+	}
+	// No handles were consumed by the failed Run
+	if *fake.Table.Handle != 1 {
+		t.Errorf("expected table handle 1, got %d", *fake.Table.Handle)
+	}
+
+	// InjectError is consulted on every Run
+	calls := 0
+	fake.InjectError = func(tx *Transaction) error {
+		calls++
+		if tx.NumOperations() > 1 {
+			return fmt.Errorf("transaction too large")
+		}
+		return nil
+	}
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{Name: "chain2"})
+	tx.Add(&Chain{Name: "chain3"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || err.Error() != "transaction too large" {
+		t.Errorf("expected injected error, got %v", err)
+	}
+	if fake.Table.Chains["chain2"] != nil {
+		t.Errorf("expected failed transaction to not be applied")
+	}
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{Name: "chain2"})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected InjectError to be called twice, got %d", calls)
+	}
+}
+
+func TestFakeFlushTable(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{Comment: PtrTo("rules for kube-proxy")})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	handle := *fake.Table.Handle
+
+	// Flushing the table removes its contents but keeps the table itself, with
+	// its original handle and comment.
+	tx = fake.NewTransaction()
+	tx.Flush(&Table{})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if fake.Table == nil {
+		t.Fatalf("flush deleted the table")
+	}
+	if fake.Table.Handle == nil || *fake.Table.Handle != handle {
+		t.Errorf("expected table handle %d after flush, got %v", handle, fake.Table.Handle)
+	}
+	if fake.Table.Comment == nil || *fake.Table.Comment != "rules for kube-proxy" {
+		t.Errorf("expected table comment to be kept after flush, got %v", fake.Table.Comment)
+	}
+	if len(fake.Table.Chains) != 0 {
+		t.Errorf("expected no chains after flush, got %v", fake.Table.Chains)
+	}
+}
+
+func TestFakeFlushAndRebuild(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	err := fake.ParseDump(dedent.Dedent(`
+		add table ip kube-proxy { comment "rules for kube-proxy" ; }
+		add chain ip kube-proxy services
+		add chain ip kube-proxy svc1
+		add map ip kube-proxy service-ips { type ipv4_addr : verdict ; }
+		add set ip kube-proxy affinity { type ipv4_addr ; flags timeout ; timeout 3600s ; }
+		add counter ip kube-proxy dropped
+		add rule ip kube-proxy services ip daddr vmap @service-ips
+		add rule ip kube-proxy svc1 counter name dropped drop
+		add element ip kube-proxy service-ips { 10.0.0.1 : goto svc1 }
+		add element ip kube-proxy affinity { 10.0.0.2 }
+		`))
+	if err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	fake.Tick(time.Minute)
+	original := fake.Dump()
+	originalTable := fake.Table
+
+	// A flush-and-rebuild transaction that fails partway through must leave the
+	// original table completely intact.
+	tx := fake.NewTransaction()
+	tx.Add(&Table{Comment: PtrTo("rules for kube-proxy")})
+	tx.Flush(&Table{})
+	tx.Add(&Chain{Name: "services"})
+	tx.Add(&Chain{Name: "svc2"})
+	tx.Add(&Map{Name: "service-ips", Type: "ipv4_addr : verdict"})
+	tx.Add(&Rule{Chain: "services", Rule: "ip daddr vmap @service-ips"})
+	tx.Add(&Element{Map: "service-ips", Key: []string{"10.0.0.2"}, Value: []string{"goto svc2"}})
+	tx.Add(&Rule{Chain: "svc2", Rule: "jump nonexistent"})
+	err = fake.Run(context.Background(), tx)
+	if err == nil || !IsNotFound(err) {
+		t.Fatalf("expected not-found error, got %v", err)
+	}
+	if fake.Table != originalTable {
+		t.Errorf("failed transaction replaced fake.Table")
+	}
+	if diff := cmp.Diff(original, fake.Dump()); diff != "" {
+		t.Errorf("failed transaction modified the table:\n%s", diff)
+	}
+	elements, err := fake.ListElements(context.Background(), "set", "affinity")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	if len(elements) != 1 || elements[0].Expires == nil || *elements[0].Expires != 59*time.Minute {
+		t.Errorf("failed transaction modified element expiration: %+v", elements)
+	}
+
+	// The same transaction, fixed, replaces the table contents entirely.
+	tx = fake.NewTransaction()
+	tx.Add(&Table{Comment: PtrTo("rules for kube-proxy")})
+	tx.Flush(&Table{})
+	tx.Add(&Chain{Name: "services"})
+	tx.Add(&Chain{Name: "svc2"})
+	tx.Add(&Map{Name: "service-ips", Type: "ipv4_addr : verdict"})
+	tx.Add(&Rule{Chain: "services", Rule: "ip daddr vmap @service-ips"})
+	tx.Add(&Element{Map: "service-ips", Key: []string{"10.0.0.2"}, Value: []string{"goto svc2"}})
+	tx.Add(&Rule{Chain: "svc2", Rule: "drop"})
+	err = fake.Run(context.Background(), tx)
+	if err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy { comment "rules for kube-proxy" ; }
+		add chain ip kube-proxy services
+		add chain ip kube-proxy svc2
+		add map ip kube-proxy service-ips { type ipv4_addr : verdict ; }
+		add rule ip kube-proxy services ip daddr vmap @service-ips
+		add rule ip kube-proxy svc2 drop
+		add element ip kube-proxy service-ips { 10.0.0.2 : goto svc2 }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after rebuild:\n%s", diff)
+	}
+}
+
+func TestFakeAppliedTransactions(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if fake.LastTransaction() != nil {
+		t.Errorf("expected no transactions")
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	// Failed and Check()ed transactions aren't recorded
+	tx = fake.NewTransaction()
+	tx.Delete(&Chain{Name: "nonexistent"})
+	if err := fake.Run(context.Background(), tx); err == nil {
+		t.Fatalf("expected error from Run")
+	}
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{Name: "checked"})
+	if err := fake.Check(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Check: %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	tx.Delete(&Chain{Name: "chain"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	// Modifying tx after running it doesn't affect the recorded copy
+	tx.Add(&Chain{Name: "later"})
+
+	applied := fake.AppliedTransactions()
+	if len(applied) != 2 {
+		t.Fatalf("expected 2 applied transactions, got %d", len(applied))
+	}
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		`), "\n")
+	if diff := cmp.Diff(expected, applied[0].String()); diff != "" {
+		t.Errorf("unexpected first transaction:\n%s", diff)
+	}
+	expected = strings.TrimPrefix(dedent.Dedent(`
+		add rule ip kube-proxy chain drop
+		delete chain ip kube-proxy chain
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.LastTransaction().String()); diff != "" {
+		t.Errorf("unexpected last transaction:\n%s", diff)
+	}
+
+	// Modifying the returned transactions doesn't affect fake's record either
+	fake.LastTransaction().Add(&Chain{Name: "modified"})
+	applied[1].Add(&Chain{Name: "modified"})
+	applied[0] = nil
+	if diff := cmp.Diff(expected, fake.LastTransaction().String()); diff != "" {
+		t.Errorf("unexpected last transaction after modifying returned copies:\n%s", diff)
+	}
+	if applied := fake.AppliedTransactions(); len(applied) != 2 || applied[0] == nil {
+		t.Errorf("unexpected applied transactions after modifying returned copies: %v", applied)
+	}
+}
+
+func TestFakeValidateFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		obj  Object
+		err  string
+	}{
+		{
+			name: "timeout and dynamic",
+			obj:  &Set{Name: "set", Type: "ipv4_addr", Flags: []SetFlag{TimeoutFlag, DynamicFlag}},
+		},
+		{
+			name: "interval with address type",
+			obj:  &Set{Name: "set", Type: "ipv4_addr . inet_service", Flags: []SetFlag{IntervalFlag}},
+		},
+		{
+			name: "interval with unknown typeof",
+			obj:  &Map{Name: "map", TypeOf: "ip saddr : verdict", Flags: []SetFlag{IntervalFlag}},
+		},
+		{
+			name: "dynamic and constant",
+			obj:  &Set{Name: "set", Type: "ipv4_addr", Flags: []SetFlag{DynamicFlag, ConstantFlag}},
+			err:  `set "set": flags "constant" and "dynamic" are incompatible`,
+		},
+		{
+			name: "constant with timeout",
+			obj:  &Map{Name: "map", Type: "ipv4_addr : verdict", Flags: []SetFlag{ConstantFlag}, Timeout: PtrTo(time.Minute)},
+			err:  `map "map": flag "constant" is incompatible with Timeout`,
+		},
+		{
+			name: "interval with non-interval type",
+			obj:  &Map{Name: "map", Type: "ipv4_addr . verdict : verdict", Flags: []SetFlag{IntervalFlag}},
+			err:  `flag "interval" cannot be used with datatype "verdict"`,
+		},
+		{
+			name: "unknown flag",
+			obj:  &Set{Name: "set", Type: "ipv4_addr", Flags: []SetFlag{"bogus"}},
+			err:  `unknown flag "bogus"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFake(IPv4Family, "kube-proxy")
+			fake.ValidateFlags = true
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(tc.obj)
+			err := fake.Run(context.Background(), tx)
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+
+			// Without ValidateFlags, everything is accepted
+			fake = NewFake(IPv4Family, "kube-proxy")
+			tx = fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(tc.obj)
+			if err := fake.Run(context.Background(), tx); err != nil {
+				t.Errorf("unexpected error without ValidateFlags: %v", err)
+			}
+		})
+	}
+}
+
+func TestFakeValidateChains(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		family Family
+		chain  *Chain
+		err    string
+	}{
+		{
+			name:   "regular chain",
+			family: IPv4Family,
+			chain:  &Chain{Name: "chain"},
+		},
+		{
+			name:   "valid filter chain",
+			family: IPv4Family,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(ForwardHook), Priority: PtrTo(FilterPriority)},
+		},
+		{
+			name:   "valid nat chain",
+			family: IPv6Family,
+			chain:  &Chain{Name: "chain", Type: PtrTo(NATType), Hook: PtrTo(PostroutingHook), Priority: PtrTo(SNATPriority)},
+		},
+		{
+			name:   "nat chain on forward hook",
+			family: IPv4Family,
+			chain:  &Chain{Name: "chain", Type: PtrTo(NATType), Hook: PtrTo(ForwardHook), Priority: PtrTo(FilterPriority)},
+			err:    `invalid Hook "forward"`,
+		},
+		{
+			name:   "route chain on input hook",
+			family: InetFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(RouteType), Hook: PtrTo(InputHook), Priority: PtrTo(ManglePriority)},
+			err:    `invalid Hook "input"`,
+		},
+		{
+			name:   "nat chain in bridge family",
+			family: BridgeFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(NATType), Hook: PtrTo(PreroutingHook), Priority: PtrTo(DNATPriority)},
+			err:    `invalid Type "nat"`,
+		},
+		{
+			name:   "bad priority",
+			family: IPv4Family,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(BaseChainPriority("bogus"))},
+			err:    "invalid Priority",
+		},
+		{
+			name:   "dstnat priority with offset",
+			family: InetFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(NATType), Hook: PtrTo(OutputHook), Priority: PtrTo(OffsetPriority(DNATPriority, 10))},
+		},
+		{
+			name:   "numeric priority",
+			family: IPv4Family,
+			chain:  &Chain{Name: "chain", Type: PtrTo(NATType), Hook: PtrTo(PostroutingHook), Priority: PtrTo(NumericPriority(110))},
+		},
+		{
+			name:   "dstnat priority on postrouting hook",
+			family: IPv4Family,
+			chain:  &Chain{Name: "chain", Type: PtrTo(NATType), Hook: PtrTo(PostroutingHook), Priority: PtrTo(DNATPriority)},
+			err:    `priority "dstnat" cannot be used with "postrouting" hook`,
+		},
+		{
+			name:   "srcnat priority with offset on prerouting hook",
+			family: IPv6Family,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(PreroutingHook), Priority: PtrTo(BaseChainPriority("srcnat - 5"))},
+			err:    `priority "srcnat" cannot be used with "prerouting" hook`,
+		},
+		{
+			name:   "out priority in bridge family",
+			family: BridgeFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(OutputHook), Priority: PtrTo(OutPriority)},
+		},
+		{
+			name:   "out priority on wrong hook in bridge family",
+			family: BridgeFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(OutPriority)},
+			err:    `priority "out" cannot be used with "input" hook`,
+		},
+		{
+			name:   "out priority outside bridge family",
+			family: InetFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(OutputHook), Priority: PtrTo(OutPriority)},
+			err:    `unknown priority "out"`,
+		},
+		{
+			name:   "raw priority in netdev family",
+			family: NetDevFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Priority: PtrTo(RawPriority), Device: PtrTo("eth0")},
+			err:    `priority "raw" cannot be used in family "netdev"`,
+		},
+		{
+			name:   "valid netdev chain",
+			family: NetDevFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Priority: PtrTo(FilterPriority), Device: PtrTo("eth0")},
+		},
+		{
+			name:   "valid netdev chain with multiple devices",
+			family: NetDevFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Priority: PtrTo(FilterPriority), Devices: []string{"eth0", "eth1"}},
+		},
+		{
+			name:   "ingress chain without device",
+			family: InetFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Priority: PtrTo(FilterPriority)},
+			err:    "Device or Devices must be specified",
+		},
+		{
+			name:   "input chain with device",
+			family: InetFamily,
+			chain:  &Chain{Name: "chain", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(FilterPriority), Device: PtrTo("eth0")},
+			err:    "Device and Devices must not be specified",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFake(tc.family, "kube-proxy")
+			fake.ValidateChains = true
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(tc.chain)
+			err := fake.Run(context.Background(), tx)
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+
+			// Without ValidateChains, everything is accepted
+			fake = NewFake(tc.family, "kube-proxy")
+			tx = fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(tc.chain)
+			if err := fake.Run(context.Background(), tx); err != nil {
+				t.Errorf("unexpected error without ValidateChains: %v", err)
+			}
+		})
+	}
+}
+
+func TestFakeNetdevChainDevices(t *testing.T) {
+	fake := NewFake(NetDevFamily, "kube-proxy")
+
+	// netdev ingress/egress chains must name a device even without ValidateChains
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "ingress", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Priority: PtrTo(FilterPriority)})
+	err := fake.Run(context.Background(), tx)
+	if err == nil || !strings.Contains(err.Error(), "Device or Devices must be specified") {
+		t.Fatalf("expected error about missing device, got %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "ingress", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Priority: PtrTo(FilterPriority), Device: PtrTo("eth0")})
+	tx.Add(&Chain{Name: "egress", Type: PtrTo(FilterType), Hook: PtrTo(EgressHook), Priority: PtrTo(FilterPriority), Devices: []string{"eth0", "eth1"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table netdev kube-proxy
+		add chain netdev kube-proxy egress { type filter hook egress devices = { eth0, eth1 } priority 0 ; }
+		add chain netdev kube-proxy ingress { type filter hook ingress device "eth0" priority 0 ; }
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected Dump content:\n%s", diff)
+	}
+
+	reparsed := NewFake(NetDevFamily, "kube-proxy")
+	if err := reparsed.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error parsing dump: %v", err)
+	}
+	if diff := cmp.Diff(dump, reparsed.Dump()); diff != "" {
+		t.Errorf("unexpected difference after round trip:\n%s", diff)
+	}
+	if chain := reparsed.Table.Chains["egress"]; chain == nil || !reflect.DeepEqual(chain.Devices, []string{"eth0", "eth1"}) {
+		t.Errorf("expected egress chain to have 2 devices, got %+v", chain)
+	}
+}
+
+func TestFakeWildcardDevices(t *testing.T) {
+	fake := NewFake(NetDevFamily, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "ingress", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Priority: PtrTo(FilterPriority), Devices: []string{"eth*", "eth1"}})
+	tx.Add(&Flowtable{Name: "ft", Priority: PtrTo(FilterPriority), Devices: []string{"veth*"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table netdev kube-proxy
+		add chain netdev kube-proxy ingress { type filter hook ingress devices = { "eth*", eth1 } priority 0 ; }
+		add flowtable netdev kube-proxy ft { hook ingress priority 0 ; devices = { "veth*" } ; }
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected Dump content:\n%s", diff)
+	}
+
+	reparsed, err := NewFakeFromDump(NetDevFamily, "kube-proxy", dump)
+	if err != nil {
+		t.Fatalf("unexpected error parsing dump: %v", err)
+	}
+	if diff := cmp.Diff([]string{"eth*", "eth1"}, reparsed.Table.Chains["ingress"].Devices); diff != "" {
+		t.Errorf("unexpected chain devices after round trip:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"veth*"}, reparsed.Table.Flowtables["ft"].Devices); diff != "" {
+		t.Errorf("unexpected flowtable devices after round trip:\n%s", diff)
+	}
+	if diff := cmp.Diff(dump, reparsed.Dump()); diff != "" {
+		t.Errorf("unexpected difference after round trip:\n%s", diff)
+	}
+}
+
+func TestFakeAnonymousSets(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: Concat("tcp dport", AnonymousSet("22", "80"), "accept")})
+	tx.Add(&Rule{Chain: "chain", Rule: Concat("ip saddr vmap", AnonymousSet("10.0.0.1 : drop", "10.0.0.2 : accept"))})
+	tx.Add(&Rule{Chain: "chain", Rule: `drop comment "unmatched { in comment"`})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, rule := range []string{
+		"tcp dport { 22, 80 accept",
+		"tcp dport 22, 80 } accept",
+		"tcp dport } 22, 80 { accept",
+	} {
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "chain", Rule: rule})
+		err := fake.Run(context.Background(), tx)
+		if err == nil || !strings.Contains(err.Error(), "unbalanced braces") {
+			t.Errorf("expected unbalanced braces error for %q, got %v", rule, err)
+		}
+	}
+
+	for _, rule := range []string{
+		Concat("tcp dport", AnonymousSet(), "accept"),
+		"ip saddr vmap {}",
+	} {
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "chain", Rule: rule})
+		err := fake.Run(context.Background(), tx)
+		if err == nil || !strings.Contains(err.Error(), "empty anonymous set") {
+			t.Errorf("expected empty anonymous set error for %q, got %v", rule, err)
+		}
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add rule ip kube-proxy chain tcp dport { 22, 80 } accept
+		add rule ip kube-proxy chain ip saddr vmap { 10.0.0.1 : drop, 10.0.0.2 : accept }
+		add rule ip kube-proxy chain drop comment "unmatched { in comment"
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump content:\n%s", diff)
+	}
+}
+
+func TestFakeElementCount(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	_, err := fake.ElementCount(context.Background(), "set", "set")
+	if !IsNotFound(err) {
+		t.Errorf("expected not-found error before table exists, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	for i := 1; i <= 5; i++ {
+		tx.Add(&Element{Set: "set", Key: []string{fmt.Sprintf("10.0.0.%d", i)}})
+	}
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.2"}, Value: []string{"accept"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		objectType string
+		name       string
+		count      int
+	}{
+		{objectType: "set", name: "set", count: 5},
+		{objectType: "map", name: "map", count: 2},
+	} {
+		count, err := fake.ElementCount(context.Background(), tc.objectType, tc.name)
+		if err != nil {
+			t.Errorf("unexpected error for %s %q: %v", tc.objectType, tc.name, err)
+		} else if count != tc.count {
+			t.Errorf("expected %d elements in %s %q, got %d", tc.count, tc.objectType, tc.name, count)
+		}
+	}
+
+	for _, tc := range []struct {
+		objectType string
+		name       string
+	}{
+		{objectType: "set", name: "nosuchset"},
+		{objectType: "map", name: "set"},
+		{objectType: "set", name: "map"},
+	} {
+		_, err := fake.ElementCount(context.Background(), tc.objectType, tc.name)
+		if !IsNotFound(err) {
+			t.Errorf("expected not-found error for %s %q, got %v", tc.objectType, tc.name, err)
+		}
+	}
+}
+
+func TestFakeRangeElements(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	for i := 1; i <= 5; i++ {
+		tx.Add(&Element{Set: "set", Key: []string{fmt.Sprintf("10.0.0.%d", i)}})
+	}
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var seen []string
+	err := fake.RangeElements(context.Background(), "set", "set", func(element *Element) bool {
+		seen = append(seen, element.Key[0])
+		return len(seen) < 3
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, seen); diff != "" {
+		t.Errorf("unexpected elements from RangeElements:\n%s", diff)
+	}
+
+	matching, err := fake.ListElementsMatching(context.Background(), "set", "set", func(element *Element) bool {
+		return element.Key[0] == "10.0.0.2" || element.Key[0] == "10.0.0.5"
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*Element{
+		{Set: "set", Key: []string{"10.0.0.2"}},
+		{Set: "set", Key: []string{"10.0.0.5"}},
+	}
+	if diff := cmp.Diff(expected, matching); diff != "" {
+		t.Errorf("unexpected result from ListElementsMatching:\n%s", diff)
+	}
+
+	// Modifying the returned elements does not affect the Fake
+	matching[0].Key[0] = "192.168.0.1"
+	if elem := fake.Table.Sets["set"].FindElement("10.0.0.2"); elem == nil {
+		t.Errorf("modifying returned element modified the Fake")
+	}
+
+	err = fake.RangeElements(context.Background(), "set", "nosuchset", func(*Element) bool { return true })
+	if !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+	_, err = fake.ListElementsMatching(context.Background(), "map", "set", func(*Element) bool { return true })
+	if !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+}
+
+func TestFakeSetGCIntervalAndPolicy(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{
+		Name:       "set",
+		Type:       "ipv4_addr",
+		Flags:      []SetFlag{TimeoutFlag},
+		Timeout:    PtrTo(2 * time.Minute),
+		GCInterval: PtrTo(30 * time.Second),
+		Policy:     PtrTo(PerformancePolicy),
+	})
+	tx.Add(&Map{
+		Name:       "map",
+		Type:       "ipv4_addr : verdict",
+		Flags:      []SetFlag{TimeoutFlag},
+		GCInterval: PtrTo(time.Minute),
+		Policy:     PtrTo(MemoryPolicy),
+	})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add set ip kube-proxy set { type ipv4_addr ; flags timeout ; timeout 120s ; gc-interval 30s ; policy performance ; }
+		add map ip kube-proxy map { type ipv4_addr : verdict ; flags timeout ; gc-interval 60s ; policy memory ; }
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected Dump content:\n%s", diff)
+	}
+
+	reparsed := NewFake(IPv4Family, "kube-proxy")
+	if err := reparsed.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error parsing dump: %v", err)
+	}
+	if diff := cmp.Diff(dump, reparsed.Dump()); diff != "" {
+		t.Errorf("unexpected difference after round trip:\n%s", diff)
+	}
+
+	sets, err := reparsed.ListSetsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sets) != 1 || sets[0].GCInterval == nil || *sets[0].GCInterval != 30*time.Second ||
+		sets[0].Policy == nil || *sets[0].Policy != PerformancePolicy {
+		t.Errorf("unexpected sets from ListSetsFull: %+v", sets)
+	}
+	maps, err := reparsed.ListMapsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(maps) != 1 || maps[0].GCInterval == nil || *maps[0].GCInterval != time.Minute ||
+		maps[0].Policy == nil || *maps[0].Policy != MemoryPolicy {
+		t.Errorf("unexpected maps from ListMapsFull: %+v", maps)
+	}
+}
+
+func TestFakeReset(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	fake.StrictTypes = true
+	fake.ValidateNames = true
+	fake.ValidateReferences = true
+	fake.ValidateFlags = true
+	fake.StrictScope = true
+
+	populate := func() {
+		t.Helper()
+		tx := fake.NewTransaction()
+		tx.Add(&Table{})
+		tx.Add(&Chain{Name: "chain"})
+		tx.Add(&Set{Name: "set", Type: "ipv4_addr", Timeout: PtrTo(time.Minute)})
+		tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	populate()
+	fake.Tick(30 * time.Second)
+	firstDump := fake.Dump()
+
+	fake.Reset()
+	if fake.Table != nil {
+		t.Errorf("expected Table to be nil after Reset")
+	}
+	if len(fake.AppliedTransactions()) != 0 {
+		t.Errorf("expected no applied transactions after Reset")
+	}
+	if !fake.StrictTypes || !fake.ValidateNames || !fake.ValidateReferences || !fake.ValidateFlags || !fake.StrictScope {
+		t.Errorf("expected configuration to be preserved by Reset")
+	}
+
+	// Rebuilding gives the same handles and timeouts as the first time
+	populate()
+	fake.Tick(30 * time.Second)
+	if diff := cmp.Diff(firstDump, fake.Dump()); diff != "" {
+		t.Errorf("unexpected difference after Reset and rebuild:\n%s", diff)
+	}
+	if chain := fake.Table.Chains["chain"]; chain == nil || chain.Handle == nil || *chain.Handle != 2 {
+		t.Errorf("expected chain to have handle 2 after Reset, got %+v", chain)
+	}
+
+	fake.FailNextRun = fmt.Errorf("fail")
+	fake.ResetAll()
+	if fake.Table != nil {
+		t.Errorf("expected Table to be nil after ResetAll")
+	}
+	if fake.StrictTypes || fake.ValidateNames || fake.ValidateReferences || fake.ValidateFlags || fake.StrictScope || fake.FailNextRun != nil {
+		t.Errorf("expected configuration to be cleared by ResetAll")
+	}
+	populate()
+}
+
+func TestFakeDestroy(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	// Destroying the table when it doesn't exist is a no-op, but destroying other
+	// objects requires the table to exist
+	tx := fake.NewTransaction()
+	tx.Destroy(&Table{})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error destroying nonexistent table: %v", err)
+	}
+	tx = fake.NewTransaction()
+	tx.Destroy(&Chain{Name: "chain"})
+	if err := fake.Run(context.Background(), tx); !IsNotFound(err) {
+		t.Errorf("expected not-found error destroying chain without table, got %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Deleting a nonexistent chain fails, but destroying it succeeds
+	tx = fake.NewTransaction()
+	tx.Delete(&Chain{Name: "nosuchchain"})
+	if err := fake.Run(context.Background(), tx); !IsNotFound(err) {
+		t.Errorf("expected not-found error deleting nonexistent chain, got %v", err)
+	}
+	tx = fake.NewTransaction()
+	tx.Destroy(&Chain{Name: "nosuchchain"})
+	tx.Destroy(&Chain{Handle: PtrTo(100)})
+	tx.Destroy(&Rule{Chain: "chain", Handle: PtrTo(100)})
+	tx.Destroy(&Set{Name: "nosuchset"})
+	tx.Destroy(&Element{Set: "set", Key: []string{"10.0.0.2"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error destroying nonexistent objects: %v", err)
+	}
+
+	// Destroying an element in a nonexistent set is still an error
+	tx = fake.NewTransaction()
+	tx.Destroy(&Element{Set: "nosuchset", Key: []string{"10.0.0.2"}})
+	if err := fake.Run(context.Background(), tx); !IsNotFound(err) {
+		t.Errorf("expected not-found error destroying element of nonexistent set, got %v", err)
+	}
+
+	// Destroying existing objects deletes them
+	tx = fake.NewTransaction()
+	tx.Destroy(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Destroy(&Rule{Chain: "chain", Handle: PtrTo(3)})
+	tx.Destroy(&Chain{Name: "chain"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add set ip kube-proxy set { type ipv4_addr ; }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump content:\n%s", diff)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Destroy(&Table{})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.Table != nil {
+		t.Errorf("expected table to be destroyed")
+	}
+}
+
+func TestFakeCreate(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Create(&Table{})
+	tx.Create(&Chain{Name: "chain"})
+	tx.Create(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Create(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	tx.Create(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Create(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := fake.Dump()
+
+	for _, obj := range []Object{
+		&Table{},
+		&Chain{Name: "chain"},
+		&Set{Name: "set", Type: "ipv4_addr"},
+		&Map{Name: "map", Type: "ipv4_addr : verdict"},
+		&Element{Set: "set", Key: []string{"10.0.0.1"}},
+		&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}},
+	} {
+		// Creating a duplicate fails
+		tx = fake.NewTransaction()
+		tx.Create(obj)
+		if err := fake.Run(context.Background(), tx); !IsAlreadyExists(err) {
+			t.Errorf("expected already-exists error creating duplicate %T, got %v", obj, err)
+		}
+
+		// Adding a duplicate does not
+		tx = fake.NewTransaction()
+		tx.Add(obj)
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Errorf("unexpected error adding duplicate %T: %v", obj, err)
+		}
+	}
+
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump content:\n%s", diff)
+	}
+}
+
+func TestFakeFlushNonexistent(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	// Flushing the table before it exists fails
+	tx := fake.NewTransaction()
+	tx.Flush(&Table{})
+	if err := fake.Run(context.Background(), tx); !IsNotFound(err) {
+		t.Errorf("expected not-found error flushing nonexistent table, got %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := fake.Dump()
+
+	for _, obj := range []Object{
+		&Chain{Name: "nosuchchain"},
+		&Set{Name: "nosuchset"},
+		&Set{Name: "chain"},
+		&Map{Name: "nosuchmap"},
+		&Map{Name: "set"},
+	} {
+		// Flushing a nonexistent object fails, without flushing anything that
+		// was flushed earlier in the transaction.
+		tx = fake.NewTransaction()
+		tx.Flush(&Chain{Name: "chain"})
+		tx.Flush(&Set{Name: "set"})
+		tx.Flush(obj)
+		if err := fake.Run(context.Background(), tx); !IsNotFound(err) {
+			t.Errorf("expected not-found error flushing %+v, got %v", obj, err)
+		}
+		if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+			t.Errorf("failed flush modified the table:\n%s", diff)
+		}
+	}
+
+	// Flushing the table removes its contents but not the table itself
+	tx = fake.NewTransaction()
+	tx.Flush(&Table{})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff("add table ip kube-proxy\n", fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after flush:\n%s", diff)
+	}
+
+	// ...so objects in it can no longer be flushed
+	tx = fake.NewTransaction()
+	tx.Flush(&Chain{Name: "chain"})
+	if err := fake.Run(context.Background(), tx); !IsNotFound(err) {
+		t.Errorf("expected not-found error flushing chain of flushed table, got %v", err)
+	}
+}
+
+func TestFakeDumpTable(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if _, err := fake.DumpTable(context.Background()); !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dump, err := fake.DumpTable(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(fake.Dump(), dump); diff != "" {
+		t.Errorf("unexpected difference between DumpTable and Dump:\n%s", diff)
+	}
+}
+
+func TestFakeDumpWithHandles(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip saddr @set drop"})
+	tx.Add(&Rule{Chain: "chain", Rule: "accept", Comment: PtrTo("accept rule")})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy # handle 1
+		add chain ip kube-proxy chain # handle 2
+		add set ip kube-proxy set { type ipv4_addr ; } # handle 3
+		add rule ip kube-proxy chain ip saddr @set drop # handle 4
+		add rule ip kube-proxy chain accept comment "accept rule" # handle 5
+		add element ip kube-proxy set { 10.0.0.1 }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.DumpWithOptions(DumpOptions{IncludeHandles: true})); diff != "" {
+		t.Errorf("unexpected DumpWithOptions content:\n%s", diff)
+	}
+
+	// Dump does not include handles
+	if dump := fake.Dump(); strings.Contains(dump, "handle") {
+		t.Errorf("unexpected handles in Dump output:\n%s", dump)
+	}
+	if diff := cmp.Diff(fake.Dump(), fake.DumpWithOptions(DumpOptions{})); diff != "" {
+		t.Errorf("unexpected difference between Dump and DumpWithOptions:\n%s", diff)
+	}
+}
+
+func TestFakeDumpSortElements(t *testing.T) {
+	keys := [][]string{
+		{"10.0.0.10", "tcp", "80"},
+		{"10.0.0.2", "udp", "53"},
+		{"10.0.0.2", "tcp", "8080"},
+		{"10.0.0.2", "tcp", "443"},
+		{"192.168.0.0/16", "tcp", "22"},
+		{"10.0.0.0/8", "tcp", "22"},
+	}
+
+	dumps := make([]string, 2)
+	for i := range dumps {
+		fake := NewFake(IPv4Family, "kube-proxy")
+		tx := fake.NewTransaction()
+		tx.Add(&Table{})
+		tx.Add(&Set{Name: "set", Type: "ipv4_addr . inet_proto . inet_service", Flags: []SetFlag{IntervalFlag}})
+		for j := range keys {
+			// Add the elements forwards the first time and backwards the second
+			key := keys[j]
+			if i == 1 {
+				key = keys[len(keys)-1-j]
+			}
+			tx.Add(&Element{Set: "set", Key: key})
+		}
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		dumps[i] = fake.DumpWithOptions(DumpOptions{SortElements: true})
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add set ip kube-proxy set { type ipv4_addr . inet_proto . inet_service ; flags interval ; }
+		add element ip kube-proxy set { 10.0.0.0/8 . tcp . 22 }
+		add element ip kube-proxy set { 10.0.0.2 . tcp . 443 }
+		add element ip kube-proxy set { 10.0.0.2 . tcp . 8080 }
+		add element ip kube-proxy set { 10.0.0.2 . udp . 53 }
+		add element ip kube-proxy set { 10.0.0.10 . tcp . 80 }
+		add element ip kube-proxy set { 192.168.0.0/16 . tcp . 22 }
+		`), "\n")
+	for i := range dumps {
+		if diff := cmp.Diff(expected, dumps[i]); diff != "" {
+			t.Errorf("unexpected sorted Dump content (%d):\n%s", i, diff)
+		}
+	}
+}
+
+func TestFakeDumpGroupElements(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "ips", Type: "ipv4_addr"})
+	tx.Add(&Set{Name: "single", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "ports", Type: "inet_service : verdict"})
+	tx.Add(&Chain{Name: "chain"})
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+		tx.Add(&Element{Set: "ips", Key: []string{ip}})
+	}
+	tx.Add(&Element{Set: "single", Key: []string{"192.168.0.1"}, Comment: PtrTo("a, b")})
+	tx.Add(&Element{Map: "ports", Key: []string{"80"}, Value: []string{"goto chain"}, Comment: PtrTo("web, http")})
+	tx.Add(&Element{Map: "ports", Key: []string{"443"}, Value: []string{"drop"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add set ip kube-proxy ips { type ipv4_addr ; }
+		add set ip kube-proxy single { type ipv4_addr ; }
+		add map ip kube-proxy ports { type inet_service : verdict ; }
+		add element ip kube-proxy ips { 10.0.0.1, 10.0.0.2, 10.0.0.3, 10.0.0.4, 10.0.0.5 }
+		add element ip kube-proxy single { 192.168.0.1 comment "a, b" }
+		add element ip kube-proxy ports { 80 comment "web, http" : goto chain, 443 : drop }
+		`), "\n")
+	dump := fake.DumpWithOptions(DumpOptions{GroupElements: true})
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected grouped Dump content:\n%s", diff)
+	}
+
+	reparsed := NewFake(IPv4Family, "kube-proxy")
+	if err := reparsed.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error parsing grouped dump: %v", err)
+	}
+	if diff := cmp.Diff(fake.Dump(), reparsed.Dump()); diff != "" {
+		t.Errorf("unexpected difference after round trip:\n%s", diff)
+	}
+}
+
+func TestFakeRunCancelled(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fake.Run(ctx, tx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from Run, got %v", err)
+	}
+	if err := fake.Check(ctx, tx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from Check, got %v", err)
+	}
+	if fake.Table != nil {
+		t.Errorf("cancelled Run modified the table")
+	}
+
+	// Cancellation after Run starts is noticed between operations
+	ctx, cancel = context.WithCancel(context.Background())
+	fake.InjectError = func(*Transaction) error {
+		cancel()
+		return nil
+	}
+	if err := fake.Run(ctx, tx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from Run, got %v", err)
+	}
+	if fake.Table != nil {
+		t.Errorf("cancelled Run modified the table")
+	}
+
+	fake.InjectError = nil
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFakeCommentRoundTrip(t *testing.T) {
+	// Double quotes can't be used in nft comments, but single quotes and
+	// backslashes are passed through as-is.
+	comment := `it's a 'quoted' comment, with spaces and a C:\dir\ path`
+
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{Comment: &comment})
+	tx.Add(&Chain{Name: "chain", Comment: &comment})
+	tx.Add(&Chain{Name: "base", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(FilterPriority), Comment: &comment})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop", Comment: &comment})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr", Comment: &comment})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict", Comment: &comment})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}, Comment: &comment})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Comment: &comment})
+	tx.Add(&Counter{Name: "counter", Comment: &comment})
+	tx.Add(&Quota{Name: "quota", Bytes: 1000, Comment: &comment})
+	tx.Add(&CTTimeout{Name: "timeout", Protocol: "udp", Policy: map[string]time.Duration{"replied": 30 * time.Second}, Comment: &comment})
+	tx.Add(&CTExpectation{Name: "expectation", Protocol: "tcp", DPort: 5060, Timeout: time.Minute, Size: 12, Comment: &comment})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dump := fake.Dump()
+	reparsed := NewFake(IPv4Family, "kube-proxy")
+	if err := reparsed.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error parsing dump: %v", err)
+	}
+	if diff := cmp.Diff(dump, reparsed.Dump()); diff != "" {
+		t.Errorf("unexpected difference after round trip:\n%s", diff)
+	}
+
+	table := reparsed.Table
+	comments := map[string]*string{
+		"table":       table.Comment,
+		"chain":       table.Chains["chain"].Comment,
+		"base chain":  table.Chains["base"].Comment,
+		"rule":        table.Chains["chain"].Rules[0].Comment,
+		"set":         table.Sets["set"].Comment,
+		"map":         table.Maps["map"].Comment,
+		"set element": table.Sets["set"].Elements[0].Comment,
+		"map element": table.Maps["map"].Elements[0].Comment,
+		"counter":     table.Counters["counter"].Comment,
+		"quota":       table.Quotas["quota"].Comment,
+		"ct timeout":  table.CTTimeouts["timeout"].Comment,
+		"ct expect":   table.CTExpectations["expectation"].Comment,
+	}
+	for objType, got := range comments {
+		if got == nil || *got != comment {
+			t.Errorf("expected %s comment to survive round trip, got %v", objType, got)
+		}
+	}
+
+	chains, err := reparsed.ListChainsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, chain := range chains {
+		if chain.Comment == nil || *chain.Comment != comment {
+			t.Errorf("expected ListChainsFull to return comment for %q, got %v", chain.Name, chain.Comment)
+		}
+	}
+	sets, err := reparsed.ListSetsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sets) != 1 || sets[0].Comment == nil || *sets[0].Comment != comment {
+		t.Errorf("expected ListSetsFull to return comment, got %+v", sets)
+	}
+}
+
+func TestFakeInvalidComments(t *testing.T) {
+	// nft does not support escapes in quoted strings, so comments containing
+	// double quotes or control characters can't be passed to it.
+	for _, comment := range []string{
+		`he said "hi"`,
+		"multi\nline comment",
+		"tab\tseparated",
+	} {
+		for _, obj := range []Object{
+			&Table{Comment: &comment},
+			&Chain{Name: "chain2", Comment: &comment},
+			&Rule{Chain: "chain", Rule: "drop", Comment: &comment},
+			&Set{Name: "set2", Type: "ipv4_addr", Comment: &comment},
+			&Map{Name: "map", Type: "ipv4_addr : verdict", Comment: &comment},
+			&Element{Set: "set", Key: []string{"10.0.0.1"}, Comment: &comment},
+		} {
+			fake := NewFake(IPv4Family, "kube-proxy")
+			tx := fake.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(&Chain{Name: "chain"})
+			tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+			tx.Add(obj)
+			err := fake.Run(context.Background(), tx)
+			if err == nil || !strings.Contains(err.Error(), "cannot contain double quotes or control characters") {
+				t.Errorf("expected error for %T with comment %q, got %v", obj, comment, err)
+			}
+			if fake.Table != nil {
+				t.Errorf("expected failed transaction to not create table")
+			}
+		}
+	}
+}
+
+func TestFakeValidate(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if err := fake.Validate(); err != nil {
+		t.Fatalf("unexpected error validating empty fake: %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Chain{Name: "target"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr", Size: PtrTo[uint64](2)})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr @set jump target"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"goto target"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := fake.Validate(); err != nil {
+		t.Fatalf("unexpected error validating fake: %v", err)
+	}
+
+	// Break things by modifying the table directly.
+	delete(fake.Table.Chains, "target")
+	set := fake.Table.Sets["set"]
+	set.Elements = append(set.Elements,
+		&Element{Set: "set", Key: []string{"10.0.0.2", "80"}},
+		&Element{Set: "set", Key: []string{"10.0.0.3"}},
+	)
+	mapObj := fake.Table.Maps["map"]
+	mapObj.Elements = append(mapObj.Elements,
+		&Element{Map: "map", Key: []string{"10.0.0.2"}, Value: []string{"bounce"}},
+	)
+
+	err := fake.Validate()
+	if err == nil {
+		t.Fatalf("expected error validating broken fake")
+	}
+	for _, expected := range []string{
+		`chain "chain": rule "ip daddr @set jump target": no such chain "target"`,
+		`set "set": element key "10.0.0.2 . 80" has 2 components`,
+		`set "set": has 3 elements but size is 2`,
+		`map "map": element "10.0.0.1": no such chain "target"`,
+		`map "map": element value "bounce" is not a valid verdict`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %q, got:\n%v", expected, err)
+		}
+	}
+}
+
+func TestFakeChainPolicy(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "regular", Policy: PtrTo(DropPolicy)})
+	err := fake.Run(context.Background(), tx)
+	if err == nil || !strings.Contains(err.Error(), "must not specify Policy") {
+		t.Fatalf("expected error adding regular chain with policy, got %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{
+		Name:     "input",
+		Type:     PtrTo(FilterType),
+		Hook:     PtrTo(InputHook),
+		Priority: PtrTo(FilterPriority),
+		Policy:   PtrTo(DropPolicy),
+	})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy input { type filter hook input priority 0 ; policy drop ; }
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected dump:\n%s", diff)
+	}
+
+	reparsed := NewFake(IPv4Family, "kube-proxy")
+	if err := reparsed.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error parsing dump: %v", err)
+	}
+	chain, err := reparsed.GetChain(context.Background(), "input")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if chain.Policy == nil || *chain.Policy != DropPolicy {
+		t.Errorf("expected policy to round-trip, got %v", chain.Policy)
+	}
+
+	jsonDump, err := fake.DumpJSON(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(jsonDump, `"policy":"drop"`) {
+		t.Errorf("expected JSON dump to include drop policy, got %s", jsonDump)
+	}
+}
+
+func TestFakeHasTable(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if exists, err := fake.HasTable(context.Background()); err != nil || exists {
+		t.Errorf("expected (false, nil) before creating table, got (%v, %v)", exists, err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists, err := fake.HasTable(context.Background()); err != nil || !exists {
+		t.Errorf("expected (true, nil) after creating table, got (%v, %v)", exists, err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Delete(&Table{})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists, err := fake.HasTable(context.Background()); err != nil || exists {
+		t.Errorf("expected (false, nil) after deleting table, got (%v, %v)", exists, err)
+	}
+}
+
+func TestFakeListWithHandles(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if _, err := fake.ListWithHandles(context.Background(), "chains"); !IsNotFound(err) {
+		t.Errorf("expected not-found error before creating table, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain1"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	tx.Add(&Counter{Name: "counter"})
+	tx.Add(&Quota{Name: "quota", Bytes: 1000})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A freshly-added chain gets the next available handle
+	expectedHandle := fake.nextHandle + 1
+	tx = fake.NewTransaction()
+	tx.Add(&Chain{Name: "chain2"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	chainHandles, err := fake.ListWithHandles(context.Background(), "chains")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"chain1": 2, "chain2": expectedHandle}, chainHandles); diff != "" {
+		t.Errorf("unexpected chain handles:\n%s", diff)
+	}
+	if chainHandles["chain2"] != fake.nextHandle {
+		t.Errorf("expected chain2 to have handle %d, got %d", fake.nextHandle, chainHandles["chain2"])
+	}
+
+	handles, err := fake.ListWithHandles(context.Background(), "set")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"set": 3}, handles); diff != "" {
+		t.Errorf("unexpected set handles:\n%s", diff)
+	}
+
+	handles, err = fake.ListWithHandles(context.Background(), "maps")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"map": 4}, handles); diff != "" {
+		t.Errorf("unexpected map handles:\n%s", diff)
+	}
+
+	handles, err = fake.ListWithHandles(context.Background(), "counters")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"counter": 5}, handles); diff != "" {
+		t.Errorf("unexpected counter handles:\n%s", diff)
+	}
+
+	handles, err = fake.ListWithHandles(context.Background(), "quota")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"quota": 6}, handles); diff != "" {
+		t.Errorf("unexpected quota handles:\n%s", diff)
+	}
+
+	handles, err = fake.ListWithHandles(context.Background(), "ct timeouts")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(handles) != 0 {
+		t.Errorf("expected no ct timeouts, got %v", handles)
+	}
+
+	if _, err := fake.ListWithHandles(context.Background(), "rules"); err == nil {
+		t.Errorf("expected error for unsupported object type")
+	}
+
+	// The handles can be used to delete the objects
+	tx = fake.NewTransaction()
+	tx.Delete(&Chain{Handle: PtrTo(chainHandles["chain1"])})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error deleting by handle: %v", err)
+	}
+	if _, err := fake.GetChain(context.Background(), "chain1"); !IsNotFound(err) {
+		t.Errorf("expected chain1 to be deleted, got %v", err)
+	}
+}
+
+func TestFakeConcatenatedMapValues(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	fake.StrictTypes = true
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Map{Name: "dnat", Type: "ipv4_addr . inet_service : ipv4_addr . inet_service"})
+	tx.Add(&Element{Map: "dnat", Key: []string{"172.30.0.1", "http"}, Value: []string{"10.0.0.1", "8080"}})
+	tx.Add(&Element{Map: "dnat", Key: []string{"172.30.0.2", "443"}, Value: []string{"10.0.0.2", "8443"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// FindElement matches on the key only
+	m := fake.Table.Maps["dnat"]
+	elem := m.FindElement("172.30.0.1", "80")
+	if elem == nil {
+		t.Fatalf("expected to find element")
+	}
+	if diff := cmp.Diff([]string{"10.0.0.1", "8080"}, elem.Value); diff != "" {
+		t.Errorf("unexpected value:\n%s", diff)
+	}
+
+	// Re-adding an existing key with a different value replaces the value
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Map: "dnat", Key: []string{"172.30.0.1", "80"}, Value: []string{"10.0.0.3", "9090"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	elem = fake.Table.Maps["dnat"].FindElement("172.30.0.1", "http")
+	if elem == nil {
+		t.Fatalf("expected to find element")
+	}
+	if diff := cmp.Diff([]string{"10.0.0.3", "9090"}, elem.Value); diff != "" {
+		t.Errorf("unexpected value after update:\n%s", diff)
+	}
+
+	// A value with the wrong number of components is rejected
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Map: "dnat", Key: []string{"172.30.0.3", "80"}, Value: []string{"10.0.0.4"}})
+	if err := fake.Run(context.Background(), tx); err == nil {
+		t.Errorf("expected error adding element with single-component value")
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add map ip kube-proxy dnat { type ipv4_addr . inet_service : ipv4_addr . inet_service ; }
+		add element ip kube-proxy dnat { 172.30.0.1 . 80 : 10.0.0.3 . 9090 }
+		add element ip kube-proxy dnat { 172.30.0.2 . 443 : 10.0.0.2 . 8443 }
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected dump:\n%s", diff)
+	}
+
+	reparsed := NewFake(IPv4Family, "kube-proxy")
+	if err := reparsed.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error parsing dump: %v", err)
+	}
+	elements, err := reparsed.ListElements(context.Background(), "map", "dnat")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(elements) != 2 {
+		t.Fatalf("expected 2 elements, got %d", len(elements))
+	}
+	for _, elem := range elements {
+		if len(elem.Key) != 2 || len(elem.Value) != 2 {
+			t.Errorf("expected 2-component key and value after round trip, got %q : %q", elem.Key, elem.Value)
+		}
+	}
+	if diff := cmp.Diff(dump, reparsed.Dump()); diff != "" {
+		t.Errorf("unexpected difference after round trip:\n%s", diff)
+	}
+}
+
+func TestFakeReAddElement(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr . inet_service", Size: PtrTo[uint64](2)})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr . inet_service : ipv4_addr"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1", "80"}, Comment: PtrTo("first")})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.2", "80"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1", "80"}, Value: []string{"192.168.0.1"}, Comment: PtrTo("first")})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Re-adding an existing key replaces the element in place, even when the set
+	// is full.
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1", "http"}, Comment: PtrTo("second")})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1", "80"}, Value: []string{"192.168.0.2"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error re-adding elements: %v", err)
+	}
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add set ip kube-proxy set { type ipv4_addr . inet_service ; size 2 ; }
+		add map ip kube-proxy map { type ipv4_addr . inet_service : ipv4_addr ; }
+		add element ip kube-proxy set { 10.0.0.1 . http comment "second" }
+		add element ip kube-proxy set { 10.0.0.2 . 80 }
+		add element ip kube-proxy map { 10.0.0.1 . 80 : 192.168.0.2 }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected dump after re-adding elements:\n%s", diff)
+	}
+
+	// Creating an existing key is an error, for both sets and maps.
+	tx = fake.NewTransaction()
+	tx.Create(&Element{Set: "set", Key: []string{"10.0.0.2", "80"}})
+	if err := fake.Run(context.Background(), tx); !IsAlreadyExists(err) {
+		t.Errorf("expected already-exists error creating set element, got %v", err)
+	}
+	tx = fake.NewTransaction()
+	tx.Create(&Element{Map: "map", Key: []string{"10.0.0.1", "80"}, Value: []string{"192.168.0.3"}})
+	err := fake.Run(context.Background(), tx)
+	if !IsAlreadyExists(err) {
+		t.Errorf("expected already-exists error creating map element, got %v", err)
+	} else if !strings.Contains(err.Error(), `"10.0.0.1 . 80"`) {
+		t.Errorf("unexpected error message: %v", err)
+	}
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected dump after failed creates:\n%s", diff)
+	}
+}
+
+func TestFakeIntervalMapFindElement(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : mark", Flags: []SetFlag{IntervalFlag}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.0/24"}, Value: []string{"1"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.1.0/24"}, Value: []string{"2"}})
+	tx.Add(&Element{Map: "map", Key: []string{"192.168.0.10-192.168.0.20"}, Value: []string{"3"}})
+	tx.Add(&Element{Map: "map", Key: []string{"172.16.0.1"}, Value: []string{"4"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Overlapping intervals are rejected, as with nft
+	tx = fake.NewTransaction()
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.0/8"}, Value: []string{"5"}})
+	if err := fake.Run(context.Background(), tx); err == nil {
+		t.Errorf("expected error adding overlapping interval")
+	}
+
+	m := fake.Table.Maps["map"]
+	for _, tc := range []struct {
+		key   string
+		value string
+	}{
+		{key: "10.0.0.0/24", value: "1"},
+		{key: "10.0.0.5", value: "1"},
+		{key: "10.0.1.255", value: "2"},
+		{key: "10.0.1.128/25", value: "2"},
+		{key: "192.168.0.15", value: "3"},
+		{key: "192.168.0.10-192.168.0.12", value: "3"},
+		{key: "172.16.0.1", value: "4"},
+		{key: "10.0.2.1"},
+		{key: "10.0.0.0/23"},
+		{key: "192.168.0.5-192.168.0.15"},
+		{key: "172.16.0.2"},
+		{key: "fd00::1"},
+	} {
+		elem := m.FindElement(tc.key)
+		if tc.value == "" {
+			if elem != nil {
+				t.Errorf("expected no match for %q, got %v", tc.key, elem.Key)
+			}
+		} else if elem == nil {
+			t.Errorf("expected match for %q, got none", tc.key)
+		} else if elem.Value[0] != tc.value {
+			t.Errorf("expected %q to match element with value %q, got %q", tc.key, tc.value, elem.Value[0])
+		}
+	}
+
+	// If overlapping intervals are added directly to the table, the most specific
+	// one wins.
+	m.Elements = append(m.Elements,
+		&Element{Map: "map", Key: []string{"10.0.0.0/8"}, Value: []string{"5"}},
+		&Element{Map: "map", Key: []string{"10.0.1.0/28"}, Value: []string{"6"}},
+	)
+	for key, value := range map[string]string{
+		"10.0.0.5":   "1",
+		"10.0.1.5":   "6",
+		"10.0.1.100": "2",
+		"10.1.0.1":   "5",
+	} {
+		elem := m.FindElement(key)
+		if elem == nil {
+			t.Errorf("expected match for %q, got none", key)
+		} else if elem.Value[0] != value {
+			t.Errorf("expected %q to match element with value %q, got %q", key, value, elem.Value[0])
+		}
+	}
+
+	// Non-interval maps still require an exact match
+	tx = fake.NewTransaction()
+	tx.Add(&Map{Name: "exact", Type: "ipv4_addr : mark"})
+	tx.Add(&Element{Map: "exact", Key: []string{"10.0.0.0/24"}, Value: []string{"1"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elem := fake.Table.Maps["exact"].FindElement("10.0.0.5"); elem != nil {
+		t.Errorf("expected no match in non-interval map, got %v", elem.Key)
+	}
+}
+
+func TestFakeChainReferences(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if _, _, _, err := fake.ChainReferences("chain"); !IsNotFound(err) {
+		t.Errorf("expected not-found error before creating table, got %v", err)
+	}
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Chain{Name: "svc1"})
+	tx.Add(&Chain{Name: "svc2"})
+	tx.Add(&Chain{Name: "svc3"})
+	tx.Add(&Set{Name: "blocked", Type: "ipv4_addr"})
+	tx.Add(&Set{Name: "unused", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "services", Type: "ipv4_addr : verdict"})
+	tx.Add(&Map{Name: "marks", Type: "ipv4_addr : mark"})
+	tx.Add(&Element{Map: "services", Key: []string{"10.0.0.3"}, Value: []string{"goto svc3"}})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip saddr @blocked drop"})
+	tx.Add(&Rule{Chain: "chain", Rule: "meta mark set ip daddr map @marks"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr vmap @services"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr 10.0.0.1 jump svc1"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip daddr vmap { 10.0.0.2 : goto svc2 }", Comment: PtrTo("not @unused")})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sets, maps, chains, err := fake.ChainReferences("chain")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"blocked"}, sets); diff != "" {
+		t.Errorf("unexpected sets:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"marks", "services"}, maps); diff != "" {
+		t.Errorf("unexpected maps:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"svc1", "svc2"}, chains); diff != "" {
+		t.Errorf("unexpected chains:\n%s", diff)
+	}
+	if _, _, _, err := fake.ChainReferences("nosuchchain"); !IsNotFound(err) {
+		t.Errorf("expected not-found error for nonexistent chain, got %v", err)
+	}
+
+	// With ValidateReferences, referenced objects can't be deleted
+	fake.ValidateReferences = true
+	for _, obj := range []Object{
+		&Set{Name: "blocked"},
+		&Map{Name: "marks"},
+		&Map{Name: "services"},
+		&Chain{Name: "svc1"},
+		&Chain{Name: "svc2"},
+		&Chain{Name: "svc3"},
+	} {
+		tx = fake.NewTransaction()
+		tx.Delete(obj)
+		err := fake.Run(context.Background(), tx)
+		if !IsBusy(err) || !strings.Contains(err.Error(), "in use") {
+			t.Errorf("expected in-use error deleting %+v, got %v", obj, err)
+		}
+	}
+
+	// Unreferenced objects can be
+	tx = fake.NewTransaction()
+	tx.Delete(&Set{Name: "unused"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error deleting unreferenced set: %v", err)
+	}
+
+	// Objects can be deleted after removing the references to them
+	tx = fake.NewTransaction()
+	tx.Flush(&Chain{Name: "chain"})
+	tx.Delete(&Set{Name: "blocked"})
+	tx.Delete(&Map{Name: "marks"})
+	tx.Delete(&Map{Name: "services"})
+	tx.Delete(&Chain{Name: "svc1"})
+	tx.Delete(&Chain{Name: "svc2"})
+	tx.Delete(&Chain{Name: "svc3"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error deleting objects after flushing chain: %v", err)
+	}
+}
+
+func TestFakeValidateReferences(t *testing.T) {
+	for _, validate := range []bool{false, true} {
+		fake := NewFake(IPv4Family, "kube-proxy")
+		fake.ValidateReferences = validate
+		tx := fake.NewTransaction()
+		tx.Add(&Table{})
+		tx.Add(&Chain{Name: "chain"})
+		tx.Add(&Set{Name: "blocked", Type: "ipv4_addr"})
+		tx.Add(&Rule{Chain: "chain", Rule: "ip saddr @blocked drop"})
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		tx = fake.NewTransaction()
+		tx.Delete(&Set{Name: "blocked"})
+		err := fake.Check(context.Background(), tx)
+		if !validate {
+			if err != nil {
+				t.Errorf("unexpected error without ValidateReferences: %v", err)
+			}
+			continue
+		}
+		if !IsBusy(err) {
+			t.Fatalf("expected busy error deleting referenced set, got %v", err)
+		}
+
+		// Once the rule is deleted, the set can be deleted (in the same
+		// transaction, as long as the rule is deleted first).
+		rules, err := fake.ListRules(context.Background(), "chain")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		tx = fake.NewTransaction()
+		tx.Delete(&Set{Name: "blocked"})
+		tx.Delete(&Rule{Chain: "chain", Handle: rules[0].Handle})
+		if err := fake.Run(context.Background(), tx); !IsBusy(err) {
+			t.Errorf("expected busy error deleting set before rule, got %v", err)
+		}
+		tx = fake.NewTransaction()
+		tx.Delete(&Rule{Chain: "chain", Handle: rules[0].Handle})
+		tx.Delete(&Set{Name: "blocked"})
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Errorf("unexpected error deleting set after rule: %v", err)
+		}
+	}
+}
+
+func TestFakeValidateNamedObjectReferences(t *testing.T) {
+	rule, err := NewRuleBuilder().MatchTCPDport(80).NamedCounter("web").Accept().Build()
+	if err != nil {
+		t.Fatalf("unexpected error from Build: %v", err)
+	}
+	quotaRule, err := NewRuleBuilder().MatchTCPDport(443).NamedQuota("tls").Drop().Build()
+	if err != nil {
+		t.Fatalf("unexpected error from Build: %v", err)
+	}
+
+	for _, validate := range []bool{false, true} {
+		fake := NewFake(IPv4Family, "kube-proxy")
+		fake.ValidateReferences = validate
+		tx := fake.NewTransaction()
+		tx.Add(&Table{})
+		tx.Add(&Chain{Name: "chain"})
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Referencing a counter or quota that doesn't exist
+		for _, r := range []string{rule, quotaRule} {
+			tx = fake.NewTransaction()
+			tx.Add(&Rule{Chain: "chain", Rule: r})
+			err = fake.Check(context.Background(), tx)
+			if !validate {
+				if err != nil {
+					t.Errorf("unexpected error without ValidateReferences: %v", err)
+				}
+			} else if !IsNotFound(err) {
+				t.Errorf("expected not-found error for %q, got %v", r, err)
+			}
+		}
+
+		// Creating the objects in the same transaction is fine
+		tx = fake.NewTransaction()
+		tx.Add(&Counter{Name: "web"})
+		tx.Add(&Quota{Name: "tls", Bytes: 1000})
+		tx.Add(&Rule{Chain: "chain", Rule: rule})
+		tx.Add(&Rule{Chain: "chain", Rule: quotaRule})
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Errorf("unexpected error with existing counter and quota: %v", err)
+		}
+
+		// The name can also be chosen by a map lookup, which isn't checked
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "chain", Rule: `counter name ip saddr map { 10.0.0.1 : "web", 10.0.0.2 : "other" } accept`})
+		tx.Add(&Rule{Chain: "chain", Rule: `quota name ip saddr . tcp dport map { 10.0.0.1 . 443 : "tls" } drop`})
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Errorf("unexpected error with map lookup: %v", err)
+		}
+
+		// But a literal name followed by an unrelated map lookup is still checked
+		tx = fake.NewTransaction()
+		tx.Add(&Rule{Chain: "chain", Rule: "counter name nosuch meta mark set ip saddr map { 10.0.0.1 : 1 }"})
+		err = fake.Check(context.Background(), tx)
+		if !validate {
+			if err != nil {
+				t.Errorf("unexpected error without ValidateReferences: %v", err)
+			}
+		} else if !IsNotFound(err) {
+			t.Errorf("expected not-found error, got %v", err)
+		}
+
+		// Referenced counters and quotas can't be deleted
+		tx = fake.NewTransaction()
+		tx.Delete(&Counter{Name: "web"})
+		err = fake.Check(context.Background(), tx)
+		if !validate {
+			if err != nil {
+				t.Errorf("unexpected error without ValidateReferences: %v", err)
+			}
+		} else if !IsBusy(err) {
+			t.Errorf("expected busy error deleting referenced counter, got %v", err)
+		}
+		tx = fake.NewTransaction()
+		tx.Delete(&Quota{Name: "tls"})
+		err = fake.Check(context.Background(), tx)
+		if !validate {
+			if err != nil {
+				t.Errorf("unexpected error without ValidateReferences: %v", err)
+			}
+		} else if !IsBusy(err) {
+			t.Errorf("expected busy error deleting referenced quota, got %v", err)
+		}
+
+		// But unreferenced ones can
+		tx = fake.NewTransaction()
+		tx.Add(&Counter{Name: "unused"})
+		tx.Delete(&Counter{Name: "unused"})
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Errorf("unexpected error deleting unreferenced counter: %v", err)
+		}
+	}
+}
+
+func TestFakeRuleCounter(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "tcp dport 80 counter accept"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip saddr 10.0.0.1 drop"})
+	tx.Add(&Rule{Chain: "chain", Rule: "tcp dport 443 counter accept", Counter: &RuleCounter{Packets: 5, Bytes: 300}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	rules, err := fake.ListRules(context.Background(), "chain")
+	if err != nil {
+		t.Fatalf("unexpected error from ListRules: %v", err)
+	}
+	expectedCounters := []*RuleCounter{{}, nil, {Packets: 5, Bytes: 300}}
+	if len(rules) != len(expectedCounters) {
+		t.Fatalf("expected %d rules, got %d", len(expectedCounters), len(rules))
+	}
+	for i, rule := range rules {
+		if diff := cmp.Diff(expectedCounters[i], rule.Counter); diff != "" {
+			t.Errorf("unexpected Counter for rule %d:\n%s", i, diff)
+		}
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add rule ip kube-proxy chain tcp dport 80 counter accept
+		add rule ip kube-proxy chain ip saddr 10.0.0.1 drop
+		add rule ip kube-proxy chain tcp dport 443 counter packets 5 bytes 300 accept
+		`), "\n")
+	dump := fake.Dump()
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected Dump:\n%s", diff)
+	}
+
+	// Counters survive a round trip through the dump
+	fake2 := NewFake(IPv4Family, "kube-proxy")
+	if err := fake2.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	rule := fake2.Table.Chains["chain"].Rules[2]
+	if rule.Rule != "tcp dport 443 counter accept" {
+		t.Errorf("unexpected rule text after ParseDump: %q", rule.Rule)
+	}
+	if diff := cmp.Diff(&RuleCounter{Packets: 5, Bytes: 300}, rule.Counter); diff != "" {
+		t.Errorf("unexpected Counter after ParseDump:\n%s", diff)
+	}
+}
+
+func TestFakeResetRules(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	dump := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add chain ip kube-proxy other
+		add rule ip kube-proxy chain tcp dport 80 counter packets 12 bytes 840 accept
+		add rule ip kube-proxy chain ip saddr 10.0.0.1 drop
+		add rule ip kube-proxy chain counter packets 3 bytes 180 comment "total"
+		add rule ip kube-proxy other counter packets 7 bytes 490 drop
+		`), "\n")
+	if err := fake.ParseDump(dump); err != nil {
+		t.Fatalf("unexpected error from ParseDump: %v", err)
+	}
+	before := fake.Table.Chains["chain"].Rules[0]
+
+	tx := fake.NewTransaction()
+	tx.ResetRules("chain")
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	// Only the counters in "chain" are reset
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain
+		add chain ip kube-proxy other
+		add rule ip kube-proxy chain tcp dport 80 counter accept
+		add rule ip kube-proxy chain ip saddr 10.0.0.1 drop
+		add rule ip kube-proxy chain counter comment "total"
+		add rule ip kube-proxy other counter packets 7 bytes 490 drop
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after ResetRules:\n%s", diff)
+	}
+	if before.Counter == nil || *before.Counter != (RuleCounter{Packets: 12, Bytes: 840}) {
+		t.Errorf("ResetRules modified a rule in place: %+v", before.Counter)
+	}
+	if after := fake.Table.Chains["chain"].Rules[0]; after.Counter == nil || *after.Counter != (RuleCounter{}) {
+		t.Errorf("expected zeroed counter after ResetRules, got %+v", after.Counter)
+	}
+
+	tx = fake.NewTransaction()
+	tx.ResetRules("nosuchchain")
+	if err := fake.Run(context.Background(), tx); !IsNotFound(err) {
+		t.Errorf("expected not-found error for missing chain, got %v", err)
+	}
+}
+
+func TestFakeFlushRuleset(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	// Flushing the ruleset works even if the table doesn't exist
+	tx := fake.NewTransaction()
+	tx.FlushRuleset()
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error flushing empty ruleset: %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "drop"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.FlushRuleset()
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.Table != nil {
+		t.Errorf("expected table to be removed by flush ruleset, got:\n%s", fake.Dump())
+	}
+	if exists, _ := fake.HasTable(context.Background()); exists {
+		t.Errorf("expected HasTable to return false after flush ruleset")
+	}
+
+	// A startup-style transaction can flush everything and then recreate the table
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "old"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tx = fake.NewTransaction()
+	tx.FlushRuleset()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "new"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy new
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected dump after flush and recreate:\n%s", diff)
+	}
+
+	// Only flush is valid for rulesets
+	tx = fake.NewTransaction()
+	tx.operation(deleteVerb, &ruleset{})
+	if err := fake.Run(context.Background(), tx); err == nil {
+		t.Errorf("expected error deleting ruleset")
+	}
+}
+
+func TestFakeElementOrder(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Map{Name: "ports", Type: "ipv4_addr . inet_service : verdict"})
+	for i := 0; i < 10; i++ {
+		tx.Add(&Element{Map: "ports", Key: []string{fmt.Sprintf("10.0.0.%d", i), "80"}, Value: []string{"accept"}})
+	}
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	// delete from the middle and the end
+	tx.Delete(&Element{Map: "ports", Key: []string{"10.0.0.3", "80"}})
+	tx.Delete(&Element{Map: "ports", Key: []string{"10.0.0.9", "http"}})
+	// re-adding an existing element replaces it in place
+	tx.Add(&Element{Map: "ports", Key: []string{"10.0.0.5", "http"}, Value: []string{"drop"}})
+	// new elements go at the end, even if they were previously deleted
+	tx.Add(&Element{Map: "ports", Key: []string{"10.0.0.3", "80"}, Value: []string{"accept"}})
+	tx.Add(&Element{Map: "ports", Key: []string{"10.0.0.10", "80"}, Value: []string{"accept"}})
+	tx.Delete(&Element{Map: "ports", Key: []string{"10.0.0.0", "80"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expected := []string{
+		"10.0.0.1 . 80 : accept",
+		"10.0.0.2 . 80 : accept",
+		"10.0.0.4 . 80 : accept",
+		"10.0.0.5 . http : drop",
+		"10.0.0.6 . 80 : accept",
+		"10.0.0.7 . 80 : accept",
+		"10.0.0.8 . 80 : accept",
+		"10.0.0.3 . 80 : accept",
+		"10.0.0.10 . 80 : accept",
+	}
+	assertOrder := func() {
+		t.Helper()
+		elements, err := fake.ListElements(context.Background(), "map", "ports")
+		if err != nil {
+			t.Fatalf("unexpected error from ListElements: %v", err)
+		}
+		var actual []string
+		for _, elem := range elements {
+			actual = append(actual, strings.Join(elem.Key, " . ")+" : "+strings.Join(elem.Value, " . "))
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("unexpected element order:\n%s", diff)
+		}
+	}
+	assertOrder()
+
+	ports := fake.Table.Maps["ports"]
+	for _, elem := range ports.Elements {
+		if found := ports.FindElement(elem.Key...); found != elem {
+			t.Errorf("FindElement(%v) returned %+v", elem.Key, found)
+		}
+	}
+	if found := ports.FindElement("10.0.0.9", "80"); found != nil {
+		t.Errorf("expected deleted element to not be found, got %+v", found)
+	}
+
+	// Elements appended directly are still found
+	ports.Elements = append(ports.Elements, &Element{Map: "ports", Key: []string{"10.0.0.11", "80"}, Value: []string{"accept"}})
+	expected = append(expected, "10.0.0.11 . 80 : accept")
+	if found := ports.FindElement("10.0.0.11", "http"); found == nil {
+		t.Errorf("expected directly-appended element to be found")
+	}
+	assertOrder()
+
+	// Elements replaced directly are also found, and the elements they replaced
+	// are not.
+	replaced := &Element{Map: "ports", Key: []string{"10.0.0.12", "80"}, Value: []string{"drop"}}
+	ports.Elements[0] = replaced
+	expected[0] = "10.0.0.12 . 80 : drop"
+	if found := ports.FindElement("10.0.0.12", "80"); found != replaced {
+		t.Errorf("expected directly-replaced element to be found, got %+v", found)
+	}
+	if found := ports.FindElement("10.0.0.1", "80"); found != nil {
+		t.Errorf("expected overwritten element to not be found, got %+v", found)
+	}
+	for _, elem := range ports.Elements {
+		if found := ports.FindElement(elem.Key...); found != elem {
+			t.Errorf("FindElement(%v) returned %+v", elem.Key, found)
+		}
+	}
+	assertOrder()
+}
+
+// benchmarkElements returns a transaction that creates a set with n elements
+func benchmarkElements(fake *Fake, n int) *Transaction {
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	for i := 0; i < n; i++ {
+		tx.Add(&Element{Set: "set", Key: []string{fmt.Sprintf("10.%d.%d.%d", i/65536, (i/256)%256, i%256)}})
+	}
+	return tx
+}
+
+func BenchmarkFakeAddElements(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		fake := NewFake(IPv4Family, "kube-proxy")
+		if err := fake.Run(context.Background(), benchmarkElements(fake, 100000)); err != nil {
+			b.Fatalf("unexpected error from Run: %v", err)
+		}
+	}
+}
+
+func BenchmarkFakeFindElement(b *testing.B) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if err := fake.Run(context.Background(), benchmarkElements(fake, 100000)); err != nil {
+		b.Fatalf("unexpected error from Run: %v", err)
+	}
+	set := fake.Table.Sets["set"]
+	keyTypes := set.keyTypes()
+	key := []string{"10.1.134.159"}
+
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if findElement(set.Elements, keyTypes, key) == -1 {
+				b.Fatalf("element not found")
+			}
+		}
+	})
+	b.Run("indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if set.FindElement(key...) == nil {
+				b.Fatalf("element not found")
+			}
+		}
+	})
+}
+
+func BenchmarkFakeDump(b *testing.B) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr . inet_service : verdict", Comment: PtrTo("services")})
+	for i := 0; i < 100; i++ {
+		chain := fmt.Sprintf("chain-%d", i)
+		tx.Add(&Chain{Name: chain})
+		for j := 0; j < 100; j++ {
+			tx.Add(&Rule{
+				Chain:   chain,
+				Rule:    fmt.Sprintf("ip daddr 10.0.%d.%d tcp dport 80 counter accept", i, j),
+				Comment: PtrTo("rule"),
+			})
+		}
+	}
+	for i := 0; i < 50000; i++ {
+		ip := fmt.Sprintf("10.%d.%d.%d", i/65536, (i/256)%256, i%256)
+		tx.Add(&Element{Set: "set", Key: []string{ip}})
+		tx.Add(&Element{Map: "map", Key: []string{ip, "80"}, Value: []string{"goto chain-0"}})
+	}
+	if err := fake.Run(context.Background(), tx); err != nil {
+		b.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	for _, opts := range []DumpOptions{{}, {IncludeHandles: true}} {
+		b.Run(fmt.Sprintf("IncludeHandles=%v", opts.IncludeHandles), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = fake.DumpWithOptions(opts)
+			}
+		})
+	}
+}
+
+func TestFakeHandleAllocation(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	for i := 1; i <= 10; i++ {
+		tx.Add(&Element{Set: "set", Key: []string{fmt.Sprintf("10.0.0.%d", i)}})
+	}
+	tx.Add(&Rule{Chain: "chain", Rule: "ip saddr @set drop"})
+	tx.Add(&Rule{Chain: "chain", Rule: "accept"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	assertHandle := func(what string, handle *int, expected int) {
+		t.Helper()
+		if handle == nil {
+			t.Errorf("expected %s to have handle %d, got nil", what, expected)
+		} else if *handle != expected {
+			t.Errorf("expected %s to have handle %d, got %d", what, expected, *handle)
+		}
+	}
+	assertHandle("table", fake.Table.Handle, 1)
+	assertHandle("chain", fake.Table.Chains["chain"].Handle, 2)
+	assertHandle("set", fake.Table.Sets["set"].Handle, 3)
+	assertHandle("rule 0", fake.Table.Chains["chain"].Rules[0].Handle, 4)
+	assertHandle("rule 1", fake.Table.Chains["chain"].Rules[1].Handle, 5)
+
+	// Re-adding existing objects and adding elements doesn't use up handles
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.11"}})
+	tx.Insert(&Rule{Chain: "chain", Rule: "ip saddr 10.0.0.0/8 accept"})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	assertHandle("table", fake.Table.Handle, 1)
+	assertHandle("inserted rule", fake.Table.Chains["chain"].Rules[0].Handle, 6)
+	assertHandle("map", fake.Table.Maps["map"].Handle, 7)
+
+	// Handles are not reused after deletion
+	tx = fake.NewTransaction()
+	tx.Delete(&Map{Name: "map"})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	assertHandle("re-created map", fake.Table.Maps["map"].Handle, 8)
+
+	// SetHandleBase
+	fake.Reset()
+	fake.SetHandleBase(100)
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	assertHandle("table", fake.Table.Handle, 100)
+	assertHandle("chain", fake.Table.Chains["chain"].Handle, 101)
+}
+
+func TestFakeElementsDoNotConsumeHandles(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : verdict"})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Create(&Element{Set: "set", Key: []string{"10.0.0.2"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip saddr @set drop"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	chain := fake.Table.Chains["chain"]
+	if *chain.Rules[0].Handle != *chain.Handle+1 {
+		t.Errorf("expected rule handle %d, got %d", *chain.Handle+1, *chain.Rules[0].Handle)
+	}
+
+	// Deleting by the expected handle works
+	tx = fake.NewTransaction()
+	tx.Delete(&Rule{Chain: "chain", Handle: PtrTo(*chain.Handle + 1)})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error deleting rule by handle: %v", err)
+	}
+	if rules := fake.Table.Chains["chain"].Rules; len(rules) != 0 {
+		t.Errorf("expected rule to be deleted, got %d rules", len(rules))
+	}
+}
+
+func TestFakeRuleIndexWithComments(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip saddr 10.0.0.1 drop", Comment: PtrTo("first")})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip saddr 10.0.0.2 drop", Comment: PtrTo("second")})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	tx = fake.NewTransaction()
+	tx.Insert(&Rule{Chain: "chain", Rule: "ip saddr 10.0.0.0 accept", Comment: PtrTo("inserted"), Index: PtrTo(0)})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip saddr 10.0.0.3 accept", Comment: PtrTo("added after index 1"), Index: PtrTo(1)})
+	tx.Add(&Rule{Chain: "chain", Rule: "ip saddr 10.0.0.4 accept", Index: PtrTo(0)})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	rules, err := fake.ListRules(context.Background(), "chain")
+	if err != nil {
+		t.Fatalf("unexpected error from ListRules: %v", err)
+	}
+	expected := []struct {
+		rule    string
+		comment *string
+	}{
+		{"ip saddr 10.0.0.0 accept", PtrTo("inserted")},
+		{"ip saddr 10.0.0.4 accept", nil},
+		{"ip saddr 10.0.0.1 drop", PtrTo("first")},
+		{"ip saddr 10.0.0.3 accept", PtrTo("added after index 1")},
+		{"ip saddr 10.0.0.2 drop", PtrTo("second")},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i := range expected {
+		if rules[i].Rule != expected[i].rule {
+			t.Errorf("expected rule %d to be %q, got %q", i, expected[i].rule, rules[i].Rule)
+		}
+		if !reflect.DeepEqual(rules[i].Comment, expected[i].comment) {
+			t.Errorf("expected rule %d to have comment %v, got %v", i, expected[i].comment, rules[i].Comment)
+		}
+		if rules[i].Index != nil {
+			t.Errorf("expected rule %d to have no Index, got %d", i, *rules[i].Index)
+		}
+		if rules[i].Handle == nil {
+			t.Errorf("expected rule %d to have a Handle", i)
+		}
+	}
+}
+
+func TestFakeMapFindElementsByValue(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Add(&Map{Name: "policy", Type: "ipv4_addr : verdict"})
+	tx.Add(&Element{Map: "policy", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	tx.Add(&Element{Map: "policy", Key: []string{"10.0.0.2"}, Value: []string{"accept"}})
+	tx.Add(&Element{Map: "policy", Key: []string{"10.0.0.3"}, Value: []string{"drop"}})
+	tx.Add(&Element{Map: "policy", Key: []string{"10.0.0.4"}, Value: []string{"goto chain"}})
+	tx.Add(&Map{Name: "concat", Type: "ipv4_addr : ipv4_addr . inet_service"})
+	tx.Add(&Element{Map: "concat", Key: []string{"10.0.0.1"}, Value: []string{"192.168.0.1", "80"}})
+	tx.Add(&Element{Map: "concat", Key: []string{"10.0.0.2"}, Value: []string{"192.168.0.1", "443"}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	keys := func(elements []*Element) []string {
+		var keys []string
+		for _, elem := range elements {
+			keys = append(keys, strings.Join(elem.Key, " . "))
+		}
+		return keys
+	}
+
+	policy := fake.Table.Maps["policy"]
+	if diff := cmp.Diff([]string{"10.0.0.1", "10.0.0.3"}, keys(policy.FindElementsByValue("drop"))); diff != "" {
+		t.Errorf("unexpected elements for drop:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"10.0.0.4"}, keys(policy.FindElementsByValue("goto chain"))); diff != "" {
+		t.Errorf("unexpected elements for goto:\n%s", diff)
+	}
+	if elements := policy.FindElementsByValue("jump chain"); elements != nil {
+		t.Errorf("expected no elements for jump, got %v", keys(elements))
+	}
+
+	concat := fake.Table.Maps["concat"]
+	if diff := cmp.Diff([]string{"10.0.0.2"}, keys(concat.FindElementsByValue("192.168.0.1", "443"))); diff != "" {
+		t.Errorf("unexpected elements for concatenated value:\n%s", diff)
+	}
+	if elements := concat.FindElementsByValue("192.168.0.1"); elements != nil {
+		t.Errorf("expected partial value to match nothing, got %v", keys(elements))
+	}
+}
+
+func TestFakeSortedElements(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr . inet_proto . inet_service"})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr . inet_service : verdict"})
+	for _, key := range [][]string{
+		{"10.0.0.10", "tcp", "80"},
+		{"10.0.0.2", "udp", "53"},
+		{"10.0.0.2", "tcp", "8080"},
+		{"10.0.0.2", "tcp", "443"},
+		{"10.0.0.1", "tcp", "80"},
+	} {
+		tx.Add(&Element{Set: "set", Key: key})
+		tx.Add(&Element{Map: "map", Key: []string{key[0], key[2]}, Value: []string{"accept"}})
+	}
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	keys := func(elements []*Element) []string {
+		var keys []string
+		for _, elem := range elements {
+			keys = append(keys, strings.Join(elem.Key, " . "))
+		}
+		return keys
+	}
+
+	set := fake.Table.Sets["set"]
+	expected := []string{
+		"10.0.0.1 . tcp . 80",
+		"10.0.0.2 . tcp . 443",
+		"10.0.0.2 . tcp . 8080",
+		"10.0.0.2 . udp . 53",
+		"10.0.0.10 . tcp . 80",
+	}
+	sorted := set.SortedElements()
+	if diff := cmp.Diff(expected, keys(sorted)); diff != "" {
+		t.Errorf("unexpected set element order:\n%s", diff)
+	}
+	if diff := cmp.Diff(keys(sorted), keys(set.SortedElements())); diff != "" {
+		t.Errorf("SortedElements is not stable:\n%s", diff)
+	}
+
+	mapObj := fake.Table.Maps["map"]
+	expected = []string{
+		"10.0.0.1 . 80",
+		"10.0.0.2 . 53",
+		"10.0.0.2 . 443",
+		"10.0.0.2 . 8080",
+		"10.0.0.10 . 80",
+	}
+	if diff := cmp.Diff(expected, keys(mapObj.SortedElements())); diff != "" {
+		t.Errorf("unexpected map element order:\n%s", diff)
+	}
+
+	// The insertion order is unchanged, and the returned elements are copies
+	if set.Elements[0].Key[0] != "10.0.0.10" {
+		t.Errorf("expected Elements to remain in insertion order, got %v", keys(set.Elements))
+	}
+	sorted[0].Key[0] = "192.168.0.1"
+	if set.FindElement("192.168.0.1", "tcp", "80") != nil || set.FindElement("10.0.0.1", "tcp", "80") == nil {
+		t.Errorf("modifying the result of SortedElements modified the set")
+	}
+}
+
+func TestFakeStrictScope(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	wrongTable := NewFake(IPv4Family, "other")
+	wrongFamily := NewFake(IPv6Family, "kube-proxy")
+
+	for _, strict := range []bool{false, true} {
+		fake.ResetAll()
+		fake.StrictScope = strict
+
+		for _, other := range []*Fake{wrongTable, wrongFamily} {
+			tx := other.NewTransaction()
+			tx.Add(&Table{})
+			tx.Add(&Chain{Name: "chain"})
+
+			err := fake.Check(context.Background(), tx)
+			if !strict {
+				if err != nil {
+					t.Errorf("unexpected error from Check with StrictScope=false: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), fmt.Sprintf(`transaction is for table "%s %s"`, other.family, other.table)) {
+				t.Errorf("expected scope error from Check, got %v", err)
+			}
+
+			err = fake.Run(context.Background(), tx)
+			if !strict {
+				if err != nil {
+					t.Errorf("unexpected error from Run with StrictScope=false: %v", err)
+				}
+			} else {
+				if err == nil || !strings.Contains(err.Error(), `but fake is for table "ip kube-proxy"`) {
+					t.Errorf("expected scope error from Run, got %v", err)
+				}
+				if fake.Table != nil {
+					t.Errorf("expected transaction for wrong table to not be applied")
+				}
+			}
+		}
+
+		// A transaction for the right table is always fine
+		tx := fake.NewTransaction()
+		tx.Add(&Table{})
+		tx.Add(&Chain{Name: "chain"})
+		if err := fake.Run(context.Background(), tx); err != nil {
+			t.Errorf("unexpected error with StrictScope=%v: %v", strict, err)
+		}
+	}
+}
+
+func TestFakeCapabilities(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Simulate an old nft that doesn't support "destroy"
+	fake.SetCapabilities()
+	tx = fake.NewTransaction()
+	tx.Destroy(&Chain{Name: "chain"})
+	for _, fn := range []func(context.Context, *Transaction) error{fake.Check, fake.Run} {
+		err := fn(context.Background(), tx)
+		if err == nil || !strings.Contains(err.Error(), "unexpected destroy") {
+			t.Errorf("expected destroy to be unsupported, got %v", err)
+		}
+	}
+	if fake.Table.Chains["chain"] == nil {
+		t.Errorf("expected chain to not be destroyed")
+	}
+
+	// Other operations still work, and Reset preserves the capabilities
+	fake.Reset()
+	tx = fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Delete(&Table{})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	tx = fake.NewTransaction()
+	tx.Destroy(&Table{})
+	if err := fake.Run(context.Background(), tx); err == nil {
+		t.Errorf("expected destroy to still be unsupported after Reset")
+	}
+
+	fake.SetCapabilities(DestroyCapability)
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error with DestroyCapability: %v", err)
+	}
+
+	fake.SetCapabilities()
+	fake.ResetAll()
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Errorf("unexpected error after ResetAll: %v", err)
+	}
+}
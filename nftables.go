@@ -21,7 +21,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Interface is an interface for running nftables commands against a given family and table.
@@ -33,16 +36,41 @@ type Interface interface {
 	// IsAlreadyExists methods can be used to test the result.
 	Run(ctx context.Context, tx *Transaction) error
 
+	// RunBatched runs a Transaction as a series of nft invocations of at most
+	// batchSize operations each, to bound the memory and parse time needed for very
+	// large transactions. Each batch is applied atomically, but the transaction as a
+	// whole is not: if a batch fails, then the batches before it will have been
+	// applied, and the batches after it will not be run. (The returned error
+	// indicates which batch failed, and can be tested with IsNotFound, etc, as with
+	// Run.) If batchSize is less than 1, this is equivalent to Run.
+	RunBatched(ctx context.Context, tx *Transaction, batchSize int) error
+
 	// Check does a dry-run of a Transaction (as with `nft --check`) and returns the
 	// result. The IsNotFound and IsAlreadyExists methods can be used to test the
 	// result.
 	Check(ctx context.Context, tx *Transaction) error
 
 	// List returns a list of the names of the objects of objectType ("chain", "set",
-	// or "map") in the table. If there are no such objects, this will return an empty
-	// list and no error.
+	// "map", "flowtable", "counter", "quota", "ct timeout", or "ct expectation") in
+	// the table. If there are no such objects, this will return an empty list and no
+	// error.
+	//
+	// As a special case, if objectType is "table" then List returns all of the
+	// tables on the system, in every family (not just the Interface's own table), in
+	// the form "FAMILY NAME" (eg, "ip kube-proxy").
 	List(ctx context.Context, objectType string) ([]string, error)
 
+	// ListWithHandles returns a map from the names of the objects of objectType
+	// ("chain", "set", "map", "flowtable", "counter", "quota", "ct timeout", or
+	// "ct expectation") in the table to their handles, which can be used
+	// to construct delete-by-handle operations. If there are no such objects, this
+	// will return an empty map and no error.
+	ListWithHandles(ctx context.Context, objectType string) (map[string]int, error)
+
+	// HasTable returns true if the Interface's table exists, and false (with no
+	// error) if it does not.
+	HasTable(ctx context.Context) (bool, error)
+
 	// ListRules returns a list of the rules in a chain, in order. If no chain name is
 	// specified, then all rules within the table will be returned. Note that at the
 	// present time, the Rule objects will have their `Comment` and `Handle` fields
@@ -56,6 +84,65 @@ type Interface interface {
 	// be "set" or "map".) If the set/map exists but contains no elements, this will
 	// return an empty list and no error.
 	ListElements(ctx context.Context, objectType, name string) ([]*Element, error)
+
+	// RangeElements calls fn on each of the elements in a set or map (objectType
+	// should be "set" or "map"), in the same order as ListElements, stopping early
+	// if fn returns false. This avoids building the full list of elements for
+	// callers that only need some of them.
+	RangeElements(ctx context.Context, objectType, name string, fn func(*Element) bool) error
+
+	// ElementCount returns the number of elements in a set or map (objectType should
+	// be "set" or "map"), without building the list of elements.
+	ElementCount(ctx context.Context, objectType, name string) (int, error)
+
+	// ListElementsMatching returns a list of the elements in a set or map for which
+	// predicate returns true. (objectType should be "set" or "map".) If there are no
+	// matching elements, this will return an empty list and no error.
+	ListElementsMatching(ctx context.Context, objectType, name string, predicate func(*Element) bool) ([]*Element, error)
+
+	// ListChainsFull returns the chains in the table, with their Type, Hook,
+	// Priority, Device, Comment, and Handle filled in (as appropriate). If there are
+	// no chains, this will return an empty list and no error.
+	ListChainsFull(ctx context.Context) ([]*Chain, error)
+
+	// ListSetsFull returns the sets in the table, with all of their properties
+	// (but not their elements) filled in. (nft does not report TypeOf, so sets
+	// that were created with TypeOf will have the corresponding Type filled in
+	// instead.) If there are no sets, this will return an empty list and no error.
+	ListSetsFull(ctx context.Context) ([]*Set, error)
+
+	// ListMapsFull returns the maps in the table, with all of their properties
+	// (but not their elements) filled in. (nft does not report TypeOf, so maps
+	// that were created with TypeOf will have the corresponding Type filled in
+	// instead.) If there are no maps, this will return an empty list and no error.
+	ListMapsFull(ctx context.Context) ([]*Map, error)
+
+	// GetChain returns the named chain, with the same fields filled in as with
+	// ListChainsFull. If the chain does not exist, it returns an error for which
+	// IsNotFound will return true.
+	GetChain(ctx context.Context, name string) (*Chain, error)
+
+	// GetSet returns the named set, with the same fields filled in as with
+	// ListSetsFull. If the set does not exist, it returns an error for which
+	// IsNotFound will return true.
+	GetSet(ctx context.Context, name string) (*Set, error)
+
+	// GetMap returns the named map, with the same fields filled in as with
+	// ListMapsFull. If the map does not exist, it returns an error for which
+	// IsNotFound will return true.
+	GetMap(ctx context.Context, name string) (*Map, error)
+
+	// DumpJSON returns the complete contents of the table, in the JSON format used
+	// by "nft --json list table", for callers that want to compare rulesets
+	// structurally rather than textually.
+	DumpJSON(ctx context.Context) (string, error)
+
+	// DumpTable returns the complete contents of the table as a series of "add"
+	// commands, in (roughly) the same format as Fake.Dump, which can be used for
+	// logging or snapshotting the table's state. (Unlike with Fake.Dump, objects
+	// are not sorted, and rules and elements are in the format that nft outputs them
+	// in, which may differ from the format they were added in.)
+	DumpTable(ctx context.Context) (string, error)
 }
 
 type nftContext struct {
@@ -151,6 +238,24 @@ func (nft *realNFTables) Run(ctx context.Context, tx *Transaction) error {
 	return err
 }
 
+// RunBatched is part of Interface
+func (nft *realNFTables) RunBatched(ctx context.Context, tx *Transaction, batchSize int) error {
+	if tx.err != nil {
+		return tx.err
+	}
+
+	batches := tx.batches(batchSize)
+	for i, batch := range batches {
+		if err := nft.Run(ctx, batch); err != nil {
+			if len(batches) == 1 {
+				return err
+			}
+			return fmt.Errorf("batch %d of %d failed: %w", i+1, len(batches), err)
+		}
+	}
+	return nil
+}
+
 // Check is part of Interface
 func (nft *realNFTables) Check(ctx context.Context, tx *Transaction) error {
 	if tx.err != nil {
@@ -272,7 +377,12 @@ func (nft *realNFTables) List(ctx context.Context, objectType string) ([]string,
 		typePlural = objectType + "s"
 	}
 
-	cmd := exec.CommandContext(ctx, nft.path, "--json", "list", typePlural, string(nft.family))
+	// Some object types ("ct timeout", "ct expectation") have multi-word names
+	args := append([]string{"--json", "list"}, strings.Fields(typePlural)...)
+	if typeSingular != "table" {
+		args = append(args, string(nft.family))
+	}
+	cmd := exec.CommandContext(ctx, nft.path, args...)
 	out, err := nft.exec.Run(cmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to run nft: %w", err)
@@ -285,6 +395,14 @@ func (nft *realNFTables) List(ctx context.Context, objectType string) ([]string,
 
 	var result []string
 	for _, obj := range objects {
+		if typeSingular == "table" {
+			family, _ := jsonVal[string](obj, "family")
+			if name, ok := jsonVal[string](obj, "name"); ok {
+				result = append(result, family+" "+name)
+			}
+			continue
+		}
+
 		objTable, _ := jsonVal[string](obj, "table")
 		if objTable != nft.table {
 			continue
@@ -297,6 +415,272 @@ func (nft *realNFTables) List(ctx context.Context, objectType string) ([]string,
 	return result, nil
 }
 
+// ListWithHandles is part of Interface
+func (nft *realNFTables) ListWithHandles(ctx context.Context, objectType string) (map[string]int, error) {
+	objectType = strings.TrimSuffix(objectType, "s")
+	switch objectType {
+	case "chain", "set", "map", "flowtable", "counter", "quota", "ct timeout", "ct expectation":
+	default:
+		return nil, fmt.Errorf("unsupported object type %q", objectType)
+	}
+
+	objects, err := nft.listObjects(ctx, objectType)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]int, len(objects))
+	for _, obj := range objects {
+		name, _ := jsonVal[string](obj, "name")
+		if _, handle := parseJSONCommentAndHandle(obj); handle != nil {
+			result[name] = *handle
+		}
+	}
+	return result, nil
+}
+
+// HasTable is part of Interface
+func (nft *realNFTables) HasTable(ctx context.Context) (bool, error) {
+	cmd := exec.CommandContext(ctx, nft.path, "--json", "list", "tables", string(nft.family))
+	out, err := nft.exec.Run(cmd)
+	if err != nil {
+		return false, fmt.Errorf("failed to run nft: %w", err)
+	}
+
+	tables, err := getJSONObjects(out, "table")
+	if err != nil {
+		return false, fmt.Errorf("unable to parse JSON output: %w", err)
+	}
+	for _, table := range tables {
+		if name, _ := jsonVal[string](table, "name"); name == nft.table {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// listObjects runs "nft --json list OBJECTTYPEs FAMILY" and returns the JSON objects
+// belonging to nft's table.
+func (nft *realNFTables) listObjects(ctx context.Context, objectType string) ([]map[string]interface{}, error) {
+	args := append([]string{"--json", "list"}, strings.Fields(objectType+"s")...)
+	args = append(args, string(nft.family))
+	cmd := exec.CommandContext(ctx, nft.path, args...)
+	out, err := nft.exec.Run(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run nft: %w", err)
+	}
+
+	objects, err := getJSONObjects(out, objectType)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse JSON output: %w", err)
+	}
+
+	result := make([]map[string]interface{}, 0, len(objects))
+	for _, obj := range objects {
+		if objTable, _ := jsonVal[string](obj, "table"); objTable == nft.table {
+			result = append(result, obj)
+		}
+	}
+	return result, nil
+}
+
+// ListChainsFull is part of Interface
+func (nft *realNFTables) ListChainsFull(ctx context.Context) ([]*Chain, error) {
+	jsonChains, err := nft.listObjects(ctx, "chain")
+	if err != nil {
+		return nil, err
+	}
+
+	chains := make([]*Chain, 0, len(jsonChains))
+	for _, jsonChain := range jsonChains {
+		chains = append(chains, parseJSONChain(jsonChain))
+	}
+	return chains, nil
+}
+
+// ListSetsFull is part of Interface
+func (nft *realNFTables) ListSetsFull(ctx context.Context) ([]*Set, error) {
+	jsonSets, err := nft.listObjects(ctx, "set")
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make([]*Set, 0, len(jsonSets))
+	for _, jsonSet := range jsonSets {
+		sets = append(sets, parseJSONSet(jsonSet))
+	}
+	return sets, nil
+}
+
+// ListMapsFull is part of Interface
+func (nft *realNFTables) ListMapsFull(ctx context.Context) ([]*Map, error) {
+	jsonMaps, err := nft.listObjects(ctx, "map")
+	if err != nil {
+		return nil, err
+	}
+
+	maps := make([]*Map, 0, len(jsonMaps))
+	for _, jsonMap := range jsonMaps {
+		maps = append(maps, parseJSONMap(jsonMap))
+	}
+	return maps, nil
+}
+
+// getObject runs "nft --json list $objectType $family $table $name" and returns the
+// single JSON object of type objectType from the result.
+func (nft *realNFTables) getObject(ctx context.Context, objectType, name string) (map[string]interface{}, error) {
+	cmd := exec.CommandContext(ctx, nft.path, "--json", "list", objectType, string(nft.family), nft.table, name)
+	out, err := nft.exec.Run(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run nft: %w", err)
+	}
+
+	objects, err := getJSONObjects(out, objectType)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse JSON output: %w", err)
+	}
+	if len(objects) != 1 {
+		return nil, fmt.Errorf("unexpected JSON output from nft (expected 1 %s, got %d)", objectType, len(objects))
+	}
+	return objects[0], nil
+}
+
+// GetChain is part of Interface
+func (nft *realNFTables) GetChain(ctx context.Context, name string) (*Chain, error) {
+	jsonChain, err := nft.getObject(ctx, "chain", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONChain(jsonChain), nil
+}
+
+// GetSet is part of Interface
+func (nft *realNFTables) GetSet(ctx context.Context, name string) (*Set, error) {
+	jsonSet, err := nft.getObject(ctx, "set", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONSet(jsonSet), nil
+}
+
+// GetMap is part of Interface
+func (nft *realNFTables) GetMap(ctx context.Context, name string) (*Map, error) {
+	jsonMap, err := nft.getObject(ctx, "map", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONMap(jsonMap), nil
+}
+
+// parseJSONChain parses a JSON chain object
+func parseJSONChain(jsonChain map[string]interface{}) *Chain {
+	chain := &Chain{}
+	chain.Name, _ = jsonVal[string](jsonChain, "name")
+	if chainType, ok := jsonVal[string](jsonChain, "type"); ok {
+		chain.Type = PtrTo(BaseChainType(chainType))
+	}
+	if hook, ok := jsonVal[string](jsonChain, "hook"); ok {
+		chain.Hook = PtrTo(BaseChainHook(hook))
+	}
+	if prio, ok := jsonVal[float64](jsonChain, "prio"); ok {
+		chain.Priority = PtrTo(BaseChainPriority(strconv.Itoa(int(prio))))
+	}
+	// "accept" is the default, so only fill in Policy if it is something else
+	if policy, ok := jsonVal[string](jsonChain, "policy"); ok && policy != string(AcceptPolicy) {
+		chain.Policy = PtrTo(BaseChainPolicy(policy))
+	}
+	if dev, ok := jsonVal[string](jsonChain, "dev"); ok {
+		chain.Device = &dev
+	} else if devs, ok := jsonVal[[]interface{}](jsonChain, "dev"); ok {
+		for _, dev := range devs {
+			if devStr, ok := dev.(string); ok {
+				chain.Devices = append(chain.Devices, devStr)
+			}
+		}
+	}
+	chain.Comment, chain.Handle = parseJSONCommentAndHandle(jsonChain)
+	return chain
+}
+
+// parseJSONSet parses a JSON set object (ignoring its elements)
+func parseJSONSet(jsonSet map[string]interface{}) *Set {
+	set := &Set{}
+	set.Name, _ = jsonVal[string](jsonSet, "name")
+	set.Type = parseJSONType(jsonSet["type"])
+	set.Flags, set.Timeout, set.GCInterval, set.Size, set.Policy = parseJSONSetProperties(jsonSet)
+	if autoMerge, ok := jsonVal[bool](jsonSet, "auto-merge"); ok {
+		set.AutoMerge = &autoMerge
+	}
+	set.Comment, set.Handle = parseJSONCommentAndHandle(jsonSet)
+	return set
+}
+
+// parseJSONMap parses a JSON map object (ignoring its elements)
+func parseJSONMap(jsonMap map[string]interface{}) *Map {
+	mapObj := &Map{}
+	mapObj.Name, _ = jsonVal[string](jsonMap, "name")
+	mapObj.Type = parseJSONType(jsonMap["type"]) + " : " + parseJSONType(jsonMap["map"])
+	mapObj.Flags, mapObj.Timeout, mapObj.GCInterval, mapObj.Size, mapObj.Policy = parseJSONSetProperties(jsonMap)
+	mapObj.Comment, mapObj.Handle = parseJSONCommentAndHandle(jsonMap)
+	return mapObj
+}
+
+// parseJSONCommentAndHandle parses the "comment" and "handle" fields of a JSON object.
+func parseJSONCommentAndHandle(obj map[string]interface{}) (*string, *int) {
+	var comment *string
+	var handle *int
+	if c, ok := jsonVal[string](obj, "comment"); ok {
+		comment = &c
+	}
+	// (See the comment in ListRules about handles and float64s.)
+	if h, ok := jsonVal[float64](obj, "handle"); ok {
+		handle = PtrTo(int(h))
+	}
+	return comment, handle
+}
+
+// parseJSONType parses a set/map "type" or "map" field, which is either a single type
+// name or (for a concatenation) an array of them.
+func parseJSONType(json interface{}) string {
+	switch val := json.(type) {
+	case string:
+		return val
+	case []interface{}:
+		types := make([]string, 0, len(val))
+		for _, t := range val {
+			if str, ok := t.(string); ok {
+				types = append(types, str)
+			}
+		}
+		return strings.Join(types, " . ")
+	}
+	return ""
+}
+
+// parseJSONSetProperties parses the properties shared by sets and maps.
+func parseJSONSetProperties(obj map[string]interface{}) (flags []SetFlag, timeout, gcInterval *time.Duration, size *uint64, policy *SetPolicy) {
+	if jsonFlags, ok := jsonVal[[]interface{}](obj, "flags"); ok {
+		for _, flag := range jsonFlags {
+			if str, ok := flag.(string); ok {
+				flags = append(flags, SetFlag(str))
+			}
+		}
+	}
+	if t, ok := jsonVal[float64](obj, "timeout"); ok {
+		timeout = PtrTo(time.Duration(t) * time.Second)
+	}
+	if gc, ok := jsonVal[float64](obj, "gc-interval"); ok {
+		gcInterval = PtrTo(time.Duration(gc) * time.Second)
+	}
+	if sz, ok := jsonVal[float64](obj, "size"); ok {
+		size = PtrTo(uint64(sz))
+	}
+	if p, ok := jsonVal[string](obj, "policy"); ok {
+		policy = PtrTo(SetPolicy(p))
+	}
+	return
+}
+
 // ListRules is part of Interface
 func (nft *realNFTables) ListRules(ctx context.Context, chain string) ([]*Rule, error) {
 	// If no chain is given, return all rules from within the table.
@@ -337,6 +721,19 @@ func (nft *realNFTables) ListRules(ctx context.Context, chain string) ([]*Rule,
 		if comment, ok := jsonVal[string](jsonRule, "comment"); ok {
 			rule.Comment = &comment
 		}
+		// An inline counter appears in the rule's expressions as
+		// `{"counter": {"packets": 0, "bytes": 0}}`. (A reference to a named
+		// counter is `{"counter": "name"}`.)
+		exprs, _ := jsonVal[[]interface{}](jsonRule, "expr")
+		for _, expr := range exprs {
+			exprObj, _ := expr.(map[string]interface{})
+			if counter, ok := jsonVal[map[string]interface{}](exprObj, "counter"); ok {
+				packets, _ := jsonVal[float64](counter, "packets")
+				bytes, _ := jsonVal[float64](counter, "bytes")
+				rule.Counter = &RuleCounter{Packets: uint64(packets), Bytes: uint64(bytes)}
+				break
+			}
+		}
 
 		rules = append(rules, rule)
 	}
@@ -377,17 +774,21 @@ func (nft *realNFTables) ListElements(ctx context.Context, objectType, name stri
 			key, value = tuple[0], tuple[1]
 		}
 
-		// If the element has a comment, then key will be a compound object like:
+		// If the element has a comment, timeout, or counter, then key will be a
+		// compound object like:
 		//
 		//   {
 		//     "elem": {
 		//       "val": "192.168.0.1",
+		//       "timeout": 60,
+		//       "expires": 45,
+		//       "counter": {"packets": 5, "bytes": 420},
 		//       "comment": "this is a comment"
 		//     }
 		//   }
 		//
 		// (Where "val" contains the value that key would have held if there was no
-		// comment.)
+		// comment, timeout, or counter.)
 		if obj, ok := key.(map[string]interface{}); ok {
 			if compoundElem, ok := jsonVal[map[string]interface{}](obj, "elem"); ok {
 				if key, ok = jsonVal[interface{}](compoundElem, "val"); !ok {
@@ -396,6 +797,17 @@ func (nft *realNFTables) ListElements(ctx context.Context, objectType, name stri
 				if comment, ok := jsonVal[string](compoundElem, "comment"); ok {
 					elem.Comment = &comment
 				}
+				if timeout, ok := jsonVal[float64](compoundElem, "timeout"); ok {
+					elem.Timeout = PtrTo(time.Duration(timeout) * time.Second)
+				}
+				if expires, ok := jsonVal[float64](compoundElem, "expires"); ok {
+					elem.Expires = PtrTo(time.Duration(expires) * time.Second)
+				}
+				if counter, ok := jsonVal[map[string]interface{}](compoundElem, "counter"); ok {
+					packets, _ := jsonVal[float64](counter, "packets")
+					bytes, _ := jsonVal[float64](counter, "bytes")
+					elem.Counter = &ElementCounter{Packets: uint64(packets), Bytes: uint64(bytes)}
+				}
 			}
 		}
 
@@ -415,6 +827,206 @@ func (nft *realNFTables) ListElements(ctx context.Context, objectType, name stri
 	return elements, nil
 }
 
+// RangeElements is part of Interface. (nft has no way to list only some of the elements
+// of a set, so this fetches all of them and then calls fn on each.)
+func (nft *realNFTables) RangeElements(ctx context.Context, objectType, name string, fn func(*Element) bool) error {
+	elements, err := nft.ListElements(ctx, objectType, name)
+	if err != nil {
+		return err
+	}
+	for _, element := range elements {
+		if !fn(element) {
+			break
+		}
+	}
+	return nil
+}
+
+// ElementCount is part of Interface
+func (nft *realNFTables) ElementCount(ctx context.Context, objectType, name string) (int, error) {
+	cmd := exec.CommandContext(ctx, nft.path, "--json", "list", objectType, string(nft.family), nft.table, name)
+	out, err := nft.exec.Run(cmd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to run nft: %w", err)
+	}
+
+	jsonSetsOrMaps, err := getJSONObjects(out, objectType)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse JSON output: %w", err)
+	}
+	if len(jsonSetsOrMaps) != 1 {
+		return 0, fmt.Errorf("unexpected JSON output from nft (multiple results)")
+	}
+
+	jsonElements, _ := jsonVal[[]interface{}](jsonSetsOrMaps[0], "elem")
+	return len(jsonElements), nil
+}
+
+// ListElementsMatching is part of Interface
+func (nft *realNFTables) ListElementsMatching(ctx context.Context, objectType, name string, predicate func(*Element) bool) ([]*Element, error) {
+	return listElementsMatching(ctx, nft, objectType, name, predicate)
+}
+
+// listElementsMatching implements ListElementsMatching on top of RangeElements
+func listElementsMatching(ctx context.Context, nft Interface, objectType, name string, predicate func(*Element) bool) ([]*Element, error) {
+	elements := []*Element{}
+	err := nft.RangeElements(ctx, objectType, name, func(element *Element) bool {
+		if predicate(element) {
+			elements = append(elements, element)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return elements, nil
+}
+
+// DumpJSON is part of Interface
+func (nft *realNFTables) DumpJSON(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, nft.path, "--json", "list", "table", string(nft.family), nft.table)
+	out, err := nft.exec.Run(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to run nft: %w", err)
+	}
+
+	// Make sure the output is something we understand
+	if _, err := getJSONObjects(out, "table"); err != nil {
+		return "", fmt.Errorf("unable to parse JSON output: %w", err)
+	}
+	return out, nil
+}
+
+// DumpTable is part of Interface
+func (nft *realNFTables) DumpTable(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, nft.path, "list", "table", string(nft.family), nft.table)
+	out, err := nft.exec.Run(cmd)
+	if err != nil {
+		return "", fmt.Errorf("failed to run nft: %w", err)
+	}
+	return listOutputToTransaction(nft.family, nft.table, out)
+}
+
+// listObjectRegexp matches the first line of an object in "nft list table" output
+var listObjectRegexp = regexp.MustCompile(`^(chain|set|map|flowtable|counter|quota|ct timeout|ct expectation|ct helper|limit|secmark|synproxy) (\S+) {$`)
+
+// listOutputToTransaction converts the output of "nft list table" (for the given family
+// and table) into a series of "add" commands, in the format used by Fake.Dump.
+// Objects are output first (in the order nft listed them), followed by rules, followed
+// by set/map elements, so that the result can be used as a transaction.
+func listOutputToTransaction(family Family, table, out string) (string, error) {
+	var tableProps, objects, rules, elements []string
+
+	tableHeader := fmt.Sprintf("table %s %s {", family, table)
+	inTable, sawTable := false, false
+	var objType, objName string
+	var objProps []string
+	var statement string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !inTable {
+			if line == tableHeader {
+				inTable, sawTable = true, true
+			}
+			continue
+		}
+
+		// Accumulate multi-line statements (eg, "elements = { ... }")
+		if statement != "" {
+			statement += " " + line
+		} else {
+			statement = line
+		}
+		if braceDelta(statement) > 0 && !listObjectRegexp.MatchString(statement) {
+			continue
+		}
+		line, statement = statement, ""
+
+		switch {
+		case objType == "" && line == "}":
+			// end of table
+			inTable = false
+		case objType == "":
+			if match := listObjectRegexp.FindStringSubmatch(line); match != nil {
+				objType, objName, objProps = match[1], match[2], nil
+			} else {
+				tableProps = append(tableProps, line)
+			}
+		case line == "}":
+			objects = append(objects, formatListObject(family, table, objType, objName, objProps))
+			objType = ""
+		case objType == "chain" && !isChainProperty(line):
+			rules = append(rules, fmt.Sprintf("add rule %s %s %s %s", family, table, objName, line))
+		case (objType == "set" || objType == "map") && strings.HasPrefix(line, "elements = "):
+			elements = append(elements, fmt.Sprintf("add element %s %s %s %s", family, table, objName,
+				strings.TrimPrefix(line, "elements = ")))
+		default:
+			for _, prop := range strings.Split(line, ";") {
+				if prop = strings.TrimSpace(prop); prop != "" {
+					objProps = append(objProps, prop)
+				}
+			}
+		}
+	}
+	if !sawTable {
+		return "", fmt.Errorf("unable to parse nft output: table %s %s not found", family, table)
+	} else if inTable {
+		return "", fmt.Errorf("unable to parse nft output: unterminated block")
+	}
+
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "%s\n", formatListObject(family, table, "table", "", tableProps))
+	for _, lines := range [][]string{objects, rules, elements} {
+		for _, line := range lines {
+			fmt.Fprintf(buf, "%s\n", line)
+		}
+	}
+	return buf.String(), nil
+}
+
+// isChainProperty returns true if line (from a chain in "nft list table" output) is a
+// chain property rather than a rule.
+func isChainProperty(line string) bool {
+	return (strings.HasPrefix(line, "type ") && strings.Contains(line, " hook ")) ||
+		strings.HasPrefix(line, "policy ") || strings.HasPrefix(line, "comment ")
+}
+
+// formatListObject formats an "add" command for an object from "nft list table"
+func formatListObject(family Family, table, objType, name string, props []string) string {
+	var cmd string
+	if objType == "table" {
+		cmd = fmt.Sprintf("add table %s %s", family, table)
+	} else {
+		cmd = fmt.Sprintf("add %s %s %s %s", objType, family, table, name)
+	}
+	if len(props) == 0 {
+		return cmd
+	}
+	return cmd + " { " + strings.Join(props, " ; ") + " ; }"
+}
+
+// braceDelta returns the number of "{"s in s minus the number of "}"s, ignoring any that
+// are inside quoted strings.
+func braceDelta(s string) int {
+	delta := 0
+	inQuotes := false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case c == '{':
+			delta++
+		case c == '}':
+			delta--
+		}
+	}
+	return delta
+}
+
 // parseElementValue parses a JSON element key/value, handling concatenations, prefixes, and
 // converting numeric or "verdict" values to strings.
 func parseElementValue(json interface{}) ([]string, error) {
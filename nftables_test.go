@@ -22,6 +22,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/lithammer/dedent"
@@ -131,6 +132,7 @@ func TestList(t *testing.T) {
 	for _, tc := range []struct {
 		name       string
 		objType    string
+		nftArgs    []string
 		nftOutput  string
 		listOutput []string
 	}{
@@ -152,13 +154,31 @@ func TestList(t *testing.T) {
 			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "output", "handle": 3, "type": "nat", "hook": "output", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "postrouting", "handle": 7, "type": "nat", "hook": "postrouting", "prio": 100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "KUBE-SERVICES", "handle": 11}}, {"chain": {"family": "ip", "table": "filter", "name": "INPUT", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "accept"}}, {"chain": {"family": "ip", "table": "filter", "name": "FOO", "handle": 3}}]}`,
 			listOutput: []string{"prerouting", "output", "postrouting", "KUBE-SERVICES"},
 		},
+		{
+			name:       "tables",
+			objType:    "tables",
+			nftArgs:    []string{"/nft", "--json", "list", "tables"},
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "testing", "handle": 1}}, {"table": {"family": "ip6", "name": "testing", "handle": 2}}, {"table": {"family": "inet", "name": "filter", "handle": 3}}]}`,
+			listOutput: []string{"ip testing", "ip6 testing", "inet filter"},
+		},
+		{
+			name:       "ct timeouts",
+			objType:    "ct timeouts",
+			nftArgs:    []string{"/nft", "--json", "list", "ct", "timeouts", "ip"},
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"ct timeout": {"family": "ip", "name": "tcp-short", "table": "testing", "handle": 4, "protocol": "tcp", "l3proto": "ip", "policy": {"established": 600}}}, {"ct timeout": {"family": "ip", "name": "other", "table": "filter", "handle": 2, "protocol": "udp", "l3proto": "ip"}}]}`,
+			listOutput: []string{"tcp-short"},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
 
+			nftArgs := tc.nftArgs
+			if nftArgs == nil {
+				nftArgs = []string{"/nft", "--json", "list", "chains", "ip"}
+			}
 			fexec.expected = append(fexec.expected,
 				expectedCmd{
-					args:   []string{"/nft", "--json", "list", "chains", "ip"},
+					args:   nftArgs,
 					stdout: tc.nftOutput,
 				},
 			)
@@ -206,6 +226,69 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunBatched(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	tx := nft.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	for i := 1; i <= 4; i++ {
+		tx.Add(&Element{Set: "set", Key: []string{fmt.Sprintf("10.0.0.%d", i)}})
+	}
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args: []string{"/nft", "-f", "-"},
+			stdin: strings.TrimPrefix(dedent.Dedent(`
+				add table ip kube-proxy
+				add set ip kube-proxy set { type ipv4_addr ; }
+				add element ip kube-proxy set { 10.0.0.1 }
+				`), "\n"),
+		},
+		expectedCmd{
+			args:  []string{"/nft", "-f", "-"},
+			stdin: "add element ip kube-proxy set { 10.0.0.2, 10.0.0.3, 10.0.0.4 }\n",
+		},
+	)
+	if err := nft.RunBatched(context.Background(), tx, 3); err != nil {
+		t.Errorf("unexpected error from RunBatched: %v", err)
+	}
+
+	// A small enough transaction is run all at once, with an unwrapped error
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args: []string{"/nft", "-f", "-"},
+			stdin: strings.TrimPrefix(dedent.Dedent(`
+				add table ip kube-proxy
+				add set ip kube-proxy set { type ipv4_addr ; }
+				add element ip kube-proxy set { 10.0.0.1, 10.0.0.2, 10.0.0.3, 10.0.0.4 }
+				`), "\n"),
+		},
+	)
+	if err := nft.RunBatched(context.Background(), tx, 0); err != nil {
+		t.Errorf("unexpected error from RunBatched: %v", err)
+	}
+
+	// A failed batch stops the run, and the error says which batch failed
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:  []string{"/nft", "-f", "-"},
+			stdin: "add table ip kube-proxy\nadd set ip kube-proxy set { type ipv4_addr ; }\n",
+		},
+		expectedCmd{
+			args:  []string{"/nft", "-f", "-"},
+			stdin: "add element ip kube-proxy set { 10.0.0.1, 10.0.0.2 }\n",
+			err:   notFoundError("No such file or directory"),
+		},
+	)
+	err := nft.RunBatched(context.Background(), tx, 2)
+	if err == nil || !strings.Contains(err.Error(), "batch 2 of 3") {
+		t.Errorf("expected error from batch 2 of 3, got %v", err)
+	} else if !IsNotFound(err) {
+		t.Errorf("expected IsNotFound to match batch error, got %v", err)
+	}
+}
+
 func TestListRules(t *testing.T) {
 	for _, tc := range []struct {
 		name       string
@@ -250,12 +333,14 @@ func TestListRules(t *testing.T) {
 			nftOutput: `{"nftables": [{"metainfo": {"version": "1.0.2", "release_name": "Lester Gooch", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "testing", "handle": 3}}, {"chain": {"family": "ip", "table": "testing", "name": "chain1", "handle": 1}}, {"rule": {"family": "ip", "table": "testing", "chain": "chain1", "handle": 3, "expr": [{"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "daddr"}}, "right": "8.8.8.8"}}, {"counter": {"packets": 0, "bytes": 0}}]}}, {"chain": {"family": "ip", "table": "testing", "name": "chain2", "handle": 2}}, {"rule": {"family": "ip", "table": "testing", "chain": "chain2", "handle": 4, "expr": [{"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "daddr"}}, "right": "1.2.3.4"}}, {"counter": {"packets": 0, "bytes": 0}}]}}]}`,
 			listOutput: []*Rule{
 				{
-					Chain:  "chain1",
-					Handle: PtrTo(3),
+					Chain:   "chain1",
+					Handle:  PtrTo(3),
+					Counter: &RuleCounter{},
 				},
 				{
-					Chain:  "chain2",
-					Handle: PtrTo(4),
+					Chain:   "chain2",
+					Handle:  PtrTo(4),
+					Counter: &RuleCounter{},
 				},
 			},
 		},
@@ -328,6 +413,22 @@ func TestListElements(t *testing.T) {
 			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "inet_proto", "handle": 16, "elem": []}}]}`,
 			listOutput: []*Element{},
 		},
+		{
+			name:       "counters",
+			objectType: "set",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12, "elem": [{"elem": {"val": "192.168.1.1", "counter": {"packets": 12, "bytes": 1024}}}, "192.168.1.2"]}}]}`,
+			listOutput: []*Element{
+				{
+					Set:     "test",
+					Key:     []string{"192.168.1.1"},
+					Counter: &ElementCounter{Packets: 12, Bytes: 1024},
+				},
+				{
+					Set: "test",
+					Key: []string{"192.168.1.2"},
+				},
+			},
+		},
 		{
 			name:       "simple type",
 			objectType: "set",
@@ -348,6 +449,26 @@ func TestListElements(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:       "timeout set",
+			objectType: "set",
+			nftOutput:  `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12, "flags": ["timeout"], "timeout": 3600, "elem": [{"elem": {"val": "192.168.1.1", "timeout": 3600, "expires": 3590}}, {"elem": {"val": "192.168.1.2", "timeout": 60, "expires": 50, "comment": "short"}}]}}]}`,
+			listOutput: []*Element{
+				{
+					Set:     "test",
+					Key:     []string{"192.168.1.1"},
+					Timeout: PtrTo(time.Hour),
+					Expires: PtrTo(3590 * time.Second),
+				},
+				{
+					Set:     "test",
+					Key:     []string{"192.168.1.2"},
+					Timeout: PtrTo(time.Minute),
+					Expires: PtrTo(50 * time.Second),
+					Comment: PtrTo("short"),
+				},
+			},
+		},
 		{
 			name:       "concatenated type",
 			objectType: "set",
@@ -467,6 +588,467 @@ func TestListElements(t *testing.T) {
 	}
 }
 
+func TestElementCount(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "set", "ip", "testing", "test"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12, "elem": [{"elem": {"val": "192.168.1.1", "comment": "a"}}, "10.0.0.1", "192.168.1.2"]}}]}`,
+		},
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "map", "ip", "testing", "test"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"map": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12, "map": "verdict"}}]}`,
+		},
+		expectedCmd{
+			args: []string{"/nft", "--json", "list", "set", "ip", "testing", "missing"},
+			err:  notFoundError("No such file or directory"),
+		},
+	)
+
+	count, err := nft.ElementCount(context.Background(), "set", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if count != 3 {
+		t.Errorf("expected 3 elements in set, got %d", count)
+	}
+
+	count, err = nft.ElementCount(context.Background(), "map", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if count != 0 {
+		t.Errorf("expected 0 elements in map, got %d", count)
+	}
+
+	_, err = nft.ElementCount(context.Background(), "set", "missing")
+	if !IsNotFound(err) {
+		t.Errorf("expected not-found error, got %v", err)
+	}
+}
+
+func TestListElementsMatching(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+	output := `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "test", "table": "testing", "type": "ipv4_addr", "handle": 12, "elem": ["192.168.1.1", "10.0.0.1", "192.168.1.2"]}}]}`
+	for i := 0; i < 2; i++ {
+		fexec.expected = append(fexec.expected,
+			expectedCmd{
+				args:   []string{"/nft", "--json", "list", "set", "ip", "testing", "test"},
+				stdout: output,
+			},
+		)
+	}
+
+	result, err := nft.ListElementsMatching(context.Background(), "set", "test", func(element *Element) bool {
+		return strings.HasPrefix(element.Key[0], "192.168.")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*Element{
+		{Set: "test", Key: []string{"192.168.1.1"}},
+		{Set: "test", Key: []string{"192.168.1.2"}},
+	}
+	if diff := cmp.Diff(expected, result); diff != "" {
+		t.Errorf("unexpected result:\n%s", diff)
+	}
+
+	var seen []string
+	err = nft.RangeElements(context.Background(), "set", "test", func(element *Element) bool {
+		seen = append(seen, element.Key[0])
+		return len(seen) < 2
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"192.168.1.1", "10.0.0.1"}, seen); diff != "" {
+		t.Errorf("unexpected elements from RangeElements:\n%s", diff)
+	}
+}
+
+func TestListFull(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "chains", "ip"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "KUBE-SERVICES", "handle": 11, "comment": "services"}}, {"chain": {"family": "ip", "table": "filter", "name": "FOO", "handle": 3}}]}`,
+		},
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "sets", "ip"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "simple", "table": "testing", "type": "ipv4_addr", "handle": 5}}, {"set": {"family": "ip", "name": "complex", "table": "testing", "type": ["ipv4_addr", "inet_proto", "inet_service"], "handle": 6, "comment": "complex set", "flags": ["interval", "timeout"], "timeout": 60, "gc-interval": 120, "size": 1000, "policy": "memory", "auto-merge": true}}, {"set": {"family": "ip", "name": "other", "table": "filter", "type": "ipv4_addr", "handle": 2}}]}`,
+		},
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "maps", "ip"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"map": {"family": "ip", "name": "vmap", "table": "testing", "type": ["ipv4_addr", "inet_service"], "handle": 7, "map": "verdict"}}]}`,
+		},
+	)
+
+	chains, err := nft.ListChainsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error listing chains: %v", err)
+	}
+	expectedChains := []*Chain{
+		{
+			Name:     "prerouting",
+			Type:     PtrTo(NATType),
+			Hook:     PtrTo(PreroutingHook),
+			Priority: PtrTo(BaseChainPriority("-100")),
+			Handle:   PtrTo(1),
+		},
+		{
+			Name:    "KUBE-SERVICES",
+			Comment: PtrTo("services"),
+			Handle:  PtrTo(11),
+		},
+	}
+	if diff := cmp.Diff(expectedChains, chains); diff != "" {
+		t.Errorf("unexpected chains:\n%s", diff)
+	}
+
+	sets, err := nft.ListSetsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error listing sets: %v", err)
+	}
+	expectedSets := []*Set{
+		{
+			Name:   "simple",
+			Type:   "ipv4_addr",
+			Handle: PtrTo(5),
+		},
+		{
+			Name:       "complex",
+			Type:       "ipv4_addr . inet_proto . inet_service",
+			Flags:      []SetFlag{IntervalFlag, TimeoutFlag},
+			Timeout:    PtrTo(time.Minute),
+			GCInterval: PtrTo(2 * time.Minute),
+			Size:       PtrTo[uint64](1000),
+			Policy:     PtrTo(MemoryPolicy),
+			AutoMerge:  PtrTo(true),
+			Comment:    PtrTo("complex set"),
+			Handle:     PtrTo(6),
+		},
+	}
+	if diff := cmp.Diff(expectedSets, sets); diff != "" {
+		t.Errorf("unexpected sets:\n%s", diff)
+	}
+
+	maps, err := nft.ListMapsFull(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error listing maps: %v", err)
+	}
+	expectedMaps := []*Map{
+		{
+			Name:   "vmap",
+			Type:   "ipv4_addr . inet_service : verdict",
+			Handle: PtrTo(7),
+		},
+	}
+	if diff := cmp.Diff(expectedMaps, maps); diff != "" {
+		t.Errorf("unexpected maps:\n%s", diff)
+	}
+}
+
+func TestGet(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "chain", "ip", "testing", "prerouting"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}, {"rule": {"family": "ip", "table": "testing", "chain": "prerouting", "handle": 4, "expr": [{"accept": null}]}}]}`,
+		},
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "set", "ip", "testing", "complex"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"set": {"family": "ip", "name": "complex", "table": "testing", "type": ["ipv4_addr", "inet_proto", "inet_service"], "handle": 6, "comment": "complex set", "flags": ["interval"], "elem": [{"concat": ["10.0.0.1", "tcp", 80]}]}}]}`,
+		},
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "map", "ip", "testing", "vmap"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"map": {"family": "ip", "name": "vmap", "table": "testing", "type": "ipv4_addr", "handle": 7, "map": "verdict"}}]}`,
+		},
+		expectedCmd{
+			args: []string{"/nft", "--json", "list", "map", "ip", "testing", "nosuchmap"},
+			err:  fmt.Errorf("Error: No such file or directory"),
+		},
+	)
+
+	chain, err := nft.GetChain(context.Background(), "prerouting")
+	if err != nil {
+		t.Fatalf("unexpected error getting chain: %v", err)
+	}
+	expectedChain := &Chain{
+		Name:     "prerouting",
+		Type:     PtrTo(NATType),
+		Hook:     PtrTo(PreroutingHook),
+		Priority: PtrTo(BaseChainPriority("-100")),
+		Handle:   PtrTo(1),
+	}
+	if diff := cmp.Diff(expectedChain, chain); diff != "" {
+		t.Errorf("unexpected chain:\n%s", diff)
+	}
+
+	set, err := nft.GetSet(context.Background(), "complex")
+	if err != nil {
+		t.Fatalf("unexpected error getting set: %v", err)
+	}
+	expectedSet := &Set{
+		Name:    "complex",
+		Type:    "ipv4_addr . inet_proto . inet_service",
+		Flags:   []SetFlag{IntervalFlag},
+		Comment: PtrTo("complex set"),
+		Handle:  PtrTo(6),
+	}
+	if diff := cmp.Diff(expectedSet, set); diff != "" {
+		t.Errorf("unexpected set:\n%s", diff)
+	}
+
+	mapObj, err := nft.GetMap(context.Background(), "vmap")
+	if err != nil {
+		t.Fatalf("unexpected error getting map: %v", err)
+	}
+	expectedMap := &Map{
+		Name:   "vmap",
+		Type:   "ipv4_addr : verdict",
+		Handle: PtrTo(7),
+	}
+	if diff := cmp.Diff(expectedMap, mapObj); diff != "" {
+		t.Errorf("unexpected map:\n%s", diff)
+	}
+
+	if _, err := nft.GetMap(context.Background(), "nosuchmap"); err == nil {
+		t.Errorf("expected error getting nonexistent map")
+	}
+}
+
+func TestListWithHandles(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "chains", "ip"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}}, {"chain": {"family": "ip", "table": "testing", "name": "mark-for-masquerade", "handle": 2}}, {"chain": {"family": "ip", "table": "other", "name": "other-chain", "handle": 5}}]}`,
+		},
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "sets", "ip"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}]}`,
+		},
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "counters", "ip"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"counter": {"family": "ip", "name": "packets", "table": "testing", "handle": 7, "packets": 0, "bytes": 0}}]}`,
+		},
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "ct", "timeouts", "ip"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"ct timeout": {"family": "ip", "name": "tcp-timeout", "table": "testing", "handle": 8, "protocol": "tcp", "l3proto": "ip"}}]}`,
+		},
+	)
+
+	handles, err := nft.ListWithHandles(context.Background(), "chains")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"prerouting": 1, "mark-for-masquerade": 2}, handles); diff != "" {
+		t.Errorf("unexpected result:\n%s", diff)
+	}
+
+	handles, err = nft.ListWithHandles(context.Background(), "set")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(handles) != 0 {
+		t.Errorf("expected no sets, got %v", handles)
+	}
+
+	handles, err = nft.ListWithHandles(context.Background(), "counters")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"packets": 7}, handles); diff != "" {
+		t.Errorf("unexpected result:\n%s", diff)
+	}
+
+	handles, err = nft.ListWithHandles(context.Background(), "ct timeout")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(map[string]int{"tcp-timeout": 8}, handles); diff != "" {
+		t.Errorf("unexpected result:\n%s", diff)
+	}
+
+	if _, err := nft.ListWithHandles(context.Background(), "rules"); err == nil {
+		t.Errorf("expected error for unsupported object type")
+	}
+}
+
+func TestHasTable(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "tables", "ip"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "other", "handle": 1}}, {"table": {"family": "ip", "name": "testing", "handle": 3}}]}`,
+		},
+		expectedCmd{
+			args:   []string{"/nft", "--json", "list", "tables", "ip"},
+			stdout: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "other", "handle": 1}}]}`,
+		},
+		expectedCmd{
+			args: []string{"/nft", "--json", "list", "tables", "ip"},
+			err:  fmt.Errorf("Error: Operation not permitted"),
+		},
+	)
+
+	exists, err := nft.HasTable(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !exists {
+		t.Errorf("expected table to exist")
+	}
+
+	exists, err = nft.HasTable(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if exists {
+		t.Errorf("expected table to not exist")
+	}
+
+	if _, err := nft.HasTable(context.Background()); err == nil {
+		t.Errorf("expected error when nft fails")
+	}
+}
+
+func TestDumpTable(t *testing.T) {
+	nft, fexec, _ := newTestInterface(t, IPv4Family, "kube-proxy")
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args: []string{"/nft", "list", "table", "ip", "kube-proxy"},
+			stdout: dedent.Dedent(`
+				table ip kube-proxy {
+					comment "rules for kube-proxy"
+					set cluster-ips {
+						type ipv4_addr
+						flags interval
+						comment "Active ClusterIPs"
+						elements = { 10.0.0.0/24, 172.30.0.1,
+							     172.30.0.10 }
+					}
+
+					map service-ips {
+						type ipv4_addr . inet_proto . inet_service : verdict
+						elements = { 172.30.0.1 . tcp . 443 : goto service-api }
+					}
+
+					counter packets {
+						packets 0 bytes 0
+					}
+
+					chain filter-prerouting {
+						type filter hook prerouting priority dstnat - 10; policy accept;
+						comment "prerouting"
+						ct state new jump firewall-check
+						ip daddr { 10.0.0.1, 10.0.0.2 } drop comment "unbalanced { in comment"
+					}
+
+					chain firewall-check {
+					}
+
+					chain service-api {
+						ip daddr @cluster-ips accept
+					}
+				}
+				`),
+		},
+	)
+
+	dump, err := nft.DumpTable(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy { comment "rules for kube-proxy" ; }
+		add set ip kube-proxy cluster-ips { type ipv4_addr ; flags interval ; comment "Active ClusterIPs" ; }
+		add map ip kube-proxy service-ips { type ipv4_addr . inet_proto . inet_service : verdict ; }
+		add counter ip kube-proxy packets { packets 0 bytes 0 ; }
+		add chain ip kube-proxy filter-prerouting { type filter hook prerouting priority dstnat - 10 ; policy accept ; comment "prerouting" ; }
+		add chain ip kube-proxy firewall-check
+		add chain ip kube-proxy service-api
+		add rule ip kube-proxy filter-prerouting ct state new jump firewall-check
+		add rule ip kube-proxy filter-prerouting ip daddr { 10.0.0.1, 10.0.0.2 } drop comment "unbalanced { in comment"
+		add rule ip kube-proxy service-api ip daddr @cluster-ips accept
+		add element ip kube-proxy cluster-ips { 10.0.0.0/24, 172.30.0.1, 172.30.0.10 }
+		add element ip kube-proxy service-ips { 172.30.0.1 . tcp . 443 : goto service-api }
+		`), "\n")
+	if diff := cmp.Diff(expected, dump); diff != "" {
+		t.Errorf("unexpected DumpTable result:\n%s", diff)
+	}
+
+	// The output can be loaded into a Fake
+	fake := NewFake(IPv4Family, "kube-proxy")
+	if err := fake.ParseDump(dump); err != nil {
+		t.Errorf("unexpected error parsing DumpTable output: %v", err)
+	}
+
+	fexec.expected = append(fexec.expected,
+		expectedCmd{
+			args:   []string{"/nft", "list", "table", "ip", "kube-proxy"},
+			stdout: "table ip kube-proxy {\n\tchain foo {\n",
+		},
+	)
+	if _, err := nft.DumpTable(context.Background()); err == nil {
+		t.Errorf("expected error parsing truncated output")
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		nftOutput string
+		nftError  string
+		parseErr  bool
+	}{
+		{
+			name:     "no such table",
+			nftError: "Error: No such file or directory\nlist table ip testing\n                ^^^^^^^\n",
+		},
+		{
+			name:      "normal output",
+			nftOutput: `{"nftables": [{"metainfo": {"version": "1.0.1", "release_name": "Fearless Fosdick #3", "json_schema_version": 1}}, {"table": {"family": "ip", "name": "testing", "handle": 1}}, {"chain": {"family": "ip", "table": "testing", "name": "testchain", "handle": 2}}]}`,
+		},
+		{
+			name:      "bad output",
+			nftOutput: `{"nftables": [{"table": {"family": "ip", "name": "testing", "handle": 1}}]}`,
+			parseErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nft, fexec, _ := newTestInterface(t, IPv4Family, "testing")
+
+			var err error
+			if tc.nftError != "" {
+				err = fmt.Errorf(tc.nftError)
+			}
+			fexec.expected = append(fexec.expected,
+				expectedCmd{
+					args:   []string{"/nft", "--json", "list", "table", "ip", "testing"},
+					stdout: tc.nftOutput,
+					err:    err,
+				},
+			)
+			result, err := nft.DumpJSON(context.Background())
+			if err != nil {
+				if tc.nftError == "" && !tc.parseErr {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			} else if tc.nftError != "" || tc.parseErr {
+				t.Errorf("unexpected non-error")
+				return
+			}
+
+			if result != tc.nftOutput {
+				t.Errorf("unexpected result: %s", result)
+			}
+		})
+	}
+}
+
 func TestFeatures(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
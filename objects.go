@@ -23,8 +23,29 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
+// writeStrings writes strs to writer. This is used instead of fmt.Fprintf when writing
+// rules and elements, since there may be very many of them, and fmt.Fprintf allocates
+// for each of its arguments.
+func writeStrings(writer io.Writer, strs ...string) {
+	for _, str := range strs {
+		_, _ = io.WriteString(writer, str)
+	}
+}
+
+// writeJoined writes strs to writer, separated by sep (like strings.Join, but without
+// allocating a new string).
+func writeJoined(writer io.Writer, strs []string, sep string) {
+	for i, str := range strs {
+		if i > 0 {
+			_, _ = io.WriteString(writer, sep)
+		}
+		_, _ = io.WriteString(writer, str)
+	}
+}
+
 func parseInt(numbersOnly string) *int {
 	i64, _ := strconv.ParseInt(numbersOnly, 10, 64)
 	i := int(i64)
@@ -42,22 +63,72 @@ func getComment(commentGroup string) *string {
 	if commentGroup == "" {
 		return nil
 	}
-	noQuotes := strings.Trim(commentGroup, "\"")
+	// nft doesn't support escapes in quoted strings, so the comment is just whatever
+	// is between the quotes.
+	noQuotes := commentGroup[1 : len(commentGroup)-1]
 	return &noQuotes
 }
 
+// plainDeviceRegexp matches device names that nft accepts without quoting. Anything
+// else (notably wildcard names like "eth*") must be quoted.
+var plainDeviceRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// formatDevices formats devices for a "devices = { ... }" property, quoting any names
+// (such as wildcards) that nft would not accept bare.
+func formatDevices(devices []string) string {
+	formatted := make([]string, len(devices))
+	for i, device := range devices {
+		if plainDeviceRegexp.MatchString(device) {
+			formatted[i] = device
+		} else {
+			formatted[i] = strconv.Quote(device)
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// parseDevices parses the contents of a "devices = { ... }" property, as written by
+// formatDevices.
+func parseDevices(devices string) []string {
+	res := strings.Split(devices, ", ")
+	for i, device := range res {
+		if unquoted, err := strconv.Unquote(device); err == nil {
+			res[i] = unquoted
+		}
+	}
+	return res
+}
+
+// checkDevices checks that device and devices don't contain any empty device names.
+// (Wildcard names like "eth*" are allowed.)
+func checkDevices(device *string, devices []string) error {
+	if device != nil && *device == "" {
+		return fmt.Errorf("empty device name")
+	}
+	for _, dev := range devices {
+		if dev == "" {
+			return fmt.Errorf("empty device name")
+		}
+	}
+	return nil
+}
+
 var commentGroup = `(".*")`
 var noSpaceGroup = `([^ ]*)`
 var numberGroup = `([0-9]*)`
 
 // Object implementation for Table
 func (table *Table) validate(verb verb) error {
+	if err := validateComment(table.Comment); err != nil {
+		return err
+	}
+
 	switch verb {
 	case addVerb, createVerb, flushVerb:
 		if table.Handle != nil {
 			return fmt.Errorf("cannot specify Handle in %s operation", verb)
 		}
-	case deleteVerb:
+	case deleteVerb, destroyVerb:
 		// Handle can be nil or non-nil
 	default:
 		return fmt.Errorf("%s is not implemented for tables", verb)
@@ -67,9 +138,9 @@ func (table *Table) validate(verb verb) error {
 }
 
 func (table *Table) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
-	// Special case for delete-by-handle
-	if verb == deleteVerb && table.Handle != nil {
-		fmt.Fprintf(writer, "delete table %s handle %d", ctx.family, *table.Handle)
+	// Special case for delete/destroy-by-handle
+	if (verb == deleteVerb || verb == destroyVerb) && table.Handle != nil {
+		fmt.Fprintf(writer, "%s table %s handle %d", verb, ctx.family, *table.Handle)
 		return
 	}
 
@@ -77,7 +148,7 @@ func (table *Table) writeOperation(verb verb, ctx *nftContext, writer io.Writer)
 	fmt.Fprintf(writer, "%s table %s %s", verb, ctx.family, ctx.table)
 	if verb == addVerb || verb == createVerb {
 		if table.Comment != nil && !ctx.noObjectComments {
-			fmt.Fprintf(writer, " { comment %q ; }", *table.Comment)
+			fmt.Fprintf(writer, " { comment %s ; }", quoteComment(*table.Comment))
 		}
 	}
 	fmt.Fprintf(writer, "\n")
@@ -97,17 +168,33 @@ func (table *Table) parse(line string) error {
 
 // Object implementation for Chain
 func (chain *Chain) validate(verb verb) error {
+	if err := validateComment(chain.Comment); err != nil {
+		return err
+	}
+
 	if chain.Hook == nil {
 		if chain.Type != nil || chain.Priority != nil {
 			return fmt.Errorf("regular chain %q must not specify Type or Priority", chain.Name)
 		}
-		if chain.Device != nil {
-			return fmt.Errorf("regular chain %q must not specify Device", chain.Name)
+		if chain.Device != nil || len(chain.Devices) != 0 {
+			return fmt.Errorf("regular chain %q must not specify Device or Devices", chain.Name)
+		}
+		if chain.Policy != nil {
+			return fmt.Errorf("regular chain %q must not specify Policy", chain.Name)
 		}
 	} else {
 		if chain.Type == nil || chain.Priority == nil {
 			return fmt.Errorf("base chain %q must specify Type and Priority", chain.Name)
 		}
+		if chain.Device != nil && len(chain.Devices) != 0 {
+			return fmt.Errorf("base chain %q must not specify both Device and Devices", chain.Name)
+		}
+		if err := checkDevices(chain.Device, chain.Devices); err != nil {
+			return fmt.Errorf("base chain %q: %w", chain.Name, err)
+		}
+		if chain.Policy != nil && *chain.Policy != AcceptPolicy && *chain.Policy != DropPolicy {
+			return fmt.Errorf("base chain %q has invalid Policy %q", chain.Name, *chain.Policy)
+		}
 	}
 
 	switch verb {
@@ -118,7 +205,7 @@ func (chain *Chain) validate(verb verb) error {
 		if chain.Handle != nil {
 			return fmt.Errorf("cannot specify Handle in %s operation", verb)
 		}
-	case deleteVerb:
+	case deleteVerb, destroyVerb:
 		if chain.Name == "" && chain.Handle == nil {
 			return fmt.Errorf("must specify either name or handle")
 		}
@@ -130,9 +217,9 @@ func (chain *Chain) validate(verb verb) error {
 }
 
 func (chain *Chain) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
-	// Special case for delete-by-handle
-	if verb == deleteVerb && chain.Handle != nil {
-		fmt.Fprintf(writer, "delete chain %s %s handle %d", ctx.family, ctx.table, *chain.Handle)
+	// Special case for delete/destroy-by-handle
+	if (verb == deleteVerb || verb == destroyVerb) && chain.Handle != nil {
+		fmt.Fprintf(writer, "%s chain %s %s handle %d", verb, ctx.family, ctx.table, *chain.Handle)
 		return
 	}
 
@@ -145,6 +232,8 @@ func (chain *Chain) writeOperation(verb verb, ctx *nftContext, writer io.Writer)
 				fmt.Fprintf(writer, " type %s hook %s", *chain.Type, *chain.Hook)
 				if chain.Device != nil {
 					fmt.Fprintf(writer, " device %q", *chain.Device)
+				} else if len(chain.Devices) != 0 {
+					fmt.Fprintf(writer, " devices = { %s }", formatDevices(chain.Devices))
 				}
 
 				// Parse the priority to a number if we can, because older
@@ -156,9 +245,12 @@ func (chain *Chain) writeOperation(verb verb, ctx *nftContext, writer io.Writer)
 				} else {
 					fmt.Fprintf(writer, " priority %s ;", *chain.Priority)
 				}
+				if chain.Policy != nil {
+					fmt.Fprintf(writer, " policy %s ;", *chain.Policy)
+				}
 			}
 			if chain.Comment != nil && !ctx.noObjectComments {
-				fmt.Fprintf(writer, " comment %q ;", *chain.Comment)
+				fmt.Fprintf(writer, " comment %s ;", quoteComment(*chain.Comment))
 			}
 
 			fmt.Fprintf(writer, " }")
@@ -168,10 +260,10 @@ func (chain *Chain) writeOperation(verb verb, ctx *nftContext, writer io.Writer)
 	fmt.Fprintf(writer, "\n")
 }
 
-// groups in []: [1]%s(?: {(?: type [2]%s hook [3]%s(?: device "[4]%s")(?: priority [5]%s ;))(?: comment [6]%s ;) })
+// groups in []: [1]%s(?: {(?: type [2]%s hook [3]%s(?: device "[4]%s"| devices = { [5]([^}]*) })(?: priority [6]%s ;)(?: policy [7]%s ;))(?: comment [8]%s ;) })
 var chainRegexp = regexp.MustCompile(fmt.Sprintf(
-	`%s(?: {(?: type %s hook %s(?: device "%s")?(?: priority %s ;))?(?: comment %s ;)? })?`,
-	noSpaceGroup, noSpaceGroup, noSpaceGroup, noSpaceGroup, noSpaceGroup, commentGroup))
+	`%s(?: {(?: type %s hook %s(?: device "%s"| devices = { ([^}]*) })?(?: priority %s ;)(?: policy %s ;)?)?(?: comment %s ;)? })?`,
+	noSpaceGroup, noSpaceGroup, noSpaceGroup, noSpaceGroup, noSpaceGroup, noSpaceGroup, commentGroup))
 
 func (chain *Chain) parse(line string) error {
 	match := chainRegexp.FindStringSubmatch(line)
@@ -179,7 +271,7 @@ func (chain *Chain) parse(line string) error {
 		return fmt.Errorf("failed parsing chain add command")
 	}
 	chain.Name = match[1]
-	chain.Comment = getComment(match[6])
+	chain.Comment = getComment(match[8])
 	if match[2] != "" {
 		chain.Type = (*BaseChainType)(&match[2])
 	}
@@ -190,13 +282,123 @@ func (chain *Chain) parse(line string) error {
 		chain.Device = &match[4]
 	}
 	if match[5] != "" {
-		chain.Priority = (*BaseChainPriority)(&match[5])
+		chain.Devices = parseDevices(match[5])
+	}
+	if match[6] != "" {
+		chain.Priority = (*BaseChainPriority)(&match[6])
+	}
+	if match[7] != "" {
+		chain.Policy = (*BaseChainPolicy)(&match[7])
 	}
 	return nil
 }
 
+// chainRename is the Object used for Transaction.Rename.
+type chainRename struct {
+	chain   *Chain
+	newName string
+}
+
+// Object implementation for chainRename
+func (rename *chainRename) validate(verb verb) error {
+	if verb != renameVerb {
+		return fmt.Errorf("%s is not implemented for chain renames", verb)
+	}
+	if rename.chain.Name == "" {
+		return fmt.Errorf("no name specified for chain")
+	}
+	if rename.newName == "" {
+		return fmt.Errorf("no new name specified for chain %q", rename.chain.Name)
+	}
+	return nil
+}
+
+func (rename *chainRename) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	fmt.Fprintf(writer, "rename chain %s %s %s %s\n", ctx.family, ctx.table, rename.chain.Name, rename.newName)
+}
+
+func (rename *chainRename) parse(line string) error {
+	return fmt.Errorf("cannot parse chain rename")
+}
+
+// ruleset is the Object used for Transaction.FlushRuleset.
+type ruleset struct{}
+
+// Object implementation for ruleset
+func (*ruleset) validate(verb verb) error {
+	if verb != flushVerb {
+		return fmt.Errorf("%s is not implemented for rulesets", verb)
+	}
+	return nil
+}
+
+func (*ruleset) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	fmt.Fprintf(writer, "flush ruleset\n")
+}
+
+func (*ruleset) parse(line string) error {
+	return fmt.Errorf("cannot parse ruleset flush")
+}
+
+// rulesReset is the Object used for Transaction.ResetRules.
+type rulesReset struct {
+	chain string
+}
+
+// Object implementation for rulesReset
+func (reset *rulesReset) validate(verb verb) error {
+	if verb != resetVerb {
+		return fmt.Errorf("%s is not implemented for rule resets", verb)
+	}
+	if reset.chain == "" {
+		return fmt.Errorf("no chain specified for rule reset")
+	}
+	return nil
+}
+
+func (reset *rulesReset) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	fmt.Fprintf(writer, "reset rules chain %s %s %s\n", ctx.family, ctx.table, reset.chain)
+}
+
+func (reset *rulesReset) parse(line string) error {
+	return fmt.Errorf("cannot parse rule reset")
+}
+
+// BaseChainInfo returns chain's base-chain attributes, and true, if chain is a base chain,
+// or nil and false if it is a regular chain.
+func (chain *Chain) BaseChainInfo() (*BaseChainInfo, bool) {
+	if chain.Hook == nil {
+		return nil, false
+	}
+
+	info := &BaseChainInfo{
+		Hook:   *chain.Hook,
+		Policy: AcceptPolicy,
+	}
+	if chain.Type != nil {
+		info.Type = *chain.Type
+	}
+	if chain.Priority != nil {
+		info.Priority = *chain.Priority
+	}
+	if chain.Policy != nil {
+		info.Policy = *chain.Policy
+	}
+	if chain.Device != nil {
+		info.Device = *chain.Device
+	}
+	if chain.Devices != nil {
+		info.Devices = append([]string(nil), chain.Devices...)
+	}
+	return info, true
+}
+
 // Object implementation for Rule
 func (rule *Rule) validate(verb verb) error {
+	if err := validateComment(rule.Comment); err != nil {
+		return err
+	}
+
 	if rule.Chain == "" {
 		return fmt.Errorf("no chain name specified for rule")
 	}
@@ -204,6 +406,12 @@ func (rule *Rule) validate(verb verb) error {
 	if rule.Index != nil && rule.Handle != nil {
 		return fmt.Errorf("cannot specify both Index and Handle")
 	}
+	if rule.Index != nil && *rule.Index < 0 {
+		return fmt.Errorf("invalid negative Index %d", *rule.Index)
+	}
+	if rule.Counter != nil && findRuleCounter(strings.Split(rule.Rule, " ")) == -1 && (verb == addVerb || verb == insertVerb || verb == replaceVerb) {
+		return fmt.Errorf("rule %q has Counter but no \"counter\" statement", rule.Rule)
+	}
 
 	switch verb {
 	case addVerb, insertVerb:
@@ -217,7 +425,7 @@ func (rule *Rule) validate(verb verb) error {
 		if rule.Handle == nil {
 			return fmt.Errorf("must specify Handle with %s", verb)
 		}
-	case deleteVerb:
+	case deleteVerb, destroyVerb:
 		if rule.Handle == nil {
 			return fmt.Errorf("must specify Handle with %s", verb)
 		}
@@ -229,7 +437,7 @@ func (rule *Rule) validate(verb verb) error {
 }
 
 func (rule *Rule) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
-	fmt.Fprintf(writer, "%s rule %s %s %s", verb, ctx.family, ctx.table, rule.Chain)
+	writeStrings(writer, string(verb), " rule ", string(ctx.family), " ", ctx.table, " ", rule.Chain)
 	if rule.Index != nil {
 		fmt.Fprintf(writer, " index %d", *rule.Index)
 	} else if rule.Handle != nil {
@@ -238,19 +446,23 @@ func (rule *Rule) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 
 	switch verb {
 	case addVerb, insertVerb, replaceVerb:
-		fmt.Fprintf(writer, " %s", rule.Rule)
+		if rule.Counter != nil {
+			writeStrings(writer, " ", ruleWithCounter(rule.Rule, rule.Counter))
+		} else {
+			writeStrings(writer, " ", rule.Rule)
+		}
 
 		if rule.Comment != nil {
-			fmt.Fprintf(writer, " comment %q", *rule.Comment)
+			writeStrings(writer, " comment ", quoteComment(*rule.Comment))
 		}
 	}
 
-	fmt.Fprintf(writer, "\n")
+	writeStrings(writer, "\n")
 }
 
-// groups in []: [1]%s(?: index [2]%s)?(?: handle [3]%s)? [4]([^"]*)(?: comment [5]%s)?$
+// groups in []: [1]%s(?: index [2]%s)?(?: handle [3]%s)? [4](.*?)(?: comment [5]%s)?$
 var ruleRegexp = regexp.MustCompile(fmt.Sprintf(
-	`%s(?: index %s)?(?: handle %s)? ([^"]*)(?: comment %s)?$`,
+	`%s(?: index %s)?(?: handle %s)? (.*?)(?: comment %s)?$`,
 	noSpaceGroup, numberGroup, numberGroup, commentGroup))
 
 func (rule *Rule) parse(line string) error {
@@ -259,7 +471,7 @@ func (rule *Rule) parse(line string) error {
 		return fmt.Errorf("failed parsing rule add command")
 	}
 	rule.Chain = match[1]
-	rule.Rule = match[4]
+	rule.Rule, rule.Counter = splitRuleCounter(match[4])
 	rule.Comment = getComment(match[5])
 	if match[2] != "" {
 		rule.Index = parseInt(match[2])
@@ -270,22 +482,172 @@ func (rule *Rule) parse(line string) error {
 	return nil
 }
 
+// findRuleCounter returns the index in words (the words of a rule) of the rule's inline
+// "counter" statement, if it has one with no packet/byte counts, or -1 if not.
+func findRuleCounter(words []string) int {
+	for i, word := range words {
+		if word == "counter" && (i == len(words)-1 || (words[i+1] != "name" && words[i+1] != "packets")) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ruleWithCounter returns rule with its inline "counter" statement replaced by one that
+// includes the values from counter.
+func ruleWithCounter(rule string, counter *RuleCounter) string {
+	words := strings.Split(rule, " ")
+	i := findRuleCounter(words)
+	if i == -1 {
+		return rule
+	}
+	words[i] = fmt.Sprintf("counter packets %d bytes %d", counter.Packets, counter.Bytes)
+	return strings.Join(words, " ")
+}
+
+// ruleCounterRegexp matches an inline counter with packet and byte counts in a rule
+var ruleCounterRegexp = regexp.MustCompile(`\bcounter packets ([0-9]+) bytes ([0-9]+)`)
+
+// splitRuleCounter is the inverse of ruleWithCounter: if rule contains an inline counter
+// with packet and byte counts, it returns rule with a plain "counter" statement instead,
+// and the counts. Otherwise it returns rule unchanged, and nil.
+func splitRuleCounter(rule string) (string, *RuleCounter) {
+	match := ruleCounterRegexp.FindStringSubmatchIndex(rule)
+	if match == nil {
+		return rule, nil
+	}
+	counter := &RuleCounter{
+		Packets: *parseUint(rule[match[2]:match[3]]),
+		Bytes:   *parseUint(rule[match[4]:match[5]]),
+	}
+	return rule[:match[0]] + "counter" + rule[match[1]:], counter
+}
+
+// validateComment validates an object's comment. nft does not support escapes in quoted
+// strings, so a comment cannot contain double quotes, and since each object is written
+// on a single line, it cannot contain newlines or other control characters either.
+func validateComment(comment *string) error {
+	if comment == nil {
+		return nil
+	}
+	for _, c := range *comment {
+		if c == '"' || unicode.IsControl(c) {
+			return fmt.Errorf("comment %q cannot contain double quotes or control characters", *comment)
+		}
+	}
+	return nil
+}
+
+// quoteComment quotes comment (which must have passed validateComment) for nft. Since
+// nft does not support escapes in quoted strings, it is written as-is between quotes.
+func quoteComment(comment string) string {
+	return `"` + comment + `"`
+}
+
+// validateSetProps validates the properties shared by Set and Map
+func validateSetProps(timeout, gcInterval *time.Duration, policy *SetPolicy) error {
+	if timeout != nil && *timeout < time.Second {
+		return fmt.Errorf("timeout must be at least 1s")
+	}
+	if gcInterval != nil && *gcInterval < time.Second {
+		return fmt.Errorf("gc-interval must be at least 1s")
+	}
+	if policy != nil && *policy != PerformancePolicy && *policy != MemoryPolicy {
+		return fmt.Errorf("unknown policy %q", *policy)
+	}
+	return nil
+}
+
+// typeOfSelectors contains the expression types that can start a component of a TypeOf
+// expression: payload protocols, extension headers, and other expressions (eg "meta",
+// "ct"), plus the meta keys that nft allows to be used without a "meta" prefix.
+var typeOfSelectors = map[string]bool{
+	// payload protocols
+	"ether": true, "vlan": true, "arp": true, "ip": true, "icmp": true, "igmp": true,
+	"ip6": true, "icmpv6": true, "tcp": true, "udp": true, "udplite": true,
+	"sctp": true, "dccp": true, "th": true, "ah": true, "esp": true, "comp": true,
+	"gre": true, "vxlan": true, "geneve": true, "gretap": true,
+
+	// IPv6 extension headers
+	"hbh": true, "frag": true, "dst": true, "mh": true, "srh": true, "exthdr": true,
+
+	// other expressions
+	"meta": true, "ct": true, "rt": true, "osf": true, "socket": true, "ipsec": true,
+	"numgen": true, "jhash": true, "symhash": true, "fib": true, "tunnel": true,
+
+	// unqualified meta keys
+	"iif": true, "iifname": true, "iiftype": true, "iifgroup": true, "oif": true,
+	"oifname": true, "oiftype": true, "oifgroup": true, "mark": true, "skuid": true,
+	"skgid": true, "nfproto": true, "l4proto": true, "priority": true, "length": true,
+	"protocol": true, "cpu": true, "cgroup": true, "rtclassid": true, "pkttype": true,
+}
+
+// validateTypeOf does some basic checks of a set's or map's TypeOf: that it has a key (and,
+// for a map, a value), that each is a well-formed concatenation, and that each
+// component starts with a recognized expression type. (This does not attempt to
+// validate the expressions fully.)
+func validateTypeOf(typeOf string, isMap bool) error {
+	parts := strings.Split(typeOf, " : ")
+	if isMap && len(parts) != 2 {
+		return fmt.Errorf("map TypeOf %q must have the form \"KEY : VALUE\"", typeOf)
+	} else if !isMap && len(parts) != 1 {
+		return fmt.Errorf("set TypeOf %q must not contain \" : \"", typeOf)
+	}
+
+	for i, part := range parts {
+		for _, component := range strings.Split(part, " . ") {
+			words := strings.Fields(component)
+			if len(words) == 0 {
+				return fmt.Errorf("malformed concatenation in TypeOf %q", typeOf)
+			}
+			for _, word := range words {
+				if strings.HasPrefix(word, ".") || strings.HasSuffix(word, ".") || strings.Contains(word, ":") {
+					return fmt.Errorf("malformed concatenation in TypeOf %q", typeOf)
+				}
+			}
+
+			selector := words[0]
+			switch {
+			case typeOfSelectors[selector]:
+			case strings.HasPrefix(selector, "@"):
+				// raw payload expression (eg "@th,16,16")
+			case i == 1 && len(words) == 1 && selector == "verdict":
+			default:
+				return fmt.Errorf("unrecognized expression %q in TypeOf %q", component, typeOf)
+			}
+		}
+	}
+	return nil
+}
+
 // Object implementation for Set
 func (set *Set) validate(verb verb) error {
+	if err := validateComment(set.Comment); err != nil {
+		return err
+	}
+
 	switch verb {
 	case addVerb, createVerb:
 		if (set.Type == "" && set.TypeOf == "") || (set.Type != "" && set.TypeOf != "") {
 			return fmt.Errorf("set must specify either Type or TypeOf")
 		}
+		if set.TypeOf != "" {
+			if err := validateTypeOf(set.TypeOf, false); err != nil {
+				return err
+			}
+		}
 		if set.Handle != nil {
 			return fmt.Errorf("cannot specify Handle in %s operation", verb)
 		}
+		if err := validateSetProps(set.Timeout, set.GCInterval, set.Policy); err != nil {
+			return err
+		}
 		fallthrough
-	case flushVerb:
+	case flushVerb, resetVerb:
 		if set.Name == "" {
 			return fmt.Errorf("no name specified for set")
 		}
-	case deleteVerb:
+	case deleteVerb, destroyVerb:
 		if set.Name == "" && set.Handle == nil {
 			return fmt.Errorf("must specify either name or handle")
 		}
@@ -297,9 +659,9 @@ func (set *Set) validate(verb verb) error {
 }
 
 func (set *Set) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
-	// Special case for delete-by-handle
-	if verb == deleteVerb && set.Handle != nil {
-		fmt.Fprintf(writer, "delete set %s %s handle %d", ctx.family, ctx.table, *set.Handle)
+	// Special case for delete/destroy-by-handle
+	if (verb == deleteVerb || verb == destroyVerb) && set.Handle != nil {
+		fmt.Fprintf(writer, "%s set %s %s handle %d", verb, ctx.family, ctx.table, *set.Handle)
 		return
 	}
 
@@ -341,7 +703,7 @@ func (set *Set) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
 		}
 
 		if set.Comment != nil && !ctx.noObjectComments {
-			fmt.Fprintf(writer, " comment %q ;", *set.Comment)
+			fmt.Fprintf(writer, " comment %s ;", quoteComment(*set.Comment))
 		}
 
 		fmt.Fprintf(writer, " }")
@@ -362,20 +724,32 @@ func (set *Set) parse(line string) error {
 
 // Object implementation for Map
 func (mapObj *Map) validate(verb verb) error {
+	if err := validateComment(mapObj.Comment); err != nil {
+		return err
+	}
+
 	switch verb {
 	case addVerb, createVerb:
 		if (mapObj.Type == "" && mapObj.TypeOf == "") || (mapObj.Type != "" && mapObj.TypeOf != "") {
 			return fmt.Errorf("map must specify either Type or TypeOf")
 		}
+		if mapObj.TypeOf != "" {
+			if err := validateTypeOf(mapObj.TypeOf, true); err != nil {
+				return err
+			}
+		}
 		if mapObj.Handle != nil {
 			return fmt.Errorf("cannot specify Handle in %s operation", verb)
 		}
+		if err := validateSetProps(mapObj.Timeout, mapObj.GCInterval, mapObj.Policy); err != nil {
+			return err
+		}
 		fallthrough
-	case flushVerb:
+	case flushVerb, resetVerb:
 		if mapObj.Name == "" {
 			return fmt.Errorf("no name specified for map")
 		}
-	case deleteVerb:
+	case deleteVerb, destroyVerb:
 		if mapObj.Name == "" && mapObj.Handle == nil {
 			return fmt.Errorf("must specify either name or handle")
 		}
@@ -387,9 +761,9 @@ func (mapObj *Map) validate(verb verb) error {
 }
 
 func (mapObj *Map) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
-	// Special case for delete-by-handle
-	if verb == deleteVerb && mapObj.Handle != nil {
-		fmt.Fprintf(writer, "delete map %s %s handle %d", ctx.family, ctx.table, *mapObj.Handle)
+	// Special case for delete/destroy-by-handle
+	if (verb == deleteVerb || verb == destroyVerb) && mapObj.Handle != nil {
+		fmt.Fprintf(writer, "%s map %s %s handle %d", verb, ctx.family, ctx.table, *mapObj.Handle)
 		return
 	}
 
@@ -428,7 +802,7 @@ func (mapObj *Map) writeOperation(verb verb, ctx *nftContext, writer io.Writer)
 		}
 
 		if mapObj.Comment != nil && !ctx.noObjectComments {
-			fmt.Fprintf(writer, " comment %q ;", *mapObj.Comment)
+			fmt.Fprintf(writer, " comment %s ;", quoteComment(*mapObj.Comment))
 		}
 
 		fmt.Fprintf(writer, " }")
@@ -499,8 +873,399 @@ func parseSetFlags(s string) []SetFlag {
 	return res
 }
 
+// Object implementation for Flowtable
+func (flowtable *Flowtable) validate(verb verb) error {
+	switch verb {
+	case addVerb, createVerb:
+		if flowtable.Priority == nil {
+			return fmt.Errorf("flowtable %q must specify Priority", flowtable.Name)
+		}
+		if flowtable.Handle != nil {
+			return fmt.Errorf("cannot specify Handle in %s operation", verb)
+		}
+		if flowtable.Name == "" {
+			return fmt.Errorf("no name specified for flowtable")
+		}
+		if err := checkDevices(nil, flowtable.Devices); err != nil {
+			return fmt.Errorf("flowtable %q: %w", flowtable.Name, err)
+		}
+	case deleteVerb, destroyVerb:
+		if flowtable.Name == "" && flowtable.Handle == nil {
+			return fmt.Errorf("must specify either name or handle")
+		}
+	default:
+		return fmt.Errorf("%s is not implemented for flowtables", verb)
+	}
+
+	return nil
+}
+
+func (flowtable *Flowtable) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	// Special case for delete/destroy-by-handle
+	if (verb == deleteVerb || verb == destroyVerb) && flowtable.Handle != nil {
+		fmt.Fprintf(writer, "%s flowtable %s %s handle %d", verb, ctx.family, ctx.table, *flowtable.Handle)
+		return
+	}
+
+	fmt.Fprintf(writer, "%s flowtable %s %s %s", verb, ctx.family, ctx.table, flowtable.Name)
+	if verb == addVerb || verb == createVerb {
+		fmt.Fprintf(writer, " {")
+
+		// As with chains, parse the priority to a number if we can.
+		if priority, err := ParsePriority(ctx.family, string(*flowtable.Priority)); err == nil {
+			fmt.Fprintf(writer, " hook ingress priority %d ;", priority)
+		} else {
+			fmt.Fprintf(writer, " hook ingress priority %s ;", *flowtable.Priority)
+		}
+
+		if len(flowtable.Devices) != 0 {
+			fmt.Fprintf(writer, " devices = { %s } ;", formatDevices(flowtable.Devices))
+		}
+
+		fmt.Fprintf(writer, " }")
+	}
+
+	fmt.Fprintf(writer, "\n")
+}
+
+// groups in []: [1]%s(?: { hook ingress priority [2]%s ;(?: devices = { [3]([^}]*) } ;)? })?
+var flowtableRegexp = regexp.MustCompile(fmt.Sprintf(
+	`%s(?: { hook ingress priority %s ;(?: devices = { ([^}]*) } ;)? })?`,
+	noSpaceGroup, noSpaceGroup))
+
+func (flowtable *Flowtable) parse(line string) error {
+	match := flowtableRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("failed parsing flowtable add command")
+	}
+	flowtable.Name = match[1]
+	if match[2] != "" {
+		flowtable.Priority = (*BaseChainPriority)(&match[2])
+	}
+	if match[3] != "" {
+		flowtable.Devices = parseDevices(match[3])
+	}
+	return nil
+}
+
+// Object implementation for Counter
+func (counter *Counter) validate(verb verb) error {
+	if err := validateComment(counter.Comment); err != nil {
+		return err
+	}
+
+	switch verb {
+	case addVerb, createVerb:
+		if (counter.Packets == nil) != (counter.Bytes == nil) {
+			return fmt.Errorf("counter %q must specify both or neither of Packets and Bytes", counter.Name)
+		}
+		if counter.Handle != nil {
+			return fmt.Errorf("cannot specify Handle in %s operation", verb)
+		}
+		fallthrough
+	case resetVerb:
+		if counter.Name == "" {
+			return fmt.Errorf("no name specified for counter")
+		}
+	case deleteVerb, destroyVerb:
+		if counter.Name == "" && counter.Handle == nil {
+			return fmt.Errorf("must specify either name or handle")
+		}
+	default:
+		return fmt.Errorf("%s is not implemented for counters", verb)
+	}
+
+	return nil
+}
+
+func (counter *Counter) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	// Special case for delete/destroy-by-handle
+	if (verb == deleteVerb || verb == destroyVerb) && counter.Handle != nil {
+		fmt.Fprintf(writer, "%s counter %s %s handle %d", verb, ctx.family, ctx.table, *counter.Handle)
+		return
+	}
+
+	fmt.Fprintf(writer, "%s counter %s %s %s", verb, ctx.family, ctx.table, counter.Name)
+	if verb == addVerb || verb == createVerb {
+		if counter.Packets != nil || (counter.Comment != nil && !ctx.noObjectComments) {
+			fmt.Fprintf(writer, " {")
+
+			if counter.Packets != nil {
+				fmt.Fprintf(writer, " packets %d bytes %d ;", *counter.Packets, *counter.Bytes)
+			}
+			if counter.Comment != nil && !ctx.noObjectComments {
+				fmt.Fprintf(writer, " comment %s ;", quoteComment(*counter.Comment))
+			}
+
+			fmt.Fprintf(writer, " }")
+		}
+	}
+
+	fmt.Fprintf(writer, "\n")
+}
+
+// groups in []: [1]%s(?: {(?: packets [2]%s bytes [3]%s ;)?(?: comment [4]%s ;)? })?
+var counterRegexp = regexp.MustCompile(fmt.Sprintf(
+	`%s(?: {(?: packets %s bytes %s ;)?(?: comment %s ;)? })?`,
+	noSpaceGroup, numberGroup, numberGroup, commentGroup))
+
+func (counter *Counter) parse(line string) error {
+	match := counterRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("failed parsing counter add command")
+	}
+	counter.Name = match[1]
+	if match[2] != "" {
+		counter.Packets = parseUint(match[2])
+		counter.Bytes = parseUint(match[3])
+	}
+	counter.Comment = getComment(match[4])
+	return nil
+}
+
+// Object implementation for Quota
+func (quota *Quota) validate(verb verb) error {
+	if err := validateComment(quota.Comment); err != nil {
+		return err
+	}
+
+	switch verb {
+	case addVerb, createVerb:
+		if quota.Handle != nil {
+			return fmt.Errorf("cannot specify Handle in %s operation", verb)
+		}
+		fallthrough
+	case resetVerb:
+		if quota.Name == "" {
+			return fmt.Errorf("no name specified for quota")
+		}
+	case deleteVerb, destroyVerb:
+		if quota.Name == "" && quota.Handle == nil {
+			return fmt.Errorf("must specify either name or handle")
+		}
+	default:
+		return fmt.Errorf("%s is not implemented for quotas", verb)
+	}
+
+	return nil
+}
+
+func (quota *Quota) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	// Special case for delete/destroy-by-handle
+	if (verb == deleteVerb || verb == destroyVerb) && quota.Handle != nil {
+		fmt.Fprintf(writer, "%s quota %s %s handle %d", verb, ctx.family, ctx.table, *quota.Handle)
+		return
+	}
+
+	fmt.Fprintf(writer, "%s quota %s %s %s", verb, ctx.family, ctx.table, quota.Name)
+	if verb == addVerb || verb == createVerb {
+		fmt.Fprintf(writer, " {")
+
+		if quota.Over {
+			fmt.Fprintf(writer, " over")
+		}
+		fmt.Fprintf(writer, " %d bytes", quota.Bytes)
+		if quota.Used != nil {
+			fmt.Fprintf(writer, " used %d bytes", *quota.Used)
+		}
+		fmt.Fprintf(writer, " ;")
+
+		if quota.Comment != nil && !ctx.noObjectComments {
+			fmt.Fprintf(writer, " comment %s ;", quoteComment(*quota.Comment))
+		}
+
+		fmt.Fprintf(writer, " }")
+	}
+
+	fmt.Fprintf(writer, "\n")
+}
+
+// groups in []: [1]%s(?: {[2]( over)? [3]%s bytes(?: used [4]%s bytes)? ;(?: comment [5]%s ;)? })?
+var quotaRegexp = regexp.MustCompile(fmt.Sprintf(
+	`%s(?: {( over)? %s bytes(?: used %s bytes)? ;(?: comment %s ;)? })?`,
+	noSpaceGroup, numberGroup, numberGroup, commentGroup))
+
+func (quota *Quota) parse(line string) error {
+	match := quotaRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("failed parsing quota add command")
+	}
+	quota.Name = match[1]
+	quota.Over = match[2] != ""
+	quota.Bytes = *parseUint(match[3])
+	if match[4] != "" {
+		quota.Used = parseUint(match[4])
+	}
+	quota.Comment = getComment(match[5])
+	return nil
+}
+
+// Object implementation for CTTimeout
+func (timeout *CTTimeout) validate(verb verb) error {
+	if err := validateComment(timeout.Comment); err != nil {
+		return err
+	}
+
+	switch verb {
+	case addVerb, createVerb:
+		if timeout.Name == "" {
+			return fmt.Errorf("no name specified for ct timeout")
+		}
+		if timeout.Protocol == "" {
+			return fmt.Errorf("no protocol specified for ct timeout %q", timeout.Name)
+		}
+		if timeout.Handle != nil {
+			return fmt.Errorf("cannot specify Handle in %s operation", verb)
+		}
+	case deleteVerb, destroyVerb:
+		if timeout.Name == "" && timeout.Handle == nil {
+			return fmt.Errorf("must specify either name or handle")
+		}
+	default:
+		return fmt.Errorf("%s is not implemented for ct timeouts", verb)
+	}
+
+	return nil
+}
+
+func (timeout *CTTimeout) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	// Special case for delete/destroy-by-handle
+	if (verb == deleteVerb || verb == destroyVerb) && timeout.Handle != nil {
+		fmt.Fprintf(writer, "%s ct timeout %s %s handle %d", verb, ctx.family, ctx.table, *timeout.Handle)
+		return
+	}
+
+	fmt.Fprintf(writer, "%s ct timeout %s %s %s", verb, ctx.family, ctx.table, timeout.Name)
+	if verb == addVerb || verb == createVerb {
+		fmt.Fprintf(writer, " { protocol %s ;", timeout.Protocol)
+		if timeout.L3Proto != nil {
+			fmt.Fprintf(writer, " l3proto %s ;", *timeout.L3Proto)
+		}
+		if len(timeout.Policy) != 0 {
+			states := sortKeys(timeout.Policy)
+			policy := make([]string, len(states))
+			for i, state := range states {
+				policy[i] = fmt.Sprintf("%s : %d", state, int64(timeout.Policy[state].Seconds()))
+			}
+			fmt.Fprintf(writer, " policy = { %s } ;", strings.Join(policy, ", "))
+		}
+		if timeout.Comment != nil && !ctx.noObjectComments {
+			fmt.Fprintf(writer, " comment %s ;", quoteComment(*timeout.Comment))
+		}
+		fmt.Fprintf(writer, " }")
+	}
+
+	fmt.Fprintf(writer, "\n")
+}
+
+// groups in []: [1]%s { protocol [2]%s ;(?: l3proto [3]%s ;)?(?: policy = { [4]([^}]*) } ;)?(?: comment [5]%s ;)? }
+var ctTimeoutRegexp = regexp.MustCompile(fmt.Sprintf(
+	`%s { protocol %s ;(?: l3proto %s ;)?(?: policy = { ([^}]*) } ;)?(?: comment %s ;)? }`,
+	noSpaceGroup, noSpaceGroup, noSpaceGroup, commentGroup))
+
+func (timeout *CTTimeout) parse(line string) error {
+	match := ctTimeoutRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("failed parsing ct timeout add command")
+	}
+	timeout.Name = match[1]
+	timeout.Protocol = match[2]
+	if match[3] != "" {
+		timeout.L3Proto = &match[3]
+	}
+	if match[4] != "" {
+		timeout.Policy = make(map[string]time.Duration)
+		for _, entry := range strings.Split(match[4], ", ") {
+			state, seconds, found := strings.Cut(entry, " : ")
+			if !found {
+				return fmt.Errorf("failed parsing ct timeout policy %q", entry)
+			}
+			timeout.Policy[state] = time.Duration(*parseUint(seconds)) * time.Second
+		}
+	}
+	timeout.Comment = getComment(match[5])
+	return nil
+}
+
+// Object implementation for CTExpectation
+func (expectation *CTExpectation) validate(verb verb) error {
+	if err := validateComment(expectation.Comment); err != nil {
+		return err
+	}
+
+	switch verb {
+	case addVerb, createVerb:
+		if expectation.Name == "" {
+			return fmt.Errorf("no name specified for ct expectation")
+		}
+		if expectation.Protocol == "" {
+			return fmt.Errorf("no protocol specified for ct expectation %q", expectation.Name)
+		}
+		if expectation.Handle != nil {
+			return fmt.Errorf("cannot specify Handle in %s operation", verb)
+		}
+	case deleteVerb, destroyVerb:
+		if expectation.Name == "" && expectation.Handle == nil {
+			return fmt.Errorf("must specify either name or handle")
+		}
+	default:
+		return fmt.Errorf("%s is not implemented for ct expectations", verb)
+	}
+
+	return nil
+}
+
+func (expectation *CTExpectation) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
+	// Special case for delete/destroy-by-handle
+	if (verb == deleteVerb || verb == destroyVerb) && expectation.Handle != nil {
+		fmt.Fprintf(writer, "%s ct expectation %s %s handle %d", verb, ctx.family, ctx.table, *expectation.Handle)
+		return
+	}
+
+	fmt.Fprintf(writer, "%s ct expectation %s %s %s", verb, ctx.family, ctx.table, expectation.Name)
+	if verb == addVerb || verb == createVerb {
+		fmt.Fprintf(writer, " { protocol %s ; dport %d ; timeout %dms ; size %d ;",
+			expectation.Protocol, expectation.DPort, expectation.Timeout.Milliseconds(), expectation.Size)
+		if expectation.L3Proto != nil {
+			fmt.Fprintf(writer, " l3proto %s ;", *expectation.L3Proto)
+		}
+		if expectation.Comment != nil && !ctx.noObjectComments {
+			fmt.Fprintf(writer, " comment %s ;", quoteComment(*expectation.Comment))
+		}
+		fmt.Fprintf(writer, " }")
+	}
+
+	fmt.Fprintf(writer, "\n")
+}
+
+// groups in []: [1]%s { protocol [2]%s ; dport [3]%s ; timeout [4]%sms ; size [5]%s ;(?: l3proto [6]%s ;)?(?: comment [7]%s ;)? }
+var ctExpectationRegexp = regexp.MustCompile(fmt.Sprintf(
+	`%s { protocol %s ; dport %s ; timeout %sms ; size %s ;(?: l3proto %s ;)?(?: comment %s ;)? }`,
+	noSpaceGroup, noSpaceGroup, numberGroup, numberGroup, numberGroup, noSpaceGroup, commentGroup))
+
+func (expectation *CTExpectation) parse(line string) error {
+	match := ctExpectationRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return fmt.Errorf("failed parsing ct expectation add command")
+	}
+	expectation.Name = match[1]
+	expectation.Protocol = match[2]
+	expectation.DPort = uint16(*parseUint(match[3]))
+	expectation.Timeout = time.Duration(*parseUint(match[4])) * time.Millisecond
+	expectation.Size = uint32(*parseUint(match[5]))
+	if match[6] != "" {
+		expectation.L3Proto = &match[6]
+	}
+	expectation.Comment = getComment(match[7])
+	return nil
+}
+
 // Object implementation for Element
 func (element *Element) validate(verb verb) error {
+	if err := validateComment(element.Comment); err != nil {
+		return err
+	}
+
 	if element.Map == "" && element.Set == "" {
 		return fmt.Errorf("no set/map name specified for element")
 	} else if element.Set != "" && element.Map != "" {
@@ -515,11 +1280,11 @@ func (element *Element) validate(verb verb) error {
 	}
 
 	switch verb {
-	case addVerb, createVerb:
+	case addVerb, createVerb, updateVerb:
 		if element.Map != "" && len(element.Value) == 0 {
 			return fmt.Errorf("no map value specified for map element")
 		}
-	case deleteVerb:
+	case deleteVerb, destroyVerb, resetVerb:
 	default:
 		return fmt.Errorf("%s is not implemented for elements", verb)
 	}
@@ -528,34 +1293,68 @@ func (element *Element) validate(verb verb) error {
 }
 
 func (element *Element) writeOperation(verb verb, ctx *nftContext, writer io.Writer) {
-	name := element.Set
-	if name == "" {
-		name = element.Map
+	opVerb := verb
+	if verb == updateVerb {
+		// There is no "update element" command; re-adding the element with a
+		// timeout restarts its timer.
+		opVerb = addVerb
 	}
+	writeStrings(writer, string(opVerb), " element ", string(ctx.family), " ", ctx.table, " ", element.setOrMapName(), " { ")
+	element.writeElement(verb, writer)
+	writeStrings(writer, " }\n")
+}
 
-	fmt.Fprintf(writer, "%s element %s %s %s { %s", verb, ctx.family, ctx.table, name,
-		strings.Join(element.Key, " . "))
+// setOrMapName returns the name of element's set or map
+func (element *Element) setOrMapName() string {
+	if element.Set != "" {
+		return element.Set
+	}
+	return element.Map
+}
+
+// writeElement writes element (without the surrounding braces) as it would appear in
+// an operation of type verb.
+func (element *Element) writeElement(verb verb, writer io.Writer) {
+	writeJoined(writer, element.Key, " . ")
 
 	if verb == addVerb || verb == createVerb {
+		if element.Timeout != nil {
+			fmt.Fprintf(writer, " timeout %ds", int64(element.Timeout.Seconds()))
+		}
+		if element.Expires != nil {
+			fmt.Fprintf(writer, " expires %ds", int64(element.Expires.Seconds()))
+		}
+		if element.Counter != nil {
+			fmt.Fprintf(writer, " counter packets %d bytes %d", element.Counter.Packets, element.Counter.Bytes)
+		}
 		if element.Comment != nil {
-			fmt.Fprintf(writer, " comment %q", *element.Comment)
+			writeStrings(writer, " comment ", quoteComment(*element.Comment))
 		}
 
 		if len(element.Value) != 0 {
-			fmt.Fprintf(writer, " : %s", strings.Join(element.Value, " . "))
+			writeStrings(writer, " : ")
+			writeJoined(writer, element.Value, " . ")
+		}
+	} else if verb == updateVerb {
+		if element.Timeout != nil {
+			fmt.Fprintf(writer, " timeout %ds", int64(element.Timeout.Seconds()))
+		}
+		if len(element.Value) != 0 {
+			writeStrings(writer, " : ")
+			writeJoined(writer, element.Value, " . ")
 		}
 	}
-
-	fmt.Fprintf(writer, " }\n")
 }
 
-// groups in []: [1]%s { [2]([^:"]*)(?: comment [3]%s)? : [4](.*) }
+// groups in []: [1]%s { [2](.*?)(?: timeout [3]%ss)?(?: expires [4]%ss)?(?: counter packets [5]%s bytes [6]%s)?(?: comment [7]%s)? : [8](.*) }$
 var mapElementRegexp = regexp.MustCompile(fmt.Sprintf(
-	`%s { ([^"]*)(?: comment %s)? : (.*) }`, noSpaceGroup, commentGroup))
+	`^%s { (.*?)(?: timeout %ss)?(?: expires %ss)?(?: counter packets %s bytes %s)?(?: comment %s)? : (.*) }$`,
+	noSpaceGroup, numberGroup, numberGroup, numberGroup, numberGroup, commentGroup))
 
-// groups in []: [1]%s { [2]([^:"]*)(?: comment [3]%s)? }
+// groups in []: [1]%s { [2](.*?)(?: timeout [3]%ss)?(?: expires [4]%ss)?(?: counter packets [5]%s bytes [6]%s)?(?: comment [7]%s)? }$
 var setElementRegexp = regexp.MustCompile(fmt.Sprintf(
-	`%s { ([^"]*)(?: comment %s)? }`, noSpaceGroup, commentGroup))
+	`^%s { (.*?)(?: timeout %ss)?(?: expires %ss)?(?: counter packets %s bytes %s)?(?: comment %s)? }$`,
+	noSpaceGroup, numberGroup, numberGroup, numberGroup, numberGroup, commentGroup))
 
 func (element *Element) parse(line string) error {
 	// try to match map element first, since it has more groups, and if it matches, then we can be sure
@@ -567,13 +1366,27 @@ func (element *Element) parse(line string) error {
 			return fmt.Errorf("failed parsing element add command")
 		}
 	}
-	element.Comment = getComment(match[3])
+	element.Comment = getComment(match[7])
+	if match[3] != "" {
+		timeout, _ := time.ParseDuration(match[3] + "s")
+		element.Timeout = &timeout
+	}
+	if match[4] != "" {
+		expires, _ := time.ParseDuration(match[4] + "s")
+		element.Expires = &expires
+	}
+	if match[5] != "" {
+		element.Counter = &ElementCounter{
+			Packets: *parseUint(match[5]),
+			Bytes:   *parseUint(match[6]),
+		}
+	}
 	mapOrSetName := match[1]
 	element.Key = append(element.Key, strings.Split(match[2], " . ")...)
-	if len(match) == 5 {
+	if len(match) == 9 {
 		// map regex matched
 		element.Map = mapOrSetName
-		element.Value = append(element.Value, strings.Split(match[4], " . ")...)
+		element.Value = append(element.Value, strings.Split(match[8], " . ")...)
 	} else {
 		element.Set = mapOrSetName
 	}
@@ -21,6 +21,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func getObjType(object Object) string {
@@ -70,6 +72,12 @@ func TestObjects(t *testing.T) {
 			object: &Table{},
 			out:    `delete table ip mytable`,
 		},
+		{
+			name:   "destroy table",
+			verb:   destroyVerb,
+			object: &Table{},
+			out:    `destroy table ip mytable`,
+		},
 		{
 			name:   "delete table by handle",
 			verb:   deleteVerb,
@@ -88,6 +96,18 @@ func TestObjects(t *testing.T) {
 			object: &Table{},
 			err:    "not implemented",
 		},
+		{
+			name:   "invalid update table",
+			verb:   updateVerb,
+			object: &Table{},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid reset table",
+			verb:   resetVerb,
+			object: &Table{},
+			err:    "not implemented",
+		},
 		{
 			name:   "invalid add table with Handle",
 			verb:   addVerb,
@@ -132,12 +152,42 @@ func TestObjects(t *testing.T) {
 			object: &Chain{Name: "mychain", Type: PtrTo(NATType), Hook: PtrTo(PostroutingHook), Priority: PtrTo(SNATPriority), Comment: PtrTo("foo")},
 			out:    `add chain ip mytable mychain { type nat hook postrouting priority 100 ; comment "foo" ; }`,
 		},
+		{
+			name:   "add base chain with policy",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(FilterPriority), Policy: PtrTo(DropPolicy), Comment: PtrTo("foo")},
+			out:    `add chain ip mytable mychain { type filter hook input priority 0 ; policy drop ; comment "foo" ; }`,
+		},
+		{
+			name:   "invalid add base chain with bad policy",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(InputHook), Priority: PtrTo(FilterPriority), Policy: PtrTo(BaseChainPolicy("reject"))},
+			err:    `invalid Policy "reject"`,
+		},
 		{
 			name:   "add base chain with device",
 			verb:   addVerb,
 			object: &Chain{Name: "mychain", Type: PtrTo(NATType), Hook: PtrTo(IngressHook), Device: PtrTo("eth0"), Priority: PtrTo(SNATPriority)},
 			out:    `add chain ip mytable mychain { type nat hook ingress device "eth0" priority 100 ; }`,
 		},
+		{
+			name:   "add base chain with devices",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Devices: []string{"eth0", "eth1"}, Priority: PtrTo(FilterPriority)},
+			out:    `add chain ip mytable mychain { type filter hook ingress devices = { eth0, eth1 } priority 0 ; }`,
+		},
+		{
+			name:   "add base chain with wildcard devices",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Devices: []string{"eth*", "vlan.100"}, Priority: PtrTo(FilterPriority)},
+			out:    `add chain ip mytable mychain { type filter hook ingress devices = { "eth*", vlan.100 } priority 0 ; }`,
+		},
+		{
+			name:   "add base chain with wildcard device",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Device: PtrTo("eth*"), Priority: PtrTo(FilterPriority)},
+			out:    `add chain ip mytable mychain { type filter hook ingress device "eth*" priority 0 ; }`,
+		},
 		{
 			name:   "create chain",
 			verb:   createVerb,
@@ -156,6 +206,12 @@ func TestObjects(t *testing.T) {
 			object: &Chain{Name: "mychain"},
 			out:    `delete chain ip mytable mychain`,
 		},
+		{
+			name:   "destroy chain",
+			verb:   destroyVerb,
+			object: &Chain{Name: "mychain"},
+			out:    `destroy chain ip mytable mychain`,
+		},
 		{
 			name:   "delete chain by handle",
 			verb:   deleteVerb,
@@ -180,6 +236,18 @@ func TestObjects(t *testing.T) {
 			object: &Chain{Name: "mychain"},
 			err:    "not implemented",
 		},
+		{
+			name:   "invalid update chain",
+			verb:   updateVerb,
+			object: &Chain{Name: "mychain"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid reset chain",
+			verb:   resetVerb,
+			object: &Chain{Name: "mychain"},
+			err:    "not implemented",
+		},
 		{
 			name:   "invalid add chain without name",
 			verb:   addVerb,
@@ -234,6 +302,30 @@ func TestObjects(t *testing.T) {
 			object: &Chain{Name: "mychain", Device: PtrTo("eth0")},
 			err:    "must not specify Device",
 		},
+		{
+			name:   "invalid add non-base chain with policy",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Policy: PtrTo(DropPolicy)},
+			err:    "must not specify Policy",
+		},
+		{
+			name:   "invalid add non-base chain with devices",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Devices: []string{"eth0", "eth1"}},
+			err:    "must not specify Device or Devices",
+		},
+		{
+			name:   "invalid add base chain with both device and devices",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Device: PtrTo("eth0"), Devices: []string{"eth1"}, Priority: PtrTo(FilterPriority)},
+			err:    "must not specify both Device and Devices",
+		},
+		{
+			name:   "invalid add base chain with empty device",
+			verb:   addVerb,
+			object: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Devices: []string{"eth0", ""}, Priority: PtrTo(FilterPriority)},
+			err:    "empty device name",
+		},
 
 		// Rules
 		{
@@ -248,6 +340,24 @@ func TestObjects(t *testing.T) {
 			object: &Rule{Chain: "mychain", Rule: "drop", Comment: PtrTo("comment")},
 			out:    `add rule ip mytable mychain drop comment "comment"`,
 		},
+		{
+			name:   "invalid add rule with comment containing double quotes",
+			verb:   addVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Comment: PtrTo(`he said "hi"`)},
+			err:    "cannot contain double quotes",
+		},
+		{
+			name:   "invalid add rule with comment containing newline",
+			verb:   addVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Comment: PtrTo("multi\nline")},
+			err:    "cannot contain double quotes or control characters",
+		},
+		{
+			name:   "add rule with comment containing backslashes",
+			verb:   addVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Comment: PtrTo(`C:\dir\`)},
+			out:    `add rule ip mytable mychain drop comment "C:\dir\"`,
+		},
 		{
 			name:   "add rule relative to index",
 			verb:   addVerb,
@@ -284,6 +394,12 @@ func TestObjects(t *testing.T) {
 			object: &Rule{Chain: "mychain", Rule: "drop", Handle: PtrTo(2)},
 			out:    `delete rule ip mytable mychain handle 2`,
 		},
+		{
+			name:   "destroy rule",
+			verb:   destroyVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Handle: PtrTo(2)},
+			out:    `destroy rule ip mytable mychain handle 2`,
+		},
 		{
 			name:   "delete rule without Rule",
 			verb:   deleteVerb,
@@ -320,18 +436,48 @@ func TestObjects(t *testing.T) {
 			object: &Rule{Chain: "mychain", Rule: "drop", Index: PtrTo(2), Handle: PtrTo(5)},
 			err:    "both Index and Handle",
 		},
+		{
+			name:   "add rule with counter",
+			verb:   addVerb,
+			object: &Rule{Chain: "mychain", Rule: "tcp dport 80 counter accept", Counter: &RuleCounter{Packets: 5, Bytes: 300}},
+			out:    `add rule ip mytable mychain tcp dport 80 counter packets 5 bytes 300 accept`,
+		},
+		{
+			name:   "invalid add rule with Counter but no counter statement",
+			verb:   addVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Counter: &RuleCounter{}},
+			err:    "no \"counter\" statement",
+		},
+		{
+			name:   "invalid add rule with negative Index",
+			verb:   addVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Index: PtrTo(-1)},
+			err:    "negative Index",
+		},
 		{
 			name:   "invalid replace rule with no Handle",
 			verb:   replaceVerb,
 			object: &Rule{Chain: "mychain", Rule: "drop"},
 			err:    "must specify Handle",
 		},
+		{
+			name:   "invalid update rule",
+			verb:   updateVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop"},
+			err:    "not implemented",
+		},
 		{
 			name:   "invalid delete rule with no Handle",
 			verb:   deleteVerb,
 			object: &Rule{Chain: "mychain", Rule: "drop"},
 			err:    "must specify Handle",
 		},
+		{
+			name:   "invalid reset rule",
+			verb:   resetVerb,
+			object: &Rule{Chain: "mychain", Rule: "drop", Handle: PtrTo(5)},
+			err:    "not implemented",
+		},
 
 		// Sets
 		{
@@ -386,6 +532,18 @@ func TestObjects(t *testing.T) {
 			object: &Set{Name: "myset"},
 			out:    `delete set ip mytable myset`,
 		},
+		{
+			name:   "destroy set",
+			verb:   destroyVerb,
+			object: &Set{Name: "myset"},
+			out:    `destroy set ip mytable myset`,
+		},
+		{
+			name:   "destroy set by handle",
+			verb:   destroyVerb,
+			object: &Set{Handle: PtrTo(5)},
+			out:    `destroy set ip mytable handle 5`,
+		},
 		{
 			name:   "delete set by handle",
 			verb:   deleteVerb,
@@ -410,6 +568,18 @@ func TestObjects(t *testing.T) {
 			object: &Set{Name: "myset", Type: "ipv4_addr"},
 			err:    "not implemented",
 		},
+		{
+			name:   "invalid update set",
+			verb:   updateVerb,
+			object: &Set{Name: "myset", Type: "ipv4_addr"},
+			err:    "not implemented",
+		},
+		{
+			name:   "reset set",
+			verb:   resetVerb,
+			object: &Set{Name: "myset"},
+			out:    `reset set ip mytable myset`,
+		},
 		{
 			name:   "invalid add set without Name",
 			verb:   addVerb,
@@ -428,12 +598,48 @@ func TestObjects(t *testing.T) {
 			object: &Set{Name: "myset", Type: "ipv4_addr", TypeOf: "ip addr"},
 			err:    "must specify either Type or TypeOf",
 		},
+		{
+			name:   "invalid add set with map TypeOf",
+			verb:   addVerb,
+			object: &Set{Name: "myset", TypeOf: "ip saddr : verdict"},
+			err:    "must not contain",
+		},
+		{
+			name:   "invalid add set with malformed TypeOf concatenation",
+			verb:   addVerb,
+			object: &Set{Name: "myset", TypeOf: "ip saddr . "},
+			err:    "malformed concatenation",
+		},
+		{
+			name:   "invalid add set with malformed TypeOf concatenation 2",
+			verb:   addVerb,
+			object: &Set{Name: "myset", TypeOf: "ip saddr .tcp dport"},
+			err:    "malformed concatenation",
+		},
+		{
+			name:   "invalid add set with unrecognized TypeOf",
+			verb:   addVerb,
+			object: &Set{Name: "myset", TypeOf: "ipv4_addr"},
+			err:    "unrecognized expression",
+		},
 		{
 			name:   "invalid add set with Handle",
 			verb:   addVerb,
 			object: &Set{Name: "myset", Type: "ipv4_addr", Handle: PtrTo(5)},
 			err:    "cannot specify Handle",
 		},
+		{
+			name:   "invalid add set with unknown Policy",
+			verb:   addVerb,
+			object: &Set{Name: "myset", Type: "ipv4_addr", Policy: PtrTo(SetPolicy("fast"))},
+			err:    "unknown policy",
+		},
+		{
+			name:   "invalid add set with sub-second GCInterval",
+			verb:   addVerb,
+			object: &Set{Name: "myset", Type: "ipv4_addr", Flags: []SetFlag{TimeoutFlag}, GCInterval: PtrTo(500 * time.Millisecond)},
+			err:    "gc-interval must be at least 1s",
+		},
 
 		// Maps
 		{
@@ -448,6 +654,12 @@ func TestObjects(t *testing.T) {
 			object: &Map{Name: "mymap", TypeOf: "ip saddr : ip saddr"},
 			out:    `add map ip mytable mymap { typeof ip saddr : ip saddr ; }`,
 		},
+		{
+			name:   "add map with concatenated TypeOf",
+			verb:   addVerb,
+			object: &Map{Name: "mymap", TypeOf: "ip daddr . @th,16,16 . iifname : verdict"},
+			out:    `add map ip mytable mymap { typeof ip daddr . @th,16,16 . iifname : verdict ; }`,
+		},
 		{
 			name: "add map with all properties",
 			verb: addVerb,
@@ -487,6 +699,12 @@ func TestObjects(t *testing.T) {
 			object: &Map{Name: "mymap"},
 			out:    `delete map ip mytable mymap`,
 		},
+		{
+			name:   "destroy map",
+			verb:   destroyVerb,
+			object: &Map{Name: "mymap"},
+			out:    `destroy map ip mytable mymap`,
+		},
 		{
 			name:   "delete map by Handle",
 			verb:   deleteVerb,
@@ -511,6 +729,18 @@ func TestObjects(t *testing.T) {
 			object: &Map{Name: "mymap", Type: "ipv4_addr : ipv4_addr"},
 			err:    "not implemented",
 		},
+		{
+			name:   "invalid update map",
+			verb:   updateVerb,
+			object: &Map{Name: "mymap", Type: "ipv4_addr : ipv4_addr"},
+			err:    "not implemented",
+		},
+		{
+			name:   "reset map",
+			verb:   resetVerb,
+			object: &Map{Name: "mymap"},
+			out:    `reset map ip mytable mymap`,
+		},
 		{
 			name:   "invalid add map without Name",
 			verb:   addVerb,
@@ -529,12 +759,462 @@ func TestObjects(t *testing.T) {
 			object: &Map{Name: "mymap", Type: "ipv4_addr : ipv4_addr", TypeOf: "ip addr : ip addr"},
 			err:    "must specify either Type or TypeOf",
 		},
+		{
+			name:   "invalid add map with TypeOf without value",
+			verb:   addVerb,
+			object: &Map{Name: "mymap", TypeOf: "ip saddr . tcp dport"},
+			err:    "must have the form",
+		},
+		{
+			name:   "invalid add map with unrecognized TypeOf value",
+			verb:   addVerb,
+			object: &Map{Name: "mymap", TypeOf: "ip saddr : ipv4_addr"},
+			err:    "unrecognized expression",
+		},
 		{
 			name:   "invalid add map with Handle",
 			verb:   addVerb,
 			object: &Map{Name: "mymap", Type: "ipv4_addr : ipv4_addr", Handle: PtrTo(5)},
 			err:    "cannot specify Handle",
 		},
+		{
+			name:   "invalid add map with unknown Policy",
+			verb:   addVerb,
+			object: &Map{Name: "mymap", Type: "ipv4_addr : ipv4_addr", Policy: PtrTo(SetPolicy("fast"))},
+			err:    "unknown policy",
+		},
+
+		// Flowtables
+		{
+			name:   "add flowtable",
+			verb:   addVerb,
+			object: &Flowtable{Name: "myflowtable", Priority: PtrTo(FilterPriority)},
+			out:    `add flowtable ip mytable myflowtable { hook ingress priority 0 ; }`,
+		},
+		{
+			name: "add flowtable with devices",
+			verb: addVerb,
+			object: &Flowtable{
+				Name:     "myflowtable",
+				Priority: PtrTo(FilterPriority + "+5"),
+				Devices:  []string{"eth0", "eth1"},
+			},
+			out: `add flowtable ip mytable myflowtable { hook ingress priority 5 ; devices = { eth0, eth1 } ; }`,
+		},
+		{
+			name:   "add flowtable with wildcard devices",
+			verb:   addVerb,
+			object: &Flowtable{Name: "myflowtable", Priority: PtrTo(FilterPriority), Devices: []string{"eth*"}},
+			out:    `add flowtable ip mytable myflowtable { hook ingress priority 0 ; devices = { "eth*" } ; }`,
+		},
+		{
+			name:   "add flowtable with empty device",
+			verb:   addVerb,
+			object: &Flowtable{Name: "myflowtable", Priority: PtrTo(FilterPriority), Devices: []string{""}},
+			err:    "empty device name",
+		},
+		{
+			name:   "add flowtable without priority",
+			verb:   addVerb,
+			object: &Flowtable{Name: "myflowtable"},
+			err:    "must specify Priority",
+		},
+		{
+			name:   "add flowtable with handle",
+			verb:   addVerb,
+			object: &Flowtable{Name: "myflowtable", Priority: PtrTo(FilterPriority), Handle: PtrTo(5)},
+			err:    "cannot specify Handle",
+		},
+		{
+			name:   "create flowtable",
+			verb:   createVerb,
+			object: &Flowtable{Name: "myflowtable", Priority: PtrTo(BaseChainPriority("10"))},
+			out:    `create flowtable ip mytable myflowtable { hook ingress priority 10 ; }`,
+		},
+		{
+			name:   "delete flowtable",
+			verb:   deleteVerb,
+			object: &Flowtable{Name: "myflowtable"},
+			out:    `delete flowtable ip mytable myflowtable`,
+		},
+		{
+			name:   "destroy flowtable",
+			verb:   destroyVerb,
+			object: &Flowtable{Name: "myflowtable"},
+			out:    `destroy flowtable ip mytable myflowtable`,
+		},
+		{
+			name:   "delete flowtable by Handle",
+			verb:   deleteVerb,
+			object: &Flowtable{Handle: PtrTo(5)},
+			out:    `delete flowtable ip mytable handle 5`,
+		},
+		{
+			name:   "invalid flush flowtable",
+			verb:   flushVerb,
+			object: &Flowtable{Name: "myflowtable"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid insert flowtable",
+			verb:   insertVerb,
+			object: &Flowtable{Name: "myflowtable", Priority: PtrTo(FilterPriority)},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid replace flowtable",
+			verb:   replaceVerb,
+			object: &Flowtable{Name: "myflowtable", Priority: PtrTo(FilterPriority)},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid update flowtable",
+			verb:   updateVerb,
+			object: &Flowtable{Name: "myflowtable", Priority: PtrTo(FilterPriority)},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid reset flowtable",
+			verb:   resetVerb,
+			object: &Flowtable{Name: "myflowtable"},
+			err:    "not implemented",
+		},
+
+		// Counters
+		{
+			name:   "add counter",
+			verb:   addVerb,
+			object: &Counter{Name: "mycounter"},
+			out:    `add counter ip mytable mycounter`,
+		},
+		{
+			name: "add counter with values and comment",
+			verb: addVerb,
+			object: &Counter{
+				Name:    "mycounter",
+				Packets: PtrTo[uint64](10),
+				Bytes:   PtrTo[uint64](1500),
+				Comment: PtrTo("web traffic"),
+			},
+			out: `add counter ip mytable mycounter { packets 10 bytes 1500 ; comment "web traffic" ; }`,
+		},
+		{
+			name:   "add counter with only packets",
+			verb:   addVerb,
+			object: &Counter{Name: "mycounter", Packets: PtrTo[uint64](10)},
+			err:    "both or neither",
+		},
+		{
+			name:   "add counter with handle",
+			verb:   addVerb,
+			object: &Counter{Name: "mycounter", Handle: PtrTo(5)},
+			err:    "cannot specify Handle",
+		},
+		{
+			name:   "create counter",
+			verb:   createVerb,
+			object: &Counter{Name: "mycounter", Comment: PtrTo("foo")},
+			out:    `create counter ip mytable mycounter { comment "foo" ; }`,
+		},
+		{
+			name:   "reset counter",
+			verb:   resetVerb,
+			object: &Counter{Name: "mycounter"},
+			out:    `reset counter ip mytable mycounter`,
+		},
+		{
+			name:   "invalid reset counter without name",
+			verb:   resetVerb,
+			object: &Counter{Handle: PtrTo(5)},
+			err:    "no name",
+		},
+		{
+			name:   "delete counter",
+			verb:   deleteVerb,
+			object: &Counter{Name: "mycounter"},
+			out:    `delete counter ip mytable mycounter`,
+		},
+		{
+			name:   "destroy counter",
+			verb:   destroyVerb,
+			object: &Counter{Name: "mycounter"},
+			out:    `destroy counter ip mytable mycounter`,
+		},
+		{
+			name:   "delete counter by Handle",
+			verb:   deleteVerb,
+			object: &Counter{Handle: PtrTo(5)},
+			out:    `delete counter ip mytable handle 5`,
+		},
+		{
+			name:   "invalid flush counter",
+			verb:   flushVerb,
+			object: &Counter{Name: "mycounter"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid insert counter",
+			verb:   insertVerb,
+			object: &Counter{Name: "mycounter"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid replace counter",
+			verb:   replaceVerb,
+			object: &Counter{Name: "mycounter"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid update counter",
+			verb:   updateVerb,
+			object: &Counter{Name: "mycounter"},
+			err:    "not implemented",
+		},
+
+		// Quotas
+		{
+			name:   "add quota",
+			verb:   addVerb,
+			object: &Quota{Name: "myquota", Bytes: 10485760},
+			out:    `add quota ip mytable myquota { 10485760 bytes ; }`,
+		},
+		{
+			name: "add quota with all properties",
+			verb: addVerb,
+			object: &Quota{
+				Name:    "myquota",
+				Bytes:   10485760,
+				Over:    true,
+				Used:    PtrTo[uint64](1024),
+				Comment: PtrTo("10 MB"),
+			},
+			out: `add quota ip mytable myquota { over 10485760 bytes used 1024 bytes ; comment "10 MB" ; }`,
+		},
+		{
+			name:   "add quota with handle",
+			verb:   addVerb,
+			object: &Quota{Name: "myquota", Handle: PtrTo(5)},
+			err:    "cannot specify Handle",
+		},
+		{
+			name:   "create quota",
+			verb:   createVerb,
+			object: &Quota{Name: "myquota", Bytes: 1000, Over: true},
+			out:    `create quota ip mytable myquota { over 1000 bytes ; }`,
+		},
+		{
+			name:   "reset quota",
+			verb:   resetVerb,
+			object: &Quota{Name: "myquota"},
+			out:    `reset quota ip mytable myquota`,
+		},
+		{
+			name:   "delete quota",
+			verb:   deleteVerb,
+			object: &Quota{Name: "myquota"},
+			out:    `delete quota ip mytable myquota`,
+		},
+		{
+			name:   "destroy quota",
+			verb:   destroyVerb,
+			object: &Quota{Name: "myquota"},
+			out:    `destroy quota ip mytable myquota`,
+		},
+		{
+			name:   "delete quota by Handle",
+			verb:   deleteVerb,
+			object: &Quota{Handle: PtrTo(5)},
+			out:    `delete quota ip mytable handle 5`,
+		},
+		{
+			name:   "invalid flush quota",
+			verb:   flushVerb,
+			object: &Quota{Name: "myquota"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid insert quota",
+			verb:   insertVerb,
+			object: &Quota{Name: "myquota"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid replace quota",
+			verb:   replaceVerb,
+			object: &Quota{Name: "myquota"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid update quota",
+			verb:   updateVerb,
+			object: &Quota{Name: "myquota"},
+			err:    "not implemented",
+		},
+
+		// CT timeouts
+		{
+			name:   "add ct timeout",
+			verb:   addVerb,
+			object: &CTTimeout{Name: "mytimeout", Protocol: "tcp"},
+			out:    `add ct timeout ip mytable mytimeout { protocol tcp ; }`,
+		},
+		{
+			name: "add ct timeout with all properties",
+			verb: addVerb,
+			object: &CTTimeout{
+				Name:     "mytimeout",
+				Protocol: "tcp",
+				L3Proto:  PtrTo("ip"),
+				Policy: map[string]time.Duration{
+					"established": 2 * time.Minute,
+					"close":       10 * time.Second,
+				},
+				Comment: PtrTo("short"),
+			},
+			out: `add ct timeout ip mytable mytimeout { protocol tcp ; l3proto ip ; policy = { close : 10, established : 120 } ; comment "short" ; }`,
+		},
+		{
+			name:   "add ct timeout without protocol",
+			verb:   addVerb,
+			object: &CTTimeout{Name: "mytimeout"},
+			err:    "no protocol specified",
+		},
+		{
+			name:   "create ct timeout",
+			verb:   createVerb,
+			object: &CTTimeout{Name: "mytimeout", Protocol: "udp", Policy: map[string]time.Duration{"replied": 30 * time.Second}},
+			out:    `create ct timeout ip mytable mytimeout { protocol udp ; policy = { replied : 30 } ; }`,
+		},
+		{
+			name:   "delete ct timeout",
+			verb:   deleteVerb,
+			object: &CTTimeout{Name: "mytimeout"},
+			out:    `delete ct timeout ip mytable mytimeout`,
+		},
+		{
+			name:   "destroy ct timeout",
+			verb:   destroyVerb,
+			object: &CTTimeout{Name: "mytimeout"},
+			out:    `destroy ct timeout ip mytable mytimeout`,
+		},
+		{
+			name:   "delete ct timeout by Handle",
+			verb:   deleteVerb,
+			object: &CTTimeout{Handle: PtrTo(5)},
+			out:    `delete ct timeout ip mytable handle 5`,
+		},
+		{
+			name:   "invalid flush ct timeout",
+			verb:   flushVerb,
+			object: &CTTimeout{Name: "mytimeout"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid insert ct timeout",
+			verb:   insertVerb,
+			object: &CTTimeout{Name: "mytimeout"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid replace ct timeout",
+			verb:   replaceVerb,
+			object: &CTTimeout{Name: "mytimeout"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid update ct timeout",
+			verb:   updateVerb,
+			object: &CTTimeout{Name: "mytimeout"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid reset ct timeout",
+			verb:   resetVerb,
+			object: &CTTimeout{Name: "mytimeout"},
+			err:    "not implemented",
+		},
+
+		// CT expectations
+		{
+			name:   "add ct expectation",
+			verb:   addVerb,
+			object: &CTExpectation{Name: "myexpect", Protocol: "tcp", DPort: 5060, Timeout: time.Hour, Size: 12},
+			out:    `add ct expectation ip mytable myexpect { protocol tcp ; dport 5060 ; timeout 3600000ms ; size 12 ; }`,
+		},
+		{
+			name: "add ct expectation with all properties",
+			verb: addVerb,
+			object: &CTExpectation{
+				Name:     "myexpect",
+				Protocol: "udp",
+				DPort:    69,
+				Timeout:  500 * time.Millisecond,
+				Size:     4,
+				L3Proto:  PtrTo("ip"),
+				Comment:  PtrTo("tftp"),
+			},
+			out: `add ct expectation ip mytable myexpect { protocol udp ; dport 69 ; timeout 500ms ; size 4 ; l3proto ip ; comment "tftp" ; }`,
+		},
+		{
+			name:   "add ct expectation with handle",
+			verb:   addVerb,
+			object: &CTExpectation{Name: "myexpect", Protocol: "tcp", Handle: PtrTo(5)},
+			err:    "cannot specify Handle",
+		},
+		{
+			name:   "create ct expectation",
+			verb:   createVerb,
+			object: &CTExpectation{Name: "myexpect", Protocol: "tcp", DPort: 21, Timeout: time.Minute, Size: 1},
+			out:    `create ct expectation ip mytable myexpect { protocol tcp ; dport 21 ; timeout 60000ms ; size 1 ; }`,
+		},
+		{
+			name:   "delete ct expectation",
+			verb:   deleteVerb,
+			object: &CTExpectation{Name: "myexpect"},
+			out:    `delete ct expectation ip mytable myexpect`,
+		},
+		{
+			name:   "destroy ct expectation",
+			verb:   destroyVerb,
+			object: &CTExpectation{Name: "myexpect"},
+			out:    `destroy ct expectation ip mytable myexpect`,
+		},
+		{
+			name:   "delete ct expectation by Handle",
+			verb:   deleteVerb,
+			object: &CTExpectation{Handle: PtrTo(5)},
+			out:    `delete ct expectation ip mytable handle 5`,
+		},
+		{
+			name:   "invalid flush ct expectation",
+			verb:   flushVerb,
+			object: &CTExpectation{Name: "myexpect"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid insert ct expectation",
+			verb:   insertVerb,
+			object: &CTExpectation{Name: "myexpect"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid replace ct expectation",
+			verb:   replaceVerb,
+			object: &CTExpectation{Name: "myexpect"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid update ct expectation",
+			verb:   updateVerb,
+			object: &CTExpectation{Name: "myexpect"},
+			err:    "not implemented",
+		},
+		{
+			name:   "invalid reset ct expectation",
+			verb:   resetVerb,
+			object: &CTExpectation{Name: "myexpect"},
+			err:    "not implemented",
+		},
 
 		// Elements
 		{
@@ -567,6 +1247,12 @@ func TestObjects(t *testing.T) {
 			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}},
 			out:    `delete element ip mytable myset { 10.0.0.1 }`,
 		},
+		{
+			name:   "destroy (set) element",
+			verb:   destroyVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}},
+			out:    `destroy element ip mytable myset { 10.0.0.1 }`,
+		},
 		{
 			name:   "delete (map) element with unnecessary Value",
 			verb:   deleteVerb,
@@ -597,6 +1283,12 @@ func TestObjects(t *testing.T) {
 			object: &Element{Set: "myset", Map: "mymap", Key: []string{"10.0.0.1"}},
 			err:    "both",
 		},
+		{
+			name:   "add element with timeout",
+			verb:   addVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}, Timeout: PtrTo(time.Hour), Comment: PtrTo("comment")},
+			out:    `add element ip mytable myset { 10.0.0.1 timeout 3600s comment "comment" }`,
+		},
 		{
 			name:   "invalid add element with no Key",
 			verb:   addVerb,
@@ -627,6 +1319,48 @@ func TestObjects(t *testing.T) {
 			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}},
 			err:    "not implemented",
 		},
+		{
+			name:   "reset element",
+			verb:   resetVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}},
+			out:    `reset element ip mytable myset { 10.0.0.1 }`,
+		},
+		{
+			name:   "update element",
+			verb:   updateVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}, Comment: PtrTo("ignored")},
+			out:    `add element ip mytable myset { 10.0.0.1 }`,
+		},
+		{
+			name:   "update map element with timeout",
+			verb:   updateVerb,
+			object: &Element{Map: "mymap", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Timeout: PtrTo(time.Minute)},
+			out:    `add element ip mytable mymap { 10.0.0.1 timeout 60s : drop }`,
+		},
+		{
+			name:   "invalid update map element with no value",
+			verb:   updateVerb,
+			object: &Element{Map: "mymap", Key: []string{"10.0.0.1"}},
+			err:    "no map value",
+		},
+		{
+			name:   "add element with timeout and expires",
+			verb:   addVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}, Timeout: PtrTo(time.Hour), Expires: PtrTo(30 * time.Minute)},
+			out:    `add element ip mytable myset { 10.0.0.1 timeout 3600s expires 1800s }`,
+		},
+		{
+			name:   "add element with counter",
+			verb:   addVerb,
+			object: &Element{Set: "myset", Key: []string{"10.0.0.1"}, Counter: &ElementCounter{}, Comment: PtrTo("counted")},
+			out:    `add element ip mytable myset { 10.0.0.1 counter packets 0 bytes 0 comment "counted" }`,
+		},
+		{
+			name:   "add map element with counter",
+			verb:   addVerb,
+			object: &Element{Map: "mymap", Key: []string{"10.0.0.1"}, Value: []string{"drop"}, Counter: &ElementCounter{Packets: 5, Bytes: 420}},
+			out:    `add element ip mytable mymap { 10.0.0.1 counter packets 5 bytes 420 : drop }`,
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			err := tc.object.validate(tc.verb)
@@ -658,8 +1392,8 @@ func TestObjects(t *testing.T) {
 		})
 	}
 
-	// add, create, flush, insert, replace, delete
-	numVerbs := 6
+	// add, create, flush, insert, replace, reset, delete, destroy, update
+	numVerbs := 9
 	for objType, verbs := range tested {
 		if len(verbs) != numVerbs {
 			t.Errorf("expected to test %d verbs for %s, got %d (%v)", numVerbs, objType, len(verbs), verbs)
@@ -726,6 +1460,50 @@ func TestNoObjectComments(t *testing.T) {
 	}
 }
 
+func TestChainBaseChainInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		chain *Chain
+		info  *BaseChainInfo
+	}{
+		{
+			name:  "regular chain",
+			chain: &Chain{Name: "mychain", Comment: PtrTo("foo")},
+		},
+		{
+			name:  "base chain with default policy",
+			chain: &Chain{Name: "mychain", Type: PtrTo(NATType), Hook: PtrTo(PostroutingHook), Priority: PtrTo(SNATPriority)},
+			info:  &BaseChainInfo{Type: NATType, Hook: PostroutingHook, Priority: SNATPriority, Policy: AcceptPolicy},
+		},
+		{
+			name:  "base chain with policy and device",
+			chain: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(IngressHook), Priority: PtrTo(FilterPriority), Policy: PtrTo(DropPolicy), Device: PtrTo("eth0")},
+			info:  &BaseChainInfo{Type: FilterType, Hook: IngressHook, Priority: FilterPriority, Policy: DropPolicy, Device: "eth0"},
+		},
+		{
+			name:  "base chain with devices",
+			chain: &Chain{Name: "mychain", Type: PtrTo(FilterType), Hook: PtrTo(EgressHook), Priority: PtrTo(FilterPriority), Devices: []string{"eth0", "eth1"}},
+			info:  &BaseChainInfo{Type: FilterType, Hook: EgressHook, Priority: FilterPriority, Policy: AcceptPolicy, Devices: []string{"eth0", "eth1"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info, isBase := tc.chain.BaseChainInfo()
+			if isBase != (tc.info != nil) {
+				t.Errorf("expected isBase=%v, got %v", tc.info != nil, isBase)
+			}
+			if diff := cmp.Diff(tc.info, info); diff != "" {
+				t.Errorf("unexpected BaseChainInfo:\n%s", diff)
+			}
+			if info != nil && len(info.Devices) != 0 {
+				info.Devices[0] = "modified"
+				if tc.chain.Devices[0] == "modified" {
+					t.Errorf("modifying the returned Devices modified the chain")
+				}
+			}
+		})
+	}
+}
+
 func TestParsePriority(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
@@ -770,6 +1548,18 @@ func TestParsePriority(t *testing.T) {
 			priority: "srcnat-1",
 			out:      99,
 		},
+		{
+			name:     "addition with spaces",
+			family:   IPv4Family,
+			priority: "filter + 10",
+			out:      10,
+		},
+		{
+			name:     "subtraction with spaces, bridge family",
+			family:   BridgeFamily,
+			priority: "dstnat - 10",
+			out:      -310,
+		},
 		{
 			name:     "unknown",
 			family:   IPv4Family,
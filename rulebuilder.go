@@ -0,0 +1,302 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// RuleBuilder is a helper for constructing the Rule field of a Rule object, as an
+// alternative to building the string by hand (or with Concat). Methods can be chained,
+// eg:
+//
+//	rule, err := NewRuleBuilder().MatchIPSaddr("10.0.0.0/8").MatchTCPDport(80).Counter().Accept().Build()
+//
+// If any method is called with an invalid argument, or in an invalid order (eg, adding
+// a second verdict, or a match after the verdict), then the error will be returned from
+// Build(), and all further method calls will be ignored.
+type RuleBuilder struct {
+	parts   []string
+	verdict string
+	comment *string
+	err     error
+}
+
+// NewRuleBuilder returns a new, empty, RuleBuilder
+func NewRuleBuilder() *RuleBuilder {
+	return &RuleBuilder{}
+}
+
+// add appends parts to the rule, unless there is already an error or a verdict
+func (b *RuleBuilder) add(parts ...string) *RuleBuilder {
+	if b.err != nil {
+		return b
+	}
+	if b.verdict != "" {
+		b.err = fmt.Errorf("cannot add %q after terminal verdict %q", strings.Join(parts, " "), b.verdict)
+		return b
+	}
+	b.parts = append(b.parts, parts...)
+	return b
+}
+
+// matchAddr adds a match of expr against addr, which must be an IP address or CIDR
+// string of the indicated family.
+func (b *RuleBuilder) matchAddr(expr string, addr string, wantIPv6 bool) *RuleBuilder {
+	if b.err != nil {
+		return b
+	}
+	var isIPv6 bool
+	if prefix, err := netip.ParsePrefix(addr); err == nil {
+		isIPv6 = !prefix.Addr().Is4()
+	} else if ip, err := netip.ParseAddr(addr); err == nil {
+		isIPv6 = !ip.Is4()
+	} else {
+		b.err = fmt.Errorf("invalid IP or CIDR %q for %q", addr, expr)
+		return b
+	}
+	if isIPv6 != wantIPv6 {
+		b.err = fmt.Errorf("wrong IP family for %q: %q", expr, addr)
+		return b
+	}
+	return b.add(expr, addr)
+}
+
+// Match adds an arbitrary match expression or statement to the rule. The arguments are
+// combined as with Concat.
+func (b *RuleBuilder) Match(args ...interface{}) *RuleBuilder {
+	expr := Concat(args...)
+	if expr == "" && b.err == nil {
+		b.err = fmt.Errorf("empty match expression")
+		return b
+	}
+	return b.add(expr)
+}
+
+// MatchIPSaddr adds a match on the IPv4 source address, which may be a single address or
+// a CIDR.
+func (b *RuleBuilder) MatchIPSaddr(cidr string) *RuleBuilder {
+	return b.matchAddr("ip saddr", cidr, false)
+}
+
+// MatchIPDaddr adds a match on the IPv4 destination address, which may be a single
+// address or a CIDR.
+func (b *RuleBuilder) MatchIPDaddr(cidr string) *RuleBuilder {
+	return b.matchAddr("ip daddr", cidr, false)
+}
+
+// MatchIP6Saddr adds a match on the IPv6 source address, which may be a single address
+// or a CIDR.
+func (b *RuleBuilder) MatchIP6Saddr(cidr string) *RuleBuilder {
+	return b.matchAddr("ip6 saddr", cidr, true)
+}
+
+// MatchIP6Daddr adds a match on the IPv6 destination address, which may be a single
+// address or a CIDR.
+func (b *RuleBuilder) MatchIP6Daddr(cidr string) *RuleBuilder {
+	return b.matchAddr("ip6 daddr", cidr, true)
+}
+
+// MatchTCPSport adds a match on the TCP source port.
+func (b *RuleBuilder) MatchTCPSport(port uint16) *RuleBuilder {
+	return b.add("tcp sport", fmt.Sprintf("%d", port))
+}
+
+// MatchTCPDport adds a match on the TCP destination port.
+func (b *RuleBuilder) MatchTCPDport(port uint16) *RuleBuilder {
+	return b.add("tcp dport", fmt.Sprintf("%d", port))
+}
+
+// MatchUDPSport adds a match on the UDP source port.
+func (b *RuleBuilder) MatchUDPSport(port uint16) *RuleBuilder {
+	return b.add("udp sport", fmt.Sprintf("%d", port))
+}
+
+// MatchUDPDport adds a match on the UDP destination port.
+func (b *RuleBuilder) MatchUDPDport(port uint16) *RuleBuilder {
+	return b.add("udp dport", fmt.Sprintf("%d", port))
+}
+
+// MatchSet adds a lookup of expr (eg, "ip saddr") in the named set.
+func (b *RuleBuilder) MatchSet(expr, set string) *RuleBuilder {
+	if b.err == nil && (expr == "" || set == "") {
+		b.err = fmt.Errorf("MatchSet requires an expression and a set name")
+		return b
+	}
+	return b.add(expr, "@"+set)
+}
+
+// validCTStates are the values accepted by CTState
+var validCTStates = map[string]bool{
+	"new":         true,
+	"established": true,
+	"related":     true,
+	"invalid":     true,
+	"untracked":   true,
+}
+
+// validCTStatuses are the values accepted by CTStatus
+var validCTStatuses = map[string]bool{
+	"expected":   true,
+	"seen-reply": true,
+	"assured":    true,
+	"confirmed":  true,
+	"snat":       true,
+	"dnat":       true,
+	"dying":      true,
+}
+
+// matchCT adds a match of the conntrack expression expr (eg "ct state") against any of
+// values, each of which must be in valid.
+func (b *RuleBuilder) matchCT(expr string, valid map[string]bool, values []string) *RuleBuilder {
+	if b.err != nil {
+		return b
+	}
+	if len(values) == 0 {
+		b.err = fmt.Errorf("no values specified for %q", expr)
+		return b
+	}
+	for _, value := range values {
+		if !valid[value] {
+			b.err = fmt.Errorf("invalid value %q for %q", value, expr)
+			return b
+		}
+	}
+	return b.add(expr, strings.Join(values, ","))
+}
+
+// CTState adds a match on the conntrack state of the packet, which must be one of
+// states ("new", "established", "related", "invalid", or "untracked").
+func (b *RuleBuilder) CTState(states ...string) *RuleBuilder {
+	return b.matchCT("ct state", validCTStates, states)
+}
+
+// CTStatus adds a match on the conntrack status of the packet's connection, which must
+// include one of statuses ("expected", "seen-reply", "assured", "confirmed", "snat",
+// "dnat", or "dying").
+func (b *RuleBuilder) CTStatus(statuses ...string) *RuleBuilder {
+	return b.matchCT("ct status", validCTStatuses, statuses)
+}
+
+// Counter adds an anonymous counter to the rule.
+func (b *RuleBuilder) Counter() *RuleBuilder {
+	return b.add("counter")
+}
+
+// NamedCounter adds a reference to the named Counter object to the rule ("counter name
+// NAME"). The counter must exist (eg, having been added earlier in the same
+// transaction) when the rule is added.
+func (b *RuleBuilder) NamedCounter(name string) *RuleBuilder {
+	if b.err == nil && name == "" {
+		b.err = fmt.Errorf("no name specified for counter")
+		return b
+	}
+	return b.add("counter name", name)
+}
+
+// NamedQuota adds a reference to the named Quota object to the rule ("quota name
+// NAME"). The quota must exist (eg, having been added earlier in the same transaction)
+// when the rule is added.
+func (b *RuleBuilder) NamedQuota(name string) *RuleBuilder {
+	if b.err == nil && name == "" {
+		b.err = fmt.Errorf("no name specified for quota")
+		return b
+	}
+	return b.add("quota name", name)
+}
+
+// Comment sets the rule's comment, which will be output (quoted) at the end of the rule.
+func (b *RuleBuilder) Comment(comment string) *RuleBuilder {
+	if b.err != nil {
+		return b
+	}
+	if b.comment != nil {
+		b.err = fmt.Errorf("rule already has a comment")
+	} else if err := validateComment(&comment); err != nil {
+		b.err = err
+	} else {
+		b.comment = &comment
+	}
+	return b
+}
+
+// setVerdict sets the rule's terminal verdict
+func (b *RuleBuilder) setVerdict(verdict string) *RuleBuilder {
+	if b.err != nil {
+		return b
+	}
+	if b.verdict != "" {
+		b.err = fmt.Errorf("cannot add verdict %q after terminal verdict %q", verdict, b.verdict)
+		return b
+	}
+	b.verdict = verdict
+	return b
+}
+
+// Accept sets the rule's verdict to "accept".
+func (b *RuleBuilder) Accept() *RuleBuilder {
+	return b.setVerdict("accept")
+}
+
+// Drop sets the rule's verdict to "drop".
+func (b *RuleBuilder) Drop() *RuleBuilder {
+	return b.setVerdict("drop")
+}
+
+// Return sets the rule's verdict to "return".
+func (b *RuleBuilder) Return() *RuleBuilder {
+	return b.setVerdict("return")
+}
+
+// Jump sets the rule's verdict to "jump chain".
+func (b *RuleBuilder) Jump(chain string) *RuleBuilder {
+	if b.err == nil && chain == "" {
+		b.err = fmt.Errorf("no chain specified for jump")
+		return b
+	}
+	return b.setVerdict("jump " + chain)
+}
+
+// Goto sets the rule's verdict to "goto chain".
+func (b *RuleBuilder) Goto(chain string) *RuleBuilder {
+	if b.err == nil && chain == "" {
+		b.err = fmt.Errorf("no chain specified for goto")
+		return b
+	}
+	return b.setVerdict("goto " + chain)
+}
+
+// Build returns the rule as a string suitable for use as the Rule field of a Rule
+// object, or an error if any of the previous method calls were invalid.
+func (b *RuleBuilder) Build() (string, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	parts := b.parts
+	if b.verdict != "" {
+		parts = append(parts, b.verdict)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("empty rule")
+	}
+	if b.comment != nil {
+		parts = append(parts, "comment", quoteComment(*b.comment))
+	}
+	return strings.Join(parts, " "), nil
+}
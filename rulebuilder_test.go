@@ -0,0 +1,158 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRuleBuilder(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		builder *RuleBuilder
+		out     string
+		err     string
+	}{
+		{
+			name:    "simple",
+			builder: NewRuleBuilder().MatchIPSaddr("10.0.0.0/8").MatchTCPDport(80).Counter().Accept(),
+			out:     "ip saddr 10.0.0.0/8 tcp dport 80 counter accept",
+		},
+		{
+			name:    "ipv6 with jump and comment",
+			builder: NewRuleBuilder().MatchIP6Daddr("fd00::1").MatchUDPDport(53).Jump("dns").Comment("DNS traffic"),
+			out:     `ip6 daddr fd00::1 udp dport 53 jump dns comment "DNS traffic"`,
+		},
+		{
+			name:    "comment with backslashes",
+			builder: NewRuleBuilder().Drop().Comment(`C:\dir\`),
+			out:     `drop comment "C:\dir\"`,
+		},
+		{
+			name:    "set lookup and generic match",
+			builder: NewRuleBuilder().MatchSet("ip saddr", "allowed").Match("ct state", "established").Goto("next"),
+			out:     "ip saddr @allowed ct state established goto next",
+		},
+		{
+			name:    "verdict only",
+			builder: NewRuleBuilder().Drop(),
+			out:     "drop",
+		},
+		{
+			name:    "no verdict",
+			builder: NewRuleBuilder().MatchTCPSport(22).Counter(),
+			out:     "tcp sport 22 counter",
+		},
+		{
+			name:    "ct state",
+			builder: NewRuleBuilder().CTState("established", "related").Accept(),
+			out:     "ct state established,related accept",
+		},
+		{
+			name:    "ct state and status",
+			builder: NewRuleBuilder().CTState("new").CTStatus("dnat").Counter(),
+			out:     "ct state new ct status dnat counter",
+		},
+		{
+			name:    "named counter and quota",
+			builder: NewRuleBuilder().MatchTCPDport(80).NamedQuota("web-quota").NamedCounter("web").Accept(),
+			out:     "tcp dport 80 quota name web-quota counter name web accept",
+		},
+		{
+			name:    "named counter with no name",
+			builder: NewRuleBuilder().NamedCounter("").Accept(),
+			err:     "no name specified for counter",
+		},
+		{
+			name:    "invalid ct state",
+			builder: NewRuleBuilder().CTState("established", "reated").Accept(),
+			err:     `invalid value "reated" for "ct state"`,
+		},
+		{
+			name:    "invalid ct status",
+			builder: NewRuleBuilder().CTStatus("new").Accept(),
+			err:     `invalid value "new" for "ct status"`,
+		},
+		{
+			name:    "empty ct state",
+			builder: NewRuleBuilder().CTState().Accept(),
+			err:     "no values specified",
+		},
+		{
+			name:    "empty",
+			builder: NewRuleBuilder(),
+			err:     "empty rule",
+		},
+		{
+			name:    "two verdicts",
+			builder: NewRuleBuilder().Accept().Drop(),
+			err:     "after terminal verdict",
+		},
+		{
+			name:    "match after verdict",
+			builder: NewRuleBuilder().Return().Counter(),
+			err:     "after terminal verdict",
+		},
+		{
+			name:    "bad address",
+			builder: NewRuleBuilder().MatchIPSaddr("10.0.0.0/33").Accept(),
+			err:     "invalid IP or CIDR",
+		},
+		{
+			name:    "wrong family",
+			builder: NewRuleBuilder().MatchIPDaddr("fd00::/64").Accept(),
+			err:     "wrong IP family",
+		},
+		{
+			name:    "bad comment",
+			builder: NewRuleBuilder().Accept().Comment(`say "hi"`),
+			err:     "cannot contain double quotes",
+		},
+		{
+			name:    "comment with control characters",
+			builder: NewRuleBuilder().Accept().Comment("multi\nline"),
+			err:     "cannot contain double quotes or control characters",
+		},
+		{
+			name:    "empty jump",
+			builder: NewRuleBuilder().Jump(""),
+			err:     "no chain specified",
+		},
+		{
+			name:    "first error wins",
+			builder: NewRuleBuilder().MatchIPSaddr("bogus").Accept().Drop(),
+			err:     "invalid IP or CIDR",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := tc.builder.Build()
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error containing %q, got %q, %v", tc.err, out, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tc.out {
+				t.Errorf("expected %q got %q", tc.out, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RuleTokenType is the type of a RuleToken
+type RuleTokenType string
+
+const (
+	// WordToken is a bare word, such as a keyword ("ip", "saddr", "accept"), an
+	// operator ("!=", "."), or a literal value ("10.0.0.1", "80").
+	WordToken RuleTokenType = "word"
+
+	// StringToken is a quoted string, such as the argument to "comment". The
+	// token's Value is the text between the quotes. (nft does not support escapes in
+	// quoted strings, so this is exactly the string that nft would see.)
+	StringToken RuleTokenType = "string"
+
+	// SetReferenceToken is a reference to a named set or map (eg "@blocked"). The
+	// token's Value is the name of the set or map, without the "@".
+	SetReferenceToken RuleTokenType = "set reference"
+
+	// AnonymousSetToken is an anonymous set or map (eg "{ 80, 443 }"). The token's
+	// Value is the text between the braces, and its Elements are the individual
+	// comma-separated elements.
+	AnonymousSetToken RuleTokenType = "anonymous set"
+)
+
+// RuleToken is a single token of a rule, as returned by ParseRuleExpr.
+type RuleToken struct {
+	// Type is the type of the token
+	Type RuleTokenType
+
+	// Value is the value of the token (as described for each RuleTokenType).
+	Value string
+
+	// Elements contains the elements of an AnonymousSetToken (and is unset for
+	// other token types).
+	Elements []string
+}
+
+// ParseRuleExpr splits rule (in the format of Rule.Rule) into tokens. This is not a
+// full parser for nftables rule syntax; it just splits the rule into words, while
+// keeping quoted strings and anonymous sets/maps together, and recognizing references
+// to named sets and maps. This can be used, eg, to find all of the sets and maps that a
+// rule refers to. It returns an error if rule contains an unterminated quoted string or
+// unbalanced braces.
+func ParseRuleExpr(rule string) ([]RuleToken, error) {
+	var tokens []RuleToken
+	for i := 0; i < len(rule); {
+		switch c := rule[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+
+		case c == '"':
+			end := findQuoteEnd(rule, i)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quoted string in rule %q", rule)
+			}
+			tokens = append(tokens, RuleToken{Type: StringToken, Value: rule[i+1 : end]})
+			i = end + 1
+
+		case c == '{':
+			end := findBraceEnd(rule, i)
+			if end == -1 {
+				return nil, fmt.Errorf("unbalanced braces in rule %q", rule)
+			}
+			contents := strings.TrimSpace(rule[i+1 : end])
+			tokens = append(tokens, RuleToken{
+				Type:     AnonymousSetToken,
+				Value:    contents,
+				Elements: splitAnonymousSet(contents),
+			})
+			i = end + 1
+
+		case c == '}':
+			return nil, fmt.Errorf("unbalanced braces in rule %q", rule)
+
+		default:
+			end := i
+			for end < len(rule) && !strings.ContainsRune(" \t\n{}\"", rune(rule[end])) {
+				end++
+			}
+			word := rule[i:end]
+			if len(word) > 1 && word[0] == '@' {
+				tokens = append(tokens, RuleToken{Type: SetReferenceToken, Value: word[1:]})
+			} else {
+				tokens = append(tokens, RuleToken{Type: WordToken, Value: word})
+			}
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// findQuoteEnd returns the index of the '"' that closes the quoted string starting at
+// rule[start], or -1 if it is unterminated. (nft does not support escapes in quoted
+// strings, so this is just the next '"'.)
+func findQuoteEnd(rule string, start int) int {
+	end := strings.IndexByte(rule[start+1:], '"')
+	if end == -1 {
+		return -1
+	}
+	return start + 1 + end
+}
+
+// findBraceEnd returns the index of the '}' that matches the '{' at rule[start], or -1
+// if there is none.
+func findBraceEnd(rule string, start int) int {
+	depth := 0
+	for i := start; i < len(rule); i++ {
+		switch rule[i] {
+		case '"':
+			i = findQuoteEnd(rule, i)
+			if i == -1 {
+				return -1
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitAnonymousSet splits the contents of an anonymous set/map into its elements.
+func splitAnonymousSet(contents string) []string {
+	var elements []string
+	depth, start := 0, 0
+	for i := 0; i < len(contents); i++ {
+		switch contents[i] {
+		case '"':
+			if end := findQuoteEnd(contents, i); end != -1 {
+				i = end
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				if elem := strings.TrimSpace(contents[start:i]); elem != "" {
+					elements = append(elements, elem)
+				}
+				start = i + 1
+			}
+		}
+	}
+	if elem := strings.TrimSpace(contents[start:]); elem != "" {
+		elements = append(elements, elem)
+	}
+	return elements
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRuleExpr(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rule string
+		out  []RuleToken
+		err  string
+	}{
+		{
+			name: "simple",
+			rule: "ip saddr 10.0.0.1 drop",
+			out: []RuleToken{
+				{Type: WordToken, Value: "ip"},
+				{Type: WordToken, Value: "saddr"},
+				{Type: WordToken, Value: "10.0.0.1"},
+				{Type: WordToken, Value: "drop"},
+			},
+		},
+		{
+			name: "set reference and anonymous set",
+			rule: `ip daddr @cluster-ips tcp dport { 80, http, 443 } accept`,
+			out: []RuleToken{
+				{Type: WordToken, Value: "ip"},
+				{Type: WordToken, Value: "daddr"},
+				{Type: SetReferenceToken, Value: "cluster-ips"},
+				{Type: WordToken, Value: "tcp"},
+				{Type: WordToken, Value: "dport"},
+				{Type: AnonymousSetToken, Value: "80, http, 443", Elements: []string{"80", "http", "443"}},
+				{Type: WordToken, Value: "accept"},
+			},
+		},
+		{
+			name: "anonymous vmap and quoted string",
+			rule: `ip daddr . tcp dport vmap { 10.0.0.1 . 80 : goto svc1, 10.0.0.2 . 80 : drop } comment "a 'quoted' {comment}, with @ref and C:\dir\"`,
+			out: []RuleToken{
+				{Type: WordToken, Value: "ip"},
+				{Type: WordToken, Value: "daddr"},
+				{Type: WordToken, Value: "."},
+				{Type: WordToken, Value: "tcp"},
+				{Type: WordToken, Value: "dport"},
+				{Type: WordToken, Value: "vmap"},
+				{
+					Type:     AnonymousSetToken,
+					Value:    "10.0.0.1 . 80 : goto svc1, 10.0.0.2 . 80 : drop",
+					Elements: []string{"10.0.0.1 . 80 : goto svc1", "10.0.0.2 . 80 : drop"},
+				},
+				{Type: WordToken, Value: "comment"},
+				{Type: StringToken, Value: `a 'quoted' {comment}, with @ref and C:\dir\`},
+			},
+		},
+		{
+			name: "lone @",
+			rule: "meta mark @",
+			out: []RuleToken{
+				{Type: WordToken, Value: "meta"},
+				{Type: WordToken, Value: "mark"},
+				{Type: WordToken, Value: "@"},
+			},
+		},
+		{
+			name: "empty",
+			rule: "",
+		},
+		{
+			name: "unterminated string",
+			rule: `counter comment "oops`,
+			err:  "unterminated quoted string",
+		},
+		{
+			name: "unclosed brace",
+			rule: "tcp dport { 80, 443 accept",
+			err:  "unbalanced braces",
+		},
+		{
+			name: "extra close brace",
+			rule: "tcp dport 80 } accept",
+			err:  "unbalanced braces",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := ParseRuleExpr(tc.rule)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.out, tokens); diff != "" {
+				t.Errorf("unexpected tokens:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseRuleExprReferences(t *testing.T) {
+	rule := Concat(
+		"ip saddr . tcp dport", "@", "allowed",
+		"ip daddr", AnonymousSet("10.0.0.1", "10.0.0.2"),
+		"meta mark set ip daddr map", "@", "marks",
+		"ip daddr vmap", "@", "services",
+		"comment", `"not @a-reference { really }"`,
+	)
+	tokens, err := ParseRuleExpr(rule)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var refs []string
+	for _, token := range tokens {
+		if token.Type == SetReferenceToken {
+			refs = append(refs, token.Value)
+		}
+	}
+	if diff := cmp.Diff([]string{"allowed", "marks", "services"}, refs); diff != "" {
+		t.Errorf("unexpected references:\n%s", diff)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // Transaction represents an nftables transaction
@@ -45,7 +46,11 @@ const (
 	insertVerb  verb = "insert"
 	replaceVerb verb = "replace"
 	deleteVerb  verb = "delete"
+	destroyVerb verb = "destroy"
 	flushVerb   verb = "flush"
+	resetVerb   verb = "reset"
+	renameVerb  verb = "rename"
+	updateVerb  verb = "update"
 )
 
 // asCommandBuf returns the transaction as an io.Reader that outputs a series of nft commands
@@ -55,9 +60,7 @@ func (tx *Transaction) asCommandBuf() (io.Reader, error) {
 	}
 
 	buf := &bytes.Buffer{}
-	for _, op := range tx.operations {
-		op.obj.writeOperation(op.verb, tx.nftContext, buf)
-	}
+	tx.writeOperations(buf)
 	return buf, nil
 }
 
@@ -65,9 +68,7 @@ func (tx *Transaction) asCommandBuf() (io.Reader, error) {
 // a pending error, it will be output as a comment at the end of the transaction.
 func (tx *Transaction) String() string {
 	buf := &bytes.Buffer{}
-	for _, op := range tx.operations {
-		op.obj.writeOperation(op.verb, tx.nftContext, buf)
-	}
+	tx.writeOperations(buf)
 
 	if tx.err != nil {
 		fmt.Fprintf(buf, "# ERROR: %v", tx.err)
@@ -76,6 +77,83 @@ func (tx *Transaction) String() string {
 	return buf.String()
 }
 
+// writeOperations writes tx's operations to writer. Consecutive "add element" operations
+// on the same set or map are coalesced into a single command, to reduce the size of
+// the transaction.
+func (tx *Transaction) writeOperations(writer io.Writer) {
+	for i := 0; i < len(tx.operations); i++ {
+		op := tx.operations[i]
+		element, ok := op.obj.(*Element)
+		if !ok || op.verb != addVerb {
+			op.obj.writeOperation(op.verb, tx.nftContext, writer)
+			continue
+		}
+
+		fmt.Fprintf(writer, "add element %s %s %s { ", tx.family, tx.table, element.setOrMapName())
+		element.writeElement(addVerb, writer)
+		keys := map[string]bool{strings.Join(element.Key, " . "): true}
+		for tx.isElementAdd(i+1, element.setOrMapName(), keys) {
+			i++
+			next := tx.operations[i].obj.(*Element)
+			keys[strings.Join(next.Key, " . ")] = true
+			fmt.Fprintf(writer, ", ")
+			next.writeElement(addVerb, writer)
+		}
+		fmt.Fprintf(writer, " }\n")
+	}
+}
+
+// isElementAdd returns true if tx.operations[i] exists and is an "add element"
+// operation on the set or map named name, for a key not in keys. (An element that is
+// added twice in the same transaction is not coalesced with its earlier add, so that
+// the later add still overrides the earlier one.)
+func (tx *Transaction) isElementAdd(i int, name string, keys map[string]bool) bool {
+	if i >= len(tx.operations) || tx.operations[i].verb != addVerb {
+		return false
+	}
+	element, ok := tx.operations[i].obj.(*Element)
+	return ok && element.setOrMapName() == name && !keys[strings.Join(element.Key, " . ")]
+}
+
+// NumOperations returns the number of operations queued in the transaction. (If the
+// transaction has a pending error, this does not include the operation that caused
+// the error or any operations that were added after it.)
+func (tx *Transaction) NumOperations() int {
+	return len(tx.operations)
+}
+
+// copy returns a copy of tx with its own list of operations, so that adding operations
+// to one does not affect the other.
+func (tx *Transaction) copy() *Transaction {
+	return &Transaction{
+		nftContext: tx.nftContext,
+		operations: append([]operation(nil), tx.operations...),
+		err:        tx.err,
+	}
+}
+
+// batches splits tx into transactions of at most batchSize operations each. If
+// batchSize is less than 1, or tx is small enough already, it returns tx itself as the
+// only batch.
+func (tx *Transaction) batches(batchSize int) []*Transaction {
+	if batchSize < 1 || len(tx.operations) <= batchSize {
+		return []*Transaction{tx}
+	}
+
+	batches := make([]*Transaction, 0, (len(tx.operations)+batchSize-1)/batchSize)
+	for start := 0; start < len(tx.operations); start += batchSize {
+		end := start + batchSize
+		if end > len(tx.operations) {
+			end = len(tx.operations)
+		}
+		batches = append(batches, &Transaction{
+			nftContext: tx.nftContext,
+			operations: tx.operations[start:end:end],
+		})
+	}
+	return batches
+}
+
 func (tx *Transaction) operation(verb verb, obj Object) {
 	if tx.err != nil {
 		return
@@ -129,6 +207,73 @@ func (tx *Transaction) Flush(obj Object) {
 	tx.operation(flushVerb, obj)
 }
 
+// FlushRuleset adds an "nft flush ruleset" operation to tx. Note that with the real
+// nftables backend, this removes *every* table on the system, in every family, not just
+// the Interface's own table, so it will also remove the rules of any other components
+// that use nftables; it is usually better to Delete or Destroy the Interface's own
+// table instead. (With Fake, which only knows about a single table, it just removes
+// that table.)
+func (tx *Transaction) FlushRuleset() {
+	tx.operation(flushVerb, &ruleset{})
+}
+
+// Rename adds an "nft rename" operation to tx, renaming chain (identified by its Name)
+// to newName. The chain keeps its rules and handle, and
+// jumps/gotos to it (in rules or verdict maps) will refer to it by its new name. The
+// Rename() call always succeeds, but if chain does not exist, or a chain named newName
+// already exists, then an error will be returned when the transaction is Run.
+func (tx *Transaction) Rename(chain *Chain, newName string) {
+	tx.operation(renameVerb, &chainRename{chain: chain, newName: newName})
+}
+
+// Reset adds an "nft reset" operation to tx, resetting the state of obj to zero. obj
+// must be a Counter, a Quota, an Element (to reset its counter), or a Set or Map (to
+// reset the counters of all of its elements). The Reset() call always succeeds, but if
+// obj does not exist (or does not support resetting) then an error will be returned
+// when the transaction is Run.
+func (tx *Transaction) Reset(obj Object) {
+	tx.operation(resetVerb, obj)
+}
+
+// ResetRules adds an "nft reset rules" operation to tx, resetting the counters of all of
+// the rules in the named chain to zero. The ResetRules() call always succeeds, but if the
+// chain does not exist then an error will be returned when the transaction is Run. Note
+// that "nft reset rules" requires nft 1.0.7 or later.
+func (tx *Transaction) ResetRules(chain string) {
+	tx.operation(resetVerb, &rulesReset{chain: chain})
+}
+
+// Update adds an operation to tx that restarts the timeout of an existing element of a
+// set or map (as an "update @set" statement in a rule would), without otherwise changing
+// it. obj must be an Element; if it has a Timeout, that replaces the element's timeout,
+// and otherwise the element's existing timeout (or its set/map's default timeout) is
+// used. (A map element must still specify its Value, which should match the existing
+// value.) nft has no "update element" command, so this is sent to nft as an "add
+// element" command, which only refreshes the timeout of an existing element on kernels
+// that support updating element timeouts. As with "add element", if the element does
+// not exist then it is created (with just the Key, Value, and Timeout from obj), both
+// by nft and by Fake.
+func (tx *Transaction) Update(obj Object) {
+	tx.operation(updateVerb, obj)
+}
+
+// Append adds all of the operations from other to the end of tx, as though they had been
+// added to tx directly. If other has a pending error, then tx will end up with the same
+// error. (other must have been created for the same family and table as tx.)
+func (tx *Transaction) Append(other *Transaction) {
+	if tx.err != nil {
+		return
+	}
+	if other.family != tx.family || other.table != tx.table {
+		tx.err = fmt.Errorf("cannot append transaction for table \"%s %s\" to transaction for table \"%s %s\"",
+			other.family, other.table, tx.family, tx.table)
+		return
+	}
+
+	tx.operations = append(tx.operations, other.operations...)
+	tx.err = other.err
+}
+
 // Delete adds an "nft delete" operation to tx, deleting obj. The Delete() call always
 // succeeds, but if obj does not exist or cannot be deleted based on the information
 // provided (eg, Handle is required but not set) then an error will be returned when the
@@ -136,3 +281,50 @@ func (tx *Transaction) Flush(obj Object) {
 func (tx *Transaction) Delete(obj Object) {
 	tx.operation(deleteVerb, obj)
 }
+
+// Destroy adds an "nft destroy" operation to tx, deleting obj if it exists, and doing
+// nothing if it does not. (It is still an error if obj's table, or, for a Rule or
+// Element, its chain, set, or map, does not exist.) The Destroy() call always succeeds,
+// but if obj cannot be deleted based on the information provided then an error will be
+// returned when the transaction is Run. Note that "nft destroy" requires nft 1.0.8 or
+// later, and kernel 6.3 or later.
+func (tx *Transaction) Destroy(obj Object) {
+	tx.operation(destroyVerb, obj)
+}
+
+// AddElements adds an "nft add" operation to tx for each of elems, adding them to the
+// set or map named setOrMapName. Each element's Set or Map field will be filled in
+// (based on whether or not it has a Value) if it is empty; it is an error for an element
+// to name a different set or map. (elems itself is not modified.)
+func (tx *Transaction) AddElements(setOrMapName string, elems []*Element) {
+	tx.elementsOperation(addVerb, setOrMapName, elems)
+}
+
+// DeleteElements adds an "nft delete" operation to tx for each of elems, deleting them
+// from the set or map named setOrMapName, as with AddElements. (Since map elements are
+// deleted by key, if elems are map elements without Values, then their Map fields must
+// already be filled in.)
+func (tx *Transaction) DeleteElements(setOrMapName string, elems []*Element) {
+	tx.elementsOperation(deleteVerb, setOrMapName, elems)
+}
+
+func (tx *Transaction) elementsOperation(verb verb, setOrMapName string, elems []*Element) {
+	for _, elem := range elems {
+		if tx.err != nil {
+			return
+		}
+		ecopy := *elem
+		switch {
+		case ecopy.Set == "" && ecopy.Map == "":
+			if len(ecopy.Value) != 0 {
+				ecopy.Map = setOrMapName
+			} else {
+				ecopy.Set = setOrMapName
+			}
+		case ecopy.Set != setOrMapName && ecopy.Map != setOrMapName:
+			tx.err = fmt.Errorf("element for %q passed to operation on %q", ecopy.Set+ecopy.Map, setOrMapName)
+			return
+		}
+		tx.operation(verb, &ecopy)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package knftables
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/lithammer/dedent"
+)
+
+func TestTransactionString(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	if tx.NumOperations() != 0 {
+		t.Errorf("expected empty transaction, got %d operations", tx.NumOperations())
+	}
+
+	tx.FlushRuleset()
+	tx.Add(&Table{})
+	tx.Flush(&Table{})
+	tx.Add(&Chain{Name: "chain"})
+	tx.Insert(&Rule{Chain: "chain", Rule: "drop", Index: PtrTo(0)})
+	tx.Replace(&Rule{Chain: "chain", Rule: "accept", Handle: PtrTo(5)})
+	tx.Delete(&Rule{Chain: "chain", Handle: PtrTo(6)})
+	tx.ResetRules("chain")
+
+	// String() preserves the exact operations, in order, including verbs and
+	// handles.
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		flush ruleset
+		add table ip kube-proxy
+		flush table ip kube-proxy
+		add chain ip kube-proxy chain
+		insert rule ip kube-proxy chain index 0 drop
+		replace rule ip kube-proxy chain handle 5 accept
+		delete rule ip kube-proxy chain handle 6
+		reset rules chain ip kube-proxy chain
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected transaction content:\n%s", diff)
+	}
+	if tx.NumOperations() != 8 {
+		t.Errorf("expected 8 operations, got %d", tx.NumOperations())
+	}
+
+	// Invalid operations are not counted
+	tx.Add(&Rule{Chain: "chain"})
+	tx.Add(&Chain{Name: "another"})
+	if tx.NumOperations() != 8 {
+		t.Errorf("expected 8 operations after error, got %d", tx.NumOperations())
+	}
+	if !strings.HasSuffix(tx.String(), "# ERROR: no rule specified") {
+		t.Errorf("expected error in transaction string, got:\n%s", tx.String())
+	}
+}
+
+func TestTransactionAppend(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Chain{Name: "chain1"})
+	tx.Add(&Rule{Chain: "chain1", Rule: "drop"})
+
+	module1 := fake.NewTransaction()
+	module1.Add(&Set{Name: "set1", Type: "ipv4_addr"})
+	module1.Add(&Element{Set: "set1", Key: []string{"10.0.0.1"}})
+
+	module2 := fake.NewTransaction()
+	module2.Add(&Chain{Name: "chain2"})
+	module2.Add(&Rule{Chain: "chain2", Rule: "ip saddr @set1 accept"})
+
+	tx.Append(module1)
+	tx.Append(module2)
+	if tx.NumOperations() != 7 {
+		t.Errorf("expected 7 operations, got %d", tx.NumOperations())
+	}
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add table ip kube-proxy
+		add chain ip kube-proxy chain1
+		add chain ip kube-proxy chain2
+		add set ip kube-proxy set1 { type ipv4_addr ; }
+		add rule ip kube-proxy chain1 drop
+		add rule ip kube-proxy chain2 ip saddr @set1 accept
+		add element ip kube-proxy set1 { 10.0.0.1 }
+		`), "\n")
+	if diff := cmp.Diff(expected, fake.Dump()); diff != "" {
+		t.Errorf("unexpected Dump after Run:\n%s", diff)
+	}
+
+	// Errors are propagated
+	broken := fake.NewTransaction()
+	broken.Add(&Chain{Name: "chain3"})
+	broken.Add(&Rule{Chain: "chain3"})
+	tx = fake.NewTransaction()
+	tx.Append(broken)
+	tx.Add(&Chain{Name: "chain4"})
+	if err := fake.Run(context.Background(), tx); err == nil || !strings.Contains(err.Error(), "no rule specified") {
+		t.Errorf("expected appended error, got %v", err)
+	}
+
+	// Transactions for different tables can't be merged
+	other := NewFake(IPv4Family, "other").NewTransaction()
+	other.Add(&Table{})
+	tx = fake.NewTransaction()
+	tx.Append(other)
+	if err := fake.Run(context.Background(), tx); err == nil || !strings.Contains(err.Error(), "cannot append") {
+		t.Errorf("expected table-mismatch error, got %v", err)
+	}
+}
+
+func TestTransactionBulkElements(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Map{Name: "map", Type: "ipv4_addr : ipv4_addr"})
+
+	var setElems, mapElems []*Element
+	for i := 0; i < 1000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		setElems = append(setElems, &Element{Key: []string{ip}})
+		mapElems = append(mapElems, &Element{Key: []string{ip}, Value: []string{"192.168.0.1"}})
+	}
+	tx.AddElements("set", setElems)
+	tx.AddElements("map", mapElems)
+	if tx.NumOperations() != 2003 {
+		t.Errorf("expected 2003 operations, got %d", tx.NumOperations())
+	}
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if setElems[0].Set != "" {
+		t.Errorf("AddElements modified its argument")
+	}
+
+	elements, err := fake.ListElements(context.Background(), "set", "set")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	if len(elements) != 1000 {
+		t.Errorf("expected 1000 set elements, got %d", len(elements))
+	}
+	elements, err = fake.ListElements(context.Background(), "map", "map")
+	if err != nil {
+		t.Fatalf("unexpected error from ListElements: %v", err)
+	}
+	if len(elements) != 1000 {
+		t.Errorf("expected 1000 map elements, got %d", len(elements))
+	}
+
+	tx = fake.NewTransaction()
+	tx.DeleteElements("set", setElems[:500])
+	tx.DeleteElements("map", []*Element{{Map: "map", Key: []string{"10.0.0.0"}}})
+	if err := fake.Run(context.Background(), tx); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if n := len(fake.Table.Sets["set"].Elements); n != 500 {
+		t.Errorf("expected 500 set elements after delete, got %d", n)
+	}
+	if n := len(fake.Table.Maps["map"].Elements); n != 999 {
+		t.Errorf("expected 999 map elements after delete, got %d", n)
+	}
+
+	// Elements for the wrong set are rejected
+	tx = fake.NewTransaction()
+	tx.AddElements("set", []*Element{{Set: "other", Key: []string{"10.1.0.1"}}})
+	if err := fake.Run(context.Background(), tx); err == nil || !strings.Contains(err.Error(), `element for "other"`) {
+		t.Errorf("expected error about mismatched set, got %v", err)
+	}
+}
+
+func TestTransactionCoalesceElements(t *testing.T) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.2"}, Comment: PtrTo("two")})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.3"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.1"}, Value: []string{"drop"}})
+	tx.Add(&Element{Map: "map", Key: []string{"10.0.0.2"}, Value: []string{"accept"}})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.4"}})
+	tx.Delete(&Element{Set: "set", Key: []string{"10.0.0.1"}})
+	tx.Delete(&Element{Set: "set", Key: []string{"10.0.0.2"}})
+	tx.Create(&Element{Set: "set", Key: []string{"10.0.0.5"}})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.6"}})
+	tx.Add(&Element{Set: "set", Key: []string{"10.0.0.6"}, Comment: PtrTo("again")})
+
+	// Consecutive adds to the same set/map are coalesced, but deletes, creates,
+	// and repeated keys are not
+	expected := strings.TrimPrefix(dedent.Dedent(`
+		add set ip kube-proxy set { type ipv4_addr ; }
+		add element ip kube-proxy set { 10.0.0.1, 10.0.0.2 comment "two", 10.0.0.3 }
+		add element ip kube-proxy map { 10.0.0.1 : drop, 10.0.0.2 : accept }
+		add element ip kube-proxy set { 10.0.0.4 }
+		delete element ip kube-proxy set { 10.0.0.1 }
+		delete element ip kube-proxy set { 10.0.0.2 }
+		create element ip kube-proxy set { 10.0.0.5 }
+		add element ip kube-proxy set { 10.0.0.6 }
+		add element ip kube-proxy set { 10.0.0.6 comment "again" }
+		`), "\n")
+	if diff := cmp.Diff(expected, tx.String()); diff != "" {
+		t.Errorf("unexpected transaction content:\n%s", diff)
+	}
+	if tx.NumOperations() != 12 {
+		t.Errorf("expected 12 operations, got %d", tx.NumOperations())
+	}
+}
+
+func BenchmarkTransactionBatches(b *testing.B) {
+	fake := NewFake(IPv4Family, "kube-proxy")
+	tx := fake.NewTransaction()
+	tx.Add(&Table{})
+	tx.Add(&Set{Name: "set", Type: "ipv4_addr"})
+	for i := 0; i < 100000; i++ {
+		tx.Add(&Element{Set: "set", Key: []string{fmt.Sprintf("10.%d.%d.%d", i/65536, (i/256)%256, i%256)}})
+	}
+
+	for _, batchSize := range []int{0, 1000, 10000} {
+		b.Run(fmt.Sprintf("batchSize=%d", batchSize), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, batch := range tx.batches(batchSize) {
+					if _, err := batch.asCommandBuf(); err != nil {
+						b.Fatalf("unexpected error: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -25,7 +25,8 @@ const (
 	// Maximum length of a table, chain, set, etc, name
 	NameLengthMax = 256
 
-	// Maximum length of a comment
+	// Maximum length of a comment. (Comments also cannot contain double quotes or
+	// control characters, since nft has no way to escape them.)
 	CommentLengthMax = 128
 )
 
@@ -145,7 +146,7 @@ const (
 //
 // In addition to the const values, you can also use a signed integer value, or an
 // arithmetic expression consisting of a const value followed by "+" or "-" and an
-// integer.
+// integer. NumericPriority and OffsetPriority can be used to construct these.
 type BaseChainPriority string
 
 const (
@@ -159,9 +160,9 @@ const (
 	ManglePriority BaseChainPriority = "mangle"
 
 	// DNATPriority is the standard priority for DNAT operations. In the ip, ip6, and
-	// inet families, it is equivalent to the value -100. In the bridge family it is
-	// equivalent to the value -300. In both cases it can only be used from the
-	// prerouting hook.
+	// inet families, it is equivalent to the value -100 and can be used from the
+	// prerouting and output hooks. In the bridge family it is equivalent to the value
+	// -300 and can only be used from the prerouting hook.
 	DNATPriority BaseChainPriority = "dstnat"
 
 	// FilterPriority is the standard priority for filtering operations. In the ip,
@@ -169,8 +170,9 @@ const (
 	// bridge family it is equivalent to the value -200.
 	FilterPriority BaseChainPriority = "filter"
 
-	// OutPriority is FIXME. It is equivalent to the value 300 and can only be used in
-	// the bridge family.
+	// OutPriority is the standard priority for bridge output operations. It is
+	// equivalent to the value 100 and can only be used from the output hook in the
+	// bridge family.
 	OutPriority BaseChainPriority = "out"
 
 	// SecurityPriority is the standard priority for security operations ("where
@@ -179,12 +181,27 @@ const (
 	SecurityPriority BaseChainPriority = "security"
 
 	// SNATPriority is the standard priority for SNAT operations. In the ip, ip6, and
-	// inet families, it is equivalent to the value 100. In the bridge family it is
-	// equivalent to the value 300. In both cases it can only be used from the
-	// postrouting hook.
+	// inet families, it is equivalent to the value 100 and can be used from the input
+	// and postrouting hooks. In the bridge family it is equivalent to the value 300 and
+	// can only be used from the postrouting hook.
 	SNATPriority BaseChainPriority = "srcnat"
 )
 
+// BaseChainPolicy represents the default policy of a base chain; the verdict applied to
+// packets that reach the end of the chain without any rule having issued a final
+// verdict.
+type BaseChainPolicy string
+
+const (
+	// AcceptPolicy indicates that packets reaching the end of the chain should be
+	// accepted. This is the default.
+	AcceptPolicy BaseChainPolicy = "accept"
+
+	// DropPolicy indicates that packets reaching the end of the chain should be
+	// dropped.
+	DropPolicy BaseChainPolicy = "drop"
+)
+
 // Chain represents an nftables chain; either a "base chain" (if Type, Hook, and Priority
 // are specified), or a "regular chain" (if they are not).
 type Chain struct {
@@ -201,11 +218,19 @@ type Chain struct {
 	// a regular chain. You can call ParsePriority() to convert this to a number.
 	Priority *BaseChainPriority
 
+	// Policy is the chain's default policy (AcceptPolicy or DropPolicy). This can
+	// only be set for a base chain. (Optional; the default is AcceptPolicy.)
+	Policy *BaseChainPolicy
+
 	// Device is the network interface that the chain is attached to; this must be set
 	// for a base chain connected to the "ingress" or "egress" hooks, and unset for
 	// all other chains.
 	Device *string
 
+	// Devices is an alternative to Device, for a netdev-family base chain attached to
+	// multiple network interfaces. At most one of Device and Devices may be set.
+	Devices []string
+
 	// Comment is an optional comment for the object.  (Requires kernel >= 5.10 and
 	// nft >= 0.9.7; otherwise this field will be silently ignored. Requires
 	// nft >= 1.0.8 to include comments in List() results.)
@@ -216,6 +241,27 @@ type Chain struct {
 	Handle *int
 }
 
+// BaseChainInfo contains the base-chain attributes of a Chain, as returned by
+// Chain.BaseChainInfo.
+type BaseChainInfo struct {
+	// Type is the chain type
+	Type BaseChainType
+	// Hook is the hook that the chain is connected to
+	Hook BaseChainHook
+	// Priority is the chain priority
+	Priority BaseChainPriority
+
+	// Policy is the chain's default policy. (This is AcceptPolicy if the Chain
+	// does not specify a Policy.)
+	Policy BaseChainPolicy
+
+	// Device is the network interface that the chain is attached to, if any.
+	Device string
+	// Devices are the network interfaces that the chain is attached to, if it
+	// specifies Devices rather than Device.
+	Devices []string
+}
+
 // Rule represents a rule in a chain
 type Rule struct {
 	// Chain is the name of the chain that contains this rule
@@ -241,6 +287,19 @@ type Rule struct {
 	// of a List, this will indicate the rule's handle that can then be used in a
 	// later operation.
 	Handle *int
+
+	// Counter contains the packet and byte counts of the rule's inline (anonymous)
+	// "counter" statement, if it has one. In the result of ListRules, this will be
+	// filled in for every rule with a counter. In Add, Insert, or Replace, it can be
+	// set (if Rule contains a "counter" statement) to give the counter initial
+	// values; otherwise the counter starts at zero.
+	Counter *RuleCounter
+}
+
+// RuleCounter represents the packet and byte counts of a rule's inline counter.
+type RuleCounter struct {
+	Packets uint64
+	Bytes   uint64
 }
 
 // SetFlag represents a set or map flag
@@ -268,10 +327,10 @@ const (
 type SetPolicy string
 
 const (
-	// PolicyPerformance FIXME
+	// PerformancePolicy indicates that the set should be optimized for lookup speed
 	PerformancePolicy SetPolicy = "performance"
 
-	// PolicyMemory FIXME
+	// MemoryPolicy indicates that the set should be optimized for memory usage
 	MemoryPolicy SetPolicy = "memory"
 )
 
@@ -297,14 +356,15 @@ type Set struct {
 	Timeout *time.Duration
 
 	// GCInterval is the interval at which timed-out elements will be removed from the
-	// set. (Optional; FIXME DEFAULT)
+	// set. (Optional; the kernel default is used if it is not set.)
 	GCInterval *time.Duration
 
 	// Size if the maximum numer of elements in the set.
 	// (Optional; mandatory for sets that will be added to from the packet path)
 	Size *uint64
 
-	// Policy is the FIXME
+	// Policy is the storage policy for the set (PerformancePolicy or MemoryPolicy).
+	// (Optional; the default is PerformancePolicy.)
 	Policy *SetPolicy
 
 	// AutoMerge indicates that adjacent/overlapping set elements should be merged
@@ -342,14 +402,15 @@ type Map struct {
 	Timeout *time.Duration
 
 	// GCInterval is the interval at which timed-out elements will be removed from the
-	// set. (Optional; FIXME DEFAULT)
+	// set. (Optional; the kernel default is used if it is not set.)
 	GCInterval *time.Duration
 
 	// Size if the maximum numer of elements in the set.
 	// (Optional; mandatory for sets that will be added to from the packet path)
 	Size *uint64
 
-	// Policy is the FIXME
+	// Policy is the storage policy for the set (PerformancePolicy or MemoryPolicy).
+	// (Optional; the default is PerformancePolicy.)
 	Policy *SetPolicy
 
 	// Comment is an optional comment for the object.  (Requires kernel >= 5.10 and
@@ -361,6 +422,131 @@ type Map struct {
 	Handle *int
 }
 
+// Flowtable represents an nftables flowtable, which can be used (via a "flow add"
+// rule) to offload established connections to a fast path.
+// See https://wiki.nftables.org/wiki-nftables/index.php/Flowtables
+type Flowtable struct {
+	// Name is the name of the flowtable.
+	Name string
+
+	// Priority is the priority of the flowtable's "ingress" hook. This must be set
+	// when adding a flowtable. You can call ParsePriority() to convert this to a
+	// number.
+	Priority *BaseChainPriority
+
+	// Devices are the network interfaces that the flowtable is attached to.
+	Devices []string
+
+	// Handle is an identifier that can be used to uniquely identify an object when
+	// deleting it. When adding a new object, this must be nil
+	Handle *int
+}
+
+// Counter represents a named nftables counter object, which rules can refer to with
+// "counter name NAME".
+type Counter struct {
+	// Name is the name of the counter.
+	Name string
+
+	// Packets and Bytes are the initial values of the counter when adding it. (They
+	// must be either both set or both unset.) In the result of a Fake operation, they
+	// are the current values.
+	Packets *uint64
+	Bytes   *uint64
+
+	// Comment is an optional comment for the object.  (Requires kernel >= 5.10 and
+	// nft >= 0.9.7; otherwise this field will be silently ignored.)
+	Comment *string
+
+	// Handle is an identifier that can be used to uniquely identify an object when
+	// deleting it. When adding a new object, this must be nil
+	Handle *int
+}
+
+// Quota represents a named nftables quota object, which rules can refer to with
+// "quota name NAME".
+type Quota struct {
+	// Name is the name of the quota.
+	Name string
+
+	// Bytes is the quota's limit.
+	Bytes uint64
+
+	// Over indicates that the quota matches once more than Bytes bytes have been
+	// used. (Otherwise it matches until Bytes bytes have been used.)
+	Over bool
+
+	// Used is the initial number of bytes already used when adding the quota.
+	// (Optional.) In the result of a Fake operation, it is the current value.
+	Used *uint64
+
+	// Comment is an optional comment for the object.  (Requires kernel >= 5.10 and
+	// nft >= 0.9.7; otherwise this field will be silently ignored.)
+	Comment *string
+
+	// Handle is an identifier that can be used to uniquely identify an object when
+	// deleting it. When adding a new object, this must be nil
+	Handle *int
+}
+
+// CTTimeout represents a named nftables conntrack timeout policy, which rules can refer
+// to with "ct timeout set NAME".
+type CTTimeout struct {
+	// Name is the name of the timeout policy.
+	Name string
+
+	// Protocol is the layer 4 protocol that the policy applies to (eg "tcp").
+	Protocol string
+
+	// L3Proto is the layer 3 protocol that the policy applies to ("ip" or "ip6").
+	// (Optional; it defaults to the table's family.)
+	L3Proto *string
+
+	// Policy maps connection states (eg "established") to the timeouts to use for
+	// connections in those states. The timeouts are rounded down to whole seconds.
+	Policy map[string]time.Duration
+
+	// Comment is an optional comment for the object.  (Requires kernel >= 5.10 and
+	// nft >= 0.9.7; otherwise this field will be silently ignored.)
+	Comment *string
+
+	// Handle is an identifier that can be used to uniquely identify an object when
+	// deleting it. When adding a new object, this must be nil
+	Handle *int
+}
+
+// CTExpectation represents a named nftables conntrack expectation, which rules can
+// refer to with "ct expectation set NAME".
+type CTExpectation struct {
+	// Name is the name of the expectation.
+	Name string
+
+	// Protocol is the layer 4 protocol of the expected connection (eg "tcp").
+	Protocol string
+
+	// DPort is the destination port of the expected connection.
+	DPort uint16
+
+	// Timeout is how long the expectation will wait for the expected connection.
+	// It is rounded down to whole milliseconds.
+	Timeout time.Duration
+
+	// Size is the maximum number of expectations that can exist at once.
+	Size uint32
+
+	// L3Proto is the layer 3 protocol of the expected connection ("ip" or "ip6").
+	// (Optional; it defaults to the table's family.)
+	L3Proto *string
+
+	// Comment is an optional comment for the object.  (Requires kernel >= 5.10 and
+	// nft >= 0.9.7; otherwise this field will be silently ignored.)
+	Comment *string
+
+	// Handle is an identifier that can be used to uniquely identify an object when
+	// deleting it. When adding a new object, this must be nil
+	Handle *int
+}
+
 // Element represents a set or map element
 type Element struct {
 	// Set is the name of the set that contains this element (or the empty string if
@@ -372,13 +558,40 @@ type Element struct {
 	Map string
 
 	// Key is the element key. (The list contains a single element for "simple" keys,
-	// or multiple elements for concatenations.)
+	// or multiple elements for concatenations.) To add a set/map's catch-all
+	// element, use a Key of []string{CatchAllKey}, regardless of the set/map's type.
 	Key []string
 
 	// Value is the map element value. As with Key, this may be a single value or
 	// multiple. For set elements, this must be nil.
 	Value []string
 
+	// Timeout is an optional timeout for the element, overriding the set/map's
+	// Timeout. (Only valid for sets/maps with the "timeout" flag.)
+	Timeout *time.Duration
+
+	// Expires is the time remaining before the element is removed. When adding an
+	// element, this can be used to make it expire sooner than its timeout. In the
+	// result of ListElements, it gives the current remaining time (if the element
+	// has a timeout).
+	Expires *time.Duration
+
+	// Counter, if set, indicates that the element has a counter attached to it.
+	// When adding an element, it gives the initial values of the counter (normally
+	// 0). In the result of ListElements, it gives the current values.
+	Counter *ElementCounter
+
 	// Comment is an optional comment for the element
 	Comment *string
 }
+
+// CatchAllKey is the key of a set/map's catch-all element ("*"), which matches any key
+// that does not match another element. (Requires kernel >= 5.13 and nft >= 1.0.0.)
+const CatchAllKey = "*"
+
+// ElementCounter represents the packet and byte counts of a set/map element with a
+// counter.
+type ElementCounter struct {
+	Packets uint64
+	Bytes   uint64
+}
@@ -50,29 +50,63 @@ func ParsePriority(family Family, priority string) (int, error) {
 		return val, nil
 	}
 
+	name, mod := splitPriority(priority)
 	modVal := 0
-	if i := strings.IndexAny(priority, "+-"); i != -1 {
-		mod := priority[i:]
+	if mod != "" {
 		modVal, err = strconv.Atoi(mod)
 		if err != nil {
 			return 0, fmt.Errorf("could not parse modifier %q: %w", mod, err)
 		}
-		priority = priority[:i]
 	}
 
 	var found bool
 	if family == BridgeFamily {
-		val, found = bridgeNumericPriorities[priority]
+		val, found = bridgeNumericPriorities[name]
 	} else {
-		val, found = numericPriorities[priority]
+		val, found = numericPriorities[name]
 	}
 	if !found {
-		return 0, fmt.Errorf("unknown priority %q", priority)
+		return 0, fmt.Errorf("unknown priority %q", name)
 	}
 
 	return val + modVal, nil
 }
 
+// splitPriority splits a symbolic priority like "filter + 10" into its name ("filter")
+// and its modifier ("+10"). The modifier is "" if there is none.
+func splitPriority(priority string) (name, mod string) {
+	i := strings.IndexAny(priority, "+-")
+	if i == -1 {
+		return strings.TrimSpace(priority), ""
+	}
+	name = strings.TrimSpace(priority[:i])
+	mod = priority[i:i+1] + strings.TrimSpace(priority[i+1:])
+	return name, mod
+}
+
+// NumericPriority returns a BaseChainPriority corresponding to the numeric value val.
+func NumericPriority(val int) BaseChainPriority {
+	return BaseChainPriority(strconv.Itoa(val))
+}
+
+// OffsetPriority returns a BaseChainPriority corresponding to priority plus offset, eg
+// `OffsetPriority(FilterPriority, 10)` returns "filter+10", and
+// `OffsetPriority(DNATPriority, -5)` returns "dstnat-5". If priority is numeric, the
+// result is numeric as well.
+func OffsetPriority(priority BaseChainPriority, offset int) BaseChainPriority {
+	if val, err := strconv.Atoi(string(priority)); err == nil {
+		return NumericPriority(val + offset)
+	}
+	switch {
+	case offset > 0:
+		return BaseChainPriority(fmt.Sprintf("%s+%d", priority, offset))
+	case offset < 0:
+		return BaseChainPriority(fmt.Sprintf("%s%d", priority, offset))
+	default:
+		return priority
+	}
+}
+
 // Concat is a helper (primarily) for constructing Rule objects. It takes a series of
 // arguments and concatenates them together into a single string with spaces between the
 // arguments. Strings are output as-is, string arrays are output element by element,
@@ -115,3 +149,33 @@ func Concat(args ...interface{}) string {
 	}
 	return b.String()
 }
+
+// AnonymousSet is a helper for constructing Rule objects. It returns an inline
+// ("anonymous") set containing elems, for use in a rule, eg
+// `Concat("tcp dport", AnonymousSet("22", "80", "443"), "accept")`. It can also be used
+// to construct an anonymous map or verdict map by passing elements of the form
+// "KEY : VALUE". (nft does not allow empty anonymous sets, so elems must not be empty;
+// Fake will reject a rule containing an empty set.)
+func AnonymousSet(elems ...string) string {
+	return "{ " + strings.Join(elems, ", ") + " }"
+}
+
+// ConcatKey is a helper for constructing concatenated set keys. It joins parts with
+// " . ", returning an error if the number of parts does not match the number of
+// components in set's Type or TypeOf. Eg:
+//
+//	key, err := ConcatKey(set, "ip daddr", "tcp dport")
+//	if err != nil {
+//		return err
+//	}
+//	tx.Add(&Rule{Chain: chain, Rule: Concat(key, "@", set.Name, "accept")})
+func ConcatKey(set *Set, parts ...string) (string, error) {
+	if set.Type == "" && set.TypeOf == "" {
+		return "", fmt.Errorf("set %q has no Type or TypeOf", set.Name)
+	}
+	arity := len(parseKeyTypes(set.Type, set.TypeOf))
+	if len(parts) != arity {
+		return "", fmt.Errorf("key has %d components but set %q has %d", len(parts), set.Name, arity)
+	}
+	return strings.Join(parts, " . "), nil
+}
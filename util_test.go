@@ -18,6 +18,7 @@ package knftables
 
 import (
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -92,3 +93,149 @@ func TestConcat(t *testing.T) {
 		})
 	}
 }
+
+func TestAnonymousSet(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		elems []string
+		out   string
+	}{
+		{
+			name:  "single element",
+			elems: []string{"22"},
+			out:   "{ 22 }",
+		},
+		{
+			name:  "multiple elements",
+			elems: []string{"22", "80", "443"},
+			out:   "{ 22, 80, 443 }",
+		},
+		{
+			name:  "verdict map",
+			elems: []string{"10.0.0.1 : goto chain1", "10.0.0.2 : drop"},
+			out:   "{ 10.0.0.1 : goto chain1, 10.0.0.2 : drop }",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := AnonymousSet(tc.elems...)
+			if out != tc.out {
+				t.Errorf("expected %q got %q", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestConcatKey(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		set   *Set
+		parts []string
+		out   string
+		err   string
+	}{
+		{
+			name:  "single component",
+			set:   &Set{Name: "s", Type: "ipv4_addr"},
+			parts: []string{"10.0.0.1"},
+			out:   "10.0.0.1",
+		},
+		{
+			name:  "type",
+			set:   &Set{Name: "s", Type: "ipv4_addr . inet_proto . inet_service"},
+			parts: []string{"10.0.0.1", "tcp", "80"},
+			out:   "10.0.0.1 . tcp . 80",
+		},
+		{
+			name:  "typeof",
+			set:   &Set{Name: "s", TypeOf: "ip daddr . tcp dport"},
+			parts: []string{"ip daddr", "tcp dport"},
+			out:   "ip daddr . tcp dport",
+		},
+		{
+			name:  "too few",
+			set:   &Set{Name: "s", Type: "ipv4_addr . inet_proto . inet_service"},
+			parts: []string{"10.0.0.1", "80"},
+			err:   "key has 2 components but set \"s\" has 3",
+		},
+		{
+			name:  "too many",
+			set:   &Set{Name: "s", Type: "ipv4_addr"},
+			parts: []string{"10.0.0.1", "80"},
+			err:   "key has 2 components but set \"s\" has 1",
+		},
+		{
+			name:  "no type",
+			set:   &Set{Name: "s"},
+			parts: []string{"10.0.0.1"},
+			err:   "no Type or TypeOf",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := ConcatKey(tc.set, tc.parts...)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error containing %q, got %q, %v", tc.err, out, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tc.out {
+				t.Errorf("expected %q got %q", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestPriorityHelpers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		priority BaseChainPriority
+		out      string
+		value    int
+	}{
+		{
+			name:     "numeric",
+			priority: NumericPriority(-150),
+			out:      "-150",
+			value:    -150,
+		},
+		{
+			name:     "symbolic",
+			priority: OffsetPriority(FilterPriority, 0),
+			out:      "filter",
+			value:    0,
+		},
+		{
+			name:     "positive offset",
+			priority: OffsetPriority(FilterPriority, 10),
+			out:      "filter+10",
+			value:    10,
+		},
+		{
+			name:     "negative offset",
+			priority: OffsetPriority(DNATPriority, -5),
+			out:      "dstnat-5",
+			value:    -105,
+		},
+		{
+			name:     "offset from numeric",
+			priority: OffsetPriority(NumericPriority(50), -60),
+			out:      "-10",
+			value:    -10,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if string(tc.priority) != tc.out {
+				t.Errorf("expected %q, got %q", tc.out, tc.priority)
+			}
+			val, err := ParsePriority(IPv4Family, string(tc.priority))
+			if err != nil {
+				t.Errorf("unexpected error parsing %q: %v", tc.priority, err)
+			} else if val != tc.value {
+				t.Errorf("expected %q to parse to %d, got %d", tc.priority, tc.value, val)
+			}
+		})
+	}
+}